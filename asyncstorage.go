@@ -0,0 +1,193 @@
+package cookiejarx
+
+import (
+	"sync"
+	"time"
+)
+
+// asyncOp is a buffered storage modification: saving entry, or removing the
+// entry with key and id when entry is nil.
+type asyncOp struct {
+	entry   *Entry
+	key, id string
+}
+
+// AsyncStorage is a Storage decorator buffering modifications in memory and
+// applying them to the underlying Storage in batches, either periodically or
+// once the buffer fills up. Lookups see buffered modifications right away.
+//
+// Close must be called to stop background flushing and persist remaining
+// modifications.
+type AsyncStorage struct {
+	inner Storage
+
+	maxBatch int
+
+	// flushMu serializes flushes, so that batches are applied in order.
+	flushMu sync.Mutex
+
+	// mu locks pending.
+	mu sync.Mutex
+
+	// pending holds buffered modifications in order of arrival.
+	pending []asyncOp
+
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	closeOnce sync.Once
+}
+
+// NewAsyncStorage returns an AsyncStorage flushing buffered modifications to
+// inner every flushInterval and whenever maxBatch modifications are buffered.
+// A non-positive flushInterval disables periodic flushing and a non-positive
+// maxBatch disables flushing on buffer size.
+func NewAsyncStorage(inner Storage, flushInterval time.Duration, maxBatch int) *AsyncStorage {
+	s := &AsyncStorage{
+		inner:    inner,
+		maxBatch: maxBatch,
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go s.run(flushInterval)
+
+	return s
+}
+
+func (s *AsyncStorage) run(flushInterval time.Duration) {
+	defer close(s.done)
+
+	var tick <-chan time.Time
+	if flushInterval > 0 {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			s.Flush()
+		case <-s.kick:
+			s.Flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// SaveEntry buffers saving of a copy of entry.
+func (s *AsyncStorage) SaveEntry(entry *Entry) {
+	e := *entry
+	s.push(asyncOp{entry: &e, key: e.Key, id: e.ID})
+}
+
+// RemoveEntry buffers removal of the entry with provided key and id.
+func (s *AsyncStorage) RemoveEntry(key, id string) {
+	s.push(asyncOp{key: key, id: id})
+}
+
+func (s *AsyncStorage) push(op asyncOp) {
+	s.mu.Lock()
+	s.pending = append(s.pending, op)
+	full := s.maxBatch > 0 && len(s.pending) >= s.maxBatch
+	s.mu.Unlock()
+
+	if full {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Entries returns entries of the underlying storage, updated with copies of
+// buffered modifications of key.
+func (s *AsyncStorage) Entries(https bool, host, path, key string, now time.Time) (entries []*Entry) {
+	overlay := make(map[string]*Entry)
+	var order []string
+
+	s.mu.Lock()
+	for _, op := range s.pending {
+		if op.key != key {
+			continue
+		}
+		if _, ok := overlay[op.id]; !ok {
+			order = append(order, op.id)
+		}
+		overlay[op.id] = op.entry
+	}
+	s.mu.Unlock()
+
+	// Underlying entries are fetched after pending modifications: a flush
+	// removes modifications from pending only after applying them, so none
+	// is missed by a concurrent flush.
+	inner := s.inner.Entries(https, host, path, key, now)
+
+	if len(overlay) == 0 {
+		return inner
+	}
+
+	for _, e := range inner {
+		if _, ok := overlay[e.ID]; !ok {
+			entries = append(entries, e)
+		}
+	}
+
+	for _, id := range order {
+		e := overlay[id]
+		if e == nil || e.Expired(now) || !e.ShouldSend(https, host, path) {
+			continue
+		}
+		c := *e
+		entries = append(entries, &c)
+	}
+
+	SortEntries(entries)
+
+	return entries
+}
+
+// Flush applies all buffered modifications to the underlying storage before
+// returning.
+func (s *AsyncStorage) Flush() {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	batch := s.pending
+	s.mu.Unlock()
+
+	for _, op := range batch {
+		if op.entry != nil {
+			// Buffered entries may be read by concurrent lookups while
+			// the underlying storage updates the saved one.
+			e := *op.entry
+			s.inner.SaveEntry(&e)
+		} else {
+			s.inner.RemoveEntry(op.key, op.id)
+		}
+	}
+
+	// Applied modifications stay visible to lookups until now, new ones may
+	// have been appended meanwhile.
+	s.mu.Lock()
+	s.pending = s.pending[len(batch):]
+	if len(s.pending) == 0 {
+		s.pending = nil
+	}
+	s.mu.Unlock()
+}
+
+// Close stops background flushing and flushes all buffered modifications. It
+// is safe to call Close multiple times.
+func (s *AsyncStorage) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+	})
+	s.Flush()
+}
@@ -0,0 +1,138 @@
+package cookiejarx
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAsyncStorageReadYourWrites(t *testing.T) {
+	inner := NewInMemoryStorage()
+	async := NewAsyncStorage(inner, 0, 0)
+	defer async.Close()
+
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: async})
+	u := mustParseURL("http://www.host.test/a/")
+
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "a", Value: "1"},
+		{Name: "b", Value: "2", Path: "/"},
+		{Name: "c", Value: "3"},
+	}, tNow)
+	async.Flush()
+
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "a", Value: "changed"},
+		{Name: "c", MaxAge: -1},
+		{Name: "d", Value: "4", Domain: "host.test", Path: "/a/b"},
+	}, tNow.Add(time.Second))
+
+	if got := len(inner.EntriesDump()); got != 3 {
+		t.Errorf("got %d flushed entries before Flush, want 3", got)
+	}
+
+	query := func(u string) string {
+		var s []string
+		for _, c := range jar.cookies(mustParseURL(u), tNow.Add(2*time.Second)) {
+			s = append(s, c.Name+"="+c.Value)
+		}
+		return strings.Join(s, " ")
+	}
+
+	if got, want := query("http://www.host.test/a/b"), "d=4 a=changed b=2"; got != want {
+		t.Errorf("buffered: got %q, want %q", got, want)
+	}
+
+	async.Flush()
+
+	if got := len(inner.EntriesDump()); got != 3 {
+		t.Errorf("got %d flushed entries after Flush, want 3", got)
+	}
+	if got, want := query("http://www.host.test/a/b"), "d=4 a=changed b=2"; got != want {
+		t.Errorf("flushed: got %q, want %q", got, want)
+	}
+}
+
+func TestAsyncStorageBatch(t *testing.T) {
+	inner := NewInMemoryStorage()
+	async := NewAsyncStorage(inner, 0, 2)
+
+	async.SaveEntry(&Entry{Name: "a", Key: "host.test", ID: "a", Expires: endOfTime})
+	async.SaveEntry(&Entry{Name: "b", Key: "host.test", ID: "b", Expires: endOfTime})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(inner.EntriesDump()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := len(inner.EntriesDump()); got != 2 {
+		t.Errorf("got %d entries after full batch, want 2", got)
+	}
+
+	async.SaveEntry(&Entry{Name: "c", Key: "host.test", ID: "c", Expires: endOfTime})
+	async.Close()
+	async.Close()
+
+	if got := len(inner.EntriesDump()); got != 3 {
+		t.Errorf("got %d entries after Close, want 3", got)
+	}
+}
+
+func TestAsyncStorageInterval(t *testing.T) {
+	inner := NewInMemoryStorage()
+	async := NewAsyncStorage(inner, time.Millisecond, 0)
+	defer async.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := string(rune('a' + i))
+			async.SaveEntry(&Entry{Name: id, Key: "host.test", ID: id, Domain: "host.test", Path: "/", Expires: endOfTime})
+			if got := async.Entries(false, "host.test", "/", "host.test", tNow); len(got) == 0 {
+				t.Errorf("%s: got no entries after save", id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(inner.EntriesDump()) != 10 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := len(inner.EntriesDump()); got != 10 {
+		t.Errorf("got %d entries after interval, want 10", got)
+	}
+}
+
+func TestAsyncStorageCopies(t *testing.T) {
+	inner := NewInMemoryStorage()
+	async := NewAsyncStorage(inner, 0, 0)
+	defer async.Close()
+
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: async})
+	u := mustParseURL("http://www.host.test/")
+
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1"}}, tNow)
+	async.Flush()
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "2"}}, tNow.Add(time.Hour))
+
+	entries := async.Entries(false, "www.host.test", "/", "host.test", tNow.Add(time.Hour))
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	buffered := entries[0]
+	creation := buffered.Creation
+
+	// Saving keeps the creation time of the flushed entry, which must not
+	// leak into entries returned before.
+	async.Flush()
+	if !buffered.Creation.Equal(creation) {
+		t.Errorf("got Creation %v after Flush, want %v", buffered.Creation, creation)
+	}
+	if got := inner.EntriesDump()[0].Creation; !got.Equal(tNow) {
+		t.Errorf("got flushed Creation %v, want %v", got, tNow)
+	}
+}
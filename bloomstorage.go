@@ -0,0 +1,221 @@
+package cookiejarx
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// DefaultBloomFalsePositiveRate is the false positive rate of a BloomStorage
+// for which NewBloomStorage is passed a rate outside of (0, 1).
+const DefaultBloomFalsePositiveRate = 0.01
+
+// BloomStorage is a Storage decorator keeping a bloom filter of the keys held
+// by the underlying Storage, so that lookups of keys which definitely have no
+// entries are answered without querying it. This saves round trips to slow,
+// e.g. remote, storages.
+//
+// Keys are added to the filter on SaveEntry, but as bloom filters do not
+// support deletion, they are never removed on RemoveEntry. Keys whose entries
+// are all removed therefore keep causing lookups until Rebuild is called,
+// which should be done periodically for long living storages.
+//
+// Clearer, Restorer and Counter are forwarded to the underlying storage,
+// falling back to its Storage and Dumper methods. A BloomStorage implements
+// Dumper only if the underlying storage does.
+type BloomStorage interface {
+	Storage
+	Clearer
+	Restorer
+	Counter
+
+	// Rebuild resets the filter to the keys currently held by the
+	// underlying storage, dropping keys of removed entries. Lookups are
+	// blocked while the underlying storage is dumped. It does nothing if
+	// the underlying storage does not implement Dumper.
+	Rebuild()
+}
+
+// bloomStorage is the BloomStorage of an underlying storage which does not
+// implement Dumper.
+type bloomStorage struct {
+	inner Storage
+
+	// mu locks the filter.
+	mu sync.RWMutex
+
+	bits []uint64
+
+	// hashes is the number of bits set per key.
+	hashes int
+}
+
+// bloomDumperStorage is the BloomStorage of an underlying storage
+// implementing Dumper.
+type bloomDumperStorage struct {
+	*bloomStorage
+}
+
+// NewBloomStorage returns a BloomStorage for inner, sized for expectedKeys
+// distinct keys with a false positive rate of falsePositiveRate, which must be
+// between 0 and 1 exclusive, DefaultBloomFalsePositiveRate being used
+// otherwise. An expectedKeys value below one is treated as one.
+//
+// If inner implements Dumper, the filter is populated with the keys of its
+// entries, otherwise inner must be empty.
+func NewBloomStorage(inner Storage, expectedKeys int, falsePositiveRate float64) BloomStorage {
+	if expectedKeys < 1 {
+		expectedKeys = 1
+	}
+	if !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		falsePositiveRate = DefaultBloomFalsePositiveRate
+	}
+
+	bits := math.Ceil(-float64(expectedKeys) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(bits / float64(expectedKeys) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	words := (int(bits) + 63) / 64
+	if words < 1 {
+		words = 1
+	}
+
+	s := &bloomStorage{
+		inner:  inner,
+		bits:   make([]uint64, words),
+		hashes: hashes,
+	}
+
+	s.Rebuild()
+
+	if _, ok := inner.(Dumper); ok {
+		return bloomDumperStorage{s}
+	}
+	return s
+}
+
+// SaveEntry implementation of Storage.SaveEntry, adding entry.Key to the
+// filter.
+func (s *bloomStorage) SaveEntry(entry *Entry) {
+	// The key is added after saving, so that a concurrent Rebuild either
+	// sees the entry or is followed by the addition.
+	s.inner.SaveEntry(entry)
+
+	s.mu.Lock()
+	s.add(entry.Key)
+	s.mu.Unlock()
+}
+
+// RemoveEntry implementation of Storage.RemoveEntry. The key is kept in the
+// filter.
+func (s *bloomStorage) RemoveEntry(key, id string) {
+	s.inner.RemoveEntry(key, id)
+}
+
+// Entries implementation of Storage.Entries, querying the underlying storage
+// only if the filter may contain key.
+func (s *bloomStorage) Entries(https bool, host, path, key string, now time.Time) (entries []*Entry) {
+	s.mu.RLock()
+	contains := s.contains(key)
+	s.mu.RUnlock()
+
+	if !contains {
+		return nil
+	}
+
+	return s.inner.Entries(https, host, path, key, now)
+}
+
+// Rebuild implements BloomStorage.Rebuild.
+func (s *bloomStorage) Rebuild() {
+	dumper, ok := s.inner.(Dumper)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.bits {
+		s.bits[i] = 0
+	}
+	for _, e := range dumper.EntriesDump() {
+		s.add(e.Key)
+	}
+}
+
+// Clear implements Clearer, clearing the underlying storage and the filter.
+// The filter is kept if the underlying storage cannot be cleared.
+func (s *bloomStorage) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !clearInner(s.inner) {
+		return
+	}
+	for i := range s.bits {
+		s.bits[i] = 0
+	}
+}
+
+// EntriesRestore implements Restorer, adding the keys of entries to the filter.
+func (s *bloomStorage) EntriesRestore(entries []*Entry) {
+	restoreInner(s.inner, entries)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range entries {
+		s.add(e.Key)
+	}
+}
+
+// Len implements Counter.
+func (s *bloomStorage) Len() int {
+	return lenInner(s.inner)
+}
+
+// Domains implements Counter.
+func (s *bloomStorage) Domains() []string {
+	return domainsInner(s.inner)
+}
+
+// EntriesDump implements Dumper.
+func (s bloomDumperStorage) EntriesDump() (entries []*Entry) {
+	return s.inner.(Dumper).EntriesDump()
+}
+
+// add adds key to the filter. s.mu must be held.
+func (s *bloomStorage) add(key string) {
+	h1, h2 := bloomHashes(key)
+	n := uint64(len(s.bits) * 64)
+	for i := 0; i < s.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % n
+		s.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// contains reports whether key may have been added to the filter. s.mu must
+// be held.
+func (s *bloomStorage) contains(key string) bool {
+	h1, h2 := bloomHashes(key)
+	n := uint64(len(s.bits) * 64)
+	for i := 0; i < s.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % n
+		if s.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHashes returns the two hashes of key combined into the filter's bit
+// positions by double hashing.
+func bloomHashes(key string) (h1, h2 uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	return sum & 0xffffffff, sum>>32 | 1
+}
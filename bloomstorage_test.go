@@ -0,0 +1,117 @@
+package cookiejarx
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStorage counts Entries calls of the wrapped InMemoryStorage.
+type countingStorage struct {
+	*InMemoryStorage
+	lookups int64
+}
+
+func (s *countingStorage) Entries(https bool, host, path, key string, now time.Time) []*Entry {
+	atomic.AddInt64(&s.lookups, 1)
+	return s.InMemoryStorage.Entries(https, host, path, key, now)
+}
+
+func TestBloomStorage(t *testing.T) {
+	inner := &countingStorage{InMemoryStorage: NewInMemoryStorage()}
+	inner.EntriesRestore([]*Entry{
+		{Name: "a", Value: "1", Key: "existing.test", ID: "existing.test;/;a", Domain: "existing.test", Path: "/", HostOnly: true, Expires: endOfTime},
+	})
+
+	storage := NewBloomStorage(inner, 1000, 0.01)
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+
+	for i := 0; i < 500; i++ {
+		u := mustParseURL(fmt.Sprintf("http://www.host%d.test/", i))
+		jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1"}}, tNow)
+	}
+
+	// No false negatives, including for entries present before the filter.
+	if got := len(jar.cookies(mustParseURL("http://existing.test/"), tNow)); got != 1 {
+		t.Errorf("got %d cookies for prepopulated key, want 1", got)
+	}
+	for i := 0; i < 500; i++ {
+		u := mustParseURL(fmt.Sprintf("http://www.host%d.test/", i))
+		if got := len(jar.cookies(u, tNow)); got != 1 {
+			t.Fatalf("%s: got %d cookies, want 1", u, got)
+		}
+	}
+
+	atomic.StoreInt64(&inner.lookups, 0)
+	for i := 0; i < 1000; i++ {
+		jar.cookies(mustParseURL(fmt.Sprintf("http://www.unknown%d.test/", i)), tNow)
+	}
+	lookups := atomic.LoadInt64(&inner.lookups)
+	t.Logf("avoided %d of 1000 backend lookups", 1000-lookups)
+	if lookups > 50 {
+		t.Errorf("got %d backend lookups for unknown keys, want at most 50", lookups)
+	}
+
+	// Removed keys keep causing lookups until the filter is rebuilt.
+	host0 := mustParseURL("http://www.host0.test/")
+	jar.setCookies(host0, []*http.Cookie{{Name: "a", MaxAge: -1}}, tNow)
+	atomic.StoreInt64(&inner.lookups, 0)
+	jar.cookies(host0, tNow)
+	if got := atomic.LoadInt64(&inner.lookups); got != 1 {
+		t.Errorf("got %d backend lookups for removed key before Rebuild, want 1", got)
+	}
+
+	storage.Rebuild()
+	for i := 1; i < 500; i++ {
+		u := mustParseURL(fmt.Sprintf("http://www.host%d.test/", i))
+		if got := len(jar.cookies(u, tNow)); got != 1 {
+			t.Fatalf("%s: got %d cookies after Rebuild, want 1", u, got)
+		}
+	}
+}
+
+func TestBloomStorageFalsePositiveRate(t *testing.T) {
+	u := mustParseURL("http://www.host.test/")
+	for _, rate := range []float64{0, -1, 1, 2, math.NaN(), math.Inf(1), 0.5} {
+		jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: NewBloomStorage(NewInMemoryStorage(), 0, rate)})
+		jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1"}}, tNow)
+		if got := len(jar.cookies(u, tNow)); got != 1 {
+			t.Errorf("rate %v: got %d cookies, want 1", rate, got)
+		}
+	}
+}
+
+func TestBloomStorageForwarding(t *testing.T) {
+	u := mustParseURL("http://www.host.test/")
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: NewBloomStorage(NewInMemoryStorage(), 10, 0.01)})
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1"}}, tNow)
+
+	var buf bytes.Buffer
+	if err := jar.Save(&buf, nil); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if got := jar.count(tNow); got != 1 {
+		t.Errorf("got Len %d, want 1", got)
+	}
+
+	jar.Clear()
+	if got := len(jar.cookies(u, tNow)); got != 0 {
+		t.Errorf("got %d cookies after Clear, want 0", got)
+	}
+
+	// Restored keys are added to the filter.
+	if err := jar.Load(&buf, nil); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := len(jar.cookies(u, tNow)); got != 1 {
+		t.Errorf("got %d cookies after Load, want 1", got)
+	}
+
+	if _, ok := NewBloomStorage(struct{ Storage }{NewInMemoryStorage()}, 10, 0.01).(Dumper); ok {
+		t.Error("BloomStorage of a storage without Dumper implements Dumper")
+	}
+}
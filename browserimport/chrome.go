@@ -0,0 +1,182 @@
+// Package browserimport reads cookies stored by web browsers into
+// cookiejarx entries, which can then be added to a storage with
+// InMemoryStorage.EntriesRestore.
+//
+// Browser profiles are SQLite databases read through database/sql. The package
+// does not depend on an SQLite driver, the caller registers one of choice,
+// e.g. by importing github.com/mattn/go-sqlite3 for the "sqlite3" driver.
+package browserimport
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/eientei/cookiejarx"
+)
+
+// DefaultDriverName is the default ChromeImporter.DriverName.
+const DefaultDriverName = "sqlite3"
+
+// webkitEpochOffset is the offset in microseconds of the Unix epoch from the
+// WebKit epoch, 1601-01-01 UTC, used by Chrome timestamps.
+const webkitEpochOffset = 11644473600000000
+
+var errNoDecrypt = errors.New("browserimport: encrypted cookie value without Decrypt function")
+
+// chromeQuery selects the cookies of a Chromium Cookies database.
+const chromeQuery = `SELECT host_key, name, value, encrypted_value, path,
+	creation_utc, expires_utc, last_access_utc,
+	is_secure, is_httponly, is_persistent, samesite, priority
+FROM cookies`
+
+// ChromeImporter reads cookies from the Cookies SQLite database of a Chrome
+// or Chromium profile.
+type ChromeImporter struct {
+	// DriverName is the name of the registered database/sql SQLite driver,
+	// DefaultDriverName if empty.
+	DriverName string
+
+	// Decrypt returns the plaintext of an encrypted_value column. Chrome
+	// encrypts cookie values with a platform specific key, e.g. kept in the
+	// macOS Keychain or protected by DPAPI on Windows, which is left to the
+	// caller.
+	//
+	// If nil, only cookies with a plaintext value are imported and
+	// encrypted ones are skipped.
+	Decrypt func(encrypted []byte) ([]byte, error)
+
+	// PublicSuffixList derives the entry keys, see cookiejarx.JarKey. It
+	// should be the list the receiving jar is configured with.
+	PublicSuffixList cookiejarx.PublicSuffixList
+
+	// SessionExpiry is the Expires time given to session cookies,
+	// cookiejarx.DefaultSessionExpiry if zero. It should be the
+	// Options.SessionExpiry of the receiving jar.
+	SessionExpiry time.Time
+}
+
+// ImportChromeCookies reads the cookies of the Chrome Cookies database at
+// dbPath using the DefaultDriverName driver, skipping encrypted values and
+// deriving entry keys without a public suffix list. Use ChromeImporter to
+// configure decryption and the public suffix list.
+func ImportChromeCookies(dbPath string) ([]*cookiejarx.Entry, error) {
+	return (&ChromeImporter{}).Import(dbPath)
+}
+
+// Import reads the cookies of the Chrome Cookies database at dbPath. Expired
+// cookies are included, they are dropped by storages on lookup.
+//
+// The database should not be in use by the browser, which keeps it locked;
+// copying it first is advisable.
+func (imp *ChromeImporter) Import(dbPath string) (entries []*cookiejarx.Entry, err error) {
+	driverName := imp.DriverName
+	if driverName == "" {
+		driverName = DefaultDriverName
+	}
+
+	db, err := sql.Open(driverName, dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	sessionExpiry := imp.SessionExpiry
+	if sessionExpiry.IsZero() {
+		sessionExpiry = cookiejarx.DefaultSessionExpiry
+	}
+
+	rows, err := db.Query(chromeQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hostKey, name, value, path string
+		var encrypted []byte
+		var creation, expires, lastAccess int64
+		var secure, httpOnly, persistent bool
+		var sameSite, priority int
+
+		err = rows.Scan(&hostKey, &name, &value, &encrypted, &path,
+			&creation, &expires, &lastAccess,
+			&secure, &httpOnly, &persistent, &sameSite, &priority)
+		if err != nil {
+			return nil, err
+		}
+
+		if value == "" && len(encrypted) > 0 {
+			if imp.Decrypt == nil {
+				continue
+			}
+			plaintext, err := imp.Decrypt(encrypted)
+			if err != nil {
+				return nil, err
+			}
+			value = string(plaintext)
+		}
+
+		e := &cookiejarx.Entry{
+			Name:       name,
+			Value:      value,
+			Domain:     strings.TrimPrefix(hostKey, "."),
+			Path:       path,
+			SameSite:   chromeSameSite(sameSite),
+			Secure:     secure,
+			HttpOnly:   httpOnly,
+			Persistent: persistent,
+			HostOnly:   !strings.HasPrefix(hostKey, "."),
+			Expires:    sessionExpiry,
+			Creation:   webkitTime(creation),
+			LastAccess: webkitTime(lastAccess),
+			Priority:   chromePriority(priority),
+		}
+		if persistent {
+			e.Expires = webkitTime(expires)
+		}
+		e.LastModified = e.Creation
+		e.Key = cookiejarx.JarKey(e.Domain, imp.PublicSuffixList)
+		e.ID = e.RawID()
+
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// webkitTime converts a Chrome timestamp in microseconds since the WebKit
+// epoch to a time, zero meaning the zero time.
+func webkitTime(us int64) time.Time {
+	if us == 0 {
+		return time.Time{}
+	}
+	return time.UnixMicro(us - webkitEpochOffset).UTC()
+}
+
+// chromeSameSite converts a Chrome samesite column to an Entry.SameSite value.
+// Unspecified (-1) and no restriction (0) both mean no SameSite attribute.
+func chromeSameSite(sameSite int) string {
+	switch sameSite {
+	case 1:
+		return "SameSite=Lax"
+	case 2:
+		return "SameSite=Strict"
+	}
+	return ""
+}
+
+// chromePriority converts a Chrome priority column to an Entry.Priority value.
+func chromePriority(priority int) string {
+	switch priority {
+	case 0:
+		return cookiejarx.PriorityLow
+	case 2:
+		return cookiejarx.PriorityHigh
+	}
+	return cookiejarx.PriorityMedium
+}
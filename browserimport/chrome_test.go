@@ -0,0 +1,135 @@
+package browserimport
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eientei/cookiejarx"
+)
+
+// fakeChromeRows are the rows of the cookies table served by fakeChromeDriver,
+// in the column order of chromeQuery.
+var fakeChromeRows = [][]driver.Value{
+	{".host.test", "domain", "1", []byte{}, "/", int64(13001515200000000), int64(13033008000000000), int64(13001515201000000),
+		int64(1), int64(0), int64(1), int64(1), int64(2)},
+	{"www.host.test", "session", "", []byte("v10secret"), "/a", int64(13001515200000000), int64(0), int64(0),
+		int64(0), int64(1), int64(0), int64(-1), int64(1)},
+}
+
+// fakeChromeDriver is a database/sql driver answering any query with
+// fakeChromeRows.
+type fakeChromeDriver struct{}
+
+func init() {
+	sql.Register("browserimport-fake", fakeChromeDriver{})
+}
+
+func (fakeChromeDriver) Open(string) (driver.Conn, error) { return fakeChromeConn{}, nil }
+
+type fakeChromeConn struct{}
+
+func (fakeChromeConn) Prepare(query string) (driver.Stmt, error) { return fakeChromeStmt{query}, nil }
+func (fakeChromeConn) Close() error                              { return nil }
+func (fakeChromeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type fakeChromeStmt struct {
+	query string
+}
+
+func (fakeChromeStmt) Close() error  { return nil }
+func (fakeChromeStmt) NumInput() int { return 0 }
+
+func (fakeChromeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s fakeChromeStmt) Query([]driver.Value) (driver.Rows, error) {
+	columns := strings.Split(s.query[len("SELECT "):strings.Index(s.query, "\nFROM")], ",")
+	for i := range columns {
+		columns[i] = strings.TrimSpace(columns[i])
+	}
+	return &fakeChromeRowsIter{columns: columns, rows: fakeChromeRows}, nil
+}
+
+type fakeChromeRowsIter struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeChromeRowsIter) Columns() []string { return r.columns }
+func (r *fakeChromeRowsIter) Close() error      { return nil }
+
+func (r *fakeChromeRowsIter) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestChromeImporter(t *testing.T) {
+	imp := &ChromeImporter{DriverName: "browserimport-fake"}
+
+	entries, err := imp.Import("Cookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries without Decrypt, want encrypted one skipped", len(entries))
+	}
+
+	e := entries[0]
+	want := cookiejarx.Entry{
+		Name:         "domain",
+		Value:        "1",
+		Domain:       "host.test",
+		Path:         "/",
+		SameSite:     "SameSite=Lax",
+		Key:          "host.test",
+		ID:           "host.test;/;domain",
+		Secure:       true,
+		Persistent:   true,
+		Expires:      time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC),
+		Creation:     time.Date(2013, 1, 1, 12, 0, 0, 0, time.UTC),
+		LastAccess:   time.Date(2013, 1, 1, 12, 0, 1, 0, time.UTC),
+		LastModified: time.Date(2013, 1, 1, 12, 0, 0, 0, time.UTC),
+		Priority:     cookiejarx.PriorityHigh,
+	}
+	if *e != want {
+		t.Errorf("got %+v, want %+v", *e, want)
+	}
+
+	imp.Decrypt = func(encrypted []byte) ([]byte, error) {
+		return bytes.TrimPrefix(encrypted, []byte("v10")), nil
+	}
+	entries, err = imp.Import("Cookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+
+	e = entries[1]
+	if e.Value != "secret" || !e.HostOnly || e.Persistent || !e.HttpOnly || e.SameSite != "" ||
+		e.Priority != cookiejarx.PriorityMedium || e.Key != "host.test" || !e.LastAccess.IsZero() ||
+		!e.Expires.Equal(cookiejarx.DefaultSessionExpiry) {
+		t.Errorf("got %+v", *e)
+	}
+
+	imp.SessionExpiry = time.Date(2999, 12, 31, 23, 59, 59, 0, time.UTC)
+	entries, err = imp.Import("Cookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e = entries[1]; !e.Expires.Equal(imp.SessionExpiry) {
+		t.Errorf("got session Expires %v, want %v", e.Expires, imp.SessionExpiry)
+	}
+}
@@ -0,0 +1,202 @@
+package cookiejarx
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Codec serializes entries to and from a byte stream, allowing jar contents
+// to be exchanged in different formats.
+type Codec interface {
+	// Encode writes entries to w
+	Encode(w io.Writer, entries []*Entry) error
+
+	// Decode reads entries from r
+	Decode(r io.Reader) (entries []*Entry, err error)
+}
+
+// Restorer is an optional interface implemented by Storage that is able to
+// import a set of entries at once.
+type Restorer interface {
+	// EntriesRestore adds provided entries to storage
+	EntriesRestore(entries []*Entry)
+}
+
+var (
+	// JSONCodec encodes entries as a JSON array.
+	JSONCodec Codec = jsonCodec{}
+
+	// GobCodec encodes entries using encoding/gob.
+	GobCodec Codec = gobCodec{}
+)
+
+var errNoDumper = errors.New("cookiejar: storage is unable to list entries")
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(w io.Writer, entries []*Entry) error {
+	return json.NewEncoder(w).Encode(entries)
+}
+
+func (jsonCodec) Decode(r io.Reader) (entries []*Entry, err error) {
+	err = json.NewDecoder(r).Decode(&entries)
+	return entries, err
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(w io.Writer, entries []*Entry) error {
+	return gob.NewEncoder(w).Encode(entries)
+}
+
+func (gobCodec) Decode(r io.Reader) (entries []*Entry, err error) {
+	err = gob.NewDecoder(r).Decode(&entries)
+	return entries, err
+}
+
+// Save writes all entries of the jar to w using codec. A nil codec is
+// equivalent to JSONCodec.
+//
+// The jar's storage must implement Dumper.
+func (j *Jar) Save(w io.Writer, codec Codec) error {
+	dumper, ok := j.storage.(Dumper)
+	if !ok {
+		return errNoDumper
+	}
+
+	if codec == nil {
+		codec = JSONCodec
+	}
+
+	return codec.Encode(w, dumper.EntriesDump())
+}
+
+// Load reads entries from r using codec and adds them to the jar. A nil codec
+// is equivalent to JSONCodec.
+//
+// Entries are added using Restorer if the jar's storage implements it, and
+// one by one using SaveEntry otherwise.
+func (j *Jar) Load(r io.Reader, codec Codec) error {
+	if codec == nil {
+		codec = JSONCodec
+	}
+
+	entries, err := codec.Decode(r)
+	if err != nil {
+		return err
+	}
+
+	j.restore(entries)
+
+	return nil
+}
+
+// LoadMany is like Load with JSONCodec, reading entries from several
+// snapshots, e.g. partial exports of different domains, and adding them to the
+// jar at once. Nothing is added unless all snapshots are read successfully.
+//
+// When several snapshots hold an entry with the same key and ID, the one most
+// recently modified according to LastModified is added, ties being won by the
+// snapshot loaded last. Added entries replace entries already in the jar like
+// with Load.
+func (j *Jar) LoadMany(readers ...io.Reader) error {
+	var merged []*Entry
+	index := make(map[[2]string]int)
+
+	for _, r := range readers {
+		entries, err := JSONCodec.Decode(r)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			id := [2]string{e.Key, e.ID}
+			i, ok := index[id]
+			switch {
+			case !ok:
+				index[id] = len(merged)
+				merged = append(merged, e)
+			case !e.LastModified.Before(merged[i].LastModified):
+				merged[i] = e
+			}
+		}
+	}
+
+	j.restore(merged)
+
+	return nil
+}
+
+// ExportOptions selects the sensitive entries included by export methods such
+// as ExportFiltered. Exports may end up at destinations less trusted than the
+// jar itself, e.g. logs or fixtures, so that HttpOnly and Secure entries are
+// left out unless explicitly included. The zero value excludes both.
+type ExportOptions struct {
+	// IncludeHttpOnly includes HttpOnly entries, which are kept out of reach
+	// of scripts by browsers
+	IncludeHttpOnly bool
+
+	// IncludeSecure includes Secure entries, which are only sent over
+	// secure connections
+	IncludeSecure bool
+}
+
+// allows reports whether e may be exported.
+func (o ExportOptions) allows(e *Entry) bool {
+	return (o.IncludeHttpOnly || !e.HttpOnly) && (o.IncludeSecure || !e.Secure)
+}
+
+// ExportFiltered is like Save with JSONCodec, writing only entries for which
+// match returns true and which are allowed by opts.
+//
+// Save is meant for persisting the jar and writes all entries.
+func (j *Jar) ExportFiltered(w io.Writer, match func(*Entry) bool, opts ExportOptions) error {
+	dumper, ok := j.storage.(Dumper)
+	if !ok {
+		return errNoDumper
+	}
+
+	selected := []*Entry{}
+	for _, e := range dumper.EntriesDump() {
+		if opts.allows(e) && match(e) {
+			selected = append(selected, e)
+		}
+	}
+
+	return JSONCodec.Encode(w, selected)
+}
+
+// ImportFiltered is like Load with JSONCodec, adding only entries for which
+// match returns true.
+func (j *Jar) ImportFiltered(r io.Reader, match func(*Entry) bool) error {
+	entries, err := JSONCodec.Decode(r)
+	if err != nil {
+		return err
+	}
+
+	selected := entries[:0]
+	for _, e := range entries {
+		if match(e) {
+			selected = append(selected, e)
+		}
+	}
+
+	j.restore(selected)
+
+	return nil
+}
+
+// restore adds entries to the jar's storage, using Restorer if the storage
+// implements it.
+func (j *Jar) restore(entries []*Entry) {
+	if restorer, ok := j.storage.(Restorer); ok {
+		restorer.EntriesRestore(entries)
+		return
+	}
+
+	for _, e := range entries {
+		j.storage.SaveEntry(e)
+	}
+}
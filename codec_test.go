@@ -0,0 +1,270 @@
+package cookiejarx
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	for name, codec := range map[string]Codec{"json": JSONCodec, "gob": GobCodec} {
+		jar := newTestJar()
+		jar.setCookies(mustParseURL("https://www.host.test/foo/"), []*http.Cookie{
+			{Name: "a", Value: "1"},
+			{Name: "b", Value: "2", Path: "/", Secure: true, HttpOnly: true},
+			{Name: "c", Value: "3", Domain: "host.test", MaxAge: 3600, SameSite: http.SameSiteStrictMode},
+		}, tNow)
+
+		var buf bytes.Buffer
+		if err := jar.Save(&buf, codec); err != nil {
+			t.Fatalf("%s: save: %v", name, err)
+		}
+
+		loaded := newTestJar()
+		if err := loaded.Load(&buf, codec); err != nil {
+			t.Fatalf("%s: load: %v", name, err)
+		}
+
+		var s []string
+		for _, c := range loaded.cookies(mustParseURL("https://www.host.test/foo/bar"), tNow) {
+			s = append(s, c.Name+"="+c.Value)
+		}
+		sort.Strings(s)
+		if got, want := strings.Join(s, " "), "a=1 b=2 c=3"; got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+
+		for _, e := range loaded.storage.(*InMemoryStorage).EntriesDump() {
+			if e.Name != "c" {
+				continue
+			}
+			if !e.Expires.Equal(tNow.Add(3600e9)) || !e.Persistent || e.SameSite != "SameSite=Strict" || e.HostOnly {
+				t.Errorf("%s: got %+v, want attributes preserved", name, e)
+			}
+		}
+	}
+}
+
+func TestExportImportFiltered(t *testing.T) {
+	jar := newTestJar()
+	jar.setCookies(mustParseURL("https://www.host.test/"), []*http.Cookie{
+		{Name: "essential", Value: "1", Secure: true},
+		{Name: "tracking", Value: "2"},
+		{Name: "session", Value: "3", Secure: true, HttpOnly: true},
+	}, tNow)
+
+	secure := func(e *Entry) bool { return e.Secure }
+
+	var buf bytes.Buffer
+	if err := jar.ExportFiltered(&buf, secure, ExportOptions{IncludeHttpOnly: true, IncludeSecure: true}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "tracking") {
+		t.Errorf("non-matching entry written: %s", buf.String())
+	}
+
+	names := func(jar *Jar) string {
+		var s []string
+		for _, c := range jar.cookies(mustParseURL("https://www.host.test/"), tNow) {
+			s = append(s, c.Name)
+		}
+		sort.Strings(s)
+		return strings.Join(s, " ")
+	}
+
+	exported := newTestJar()
+	if err := exported.Load(bytes.NewReader(buf.Bytes()), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(exported), "essential session"; got != want {
+		t.Errorf("export: got %q, want %q", got, want)
+	}
+
+	buf.Reset()
+	if err := jar.Save(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	imported := newTestJar()
+	err := imported.ImportFiltered(&buf, func(e *Entry) bool { return !e.HttpOnly })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(imported), "essential tracking"; got != want {
+		t.Errorf("import: got %q, want %q", got, want)
+	}
+}
+
+func TestExportOptions(t *testing.T) {
+	u := mustParseURL("https://www.host.test/")
+	jar := newTestJar()
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "plain", Value: "1"},
+		{Name: "secure", Value: "2", Secure: true},
+		{Name: "httponly", Value: "3", HttpOnly: true},
+		{Name: "both", Value: "4", Secure: true, HttpOnly: true},
+	}, tNow)
+
+	all := func(*Entry) bool { return true }
+
+	for _, tc := range []struct {
+		opts ExportOptions
+		want string
+	}{
+		{ExportOptions{}, "plain"},
+		{ExportOptions{IncludeSecure: true}, "plain secure"},
+		{ExportOptions{IncludeHttpOnly: true}, "httponly plain"},
+		{ExportOptions{IncludeHttpOnly: true, IncludeSecure: true}, "both httponly plain secure"},
+	} {
+		var buf bytes.Buffer
+		if err := jar.ExportFiltered(&buf, all, tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := JSONCodec.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, " "); got != tc.want {
+			t.Errorf("%+v: got exported %q, want %q", tc.opts, got, tc.want)
+		}
+
+		header := jar.exportHeaders([]*url.URL{u}, tc.opts, tNow)[u.String()]
+		var cookies []string
+		for _, c := range strings.Split(header, "; ") {
+			cookies = append(cookies, strings.SplitN(c, "=", 2)[0])
+		}
+		sort.Strings(cookies)
+		if got := strings.Join(cookies, " "); got != tc.want {
+			t.Errorf("%+v: got header %q, want cookies %q", tc.opts, header, tc.want)
+		}
+	}
+}
+
+func TestLoadMany(t *testing.T) {
+	snapshot := func(u string, cookies []*http.Cookie, now time.Time) *bytes.Buffer {
+		jar := newTestJar()
+		jar.setCookies(mustParseURL(u), cookies, now)
+		var buf bytes.Buffer
+		if err := jar.Save(&buf, JSONCodec); err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+
+	first := snapshot("http://www.host.test/", []*http.Cookie{{Name: "a", Value: "1"}, {Name: "b", Value: "old"}}, tNow.Add(time.Second))
+	second := snapshot("http://www.other.test/", []*http.Cookie{{Name: "c", Value: "3"}}, tNow)
+	// The older b of the third snapshot loses against the first one.
+	third := snapshot("http://www.host.test/", []*http.Cookie{{Name: "b", Value: "older"}, {Name: "d", Value: "4"}}, tNow)
+
+	jar := newTestJar()
+	if err := jar.LoadMany(first, second, third); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(u string) string {
+		var s []string
+		for _, c := range jar.cookies(mustParseURL(u), tNow.Add(time.Minute)) {
+			s = append(s, c.Name+"="+c.Value)
+		}
+		sort.Strings(s)
+		return strings.Join(s, " ")
+	}
+	if got, want := query("http://www.host.test/"), "a=1 b=old d=4"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := query("http://www.other.test/"), "c=3"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Nothing is loaded if a snapshot is malformed.
+	jar = newTestJar()
+	fourth := snapshot("http://www.host.test/", []*http.Cookie{{Name: "e", Value: "5"}}, tNow)
+	if err := jar.LoadMany(fourth, strings.NewReader("[{")); err == nil {
+		t.Error("got no error for malformed snapshot")
+	}
+	if n := jar.count(tNow); n != 0 {
+		t.Errorf("got %d cookies after failed load, want 0", n)
+	}
+}
+
+func TestSessionExpiryRoundTrip(t *testing.T) {
+	sessionExpiry := time.Date(2999, 12, 31, 23, 59, 59, 0, time.UTC)
+	u := mustParseURL("https://www.host.test/")
+
+	for name, codec := range map[string]Codec{"json": JSONCodec, "gob": GobCodec} {
+		jar, _ := New(&Options{PublicSuffixList: testPSL{}, SessionExpiry: sessionExpiry})
+		jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1"}}, tNow)
+
+		var buf bytes.Buffer
+		if err := jar.Save(&buf, codec); err != nil {
+			t.Fatalf("%s: save: %v", name, err)
+		}
+
+		loaded := newTestJar()
+		if err := loaded.Load(&buf, codec); err != nil {
+			t.Fatalf("%s: load: %v", name, err)
+		}
+
+		entries := loaded.storage.(*InMemoryStorage).EntriesDump()
+		if len(entries) != 1 {
+			t.Fatalf("%s: got %d entries, want 1", name, len(entries))
+		}
+		if e := entries[0]; !e.Expires.Equal(sessionExpiry) || e.Persistent {
+			t.Errorf("%s: got Expires %v, Persistent %t, want %v, false", name, e.Expires, e.Persistent, sessionExpiry)
+		}
+
+		// Session cookies do not expire by time, even past SessionExpiry.
+		if got := loaded.cookies(u, sessionExpiry.Add(time.Hour)); len(got) != 1 {
+			t.Errorf("%s: got %d cookies past SessionExpiry, want 1", name, len(got))
+		}
+	}
+
+	// The default storage gives session cookies read from cookies.txt the
+	// same Expires time.
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, SessionExpiry: sessionExpiry})
+	storage := jar.storage.(*InMemoryStorage)
+	if err := storage.ReadNetscape(strings.NewReader(".host.test\tTRUE\t/\tFALSE\t0\ta\t1\n")); err != nil {
+		t.Fatal(err)
+	}
+	if entries := storage.EntriesDump(); len(entries) != 1 || !entries[0].Expires.Equal(sessionExpiry) {
+		t.Errorf("netscape: got %+v, want a session entry expiring at %v", entries, sessionExpiry)
+	}
+}
+
+func TestSaveLoadConcurrentLookups(t *testing.T) {
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}})
+	u := mustParseURL("https://www.host.test/")
+	jar.SetCookies(u, []*http.Cookie{{Name: "a", Value: "1"}, {Name: "b", Value: "2", MaxAge: 60}})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			jar.Cookies(u)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		var buf bytes.Buffer
+		if err := jar.Save(&buf, JSONCodec); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		if err := jar.Load(&buf, JSONCodec); err != nil {
+			t.Fatalf("load: %v", err)
+		}
+	}
+
+	<-done
+
+	if got := len(jar.Cookies(u)); got != 2 {
+		t.Errorf("got %d cookies, want 2", got)
+	}
+}
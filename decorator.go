@@ -0,0 +1,125 @@
+package cookiejarx
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// The functions below implement optional interfaces of Storage decorators by
+// forwarding them to the decorated storage, falling back to the Storage and
+// Dumper methods like Jar does when the decorated storage lacks them.
+
+// clearInner removes all entries of inner using Clearer, or by removing its
+// dumped entries one by one. It reports false if inner is neither Clearer nor
+// Dumper, leaving it untouched.
+func clearInner(inner Storage) bool {
+	switch s := inner.(type) {
+	case Clearer:
+		s.Clear()
+	case Dumper:
+		for _, e := range s.EntriesDump() {
+			inner.RemoveEntry(e.Key, e.ID)
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+// restoreInner adds entries to inner using Restorer, or by saving them one by
+// one.
+func restoreInner(inner Storage, entries []*Entry) {
+	if restorer, ok := inner.(Restorer); ok {
+		restorer.EntriesRestore(entries)
+		return
+	}
+
+	for _, e := range entries {
+		inner.SaveEntry(e)
+	}
+}
+
+// lenInner implements Counter.Len for inner, counting its dumped entries if it
+// is not a Counter, or returning 0 if it is neither Counter nor Dumper.
+func lenInner(inner Storage) (n int) {
+	switch s := inner.(type) {
+	case Counter:
+		return s.Len()
+	case Dumper:
+		now := time.Now()
+		for _, e := range s.EntriesDump() {
+			if !e.Expired(now) {
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+// domainsInner implements Counter.Domains for inner, collecting the keys of
+// its dumped entries, sorted, if it is not a Counter.
+func domainsInner(inner Storage) (domains []string) {
+	switch s := inner.(type) {
+	case Counter:
+		return s.Domains()
+	case Dumper:
+		now := time.Now()
+		seen := make(map[string]bool)
+		for _, e := range s.EntriesDump() {
+			if !e.Expired(now) && !seen[e.Key] {
+				seen[e.Key] = true
+				domains = append(domains, e.Key)
+			}
+		}
+		sort.Strings(domains)
+	}
+
+	return domains
+}
+
+// generationInner returns the generation of inner, or 0 if it does not count
+// modifications, which makes Jar.CookiesIfChanged always return the cookies.
+func generationInner(inner Storage) uint64 {
+	if s, ok := inner.(generational); ok {
+		return s.Generation()
+	}
+	return 0
+}
+
+// saveEntryContext saves entry to inner, passing ctx on if inner implements
+// ContextStorage.
+func saveEntryContext(ctx context.Context, inner Storage, entry *Entry) error {
+	if s, ok := inner.(ContextStorage); ok {
+		return s.SaveEntryContext(ctx, entry)
+	}
+	inner.SaveEntry(entry)
+	return nil
+}
+
+// removeEntryContext removes the entry with key and id from inner, passing ctx
+// on if inner implements ContextStorage.
+func removeEntryContext(ctx context.Context, inner Storage, key, id string) error {
+	if s, ok := inner.(ContextStorage); ok {
+		return s.RemoveEntryContext(ctx, key, id)
+	}
+	inner.RemoveEntry(key, id)
+	return nil
+}
+
+// entriesContext looks up entries of inner, passing ctx on if inner implements
+// ContextStorage.
+func entriesContext(
+	ctx context.Context,
+	inner Storage,
+	https bool,
+	host, path, key string,
+	now time.Time,
+) ([]*Entry, error) {
+	if s, ok := inner.(ContextStorage); ok {
+		return s.EntriesContext(ctx, https, host, path, key, now)
+	}
+	return inner.Entries(https, host, path, key, now), nil
+}
@@ -0,0 +1,50 @@
+package cookiejarx
+
+// EvictionPolicy picks entries to evict from an InMemoryStorage making room for
+// a new entry, see InMemoryStorage.EvictionPolicy.
+//
+// Implementations must be safe for concurrent use by multiple goroutines.
+type EvictionPolicy interface {
+	// ShouldEvict returns the IDs of the entries to evict among entries, in
+	// the order they were first stored, to make room for incoming. It is
+	// called with the storage locked and must neither use the storage nor
+	// modify the entries.
+	ShouldEvict(entries []*Entry, incoming *Entry) (evictIDs []string)
+}
+
+// LRUEviction is an EvictionPolicy evicting the least recently accessed entry,
+// the one stored first among equally recent ones. Unlike the default order,
+// it disregards entry priorities.
+type LRUEviction struct{}
+
+// ShouldEvict implements EvictionPolicy.
+func (LRUEviction) ShouldEvict(entries []*Entry, incoming *Entry) (evictIDs []string) {
+	var lru *Entry
+	for _, e := range entries {
+		if lru == nil || e.LastAccess.Before(lru.LastAccess) {
+			lru = e
+		}
+	}
+	if lru == nil {
+		return nil
+	}
+	return []string{lru.ID}
+}
+
+// OldestCreationEviction is an EvictionPolicy evicting the entry created
+// first, regardless of its use, the one stored first among equally old ones.
+type OldestCreationEviction struct{}
+
+// ShouldEvict implements EvictionPolicy.
+func (OldestCreationEviction) ShouldEvict(entries []*Entry, incoming *Entry) (evictIDs []string) {
+	var oldest *Entry
+	for _, e := range entries {
+		if oldest == nil || e.Creation.Before(oldest.Creation) {
+			oldest = e
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	return []string{oldest.ID}
+}
@@ -0,0 +1,71 @@
+package cookiejarx
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nameEviction evicts the entries with the listed names.
+type nameEviction []string
+
+func (p nameEviction) ShouldEvict(entries []*Entry, incoming *Entry) (evictIDs []string) {
+	for _, e := range entries {
+		for _, name := range p {
+			if e.Name == name {
+				evictIDs = append(evictIDs, e.ID)
+			}
+		}
+	}
+	return evictIDs
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy EvictionPolicy
+		perKey int
+		total  int
+		want   string
+	}{
+		// a is created first, but accessed last.
+		{"default", nil, 3, -1, "a c d x"},
+		{"lru", LRUEviction{}, 3, -1, "a c d x"},
+		{"oldest creation", OldestCreationEviction{}, 3, -1, "b c d x"},
+		{"custom", nameEviction{"c"}, 3, -1, "a b d x"},
+		{"custom several", nameEviction{"a", "b", "c"}, 3, -1, "d x"},
+		{"custom none", nameEviction{"missing"}, 3, -1, "a c d x"},
+		{"global default", nil, -1, 4, "a b c d"},
+		{"global lru", LRUEviction{}, -1, 4, "a b c d"},
+		{"global custom", nameEviction{"b"}, -1, 4, "a c d x"},
+	} {
+		storage := NewInMemoryStorage()
+		jar, _ := New(&Options{
+			PublicSuffixList:    testPSL{},
+			Storage:             storage,
+			MaxCookiesPerDomain: tc.perKey,
+			MaxCookiesTotal:     tc.total,
+			EvictionPolicy:      tc.policy,
+		})
+
+		jar.setCookies(mustParseURL("http://www.other.test/"), []*http.Cookie{{Name: "x", Value: "0"}}, tNow)
+		u := mustParseURL("http://www.host.test/")
+		for i, name := range []string{"a", "b", "c"} {
+			jar.setCookies(u, []*http.Cookie{{Name: name, Value: "1", Path: "/" + name}},
+				tNow.Add(time.Duration(i+1)*time.Second))
+		}
+		jar.cookies(mustParseURL("http://www.host.test/a"), tNow.Add(4*time.Second))
+		jar.setCookies(u, []*http.Cookie{{Name: "d", Value: "1", Path: "/d"}}, tNow.Add(5*time.Second))
+
+		var names []string
+		for _, e := range storage.EntriesDump() {
+			names = append(names, e.Name)
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, " "); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
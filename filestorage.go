@@ -0,0 +1,176 @@
+package cookiejarx
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStorage is a Storage keeping entries in memory and persisting them to a
+// JSON file on every modification. Entries restored by Jar.Load and cookies set
+// by Jar.SetCookiesBatch are persisted with a single write, see EntriesRestore
+// and WriteBatch.
+//
+// The file is replaced atomically by writing a temporary file in the same
+// directory and renaming it over the original, so a crash never leaves a
+// partially written file behind.
+type FileStorage struct {
+	// mu serializes file writes and guards err.
+	mu sync.Mutex
+
+	path string
+
+	storage *InMemoryStorage
+
+	// err is the error of the most recent failed write.
+	err error
+}
+
+// NewFileStorage returns a FileStorage persisting entries to the file at path.
+// Entries are loaded from the file if it exists, dropping expired ones.
+func NewFileStorage(path string) (*FileStorage, error) {
+	s := &FileStorage{
+		path:    path,
+		storage: NewInMemoryStorage(),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if err = s.storage.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+
+	s.storage.removeExpired(time.Now())
+
+	return s, nil
+}
+
+// SaveEntry implementation of Storage.SaveEntry, persisting the change to the
+// file.
+func (s *FileStorage) SaveEntry(entry *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.storage.SaveEntry(entry)
+	s.flush()
+}
+
+// RemoveEntry implementation of Storage.RemoveEntry, persisting the change to
+// the file.
+func (s *FileStorage) RemoveEntry(key, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.storage.RemoveEntry(key, id)
+	s.flush()
+}
+
+// EntriesRestore implements Restorer, adding entries like
+// InMemoryStorage.EntriesRestore and persisting them with a single file write.
+func (s *FileStorage) EntriesRestore(entries []*Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.storage.EntriesRestore(entries)
+	s.flush()
+}
+
+// WriteBatch implements BatchWriter, applying ops like
+// InMemoryStorage.WriteBatch and persisting them with a single file write.
+func (s *FileStorage) WriteBatch(ops []BatchOp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.storage.WriteBatch(ops)
+	s.flush()
+}
+
+// Clear implements Clearer, removing all entries and persisting the change to
+// the file.
+func (s *FileStorage) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.storage.EntriesClear()
+	s.flush()
+}
+
+// Entries implementation of Storage.Entries. Lookups are served from memory
+// and are persisted along with the next modification.
+func (s *FileStorage) Entries(https bool, host, path, key string, now time.Time) (entries []*Entry) {
+	return s.storage.Entries(https, host, path, key, now)
+}
+
+// EntriesDump returns all entries held by the storage.
+func (s *FileStorage) EntriesDump() (entries []*Entry) {
+	return s.storage.EntriesDump()
+}
+
+// Len implements Counter.
+func (s *FileStorage) Len() int {
+	return s.storage.Len()
+}
+
+// Domains implements Counter.
+func (s *FileStorage) Domains() []string {
+	return s.storage.Domains()
+}
+
+// Generation returns the generation of the entries held in memory, see
+// InMemoryStorage.Generation.
+func (s *FileStorage) Generation() uint64 {
+	return s.storage.Generation()
+}
+
+// Err returns the error of the most recent failed file write, or nil if the
+// most recent write succeeded.
+func (s *FileStorage) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// flush writes all entries to the file. s.mu must be held.
+func (s *FileStorage) flush() {
+	s.err = s.write()
+}
+
+func (s *FileStorage) write() error {
+	data, err := s.storage.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+
+	return err
+}
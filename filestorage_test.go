@@ -0,0 +1,159 @@
+package cookiejarx
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.json")
+
+	storage, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(storage.EntriesDump()); got != 0 {
+		t.Fatalf("got %d entries for missing file, want 0", got)
+	}
+
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/")
+	now := time.Now()
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "session", Value: "1"},
+		{Name: "persistent", Value: "2", MaxAge: 3600},
+		{Name: "removed", Value: "4"},
+	}, now)
+	jar.setCookies(u, []*http.Cookie{{Name: "removed", MaxAge: -1}}, now)
+	storage.SaveEntry(&Entry{
+		Name:       "expired",
+		Key:        "host.test",
+		ID:         "www.host.test;/;expired",
+		Domain:     "www.host.test",
+		Path:       "/",
+		Persistent: true,
+		Expires:    now.Add(-time.Second),
+	})
+	if err := storage.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, _ := filepath.Glob(path + ".tmp*")
+	if len(matches) != 0 {
+		t.Errorf("got leftover temporary files %v", matches)
+	}
+
+	reloaded, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, e := range reloaded.EntriesDump() {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	if got, want := strings.Join(names, " "), "persistent session"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFileStorageConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.json")
+	storage, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar, _ := New(&Options{Storage: storage})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u := mustParseURL("http://www.host.test/")
+			jar.SetCookies(u, []*http.Cookie{{Name: string(rune('a' + i)), Value: "1"}})
+			jar.Cookies(u)
+		}(i)
+	}
+	wg.Wait()
+
+	reloaded, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(reloaded.EntriesDump()); got != 8 {
+		t.Errorf("got %d entries, want 8", got)
+	}
+}
+
+func TestFileStorageCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.json")
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStorage(path); err == nil {
+		t.Errorf("got nil error for corrupt file, want non-nil")
+	}
+}
+
+func TestFileStorageClear(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.json")
+
+	storage, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	jar.SetCookies(mustParseURL("http://www.host.test/"), []*http.Cookie{{Name: "a", Value: "1", MaxAge: 3600}})
+
+	jar.Clear()
+
+	reloaded, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(reloaded.EntriesDump()); got != 0 {
+		t.Errorf("got %d entries after Clear, want 0", got)
+	}
+}
+
+func TestFileStorageBatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.json")
+
+	storage, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var _ Restorer = storage
+	var _ BatchWriter = storage
+
+	entry := func(name string) *Entry {
+		return &Entry{Name: name, Value: "1", Domain: "www.host.test", Path: "/", Key: "host.test",
+			ID: "www.host.test;/;" + name, HostOnly: true, Persistent: true, Expires: endOfTime}
+	}
+	storage.EntriesRestore([]*Entry{entry("a"), entry("b")})
+	storage.WriteBatch([]BatchOp{{Entry: entry("c")}, {Entry: entry("a"), Remove: true}})
+	if err := storage.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range reloaded.EntriesDump() {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, " "); got != "b c" {
+		t.Errorf("got %q after reload, want %q", got, "b c")
+	}
+}
@@ -0,0 +1,79 @@
+package cookiejarx
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// FrozenJar is an immutable snapshot of a Jar. It answers cookie queries
+// against the entries captured at the time of Jar.Freeze and does not reflect
+// any subsequent modifications of the source jar.
+type FrozenJar struct {
+	// jar is the source jar, used only for its configuration which does
+	// not change after New.
+	jar *Jar
+
+	storage *InMemoryStorage
+}
+
+// Freeze returns an immutable snapshot of the jar's current entries.
+//
+// Storage implementations which are neither InMemoryStorage nor Dumper yield
+// an empty snapshot.
+func (j *Jar) Freeze() *FrozenJar {
+	frozen := &FrozenJar{
+		jar: j,
+	}
+
+	switch s := j.storage.(type) {
+	case *InMemoryStorage:
+		frozen.storage = s.Clone()
+	case Dumper:
+		frozen.storage = NewInMemoryStorage()
+		for _, e := range s.EntriesDump() {
+			entry := *e
+			frozen.storage.saveEntry(&entry)
+		}
+	default:
+		frozen.storage = NewInMemoryStorage()
+	}
+
+	return frozen
+}
+
+// Cookies returns the cookies captured in the snapshot to send in a request
+// for the given URL, carrying only Name and Value like Jar.Cookies.
+//
+// It returns an empty slice if the URL's scheme is not HTTP or HTTPS.
+func (f *FrozenJar) Cookies(u *url.URL) (cookies []*http.Cookie) {
+	for _, e := range f.entries(u, f.jar.now()) {
+		cookies = append(cookies, &http.Cookie{Name: e.Name, Value: e.Value})
+	}
+
+	return cookies
+}
+
+// CookiesFull is like Cookies, but returned cookies carry all stored
+// attributes.
+func (f *FrozenJar) CookiesFull(u *url.URL) (cookies []*http.Cookie) {
+	for _, e := range f.entries(u, f.jar.now()) {
+		cookies = append(cookies, fullCookie(e))
+	}
+
+	return cookies
+}
+
+// entries returns the captured entries matching u which are not expired at now,
+// leaving out partitioned entries of other top-level sites like Jar.Cookies.
+func (f *FrozenJar) entries(u *url.URL, now time.Time) []*Entry {
+	https, host, path, key, ok := f.jar.requestParams(u)
+	if !ok {
+		return nil
+	}
+
+	lookup := func(key string) []*Entry {
+		return f.storage.EntriesPeek(https, host, path, key, now)
+	}
+	return inPartition(f.jar.withDomainKeys(host, key, lookup(key), lookup), key)
+}
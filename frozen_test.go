@@ -0,0 +1,45 @@
+package cookiejarx
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFreeze(t *testing.T) {
+	jar := newTestJar()
+	u := mustParseURL("http://www.host.test/")
+
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "a", Value: "1"},
+		{Name: "b", Value: "2", Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode},
+	})
+
+	frozen := jar.Freeze()
+
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "a", Value: "changed"},
+		{Name: "b", MaxAge: -1},
+		{Name: "c", Value: "3"},
+	})
+
+	var s []string
+	for _, c := range frozen.Cookies(u) {
+		s = append(s, c.Name+"="+c.Value)
+	}
+	if got, want := strings.Join(s, " "), "a=1 b=2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	full := frozen.CookiesFull(u)
+	if len(full) != 2 {
+		t.Fatalf("got %d cookies, want 2", len(full))
+	}
+	if c := full[1]; c.Domain != "www.host.test" || c.Path != "/" || !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("got %#v, want full attributes", c)
+	}
+
+	if got := frozen.Cookies(mustParseURL("ftp://www.host.test/")); len(got) != 0 {
+		t.Errorf("got %v for unsupported scheme, want none", got)
+	}
+}
@@ -0,0 +1,95 @@
+package cookiejarx
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestInMemoryStorageBinary(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/")
+	for _, name := range []string{"c", "a", "d", "b"} {
+		jar.setCookies(u, []*http.Cookie{{Name: name, Value: name}}, tNow)
+	}
+	jar.setCookies(mustParseURL("http://www.other.test/"), []*http.Cookie{{Name: "x", MaxAge: 60}}, tNow)
+
+	data, err := storage.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewInMemoryStorage()
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if restored.nextSeqNum != storage.nextSeqNum {
+		t.Errorf("got nextSeqNum %d, want %d", restored.nextSeqNum, storage.nextSeqNum)
+	}
+
+	restoredJar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: restored})
+	var s []string
+	for _, c := range restoredJar.cookies(u, tNow) {
+		s = append(s, c.Name)
+	}
+	if got, want := strings.Join(s, " "), "c a d b"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := len(restored.EntriesDump()); got != 5 {
+		t.Errorf("got %d entries, want 5", got)
+	}
+
+	for _, bad := range [][]byte{nil, append([]byte{binaryVersion + 1}, data[1:]...)} {
+		if err := restored.UnmarshalBinary(bad); err == nil {
+			t.Errorf("UnmarshalBinary(%.4x) succeeded, want error", bad)
+		}
+	}
+	if got := len(restored.EntriesDump()); got != 5 {
+		t.Errorf("got %d entries after failed unmarshal, want 5", got)
+	}
+}
+
+// newSnapshotStorage returns a storage holding n cookies spread over 100
+// domains.
+func newSnapshotStorage(n int) *InMemoryStorage {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage, MaxCookiesPerDomain: -1, MaxCookiesTotal: -1})
+	for i := 0; i < n; i++ {
+		u := mustParseURL(fmt.Sprintf("http://www.host%d.test/", i%100))
+		jar.setCookies(u, []*http.Cookie{{Name: fmt.Sprintf("cookie%d", i), Value: "value", MaxAge: 3600}}, tNow)
+	}
+	return storage
+}
+
+func BenchmarkInMemoryStorageSnapshotJSON(b *testing.B) {
+	storage := newSnapshotStorage(1000)
+	size := 0
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		data, _ := json.Marshal(storage)
+		size = len(data)
+		if err := json.Unmarshal(data, NewInMemoryStorage()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(size), "bytes/snapshot")
+}
+
+func BenchmarkInMemoryStorageSnapshotBinary(b *testing.B) {
+	storage := newSnapshotStorage(1000)
+	size := 0
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		data, _ := storage.MarshalBinary()
+		size = len(data)
+		if err := NewInMemoryStorage().UnmarshalBinary(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(size), "bytes/snapshot")
+}
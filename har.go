@@ -0,0 +1,56 @@
+package cookiejarx
+
+import (
+	"net/url"
+	"time"
+)
+
+// HARCookie is a cookie in the form of the cookies array of an HTTP Archive
+// (HAR 1.2) request, as returned by Jar.HARCookies.
+type HARCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Path  string `json:"path,omitempty"`
+
+	Domain string `json:"domain,omitempty"`
+
+	// Expires is the expiration time of a persistent cookie, encoded as
+	// ISO 8601, and nil for session cookies, whose field is omitted.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	HTTPOnly bool `json:"httpOnly"`
+	Secure   bool `json:"secure"`
+}
+
+// HARCookies returns the cookies a request to u would carry, as selected and
+// ordered by CookiesFull, in HAR form, e.g. to be serialized into the request
+// of a HAR entry.
+func (j *Jar) HARCookies(u *url.URL) (cookies []HARCookie) {
+	return j.harCookies(u, j.now())
+}
+
+// harCookies is like HARCookies but takes the current time as a parameter.
+func (j *Jar) harCookies(u *url.URL, now time.Time) (cookies []HARCookie) {
+	https, host, path, key, ok := j.requestParams(u)
+	if !ok {
+		return cookies
+	}
+
+	for _, e := range j.entries(https, host, path, key, now) {
+		c := HARCookie{
+			Name:     e.Name,
+			Value:    e.Value,
+			Path:     e.Path,
+			Domain:   e.Domain,
+			HTTPOnly: e.HttpOnly,
+			Secure:   e.Secure,
+		}
+		if e.Persistent {
+			expires := e.Expires.UTC()
+			c.Expires = &expires
+		}
+		cookies = append(cookies, c)
+	}
+
+	return cookies
+}
@@ -0,0 +1,33 @@
+package cookiejarx
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHARCookies(t *testing.T) {
+	jar := newTestJar()
+	u := mustParseURL("https://www.host.test/a/")
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "session", Value: "1", HttpOnly: true},
+		{Name: "persistent", Value: "2", Domain: "host.test", Path: "/", Secure: true, MaxAge: 3600},
+	}, tNow)
+
+	data, err := json.Marshal(jar.harCookies(u, tNow))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := tNow.Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	want := `[{"name":"session","value":"1","path":"/a","domain":"www.host.test","httpOnly":true,"secure":false},` +
+		`{"name":"persistent","value":"2","path":"/","domain":"host.test","expires":"` + expires + `","httpOnly":false,"secure":true}]`
+	if string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+
+	if cookies := jar.harCookies(mustParseURL("ftp://www.host.test/"), tNow); len(cookies) != 0 {
+		t.Errorf("got %d cookies for a non-HTTP URL, want 0", len(cookies))
+	}
+}
@@ -6,14 +6,22 @@
 package cookiejarx
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/eientei/cookiejarx/punycode"
 	"net"
 	"net/http"
 	"net/url"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // PublicSuffixList provides the public suffix of a domain. For example:
@@ -73,10 +81,313 @@ type Options struct {
 	// for bar.co.uk.
 	PublicSuffixList PublicSuffixList
 
+	// AdditionalPublicSuffixExceptions lists domains owned by the host of
+	// the same name, e.g. internal suffixes such as "app.corp" unknown to
+	// PublicSuffixList. A cookie set by such a host with a Domain attribute
+	// naming it is a host cookie, as if the domain were a public suffix,
+	// see DomainAndType. Cookies of other hosts are not affected, and
+	// domains which PublicSuffixList reports as public suffixes behave this
+	// way without being listed.
+	//
+	// By default, the list is empty and a Domain attribute naming the host
+	// makes a domain cookie, unless the host is a public suffix.
+	AdditionalPublicSuffixExceptions []string
+
 	// Storage is the cookie entry persistence implementation.
 	//
-	// If not provided, InMemoryStorage will be used.
+	// If not provided, InMemoryStorage will be used, with its default zero
+	// AccessResolution: concurrent lookups are then serialized, a storage
+	// with a positive InMemoryStorage.AccessResolution lets them proceed in
+	// parallel.
 	Storage Storage
+
+	// HashIDs makes the jar store entries under a fixed-length HashID of
+	// their "Domain;Path;Name" identifier, which suits persistent backends
+	// preferring short keys. The original identifier remains available
+	// through Entry.RawID.
+	HashIDs bool
+
+	// LenientIDNA makes the jar retry request hosts rejected by
+	// CanonicalHost for needing the UTS #46 mapping of browsers, lower
+	// casing their non-ASCII letters and turning ideographic and fullwidth
+	// full stops into dots. For example, "BÜCHER.de" is then accepted as
+	// "xn--bcher-kva.de".
+	//
+	// By default, such hosts are rejected as IDNA2008 requires.
+	LenientIDNA bool
+
+	// OnCanonicalHostError, if set, is called with a request host and the
+	// error of CanonicalHost, or of the LenientIDNA retry, when it fails
+	// on it. The jar then uses the returned host, canonicalized like a
+	// request host, or drops the cookies of the request if an error is
+	// returned, e.g. by a caller wrapping golang.org/x/net/idna with a
+	// non-strict profile.
+	//
+	// When nil, cookies for hosts rejected by CanonicalHost are dropped.
+	OnCanonicalHostError func(host string, err error) (string, error)
+
+	// IDNAMode selects how request hosts with IDNA deviation characters,
+	// such as ß in "faß.de", are converted to their ASCII form, see
+	// punycode.Mode. The zero value is punycode.Nontransitional, the
+	// IDNA2008 processing of current browsers, as used by CanonicalHost.
+	IDNAMode punycode.Mode
+
+	// MaxCookiesPerDomain limits the number of cookies stored per jar key
+	// (registrable domain) as suggested by RFC 6265 section 6.1. Zero means
+	// DefaultMaxCookiesPerDomain, a negative value disables the limit.
+	//
+	// Limits are enforced by InMemoryStorage, see
+	// InMemoryStorage.MaxEntriesPerKey, and are applied to the storage
+	// created by New as well as to a provided *InMemoryStorage or storage
+	// returned by NewShardedInMemoryStorage. Zero keeps any limit already
+	// set on a provided storage, the default only applying to storages
+	// without one.
+	MaxCookiesPerDomain int
+
+	// MaxCookieBytes, if positive, limits the length of cookie name and
+	// value in total, longer cookies are rejected with ErrCookieTooLarge as
+	// browsers do, e.g. with DefaultMaxCookieBytes. Zero or a negative
+	// value disables the limit, unless StrictRFC6265 is set.
+	MaxCookieBytes int
+
+	// MaxDomainLength limits the length of Domain attributes, not counting
+	// a leading dot. Longer ones are rejected before any other processing,
+	// bounding the work spent on hostile input. Zero means
+	// DefaultMaxDomainLength, a negative value disables the limit.
+	MaxDomainLength int
+
+	// MaxCookiesTotal limits the total number of cookies stored in the jar.
+	// Zero means DefaultMaxCookiesTotal, a negative value disables the
+	// limit. It is applied like MaxCookiesPerDomain, see
+	// InMemoryStorage.MaxEntries.
+	MaxCookiesTotal int
+
+	// StrictRFC6265 enables a coherent set of strict behaviors for
+	// security-conscious users:
+	//   - cookies with names not being RFC 6265 tokens or values not
+	//     consisting of cookie-octets are rejected, see ValidateNameValue,
+	//   - cookies with name and value longer than MaxCookieBytes in total,
+	//     or DefaultMaxCookieBytes if it is not positive, are rejected,
+	//   - a PublicSuffixList is required, New fails if it is nil,
+	//   - cookies with a Domain attribute set by IP address hosts are
+	//     rejected, AllowIPCookies is ignored.
+	//
+	// A Max-Age=0 attribute, parsed by net/http as a negative
+	// http.Cookie.MaxAge, always deletes the cookie.
+	StrictRFC6265 bool
+
+	// ValidateNameValue makes the jar reject cookies with names not being
+	// RFC 6265 tokens or values not consisting of cookie-octets, such as
+	// values containing a comma or semicolon, see ValidateNameValue, which
+	// could corrupt Cookie headers. It is implied by StrictRFC6265.
+	ValidateNameValue bool
+
+	// StrictPrefixes makes the jar reject cookies violating the restrictions
+	// of the "__Secure-" and "__Host-" name prefixes, as browsers do, see
+	// Entry.ValidatePrefix. The restrictions are checked against the
+	// resolved domain and path, so a "__Host-" cookie without a Path
+	// attribute is only accepted when its default path is "/".
+	StrictPrefixes bool
+
+	// RootDefaultPath makes cookies without a valid Path attribute, i.e.
+	// none or one not starting with a slash, default to the path "/". By
+	// default they get the default-path of the request URL as required by
+	// RFC 6265 section 5.1.4, its directory, e.g. "/a/b" for a cookie set
+	// by "/a/b/c", see DefaultPath, so that they are not sent to "/" or
+	// "/x".
+	RootDefaultPath bool
+
+	// StripTrailingDotDomain makes the jar strip a single trailing dot from
+	// Domain attributes such as "www.example.com." instead of rejecting
+	// the cookie, as common browsers do. By default such cookies are
+	// rejected as required by RFC 6265.
+	StripTrailingDotDomain bool
+
+	// AllowIPCookies makes the jar accept cookies set by an IP address host
+	// with a Domain attribute equal to that address, storing them as
+	// host-only cookies as common browsers do. IPv6 addresses may be given
+	// with or without brackets. By default such cookies are rejected as
+	// required by RFC 6265. It is ignored with StrictRFC6265.
+	AllowIPCookies bool
+
+	// DefaultSameSite, if set, returns the SameSite mode applied to cookies
+	// set by host without a SameSite attribute, allowing e.g. untrusted hosts
+	// to default to http.SameSiteStrictMode. When nil, such cookies have no
+	// SameSite restriction.
+	DefaultSameSite func(host string) http.SameSite
+
+	// MaxExpiryForHost, if set, returns the maximum lifetime of persistent
+	// cookies set by host, zero meaning no limit. Cookies expiring later are
+	// clamped to expire after that lifetime, enabling per-site retention
+	// policies such as keeping analytics cookies for a day at most.
+	MaxExpiryForHost func(host string) time.Duration
+
+	// SessionExpiry is the Expires time given to session (non-persistent)
+	// cookies, 9999-12-31 23:59:59 UTC if zero. Setting e.g. a time in year
+	// 2999 keeps entries representable by serialization targets with a
+	// narrower range, such as SQL DATETIME columns or JavaScript dates.
+	// Session cookies are identified by Entry.Persistent, never by this
+	// time, so it does not affect when they expire.
+	//
+	// The default storage applies it to session cookies read by
+	// InMemoryStorage.ReadNetscape as well, see
+	// InMemoryStorage.SessionExpiry.
+	SessionExpiry time.Time
+
+	// SchemeSecurity, if set, reports whether the jar handles URLs with
+	// scheme, and whether the scheme is secure, so that Secure cookies are
+	// sent with it. It allows custom schemes such as "app" to be used. When
+	// nil, only "http" and "https" are handled, "https" being secure.
+	SchemeSecurity func(scheme string) (allowed bool, secure bool)
+
+	// AcceptCookieForContentType, if set, reports whether cookies of a
+	// response with the Content-Type header value contentType are accepted
+	// by SetCookiesFromResponse, allowing e.g. cookies of image or script
+	// responses to be ignored as a tracking mitigation. When nil, cookies of
+	// all responses are accepted. SetCookies is not affected.
+	AcceptCookieForContentType func(contentType string) bool
+
+	// AcceptCookieWithJar, if set, reports whether cookie c received from u
+	// is accepted, given the jar j, so that the decision may depend on the
+	// cookies already stored, e.g. to accept cookies of a domain only once
+	// the user accepted a consent cookie. It is called for every cookie of a
+	// SetCookies call, deleting ones included, in order, so it sees the
+	// cookies accepted before.
+	//
+	// It is called without holding any jar or storage lock, so it may query
+	// j, e.g. by Cookies or GetCookie, without deadlocking. It should not
+	// store cookies itself.
+	AcceptCookieWithJar func(j *Jar, u *url.URL, c *http.Cookie) bool
+
+	// MaxSetCookiesPerSecond, if positive, limits the number of
+	// SetCookies calls per second and jar key (registrable domain) of the
+	// URL, guarding against servers setting cookies on every response. The
+	// cookies of calls beyond the limit are dropped and reported to an
+	// Observer implementing RateLimitObserver.
+	MaxSetCookiesPerSecond int
+
+	// EvictionPolicy, if set, picks the cookies evicted when the limits
+	// MaxCookiesPerDomain and MaxCookiesTotal are exceeded, see
+	// InMemoryStorage.EvictionPolicy. It is applied like the limits. When
+	// nil, least recently accessed cookies are evicted.
+	EvictionPolicy EvictionPolicy
+
+	// TrackStats makes the jar's InMemoryStorage, or storage returned by
+	// NewShardedInMemoryStorage, count the storage lookups selecting each
+	// entry, see Entry.SendCount and InMemoryStorage.Stats. As every
+	// lookup then modifies the storage, lookups need an exclusive lock.
+	TrackStats bool
+
+	// Observer, if set, is notified of cookies set, removed and expired by
+	// the jar, see Observer. Entries added by Load or ImportFiltered are
+	// not reported. Jars sharing a storage should share a pointer observer,
+	// which is notified of each expired entry once, whereas observers of
+	// other kinds are notified once per jar.
+	Observer Observer
+
+	// Logger, if set, is told about cookies dropped by SetCookies and
+	// related methods and why, e.g. an illegal Domain attribute, and about
+	// cookies removed by them, by a non-positive Max-Age or by a past
+	// Expires attribute. A nil Logger disables logging.
+	Logger Logger
+
+	// LogAccepted makes Logger also told about each accepted cookie, as a
+	// Set-Cookie header with its value redacted by RedactEntry, e.g. for
+	// audit logs.
+	LogAccepted bool
+
+	// LogRedactNames redacts cookie names in messages to Logger, see
+	// RedactEntry. Use NewRedactingObserver to redact entries passed to
+	// an Observer.
+	LogRedactNames bool
+
+	// LogRedactionKey is the secret key of the HMAC redacting cookie values
+	// and names in messages to Logger, see RedactEntry. Reusing a key keeps
+	// redacted values recognizable across jars and restarts. If empty, a
+	// random key is generated for the jar.
+	LogRedactionKey []byte
+
+	// Now returns the current time used to determine cookie creation and
+	// expiration. It is called on every jar operation, so a mutable clock
+	// may be provided for testing. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Default cookie count limits, see Options.
+const (
+	DefaultMaxCookiesPerDomain = 50
+	DefaultMaxCookiesTotal     = 3000
+)
+
+// DefaultMaxCookieBytes is the limit of name and value length enforced by
+// Options.StrictRFC6265 if Options.MaxCookieBytes is not set, the common
+// browser limit.
+const DefaultMaxCookieBytes = 4096
+
+// DefaultMaxDomainLength is the default Options.MaxDomainLength, the maximum
+// length of a DNS name in its textual form.
+const DefaultMaxDomainLength = 253
+
+// Dumper is an optional interface implemented by Storage that is able to list
+// all of its entries.
+type Dumper interface {
+	// EntriesDump returns all entries persisted in storage
+	EntriesDump() (entries []*Entry)
+}
+
+// Clearer is an optional interface implemented by Storage that is able to
+// remove all of its entries at once.
+type Clearer interface {
+	// Clear removes all entries persisted in storage
+	Clear()
+}
+
+// Counter is an optional interface implemented by Storage that is able to
+// count its entries without listing them.
+type Counter interface {
+	// Len returns the number of non-expired entries persisted in storage
+	Len() int
+
+	// Domains returns the keys of non-expired entries persisted in storage
+	Domains() []string
+}
+
+// ContextStorage is an optional interface implemented by Storage that is able
+// to take the context of a call, e.g. to give up waiting once it is done or to
+// start tracing spans as its children. Jar.CookiesWithContext and
+// Jar.SetCookiesWithContext pass their context to the jar's storage, and
+// Storage decorators such as NewSemaphoreStorage and NewTracedStorage pass it
+// on to decorated ContextStorage implementations.
+type ContextStorage interface {
+	Storage
+
+	// SaveEntryContext is like SaveEntry, returning an error if entry
+	// could not be saved because of ctx.
+	SaveEntryContext(ctx context.Context, entry *Entry) error
+
+	// RemoveEntryContext is like RemoveEntry, returning an error if the
+	// entry could not be removed because of ctx.
+	RemoveEntryContext(ctx context.Context, key, id string) error
+
+	// EntriesContext is like Entries, returning an error if the entries
+	// could not be looked up because of ctx.
+	EntriesContext(ctx context.Context, https bool, host, path, key string, now time.Time) ([]*Entry, error)
+}
+
+// BatchOp is a single operation of a batch written by a BatchWriter: a save of
+// Entry, or, if Remove is set, a removal of the entry with the key and ID of
+// Entry.
+type BatchOp struct {
+	Entry  *Entry
+	Remove bool
+}
+
+// BatchWriter is an optional interface implemented by Storage that is able to
+// apply several saves and removals at once, e.g. under a single lock
+// acquisition. See Jar.SetCookiesBatch.
+type BatchWriter interface {
+	// WriteBatch applies ops in order
+	WriteBatch(ops []BatchOp)
 }
 
 // Jar implements the http.CookieJar interface from the net/http package.
@@ -84,23 +395,204 @@ type Jar struct {
 	storage Storage
 
 	psList PublicSuffixList
+
+	// suffixExceptions holds the canonical domains of
+	// Options.AdditionalPublicSuffixExceptions.
+	suffixExceptions map[string]bool
+
+	hashIDs bool
+
+	strict bool
+
+	validateNameValue bool
+
+	strictPrefixes bool
+
+	maxCookieBytes int
+
+	maxDomainLength int
+
+	onCanonicalHostError func(host string, err error) (string, error)
+
+	idnaMode punycode.Mode
+
+	lenientIDNA bool
+
+	allowIPCookies bool
+
+	stripTrailingDotDomain bool
+
+	rootDefaultPath bool
+
+	defaultSameSite func(host string) http.SameSite
+
+	maxExpiryForHost func(host string) time.Duration
+
+	sessionExpiry time.Time
+
+	schemeSecurityFunc func(scheme string) (allowed bool, secure bool)
+
+	acceptCookieForContentType func(contentType string) bool
+
+	acceptCookieWithJar func(j *Jar, u *url.URL, c *http.Cookie) bool
+
+	observer Observer
+
+	logger Logger
+
+	logAccepted bool
+
+	logRedactNames bool
+
+	logRedactionKey []byte
+
+	maxSetCookiesPerSecond int
+
+	now func() time.Time
+
+	// mu locks the remaining fields.
+	mu sync.Mutex
+
+	// sessionStart is the time of the most recent StartSession call.
+	sessionStart time.Time
+
+	// setCookiesWindows counts SetCookies calls per jar key in the current
+	// one second window, see Options.MaxSetCookiesPerSecond.
+	setCookiesWindows map[string]*rateWindow
+}
+
+// rateWindow is a one second window counting calls.
+type rateWindow struct {
+	start time.Time
+	calls int
 }
 
-// New returns a new cookie jar. A nil *Options is equivalent to a zero
-// Options.
-func New(o *Options) (*Jar, error) {
-	jar := &Jar{}
+// maxRateWindows is the number of rate windows above which windows of keys not
+// used within the last second are pruned.
+const maxRateWindows = 1024
+
+// New returns a new cookie jar configured by opts, see Option. New(nil) and
+// New(&Options{}) are equivalent to New().
+func New(opts ...Option) (*Jar, error) {
+	var o Options
+	for _, opt := range opts {
+		if opt != nil {
+			opt.applyOption(&o)
+		}
+	}
+
+	return newJar(&o)
+}
+
+// newJar returns a new cookie jar configured by o. A nil *Options is
+// equivalent to a zero Options.
+func newJar(o *Options) (*Jar, error) {
+	jar := &Jar{maxDomainLength: DefaultMaxDomainLength}
+	// Zero limits keep the ones of the storage, see applyLimits.
+	var maxPerDomain, maxTotal int
+	trackStats := false
+	var evictionPolicy EvictionPolicy
 	if o != nil {
+		jar.maxCookieBytes = o.MaxCookieBytes
+		if o.MaxDomainLength != 0 {
+			jar.maxDomainLength = o.MaxDomainLength
+		}
 		jar.psList = o.PublicSuffixList
+		for _, domain := range o.AdditionalPublicSuffixExceptions {
+			domain, _ = punycode.ToLower(strings.TrimPrefix(domain, "."))
+			if domain == "" {
+				continue
+			}
+			if jar.suffixExceptions == nil {
+				jar.suffixExceptions = make(map[string]bool)
+			}
+			jar.suffixExceptions[domain] = true
+		}
+		jar.hashIDs = o.HashIDs
+		jar.onCanonicalHostError = o.OnCanonicalHostError
+		jar.idnaMode = o.IDNAMode
+		jar.lenientIDNA = o.LenientIDNA
+		jar.strict = o.StrictRFC6265
+		jar.validateNameValue = o.ValidateNameValue
+		jar.strictPrefixes = o.StrictPrefixes
+		jar.allowIPCookies = o.AllowIPCookies
+		jar.stripTrailingDotDomain = o.StripTrailingDotDomain
+		jar.rootDefaultPath = o.RootDefaultPath
+		jar.defaultSameSite = o.DefaultSameSite
+		jar.maxExpiryForHost = o.MaxExpiryForHost
+		jar.sessionExpiry = o.SessionExpiry
+		jar.schemeSecurityFunc = o.SchemeSecurity
+		jar.acceptCookieForContentType = o.AcceptCookieForContentType
+		jar.acceptCookieWithJar = o.AcceptCookieWithJar
+		jar.observer = o.Observer
+		jar.logger = o.Logger
+		jar.logAccepted = o.LogAccepted
+		jar.logRedactNames = o.LogRedactNames
+		jar.logRedactionKey = o.LogRedactionKey
+		jar.maxSetCookiesPerSecond = o.MaxSetCookiesPerSecond
+		jar.now = o.Now
+		maxPerDomain = o.MaxCookiesPerDomain
+		maxTotal = o.MaxCookiesTotal
+		trackStats = o.TrackStats
+		evictionPolicy = o.EvictionPolicy
 		if o.Storage != nil {
 			jar.storage = o.Storage
 		}
 	}
 
+	if jar.now == nil {
+		jar.now = time.Now
+	}
+
+	if jar.strict && jar.psList == nil {
+		return nil, errNoPublicSuffixList
+	}
+
+	if jar.logger != nil && len(jar.logRedactionKey) == 0 {
+		key, err := newRedactionKey()
+		if err != nil {
+			return nil, err
+		}
+		jar.logRedactionKey = key
+	}
+
+	if jar.strict {
+		if jar.maxCookieBytes <= 0 {
+			jar.maxCookieBytes = DefaultMaxCookieBytes
+		}
+		jar.allowIPCookies = false
+	}
+
 	if jar.storage == nil {
-		jar.storage = NewInMemoryStorage()
+		storage := NewInMemoryStorage()
+		storage.PublicSuffixList = jar.psList
+		storage.SessionExpiry = jar.sessionExpiry
+		jar.storage = storage
+	}
+
+	switch storage := jar.storage.(type) {
+	case *InMemoryStorage:
+		storage.applyLimits(maxPerDomain, maxTotal, DefaultMaxCookiesPerDomain, DefaultMaxCookiesTotal)
+		if trackStats {
+			storage.TrackStats = true
+		}
+		if evictionPolicy != nil {
+			storage.EvictionPolicy = evictionPolicy
+		}
+	case *shardedInMemoryStorage:
+		storage.setLimits(maxPerDomain, maxTotal)
+		for _, shard := range storage.shards {
+			if trackStats {
+				shard.TrackStats = true
+			}
+			if evictionPolicy != nil {
+				shard.EvictionPolicy = evictionPolicy
+			}
+		}
 	}
 
+	jar.observeStorage()
+
 	return jar, nil
 }
 
@@ -120,6 +612,116 @@ type Entry struct {
 	Expires    time.Time
 	Creation   time.Time
 	LastAccess time.Time
+
+	// LastModified is the time Value, Expires or any of the flags last
+	// changed. Storing an entry equal to the stored one besides its
+	// timestamps keeps the stored LastModified, see InMemoryStorage.
+	LastModified time.Time
+
+	// Priority is the value of the non-standard Priority attribute, one of
+	// PriorityLow, PriorityMedium and PriorityHigh. InMemoryStorage evicts
+	// entries of a key in order of priority, see
+	// InMemoryStorage.MaxEntriesPerKey. An empty Priority is equivalent to
+	// PriorityMedium.
+	Priority string
+
+	// Partitioned records the Partitioned attribute of CHIPS (Cookies
+	// Having Independent Partitioned State): the entry is only sent in
+	// requests made within the top-level site it was set in, whose jar key
+	// is PartitionKey. See Jar.SetCookiesPartitioned.
+	Partitioned  bool
+	PartitionKey string
+
+	// SendCount is the number of lookups of Storage.Entries which selected
+	// the entry, maintained by InMemoryStorage if its TrackStats is set, see
+	// Options.TrackStats. The jar filters selected entries further, e.g.
+	// dropping partitioned entries of other top-level sites or session
+	// entries of a previous session, so the count may exceed the number of
+	// requests the cookie was actually sent with.
+	SendCount uint64
+}
+
+// Cookie priorities, see Entry.Priority.
+const (
+	PriorityLow    = "Low"
+	PriorityMedium = "Medium"
+	PriorityHigh   = "High"
+)
+
+// ParsePriority returns the priority given by a Priority attribute among the
+// attributes of a Set-Cookie header net/http did not parse, see
+// http.Cookie.Unparsed, matching attribute name and value case-insensitively
+// as Chrome does. It returns PriorityMedium if there is no valid Priority
+// attribute.
+func ParsePriority(unparsed []string) string {
+	priority := PriorityMedium
+	for _, attr := range unparsed {
+		name, value := attr, ""
+		if i := strings.IndexByte(attr, '='); i >= 0 {
+			name, value = attr[:i], attr[i+1:]
+		}
+		if !strings.EqualFold(strings.TrimSpace(name), "Priority") {
+			continue
+		}
+
+		switch value = strings.TrimSpace(value); {
+		case strings.EqualFold(value, PriorityLow):
+			priority = PriorityLow
+		case strings.EqualFold(value, PriorityMedium):
+			priority = PriorityMedium
+		case strings.EqualFold(value, PriorityHigh):
+			priority = PriorityHigh
+		}
+	}
+	return priority
+}
+
+// priorityRank orders priorities from PriorityLow to PriorityHigh.
+func priorityRank(priority string) int {
+	switch priority {
+	case PriorityLow:
+		return 0
+	case PriorityHigh:
+		return 2
+	}
+	return 1
+}
+
+// RawID returns the unhashed "Domain;Path;Name" identifier of e, suffixed by
+// ";" and the PartitionKey for partitioned entries, so that entries of
+// different partitions do not replace each other.
+func (e *Entry) RawID() string {
+	if e.Partitioned {
+		return fmt.Sprintf("%s;%s;%s;%s", e.Domain, e.Path, e.Name, e.PartitionKey)
+	}
+	return fmt.Sprintf("%s;%s;%s", e.Domain, e.Path, e.Name)
+}
+
+// IsPartitioned reports whether c carries the Partitioned attribute. Since Go
+// 1.23 net/http parses it into http.Cookie.Partitioned, which is read by
+// reflection so that older Go versions remain supported, whereas older
+// versions leave it among http.Cookie.Unparsed.
+func IsPartitioned(c *http.Cookie) bool {
+	if f := reflect.ValueOf(c).Elem().FieldByName("Partitioned"); f.Kind() == reflect.Bool && f.Bool() {
+		return true
+	}
+	for _, attr := range c.Unparsed {
+		if strings.EqualFold(strings.TrimSpace(attr), "Partitioned") {
+			return true
+		}
+	}
+	return false
+}
+
+// HashID returns a fixed-length identifier derived from id: the hex encoded
+// first 128 bits of its SHA-256 hash.
+//
+// Distinct identifiers colliding is astronomically unlikely, but should it
+// happen, the colliding cookies replace each other like cookies sharing the
+// same identifier would.
+func HashID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:16])
 }
 
 // ShouldSend determines whether e's cookie qualifies to be included in a
@@ -129,6 +731,28 @@ func (e *Entry) ShouldSend(https bool, host, path string) bool {
 	return e.DomainMatch(host) && e.PathMatch(path) && (https || !e.Secure)
 }
 
+// SessionTTL is the TTL of session entries, which expire with the session
+// rather than at a given time, see Entry.TTL.
+const SessionTTL time.Duration = -1
+
+// Expired reports whether e is a persistent entry expired at now. Session
+// entries never expire by time.
+func (e *Entry) Expired(now time.Time) bool {
+	return e.Persistent && !e.Expires.After(now)
+}
+
+// TTL returns the time remaining until e expires from now, zero if e is
+// expired, or SessionTTL if e is a session entry.
+func (e *Entry) TTL(now time.Time) time.Duration {
+	if !e.Persistent {
+		return SessionTTL
+	}
+	if e.Expired(now) {
+		return 0
+	}
+	return e.Expires.Sub(now)
+}
+
 // DomainMatch implements "domain-match" of RFC 6265 section 5.1.3.
 func (e *Entry) DomainMatch(host string) bool {
 	if e.Domain == host {
@@ -137,100 +761,1542 @@ func (e *Entry) DomainMatch(host string) bool {
 	return !e.HostOnly && HasDotSuffix(host, e.Domain)
 }
 
-// PathMatch implements "path-match" according to RFC 6265 section 5.1.4.
-func (e *Entry) PathMatch(requestPath string) bool {
-	if requestPath == e.Path {
-		return true
-	}
-	if strings.HasPrefix(requestPath, e.Path) {
-		if e.Path[len(e.Path)-1] == '/' {
-			return true // The "/any/" matches "/any/path" case.
-		} else if requestPath[len(e.Path)] == '/' {
-			return true // The "/any" matches "/any/path" case.
+// PathMatch implements "path-match" according to RFC 6265 section 5.1.4.
+func (e *Entry) PathMatch(requestPath string) bool {
+	if requestPath == e.Path {
+		return true
+	}
+	if strings.HasPrefix(requestPath, e.Path) {
+		if e.Path[len(e.Path)-1] == '/' {
+			return true // The "/any/" matches "/any/path" case.
+		} else if requestPath[len(e.Path)] == '/' {
+			return true // The "/any" matches "/any/path" case.
+		}
+	}
+	return false
+}
+
+// Shadows reports whether e and other are distinct cookies with the same name
+// that may both be sent in a single request, so that a server sees one of them
+// shadowing the other.
+func (e *Entry) Shadows(other *Entry) bool {
+	if e.Name != other.Name || e.ID == other.ID {
+		return false
+	}
+	domainOverlap := e.DomainMatch(other.Domain) || other.DomainMatch(e.Domain)
+	pathOverlap := e.PathMatch(other.Path) || other.PathMatch(e.Path)
+	return domainOverlap && pathOverlap
+}
+
+// Subsumes reports whether e makes other redundant: both carry the same name
+// and value, and every request other would be sent in also receives e.
+func (e *Entry) Subsumes(other *Entry) bool {
+	if e.ID == other.ID || e.Name != other.Name || e.Value != other.Value {
+		return false
+	}
+	if e.Secure && !other.Secure {
+		return false
+	}
+	domainCovered := e.Domain == other.Domain && (!e.HostOnly || other.HostOnly) ||
+		!e.HostOnly && HasDotSuffix(other.Domain, e.Domain)
+	return domainCovered && e.PathMatch(other.Path)
+}
+
+// sameContent reports whether e and other carry equal values, expiration and
+// flags, ignoring their timestamps.
+func (e *Entry) sameContent(other *Entry) bool {
+	return e.Value == other.Value &&
+		e.SameSite == other.SameSite &&
+		e.Secure == other.Secure &&
+		e.HttpOnly == other.HttpOnly &&
+		e.Persistent == other.Persistent &&
+		e.HostOnly == other.HostOnly &&
+		priorityRank(e.Priority) == priorityRank(other.Priority) &&
+		e.Expires.Equal(other.Expires)
+}
+
+// ValidatePrefix checks e against the restrictions implied by the "__Secure-"
+// and "__Host-" cookie name prefixes: both require e to be Secure, and
+// "__Host-" additionally requires a host-only cookie with Path "/".
+func (e *Entry) ValidatePrefix() error {
+	switch {
+	case strings.HasPrefix(e.Name, "__Secure-"):
+		if !e.Secure {
+			return errSecurePrefix
+		}
+	case strings.HasPrefix(e.Name, "__Host-"):
+		if !e.Secure || !e.HostOnly || e.Path != "/" {
+			return errHostPrefix
+		}
+	}
+	return nil
+}
+
+// ToSetCookieHeader returns a Set-Cookie header value recreating e: its Domain
+// attribute is omitted for host-only entries and carries a leading dot
+// otherwise, and Expires is present for persistent entries only.
+func (e *Entry) ToSetCookieHeader() string {
+	var b strings.Builder
+	b.WriteString((&http.Cookie{Name: e.Name, Value: e.Value}).String())
+	if e.Path != "" {
+		b.WriteString("; Path=")
+		b.WriteString(e.Path)
+	}
+	if !e.HostOnly {
+		b.WriteString("; Domain=.")
+		b.WriteString(e.Domain)
+	}
+	if e.Persistent {
+		b.WriteString("; Expires=")
+		b.WriteString(e.Expires.UTC().Format(http.TimeFormat))
+	}
+	if e.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if e.Secure {
+		b.WriteString("; Secure")
+	}
+	if e.SameSite != "" {
+		b.WriteString("; ")
+		b.WriteString(e.SameSite)
+	}
+	if priorityRank(e.Priority) != priorityRank(PriorityMedium) {
+		b.WriteString("; Priority=")
+		b.WriteString(e.Priority)
+	}
+	if e.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
+
+// HasDotSuffix reports whether s ends in "."+suffix.
+func HasDotSuffix(s, suffix string) bool {
+	return len(s) > len(suffix) && s[len(s)-len(suffix)-1] == '.' && s[len(s)-len(suffix):] == suffix
+}
+
+// Cookies implements the Cookies method of the http.CookieJar interface.
+//
+// It returns an empty slice if the URL's scheme is not HTTP or HTTPS.
+func (j *Jar) Cookies(u *url.URL) (cookies []*http.Cookie) {
+	return j.cookies(u, j.now())
+}
+
+// cookies is like Cookies but takes the current time as a parameter.
+func (j *Jar) cookies(u *url.URL, now time.Time) (cookies []*http.Cookie) {
+	cookies, _ = j.cookiesWithContext(context.Background(), u, now)
+	return cookies
+}
+
+// CookiesWithContext is like Cookies, passing ctx to the storage if it
+// implements ContextStorage, e.g. so that NewTracedStorage reports the lookup
+// as part of the caller's trace. It returns the first error of the storage,
+// such as the error of ctx, and no cookies in that case.
+func (j *Jar) CookiesWithContext(ctx context.Context, u *url.URL) ([]*http.Cookie, error) {
+	return j.cookiesWithContext(ctx, u, j.now())
+}
+
+// cookiesWithContext is like CookiesWithContext but takes the current time as
+// a parameter.
+func (j *Jar) cookiesWithContext(ctx context.Context, u *url.URL, now time.Time) (cookies []*http.Cookie, err error) {
+	https, host, path, key, ok := j.requestParams(u)
+	if !ok {
+		return cookies, nil
+	}
+
+	entries, err := j.partitionEntriesContext(ctx, https, host, path, key, key, now)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		cookies = append(cookies, &http.Cookie{Name: e.Name, Value: e.Value})
+	}
+
+	return cookies, nil
+}
+
+// CookiesPartitioned is like Cookies for a request made within the top-level
+// site of topLevel, e.g. by a frame embedded in a page at topLevel: only the
+// partitioned cookies stored for that site by SetCookiesPartitioned are
+// returned along with unpartitioned ones. A nil topLevel stands for u itself,
+// as for Cookies.
+func (j *Jar) CookiesPartitioned(u, topLevel *url.URL) (cookies []*http.Cookie) {
+	return j.cookiesPartitioned(u, topLevel, j.now())
+}
+
+// cookiesPartitioned is like CookiesPartitioned but takes the current time as a
+// parameter.
+func (j *Jar) cookiesPartitioned(u, topLevel *url.URL, now time.Time) (cookies []*http.Cookie) {
+	https, host, path, key, ok := j.requestParams(u)
+	if !ok {
+		return cookies
+	}
+
+	partition := key
+	if topLevel != nil {
+		var err error
+		if partition, err = j.partitionKey(topLevel); err != nil {
+			return cookies
+		}
+	}
+
+	for _, e := range j.partitionEntries(https, host, path, key, partition, now) {
+		cookies = append(cookies, &http.Cookie{Name: e.Name, Value: e.Value})
+	}
+
+	return cookies
+}
+
+// generational is implemented by storages counting modifications of their
+// entries, such as InMemoryStorage, see InMemoryStorage.Generation.
+type generational interface {
+	Generation() uint64
+}
+
+// CookiesIfChanged is like Cookies, but returns no cookies and false if the
+// generation of the jar's storage is still lastGen, i.e. no cookie was set or
+// removed since the call which returned lastGen, so that a Cookie header
+// computed from its cookies can be reused. It returns the cookies, the current
+// generation and true otherwise.
+//
+// Expiration of cookies is only detected once they are removed, e.g. by a
+// lookup of another URL of the same domain or by InMemoryStorage.StartSweeper.
+// Passing a lastGen of 0 always returns the cookies. If the storage does not
+// count modifications, or reports a generation of 0, the cookies are always
+// returned with generation 0.
+func (j *Jar) CookiesIfChanged(u *url.URL, lastGen uint64) (cookies []*http.Cookie, gen uint64, changed bool) {
+	return j.cookiesIfChanged(u, lastGen, j.now())
+}
+
+// cookiesIfChanged is like CookiesIfChanged but takes the current time as a
+// parameter.
+func (j *Jar) cookiesIfChanged(u *url.URL, lastGen uint64, now time.Time) (cookies []*http.Cookie, gen uint64, changed bool) {
+	s, ok := j.storage.(generational)
+	if !ok {
+		return j.cookies(u, now), 0, true
+	}
+
+	// The generation is read first, so that modifications made while the
+	// cookies are collected are picked up by the next call.
+	gen = s.Generation()
+	if gen != 0 && gen == lastGen {
+		return nil, gen, false
+	}
+
+	return j.cookies(u, now), gen, true
+}
+
+// GetCookie returns the cookie named name which Cookies would return first for
+// u, i.e. the one with the longest path and earliest creation time among the
+// cookies sharing the name, which a server sees first. It reports false if no
+// such cookie exists or if the URL's scheme is not HTTP or HTTPS.
+func (j *Jar) GetCookie(u *url.URL, name string) (*http.Cookie, bool) {
+	return j.getCookie(u, name, j.now())
+}
+
+// getCookie is like GetCookie but takes the current time as a parameter.
+func (j *Jar) getCookie(u *url.URL, name string, now time.Time) (*http.Cookie, bool) {
+	for _, c := range j.cookies(u, now) {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// CookieHeader returns the value of the Cookie header a request to u would
+// carry, the cookies returned by Cookies serialized like http.Request.AddCookie
+// does and joined by "; ". It returns an empty string if no cookie applies or
+// if the URL's scheme is not HTTP or HTTPS.
+func (j *Jar) CookieHeader(u *url.URL) string {
+	return j.cookieHeader(u, j.now())
+}
+
+// cookieHeader is like CookieHeader but takes the current time as a parameter.
+func (j *Jar) cookieHeader(u *url.URL, now time.Time) string {
+	var b strings.Builder
+	for _, c := range j.cookies(u, now) {
+		s := c.String()
+		if s == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+// ExportHeaders returns the Cookie header value a request to each of urls
+// would carry, see CookieHeader, keyed by the URL string, e.g. to generate
+// request fixtures. Only cookies allowed by opts are included. All headers are
+// computed at the same time. URLs no cookie applies to are mapped to an empty
+// string.
+func (j *Jar) ExportHeaders(urls []*url.URL, opts ExportOptions) map[string]string {
+	return j.exportHeaders(urls, opts, j.now())
+}
+
+// exportHeaders is like ExportHeaders but takes the current time as a
+// parameter.
+func (j *Jar) exportHeaders(urls []*url.URL, opts ExportOptions, now time.Time) map[string]string {
+	headers := make(map[string]string, len(urls))
+	for _, u := range urls {
+		headers[u.String()] = j.exportHeader(u, opts, now)
+	}
+	return headers
+}
+
+// exportHeader is like cookieHeader, including only cookies allowed by opts.
+func (j *Jar) exportHeader(u *url.URL, opts ExportOptions, now time.Time) string {
+	https, host, path, key, ok := j.requestParams(u)
+	if !ok {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, e := range j.entries(https, host, path, key, now) {
+		if !opts.allows(e) {
+			continue
+		}
+		s := (&http.Cookie{Name: e.Name, Value: e.Value}).String()
+		if s == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+// CookiesWithExtra is like Cookies, merging extra cookies into the result
+// without storing them in the jar. An extra cookie replaces all stored cookies
+// of the same name, taking the place of the first one; remaining extra cookies
+// are appended in order. Only Name and Value of extra cookies are used.
+func (j *Jar) CookiesWithExtra(u *url.URL, extra []*http.Cookie) (cookies []*http.Cookie) {
+	return j.cookiesWithExtra(u, extra, j.now())
+}
+
+// cookiesWithExtra is like CookiesWithExtra but takes the current time as a
+// parameter.
+func (j *Jar) cookiesWithExtra(u *url.URL, extra []*http.Cookie, now time.Time) (cookies []*http.Cookie) {
+	overrides := make(map[string]*http.Cookie, len(extra))
+	for _, c := range extra {
+		if _, ok := overrides[c.Name]; !ok {
+			overrides[c.Name] = &http.Cookie{Name: c.Name, Value: c.Value}
+		}
+	}
+
+	for _, c := range j.cookies(u, now) {
+		override, ok := overrides[c.Name]
+		switch {
+		case !ok:
+			cookies = append(cookies, c)
+		case override != nil:
+			cookies = append(cookies, override)
+			overrides[c.Name] = nil
+		}
+	}
+
+	for _, c := range extra {
+		if override := overrides[c.Name]; override != nil {
+			cookies = append(cookies, override)
+			overrides[c.Name] = nil
+		}
+	}
+
+	return cookies
+}
+
+// CookiesFull is like Cookies, but returned cookies carry all stored
+// attributes: Domain, Path, Expires (for persistent cookies), Secure, HttpOnly
+// and SameSite. Such cookies are useful for inspection or re-emission; only
+// Name and Value belong into a request header.
+func (j *Jar) CookiesFull(u *url.URL) (cookies []*http.Cookie) {
+	return j.cookiesFull(u, j.now())
+}
+
+// cookiesFull is like CookiesFull but takes the current time as a parameter.
+func (j *Jar) cookiesFull(u *url.URL, now time.Time) (cookies []*http.Cookie) {
+	https, host, path, key, ok := j.requestParams(u)
+	if !ok {
+		return cookies
+	}
+
+	for _, e := range j.entries(https, host, path, key, now) {
+		cookies = append(cookies, fullCookie(e))
+	}
+
+	return cookies
+}
+
+// DetailedCookie is a cookie with all stored attributes, as returned by
+// Jar.CookiesDetailed.
+type DetailedCookie struct {
+	// Cookie carries the attributes returned by Jar.CookiesFull, including
+	// the parsed SameSite mode.
+	http.Cookie
+
+	// HostOnly reports whether the cookie is sent to its exact Domain only.
+	HostOnly bool
+
+	// Persistent reports whether the cookie has an expiration time, as
+	// opposed to a session cookie.
+	Persistent bool
+
+	// TTL is the remaining lifetime of the cookie, SessionTTL for session
+	// cookies, see Entry.TTL.
+	TTL time.Duration
+}
+
+// CookiesDetailed is like CookiesFull, but additionally reports whether
+// cookies are host-only and persistent, and their remaining lifetime.
+func (j *Jar) CookiesDetailed(u *url.URL) (cookies []DetailedCookie) {
+	return j.cookiesDetailed(u, j.now())
+}
+
+// cookiesDetailed is like CookiesDetailed but takes the current time as a
+// parameter.
+func (j *Jar) cookiesDetailed(u *url.URL, now time.Time) (cookies []DetailedCookie) {
+	https, host, path, key, ok := j.requestParams(u)
+	if !ok {
+		return cookies
+	}
+
+	for _, e := range j.entries(https, host, path, key, now) {
+		cookies = append(cookies, DetailedCookie{
+			Cookie:     *fullCookie(e),
+			HostOnly:   e.HostOnly,
+			Persistent: e.Persistent,
+			TTL:        e.TTL(now),
+		})
+	}
+
+	return cookies
+}
+
+// MatchedEntries returns copies of the entries behind the cookies Cookies
+// would return for u, in the same order, e.g. to inspect their Creation time
+// or Key for diagnostics. Like Cookies, it updates their last access time.
+func (j *Jar) MatchedEntries(u *url.URL) (entries []*Entry) {
+	return j.matchedEntries(u, j.now())
+}
+
+// matchedEntries is like MatchedEntries but takes the current time as a
+// parameter.
+func (j *Jar) matchedEntries(u *url.URL, now time.Time) (entries []*Entry) {
+	https, host, path, key, ok := j.requestParams(u)
+	if !ok {
+		return entries
+	}
+
+	for _, e := range j.entries(https, host, path, key, now) {
+		entry := *e
+		entries = append(entries, &entry)
+	}
+
+	return entries
+}
+
+// PlanSends is like MatchedEntries for each of urls, keyed by the URL string,
+// e.g. to plan a crawl. URLs are grouped by jar key, so that an
+// InMemoryStorage scans the entries of each key once, under a single lock
+// acquisition, without updating their last access time. Other storages are
+// queried once per URL. URLs no cookie applies to are mapped to nil.
+func (j *Jar) PlanSends(urls []*url.URL) map[string][]*Entry {
+	return j.planSends(urls, j.now())
+}
+
+// planSends is like PlanSends but takes the current time as a parameter.
+func (j *Jar) planSends(urls []*url.URL, now time.Time) map[string][]*Entry {
+	plan := make(map[string][]*Entry, len(urls))
+
+	var keys []string
+	groups := make(map[string][]int)
+	requests := make([]planRequest, len(urls))
+	for i, u := range urls {
+		plan[u.String()] = nil
+
+		https, host, path, key, ok := j.requestParams(u)
+		if !ok {
+			continue
+		}
+		requests[i] = planRequest{https: https, host: host, path: path}
+
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	sessionStart := j.currentSessionStart()
+
+	for _, key := range keys {
+		group := groups[key]
+		grouped := make([]planRequest, len(group))
+		for n, i := range group {
+			grouped[n] = requests[i]
+		}
+
+		for n, entries := range j.planEntries(key, grouped, now) {
+			r := grouped[n]
+			entries = inPartition(j.withDomainKeys(r.host, key, entries, func(key string) []*Entry {
+				return j.peekStorage(r.https, r.host, r.path, key, now)
+			}), key)
+			if len(entries) == 0 {
+				continue
+			}
+
+			// Copies are allocated at once.
+			values := make([]Entry, 0, len(entries))
+			copies := make([]*Entry, 0, len(entries))
+			for _, e := range entries {
+				if outdatedSession(e, sessionStart) {
+					continue
+				}
+				values = append(values, *e)
+				copies = append(copies, &values[len(values)-1])
+			}
+			plan[urls[group[n]].String()] = copies
+		}
+	}
+
+	return plan
+}
+
+// planEntries returns the storage entries of key matching each of requests,
+// scanning them at once if the storage allows it.
+func (j *Jar) planEntries(key string, requests []planRequest, now time.Time) [][]*Entry {
+	switch s := j.storage.(type) {
+	case *InMemoryStorage:
+		return s.planEntries(key, requests, now)
+	case *shardedInMemoryStorage:
+		return s.shard(key).planEntries(key, requests, now)
+	}
+
+	entries := make([][]*Entry, len(requests))
+	for i, r := range requests {
+		entries[i] = j.storage.Entries(r.https, r.host, r.path, key, now)
+	}
+	return entries
+}
+
+// entries returns storage entries for the request parameters made within the
+// top-level site of the request itself, see partitionEntries.
+func (j *Jar) entries(https bool, host, path, key string, now time.Time) []*Entry {
+	return j.partitionEntries(https, host, path, key, key, now)
+}
+
+// partitionEntries returns storage entries for the request parameters made
+// within the top-level site with jar key partition, removing session entries
+// created before the current session start.
+func (j *Jar) partitionEntries(https bool, host, path, key, partition string, now time.Time) []*Entry {
+	entries, _ := j.partitionEntriesContext(context.Background(), https, host, path, key, partition, now)
+	return entries
+}
+
+// partitionEntriesContext is like partitionEntries, passing ctx to the storage
+// if it implements ContextStorage and returning the first error of a lookup.
+// Outdated session entries which fail to be removed are left out all the same,
+// to be removed by a later lookup.
+func (j *Jar) partitionEntriesContext(
+	ctx context.Context,
+	https bool,
+	host, path, key, partition string,
+	now time.Time,
+) ([]*Entry, error) {
+	var err error
+	lookup := func(key string) []*Entry {
+		entries, lookupErr := entriesContext(ctx, j.storage, https, host, path, key, now)
+		if err == nil {
+			err = lookupErr
+		}
+		return entries
+	}
+	entries := inPartition(j.withDomainKeys(host, key, lookup(key), lookup), partition)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionStart := j.currentSessionStart()
+	if sessionStart.IsZero() {
+		return entries, nil
+	}
+
+	live := entries[:0]
+	for _, e := range entries {
+		if outdatedSession(e, sessionStart) {
+			_ = j.expireEntryContext(ctx, e)
+			continue
+		}
+		live = append(live, e)
+	}
+
+	return live, nil
+}
+
+// currentSessionStart returns the time of the most recent StartSession call,
+// or the zero time if there was none.
+func (j *Jar) currentSessionStart() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.sessionStart
+}
+
+// outdatedSession reports whether e is a session entry created before
+// sessionStart, which must not be sent anymore. No entry is outdated when
+// sessionStart is zero.
+func outdatedSession(e *Entry, sessionStart time.Time) bool {
+	return !sessionStart.IsZero() && !e.Persistent && e.Creation.Before(sessionStart)
+}
+
+// CookiesForDomain returns all non-expired cookies, with full attributes,
+// which a top-level request with scheme to the host domain could carry
+// regardless of path. Like Cookies, it returns no cookies if the jar does not
+// handle scheme, and Secure cookies only if scheme is secure, see
+// Options.SchemeSecurity. Partitioned cookies are returned only from the
+// partition of domain itself, see CookiesPartitioned.
+//
+// Domain cookies are returned for their domain and all of its subdomains,
+// whereas host-only cookies are returned only when domain is exactly their
+// host: host-only cookies of "api.example.com" are not part of the result for
+// "example.com".
+//
+// The jar's storage must implement Dumper, otherwise no cookies are returned.
+func (j *Jar) CookiesForDomain(scheme, domain string) (cookies []*http.Cookie) {
+	return j.cookiesForDomain(scheme, domain, j.now())
+}
+
+// cookiesForDomain is like CookiesForDomain but takes the current time as a
+// parameter.
+func (j *Jar) cookiesForDomain(scheme, domain string, now time.Time) (cookies []*http.Cookie) {
+	dumper, ok := j.storage.(Dumper)
+	if !ok {
+		return cookies
+	}
+
+	allowed, https := j.schemeSecurity(scheme)
+	if !allowed {
+		return cookies
+	}
+	host, err := j.canonicalHost(domain)
+	if err != nil {
+		return cookies
+	}
+
+	var selected []*Entry
+	for _, e := range dumper.EntriesDump() {
+		if e.Expired(now) || !e.DomainMatch(host) || !https && e.Secure {
+			continue
+		}
+		selected = append(selected, e)
+	}
+	selected = inPartition(selected, JarKey(host, j.psList))
+
+	SortEntries(selected)
+
+	for _, e := range selected {
+		cookies = append(cookies, fullCookie(e))
+	}
+
+	return cookies
+}
+
+// CookiesGrouped returns all non-expired cookies, with full attributes,
+// grouped by their jar key, the registrable domain (eTLD+1) of their domain.
+// Within a group cookies are ordered as by SortEntries.
+//
+// The jar's storage must implement Dumper, otherwise no cookies are returned.
+func (j *Jar) CookiesGrouped() map[string][]*http.Cookie {
+	return j.cookiesGrouped(j.now())
+}
+
+// cookiesGrouped is like CookiesGrouped but takes the current time as a
+// parameter.
+func (j *Jar) cookiesGrouped(now time.Time) map[string][]*http.Cookie {
+	groups := make(map[string][]*http.Cookie)
+
+	dumper, ok := j.storage.(Dumper)
+	if !ok {
+		return groups
+	}
+
+	entries := dumper.EntriesDump()
+	SortEntries(entries)
+
+	for _, e := range entries {
+		if e.Expired(now) {
+			continue
+		}
+		groups[e.Key] = append(groups[e.Key], fullCookie(e))
+	}
+
+	return groups
+}
+
+// SortEntries sorts entries according to RFC 6265 section 5.4 point 2: by
+// longest path and then by earliest creation time. Ties are broken by ID to
+// keep the order deterministic.
+func SortEntries(entries []*Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if before, ok := sendOrder(entries[i], entries[j]); ok {
+			return before
+		}
+		return entries[i].ID < entries[j].ID
+	})
+}
+
+// sendOrder reports whether a is sent before b according to RFC 6265 section
+// 5.4 point 2, and ok whether that order is decided, i.e. whether a and b
+// differ in path length or creation time. Ties are left to the caller.
+func sendOrder(a, b *Entry) (before, ok bool) {
+	if len(a.Path) != len(b.Path) {
+		return len(a.Path) > len(b.Path), true
+	}
+	if !a.Creation.Equal(b.Creation) {
+		return a.Creation.Before(b.Creation), true
+	}
+	return false, false
+}
+
+// SortKeyFor returns the values determining the send order of the cookie named
+// name among the cookies for u: its path length, creation time and, for
+// InMemoryStorage, the sequence number breaking remaining ties. If several
+// cookies named name match u, the one sent first is reported. ok is false if
+// no such cookie matches u.
+func (j *Jar) SortKeyFor(u *url.URL, name string) (pathLen int, creation time.Time, seq uint64, ok bool) {
+	return j.sortKeyFor(u, name, j.now())
+}
+
+// sortKeyFor is like SortKeyFor but takes the current time as a parameter.
+func (j *Jar) sortKeyFor(u *url.URL, name string, now time.Time) (pathLen int, creation time.Time, seq uint64, ok bool) {
+	https, host, path, key, ok := j.requestParams(u)
+	if !ok {
+		return 0, time.Time{}, 0, false
+	}
+
+	for _, e := range j.peekEntries(https, host, path, key, now) {
+		if e.Name != name {
+			continue
+		}
+		if s, isMemory := j.storage.(*InMemoryStorage); isMemory {
+			seq, _ = s.seqNum(e.Key, e.ID)
+		}
+		return len(e.Path), e.Creation, seq, true
+	}
+
+	return 0, time.Time{}, 0, false
+}
+
+// FindRedundant returns the cookies sent in a request to u which are
+// redundant: another cookie sent in the same request carries the same name
+// and value, and its scope subsumes theirs, see Entry.Subsumes.
+func (j *Jar) FindRedundant(u *url.URL) (redundant []*Entry) {
+	return j.findRedundant(u, j.now())
+}
+
+// findRedundant is like FindRedundant but takes the current time as a
+// parameter.
+func (j *Jar) findRedundant(u *url.URL, now time.Time) (redundant []*Entry) {
+	https, host, path, key, ok := j.requestParams(u)
+	if !ok {
+		return redundant
+	}
+
+	entries := j.peekEntries(https, host, path, key, now)
+	for _, e := range entries {
+		for _, other := range entries {
+			if other.Subsumes(e) {
+				redundant = append(redundant, e)
+				break
+			}
+		}
+	}
+
+	return redundant
+}
+
+// ExpiringWithin returns the persistent cookies, with full attributes, sent
+// in a request to u which expire within d from now. Session cookies are never
+// reported. It allows a client to refresh credentials before they lapse.
+func (j *Jar) ExpiringWithin(u *url.URL, d time.Duration) (cookies []*http.Cookie) {
+	return j.expiringWithin(u, d, j.now())
+}
+
+// expiringWithin is like ExpiringWithin but takes the current time as a
+// parameter.
+func (j *Jar) expiringWithin(u *url.URL, d time.Duration, now time.Time) (cookies []*http.Cookie) {
+	https, host, path, key, ok := j.requestParams(u)
+	if !ok {
+		return cookies
+	}
+
+	deadline := now.Add(d)
+	for _, e := range j.peekEntries(https, host, path, key, now) {
+		if !e.Persistent || e.Expires.After(deadline) {
+			continue
+		}
+		cookies = append(cookies, fullCookie(e))
+	}
+
+	return cookies
+}
+
+// Clear removes all cookies from the jar. Storage implementations which are
+// neither Clearer nor Dumper are left untouched.
+//
+// Removals are reported to Options.Observer only if the storage implements
+// Dumper.
+func (j *Jar) Clear() {
+	switch s := j.storage.(type) {
+	case Clearer:
+		var entries []*Entry
+		if dumper, ok := s.(Dumper); ok && j.observer != nil {
+			entries = dumper.EntriesDump()
+		}
+		s.Clear()
+		for _, e := range entries {
+			j.observer.OnRemove(e.Key, e.ID)
+		}
+	case Dumper:
+		for _, e := range s.EntriesDump() {
+			j.removeEntry(e.Key, e.ID)
+		}
+	}
+}
+
+// Len returns the number of non-expired cookies in the jar. The jar's storage
+// must implement Counter or Dumper, otherwise 0 is returned.
+func (j *Jar) Len() int {
+	return j.count(j.now())
+}
+
+// count is like Len but takes the current time as a parameter.
+func (j *Jar) count(now time.Time) (n int) {
+	switch s := j.storage.(type) {
+	case *InMemoryStorage:
+		return s.count(now)
+	case Counter:
+		return s.Len()
+	case Dumper:
+		for _, e := range s.EntriesDump() {
+			if !e.Expired(now) {
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+// RemoveCookie removes all stored cookies named name whose domain and path
+// match u, both host-only and domain cookies, regardless of their Secure
+// attribute. It does nothing if no cookie matches or if the URL's scheme is not
+// HTTP or HTTPS.
+func (j *Jar) RemoveCookie(u *url.URL, name string) {
+	j.removeCookie(u, name, j.now())
+}
+
+// removeCookie is like RemoveCookie but takes the current time as a parameter.
+func (j *Jar) removeCookie(u *url.URL, name string, now time.Time) {
+	_, host, path, key, ok := j.requestParams(u)
+	if !ok {
+		return
+	}
+
+	for _, e := range j.peekEntries(true, host, path, key, now) {
+		if e.Name == name {
+			j.removeEntry(e.Key, e.ID)
+		}
+	}
+}
+
+// RemoveDomain removes all cookies stored under the jar key of domain, i.e.
+// those of its registrable domain and all of its subdomains, along with any
+// cookie whose Domain is domain or one of its parents, e.g. to log out of a
+// site. The domain is canonicalized like by CanonicalHost. It does nothing if
+// no cookie matches.
+//
+// The jar's storage must implement Dumper, otherwise nothing is removed.
+func (j *Jar) RemoveDomain(domain string) {
+	dumper, ok := j.storage.(Dumper)
+	if !ok {
+		return
+	}
+
+	host, err := j.canonicalHost(domain)
+	if err != nil || host == "" {
+		return
+	}
+	key := JarKey(host, j.psList)
+
+	for _, e := range dumper.EntriesDump() {
+		if e.Key == key || e.Domain == host || HasDotSuffix(host, e.Domain) {
+			j.removeEntry(e.Key, e.ID)
+		}
+	}
+}
+
+// PeekCookies is like Cookies for read-only inspection, e.g. by dashboards: it
+// neither updates the last access time of the cookies, which would perturb the
+// order of evictions, nor removes expired or outdated session cookies. Storages
+// other than InMemoryStorage and those returned by NewShardedInMemoryStorage
+// are queried with Storage.Entries.
+func (j *Jar) PeekCookies(u *url.URL) (cookies []*http.Cookie) {
+	return j.peekCookies(u, j.now())
+}
+
+// peekCookies is like PeekCookies but takes the current time as a parameter.
+func (j *Jar) peekCookies(u *url.URL, now time.Time) (cookies []*http.Cookie) {
+	https, host, path, key, ok := j.requestParams(u)
+	if !ok {
+		return cookies
+	}
+
+	sessionStart := j.currentSessionStart()
+	for _, e := range j.peekEntries(https, host, path, key, now) {
+		if outdatedSession(e, sessionStart) {
+			continue
+		}
+		cookies = append(cookies, &http.Cookie{Name: e.Name, Value: e.Value})
+	}
+
+	return cookies
+}
+
+// peekEntries returns storage entries for the request parameters without
+// updating their last access time, if the storage allows it.
+//
+// Like entries, partitioned entries of top-level sites other than the request's
+// own are left out.
+func (j *Jar) peekEntries(https bool, host, path, key string, now time.Time) []*Entry {
+	lookup := func(key string) []*Entry {
+		return j.peekStorage(https, host, path, key, now)
+	}
+	return inPartition(j.withDomainKeys(host, key, lookup(key), lookup), key)
+}
+
+// peekStorage returns the storage entries of key for the request parameters
+// without updating their last access time, if the storage allows it.
+func (j *Jar) peekStorage(https bool, host, path, key string, now time.Time) []*Entry {
+	switch s := j.storage.(type) {
+	case *InMemoryStorage:
+		return s.EntriesPeek(https, host, path, key, now)
+	case *shardedInMemoryStorage:
+		return s.peekEntries(https, host, path, key, now)
+	}
+	return j.storage.Entries(https, host, path, key, now)
+}
+
+// withDomainKeys adds to entries, found for host under its key, the entries
+// lookup returns for the other keys of domain cookies sent to host, see
+// domainKeys, sorting them all like SortEntries.
+func (j *Jar) withDomainKeys(host, key string, entries []*Entry, lookup func(key string) []*Entry) []*Entry {
+	keys := j.domainKeys(host, key)
+	if len(keys) == 0 {
+		return entries
+	}
+
+	for _, k := range keys {
+		entries = append(entries, lookup(k)...)
+	}
+	SortEntries(entries)
+
+	return entries
+}
+
+// domainKeys returns the keys other than key, the key of host, of the parent
+// domains of host which can be Domain attributes of cookies. Entries of domain
+// cookies are keyed by their Domain, see NewEntry, which only differs from the
+// key of host if the public suffix list is broken.
+func (j *Jar) domainKeys(host, key string) (keys []string) {
+	if j.psList == nil || IsIP(host) {
+		return nil
+	}
+
+	for domain := host; ; {
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return keys
+		}
+		domain = domain[i+1:]
+
+		if ps := j.psList.PublicSuffix(domain); ps != "" && !HasDotSuffix(domain, ps) {
+			// Public suffixes, and hence their parents, are no
+			// Domain attributes of hosts below them.
+			return keys
+		}
+
+		if k := JarKey(domain, j.psList); k != key && !hasKey(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+}
+
+// hasKey reports whether keys contains key.
+func hasKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
 		}
 	}
 	return false
 }
 
-// HasDotSuffix reports whether s ends in "."+suffix.
-func HasDotSuffix(s, suffix string) bool {
-	return len(s) > len(suffix) && s[len(s)-len(suffix)-1] == '.' && s[len(s)-len(suffix):] == suffix
+// inPartition filters out partitioned entries whose PartitionKey is not
+// partition, reusing the backing array of entries.
+func inPartition(entries []*Entry, partition string) []*Entry {
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.Partitioned && e.PartitionKey != partition {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
 }
 
-// Cookies implements the Cookies method of the http.CookieJar interface.
+// StartSession starts a new browser session: session (non-persistent) cookies
+// created before the call are considered expired, while persistent cookies
+// remain.
 //
-// It returns an empty slice if the URL's scheme is not HTTP or HTTPS.
-func (j *Jar) Cookies(u *url.URL) (cookies []*http.Cookie) {
-	return j.cookies(u, time.Now())
+// Stale session cookies are removed right away if the jar's storage implements
+// Dumper, and lazily on lookup or when replaced by SetCookies otherwise.
+func (j *Jar) StartSession() {
+	j.startSession(j.now())
 }
 
-// cookies is like Cookies but takes the current time as a parameter.
-func (j *Jar) cookies(u *url.URL, now time.Time) (cookies []*http.Cookie) {
-	if u.Scheme != "http" && u.Scheme != "https" {
-		return cookies
+// startSession is like StartSession but takes the current time as parameter.
+func (j *Jar) startSession(now time.Time) {
+	j.mu.Lock()
+	j.sessionStart = now
+	j.mu.Unlock()
+
+	dumper, ok := j.storage.(Dumper)
+	if !ok {
+		return
 	}
-	host, err := CanonicalHost(u.Host)
+
+	for _, e := range dumper.EntriesDump() {
+		if !e.Persistent && e.Creation.Before(now) {
+			j.expireEntry(e)
+		}
+	}
+}
+
+// requestParams extracts the parameters used to select entries for a request
+// to u: whether the scheme is secure, the canonical host, the request path and
+// the jar key. ok is false if the URL's scheme is not allowed or its host
+// cannot be canonicalized.
+func (j *Jar) requestParams(u *url.URL) (https bool, host, path, key string, ok bool) {
+	allowed, https := j.schemeSecurity(u.Scheme)
+	if !allowed {
+		return false, "", "", "", false
+	}
+	host, err := j.canonicalHost(u.Host)
 	if err != nil {
-		return cookies
+		return false, "", "", "", false
 	}
-	key := JarKey(host, j.psList)
+	key = JarKey(host, j.psList)
 
-	https := u.Scheme == "https"
-	path := u.Path
+	path = u.Path
 	if path == "" {
 		path = "/"
 	}
 
-	for _, e := range j.storage.Entries(https, host, path, key, now) {
-		cookies = append(cookies, &http.Cookie{Name: e.Name, Value: e.Value})
+	return https, host, path, key, true
+}
+
+// fullCookie converts e to a http.Cookie carrying all attributes of e, not
+// just Name and Value.
+func fullCookie(e *Entry) *http.Cookie {
+	c := &http.Cookie{
+		Name:     e.Name,
+		Value:    e.Value,
+		Domain:   e.Domain,
+		Path:     e.Path,
+		Secure:   e.Secure,
+		HttpOnly: e.HttpOnly,
 	}
 
-	return cookies
+	if e.Persistent {
+		c.Expires = e.Expires
+	}
+
+	switch e.SameSite {
+	case "SameSite":
+		c.SameSite = http.SameSiteDefaultMode
+	case "SameSite=Strict":
+		c.SameSite = http.SameSiteStrictMode
+	case "SameSite=Lax":
+		c.SameSite = http.SameSiteLaxMode
+	}
+
+	return c
 }
 
 // SetCookies implements the SetCookies method of the http.CookieJar interface.
 //
 // It does nothing if the URL's scheme is not HTTP or HTTPS.
 func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
-	j.setCookies(u, cookies, time.Now())
+	j.setCookies(u, cookies, j.now())
+}
+
+// SetCookie is like SetCookies for a single cookie.
+func (j *Jar) SetCookie(u *url.URL, cookie *http.Cookie) {
+	j.setCookies(u, []*http.Cookie{cookie}, j.now())
+}
+
+// SetCookiesBatch is like SetCookies for the cookies of several URLs. The URLs
+// are handled in the order of their string form, the cookies of each URL in
+// order, as by SetCookies.
+//
+// If the storage implements BatchWriter, as InMemoryStorage does, the
+// resulting saves and removals are written as a single batch, e.g. under a
+// single lock acquisition. Otherwise, or if Options.AcceptCookieWithJar is set,
+// which may inspect the jar between cookies, each URL is stored by its own
+// SetCookies call.
+func (j *Jar) SetCookiesBatch(batch map[*url.URL][]*http.Cookie) {
+	j.setCookiesBatch(batch, j.now())
+}
+
+func (j *Jar) setCookiesBatch(batch map[*url.URL][]*http.Cookie, now time.Time) {
+	urls := make([]*url.URL, 0, len(batch))
+	for u := range batch {
+		urls = append(urls, u)
+	}
+	sort.SliceStable(urls, func(a, b int) bool {
+		return urls[a].String() < urls[b].String()
+	})
+
+	writer, ok := j.storage.(BatchWriter)
+	if !ok || j.acceptCookieWithJar != nil {
+		for _, u := range urls {
+			j.setCookies(u, batch[u], now)
+		}
+		return
+	}
+
+	var ops []BatchOp
+	for _, u := range urls {
+		j.cookieOps(context.Background(), u, nil, batch[u], now, func(op BatchOp) {
+			ops = append(ops, op)
+		})
+	}
+
+	if len(ops) == 0 {
+		return
+	}
+
+	writer.WriteBatch(ops)
+
+	if j.observer == nil {
+		return
+	}
+
+	for _, op := range ops {
+		if op.Remove {
+			j.observer.OnRemove(op.Entry.Key, op.Entry.ID)
+		} else {
+			j.observer.OnSet(op.Entry)
+		}
+	}
+}
+
+// SetCookiesFromResponse stores the cookies set by resp for the URL of
+// resp.Request, if Options.AcceptCookieForContentType accepts the
+// Content-Type of resp.
+//
+// It does nothing if resp.Request is nil.
+func (j *Jar) SetCookiesFromResponse(resp *http.Response) {
+	j.setCookiesFromResponse(resp, j.now())
+}
+
+// setCookiesFromResponse is like SetCookiesFromResponse but takes the current
+// time as parameter.
+func (j *Jar) setCookiesFromResponse(resp *http.Response, now time.Time) {
+	if resp.Request == nil || resp.Request.URL == nil {
+		return
+	}
+	if j.acceptCookieForContentType != nil && !j.acceptCookieForContentType(resp.Header.Get("Content-Type")) {
+		return
+	}
+
+	j.setCookies(resp.Request.URL, resp.Cookies(), now)
 }
 
 // setCookies is like SetCookies but takes the current time as parameter.
 func (j *Jar) setCookies(u *url.URL, cookies []*http.Cookie, now time.Time) {
+	j.setCookiesPartitioned(u, nil, cookies, now)
+}
+
+// SetCookiesWithContext is like SetCookies, passing ctx to the storage if it
+// implements ContextStorage, e.g. so that NewSemaphoreStorage gives up waiting
+// once ctx is done. It stops at the first error of the storage, such as the
+// error of ctx, and returns it; cookies before the failed one are stored.
+func (j *Jar) SetCookiesWithContext(ctx context.Context, u *url.URL, cookies []*http.Cookie) error {
+	return j.setCookiesWithContext(ctx, u, cookies, j.now())
+}
+
+// setCookiesWithContext is like SetCookiesWithContext but takes the current
+// time as parameter.
+func (j *Jar) setCookiesWithContext(ctx context.Context, u *url.URL, cookies []*http.Cookie, now time.Time) (err error) {
+	j.cookieOps(ctx, u, nil, cookies, now, func(op BatchOp) {
+		if err == nil {
+			err = j.applyOpContext(ctx, op)
+		}
+	})
+	return err
+}
+
+// SetCookiesPartitioned is like SetCookies for a response to a request made
+// within the top-level site of topLevel, e.g. by a frame embedded in a page
+// at topLevel. Cookies with the Partitioned attribute are stored in the
+// partition of that site and only returned by CookiesPartitioned for the same
+// top-level site. Other cookies are handled like SetCookies does.
+//
+// A nil topLevel stands for u itself, as for SetCookies, which stores
+// partitioned cookies in the partition of u's site, returned by Cookies.
+// Partitioned cookies must be Secure, others are rejected as browsers do.
+func (j *Jar) SetCookiesPartitioned(u, topLevel *url.URL, cookies []*http.Cookie) {
+	j.setCookiesPartitioned(u, topLevel, cookies, j.now())
+}
+
+// setCookiesPartitioned is like SetCookiesPartitioned but takes the current
+// time as parameter.
+func (j *Jar) setCookiesPartitioned(u, topLevel *url.URL, cookies []*http.Cookie, now time.Time) {
+	j.cookieOps(context.Background(), u, topLevel, cookies, now, j.applyOp)
+}
+
+// cookieOps passes the storage operations resulting from cookies received from
+// u, in order, to apply. ctx is passed to the storage by the removals of
+// replaceSession.
+func (j *Jar) cookieOps(
+	ctx context.Context,
+	u, topLevel *url.URL,
+	cookies []*http.Cookie,
+	now time.Time,
+	apply func(op BatchOp),
+) {
 	if len(cookies) == 0 {
 		return
 	}
-	if u.Scheme != "http" && u.Scheme != "https" {
+	if allowed, _ := j.schemeSecurity(u.Scheme); !allowed {
+		if j.logger != nil {
+			j.logger.Debugf("cookiejar: dropping %d cookies from %s: scheme %q not allowed", len(cookies), u.Redacted(), u.Scheme)
+		}
 		return
 	}
-	host, err := CanonicalHost(u.Host)
+	host, err := j.canonicalHost(u.Host)
 	if err != nil {
+		if j.logger != nil {
+			j.logger.Debugf("cookiejar: dropping %d cookies from %s: %v", len(cookies), u.Redacted(), err)
+		}
 		return
 	}
 
 	key := JarKey(host, j.psList)
-	defPath := DefaultPath(u.Path)
+	defPath := "/"
+	if !j.rootDefaultPath {
+		defPath = DefaultPath(u.Path)
+	}
+
+	partition := key
+	if topLevel != nil {
+		if partition, err = j.partitionKey(topLevel); err != nil {
+			if j.logger != nil {
+				j.logger.Debugf("cookiejar: dropping %d cookies from %s: top-level site: %v", len(cookies), u.Redacted(), err)
+			}
+			return
+		}
+	}
+
+	if !j.allowSetCookies(key, now) {
+		if j.logger != nil {
+			j.logger.Debugf("cookiejar: dropping %d cookies from %s: rate limit exceeded", len(cookies), u.Redacted())
+		}
+		if observer, ok := j.observer.(RateLimitObserver); ok {
+			observer.OnRateLimit(u, cookies)
+		}
+		return
+	}
 
 	for _, cookie := range cookies {
-		e, remove, err := NewEntry(cookie, now, defPath, host, key, j.psList)
+		if j.acceptCookieWithJar != nil && !j.acceptCookieWithJar(j, u, cookie) {
+			if j.logger != nil {
+				j.logger.Debugf("cookiejar: dropping cookie %q from %s: rejected by AcceptCookieWithJar", j.logName(cookie.Name), u.Redacted())
+			}
+			continue
+		}
+
+		e, remove, err := j.newEntry(cookie, now, defPath, host, key, partition)
 		if err != nil {
+			if j.logger != nil {
+				j.logger.Debugf("cookiejar: dropping cookie %q from %s: %v", j.logName(cookie.Name), u.Redacted(), err)
+			}
 			continue
 		}
 
 		if remove {
-			j.storage.RemoveEntry(key, e.ID)
+			if j.logger != nil {
+				j.logger.Debugf("cookiejar: removing cookie %q from %s: %s", j.logName(cookie.Name), u.Redacted(), removalReason(cookie))
+			}
+			apply(BatchOp{Entry: &e, Remove: true})
 			continue
 		}
 
 		e.LastAccess = now
+		j.replaceSession(ctx, &e)
+
+		if j.logger != nil && j.logAccepted {
+			j.logger.Debugf("cookiejar: accepted cookie from %s: %s", u.Redacted(), RedactEntry(&e, j.logRedactionKey, j.logRedactNames).ToSetCookieHeader())
+		}
+
+		apply(BatchOp{Entry: &e})
+	}
+}
+
+// removalReason describes why c, a cookie NewEntry reported for removal, is
+// removed. net/http parses both "Max-Age=0" and negative Max-Age attributes as
+// a negative MaxAge.
+func removalReason(c *http.Cookie) string {
+	if c.MaxAge < 0 {
+		return "Max-Age <= 0"
+	}
+	return "Expires " + c.Expires.UTC().Format(http.TimeFormat) + " in the past"
+}
+
+// replaceSession removes the stored entry with the key and ID of e, a new entry
+// about to be saved, if e is a session entry and a session was started, unless
+// the storage implements Dumper. Such storages are not purged by StartSession,
+// so the stored entry may be outdated, and saving e over it would carry its
+// Creation over, outdating e as well.
+//
+// The stored entry is removed without notifying the observer, as it is
+// replaced right away. Its Creation is thus lost even if it is not outdated,
+// which only affects the order in which cookies are sent.
+func (j *Jar) replaceSession(ctx context.Context, e *Entry) {
+	if e.Persistent || j.currentSessionStart().IsZero() {
+		return
+	}
+	if _, ok := j.storage.(Dumper); ok {
+		return
+	}
+
+	// Errors are left to the save of e, which fails as well if ctx is
+	// done.
+	_ = removeEntryContext(ctx, j.storage, e.Key, e.ID)
+}
+
+// logName returns name as written to the logger, redacted if
+// Options.LogRedactNames is set.
+func (j *Jar) logName(name string) string {
+	if j.logRedactNames {
+		return redact(j.logRedactionKey, name)
+	}
+	return name
+}
+
+// applyOp applies op to the storage and notifies the observer.
+func (j *Jar) applyOp(op BatchOp) {
+	_ = j.applyOpContext(context.Background(), op)
+}
 
-		j.storage.SaveEntry(&e)
+// applyOpContext is like applyOp, passing ctx to the storage if it implements
+// ContextStorage.
+func (j *Jar) applyOpContext(ctx context.Context, op BatchOp) error {
+	if op.Remove {
+		return j.removeEntryContext(ctx, op.Entry.Key, op.Entry.ID)
 	}
+	return j.saveEntryContext(ctx, op.Entry)
+}
+
+// allowSetCookies reports whether a SetCookies call for key at now is within
+// Options.MaxSetCookiesPerSecond, counting it if so.
+func (j *Jar) allowSetCookies(key string, now time.Time) bool {
+	if j.maxSetCookiesPerSecond <= 0 {
+		return true
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.setCookiesWindows == nil {
+		j.setCookiesWindows = make(map[string]*rateWindow)
+	}
+
+	w := j.setCookiesWindows[key]
+	if w == nil || now.Sub(w.start) >= time.Second || now.Before(w.start) {
+		if w == nil && len(j.setCookiesWindows) >= maxRateWindows {
+			for k, old := range j.setCookiesWindows {
+				if now.Sub(old.start) >= time.Second {
+					delete(j.setCookiesWindows, k)
+				}
+			}
+		}
+		w = &rateWindow{start: now}
+		j.setCookiesWindows[key] = w
+	}
+
+	if w.calls >= j.maxSetCookiesPerSecond {
+		return false
+	}
+	w.calls++
+
+	return true
+}
+
+// partitionKey returns the key of the partition of the top-level site of
+// topLevel, the jar key of its host.
+func (j *Jar) partitionKey(topLevel *url.URL) (string, error) {
+	host, err := j.canonicalHost(topLevel.Host)
+	if err != nil {
+		return "", err
+	}
+	return JarKey(host, j.psList), nil
+}
+
+// newEntry is NewEntry applying the jar's policies to the cookie and the
+// resulting entry. Partitioned entries are assigned to partition.
+func (j *Jar) newEntry(c *http.Cookie, now time.Time, defPath, host, key, partition string) (e Entry, remove bool, err error) {
+	if j.strict || j.validateNameValue {
+		if err = ValidateNameValue(c.Name, c.Value); err != nil {
+			return e, false, err
+		}
+	}
+
+	if j.maxCookieBytes > 0 && len(c.Name)+len(c.Value) > j.maxCookieBytes {
+		return e, false, ErrCookieTooLarge
+	}
+
+	if j.stripTrailingDotDomain && len(c.Domain) > 1 && strings.HasSuffix(c.Domain, ".") {
+		stripped := *c
+		stripped.Domain = c.Domain[:len(c.Domain)-1]
+		c = &stripped
+	}
+
+	if j.allowIPCookies && c.Domain != "" {
+		if ip := parseIPLiteral(host); ip != nil && ip.Equal(parseIPLiteral(c.Domain)) {
+			hostOnly := *c
+			hostOnly.Domain = ""
+			c = &hostOnly
+		}
+	}
+
+	if c.SameSite == 0 && j.defaultSameSite != nil {
+		withDefault := *c
+		withDefault.SameSite = j.defaultSameSite(host)
+		c = &withDefault
+	}
+
+	e, remove, err = newEntry(c, now, defPath, host, key, j.psList, j.maxDomainLength, j.suffixExceptions)
+	if err != nil {
+		return e, false, err
+	}
+
+	if j.strictPrefixes {
+		// Entries to be removed lack the cookie attributes, so the
+		// Secure flag is taken from c.
+		checked := e
+		checked.Secure = c.Secure
+		if err = checked.ValidatePrefix(); err != nil {
+			return e, false, err
+		}
+	}
+
+	if !remove && !e.Persistent && !j.sessionExpiry.IsZero() {
+		e.Expires = j.sessionExpiry
+	}
+
+	if !remove && e.Persistent && j.maxExpiryForHost != nil {
+		if d := j.maxExpiryForHost(host); d > 0 && e.Expires.After(now.Add(d)) {
+			e.Expires = now.Add(d)
+		}
+	}
+
+	if e.Partitioned && e.PartitionKey != partition {
+		e.PartitionKey = partition
+		e.ID = e.RawID()
+	}
+
+	if j.hashIDs {
+		e.ID = HashID(e.ID)
+	}
+
+	return e, remove, nil
+}
+
+// schemeSecurity reports whether the jar handles URLs with scheme and whether
+// the scheme is secure, according to the jar's SchemeSecurity. By default only
+// HTTP and HTTPS are allowed, HTTPS being secure.
+func (j *Jar) schemeSecurity(scheme string) (allowed, secure bool) {
+	if j.schemeSecurityFunc != nil {
+		return j.schemeSecurityFunc(scheme)
+	}
+	return scheme == "http" || scheme == "https", scheme == "https"
+}
+
+// canonicalHost is CanonicalHost with the jar's IDNAMode, retrying with the
+// UTS #46 mapping if LenientIDNA is set and deferring to the jar's
+// OnCanonicalHostError, if any, when it fails.
+func (j *Jar) canonicalHost(host string) (string, error) {
+	canonical, err := canonicalHost(host, j.idnaMode)
+	if err == errUnmappedHost && j.lenientIDNA {
+		canonical, err = canonicalHost(mapHost(host), j.idnaMode)
+	}
+	if err != nil && j.onCanonicalHostError != nil {
+		fallback, ferr := j.onCanonicalHostError(host, err)
+		if ferr != nil {
+			return "", ferr
+		}
+		return canonicalHost(fallback, j.idnaMode)
+	}
+	return canonical, err
+}
+
+// mapHost applies the part of the UTS #46 mapping rejected by CanonicalHost to
+// host: non-ASCII letters are lower cased and alternate full stops become
+// dots.
+func mapHost(host string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case isAlternateDot(r):
+			return '.'
+		case r >= utf8.RuneSelf:
+			return unicode.ToLower(r)
+		}
+		return r
+	}, host)
+}
+
+// isAlternateDot reports whether r is one of the full stops UTS #46 maps to a
+// dot.
+func isAlternateDot(r rune) bool {
+	return r == '\u3002' || r == '\uff0e' || r == '\uff61'
 }
 
 // CanonicalHost strips port from host if present and returns the canonicalized
 // host name.
+//
+// IP addresses, including IPv6 addresses enclosed in brackets, are returned in
+// the canonical form of net.IP.String, without brackets. The zone of an IPv6
+// address is kept, so that e.g. "[FE80::0001%eth0]:8080" becomes
+// "fe80::1%eth0".
+//
+// Host names with upper case non-ASCII letters or alternate full stops, such
+// as "BÜCHER.de", are rejected as IDNA2008 requires, see
+// Options.LenientIDNA.
 func CanonicalHost(host string) (string, error) {
+	return canonicalHost(host, punycode.Nontransitional)
+}
+
+// canonicalHost is like CanonicalHost, converting host to its ASCII form
+// according to mode.
+func canonicalHost(host string, mode punycode.Mode) (string, error) {
 	var err error
 	if HasPort(host) {
 		host, _, err = net.SplitHostPort(host)
@@ -238,11 +2304,22 @@ func CanonicalHost(host string) (string, error) {
 			return "", err
 		}
 	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
 	if strings.HasSuffix(host, ".") {
 		// Strip trailing dot from fully qualified domain names.
 		host = host[:len(host)-1]
 	}
-	encoded, err := punycode.ToASCII(host)
+	if ip, ok := canonicalIP(host); ok {
+		return ip, nil
+	}
+	for _, r := range host {
+		if r >= utf8.RuneSelf && (unicode.IsUpper(r) || isAlternateDot(r)) {
+			return "", errUnmappedHost
+		}
+	}
+	encoded, err := punycode.ToASCIIMode(host, mode)
 	if err != nil {
 		return "", err
 	}
@@ -264,7 +2341,11 @@ func HasPort(host string) bool {
 	return host[0] == '[' && strings.Contains(host, "]:")
 }
 
-// JarKey returns the key to use for a jar.
+// JarKey returns the key to use for a jar. Lookups use the key of the request
+// host, entries of host-only cookies the key of the host which set them and
+// entries of domain cookies the key of their Domain, see NewEntry. With a
+// broken public suffix list, the key of a Domain may differ from the key of
+// the hosts it matches, which Jar lookups therefore also search.
 func JarKey(host string, psl PublicSuffixList) string {
 	if IsIP(host) {
 		return host
@@ -295,9 +2376,40 @@ func JarKey(host string, psl PublicSuffixList) string {
 	return host[prevDot+1:]
 }
 
-// IsIP reports whether host is an IP address.
+// IsIP reports whether host is an IP address, an IPv6 address possibly with
+// a zone.
 func IsIP(host string) bool {
-	return net.ParseIP(host) != nil
+	_, ok := canonicalIP(host)
+	return ok
+}
+
+// canonicalIP returns the canonical form of the IP address host, keeping the
+// zone of an IPv6 address, and whether host is an IP address at all.
+func canonicalIP(host string) (string, bool) {
+	addr, zone := host, ""
+	if i := strings.LastIndexByte(host, '%'); i >= 0 && strings.Contains(host[:i], ":") {
+		addr, zone = host[:i], host[i+1:]
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", false
+	}
+
+	if zone == "" || ip.To4() != nil {
+		return ip.String(), true
+	}
+
+	return ip.String() + "%" + zone, true
+}
+
+// parseIPLiteral is net.ParseIP also accepting IPv6 addresses enclosed in
+// brackets.
+func parseIPLiteral(s string) net.IP {
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	return net.ParseIP(s)
 }
 
 // DefaultPath returns the directory part of an URL's path according to
@@ -318,16 +2430,46 @@ func DefaultPath(path string) string {
 // is compared to c.Expires to determine deletion of c. defPath and host are the
 // default-path and the canonical host name of the URL c was received from.
 //
+// key is the jar key of host, see JarKey, and becomes the key of a host-only
+// entry. The key of a domain cookie is derived from its resolved Domain
+// instead, so that it is the registrable domain of the Domain attribute even
+// if a broken public suffix list makes it differ from the key of host. Jar
+// lookups cover such keys as well.
+//
+// A cookie with the Partitioned attribute, see IsPartitioned, results in an
+// entry of the partition of key, i.e. the site of host being the top-level
+// site; such a cookie lacking the Secure attribute results in an error.
+//
+// A c.MaxAge of zero means that the cookie has no Max-Age attribute, a
+// negative one that it has to be deleted. net/http parses a "Max-Age=0"
+// attribute, which deletes a cookie in browsers, as a negative MaxAge, so that
+// such cookies received in responses are deleted as well.
+//
 // remove records whether the jar should delete this cookie, as it has already
 // expired with respect to now. In this case, e may be incomplete, but it will
 // be valid to use e.ID
 //
-// A malformed c.Domain will result in an error.
+// A malformed c.Domain will result in an error, as will a c.Domain longer than
+// DefaultMaxDomainLength.
 func NewEntry(
 	c *http.Cookie,
 	now time.Time,
 	defPath, host, key string,
 	psList PublicSuffixList,
+) (e Entry, remove bool, err error) {
+	return newEntry(c, now, defPath, host, key, psList, DefaultMaxDomainLength, nil)
+}
+
+// newEntry is like NewEntry, rejecting Domain attributes longer than
+// maxDomainLength instead and making those naming host host-only if host is
+// one of suffixExceptions, see domainAndType.
+func newEntry(
+	c *http.Cookie,
+	now time.Time,
+	defPath, host, key string,
+	psList PublicSuffixList,
+	maxDomainLength int,
+	suffixExceptions map[string]bool,
 ) (e Entry, remove bool, err error) {
 	e.Name = c.Name
 	e.Key = key
@@ -339,13 +2481,21 @@ func NewEntry(
 	}
 
 	defer func() {
-		e.ID = fmt.Sprintf("%s;%s;%s", e.Domain, e.Path, e.Name)
+		e.ID = e.RawID()
 	}()
 
-	e.Domain, e.HostOnly, err = DomainAndType(host, c.Domain, psList)
+	e.Domain, e.HostOnly, err = domainAndType(host, c.Domain, psList, maxDomainLength, suffixExceptions)
 	if err != nil {
 		return e, false, err
 	}
+	if !e.HostOnly {
+		e.Key = JarKey(e.Domain, psList)
+	}
+
+	if IsPartitioned(c) {
+		e.Partitioned = true
+		e.PartitionKey = key
+	}
 
 	// MaxAge takes precedence over Expires.
 	if c.MaxAge < 0 {
@@ -366,10 +2516,16 @@ func NewEntry(
 		}
 	}
 
+	if e.Partitioned && !c.Secure {
+		return e, false, errPartitionedInsecure
+	}
+
 	e.Creation = now
+	e.LastModified = now
 	e.Value = c.Value
 	e.Secure = c.Secure
 	e.HttpOnly = c.HttpOnly
+	e.Priority = ParsePriority(c.Unparsed)
 
 	switch c.SameSite {
 	case http.SameSiteDefaultMode:
@@ -387,15 +2543,104 @@ var (
 	errIllegalDomain   = errors.New("cookiejar: illegal cookie domain attribute")
 	errMalformedDomain = errors.New("cookiejar: malformed cookie domain attribute")
 	errNoHostname      = errors.New("cookiejar: no host name available (IP only)")
+	errSecurePrefix    = errors.New("cookiejar: __Secure- prefixed cookie is not secure")
+	errHostPrefix      = errors.New("cookiejar: __Host- prefixed cookie is not secure, host-only with root path")
+	errMalformedName   = errors.New("cookiejar: malformed cookie name")
+	errMalformedValue  = errors.New("cookiejar: malformed cookie value")
+	errDomainTooLong   = errors.New("cookiejar: cookie domain attribute too long")
+
+	errPartitionedInsecure = errors.New("cookiejar: partitioned cookie is not secure")
+
+	errNoPublicSuffixList = errors.New("cookiejar: public suffix list is required in strict mode")
+
+	errUnmappedHost = errors.New("cookiejar: host name needs IDNA mapping")
 )
 
-// endOfTime is the time when session (non-persistent) cookies expire.
+// ErrCookieTooLarge is the error of cookies rejected because of
+// Options.MaxCookieBytes, reported e.g. to Options.Logger.
+var ErrCookieTooLarge = errors.New("cookiejar: cookie name and value too large")
+
+// ValidateNameValue checks that name is a token and value consists of
+// cookie-octets, optionally enclosed in double quotes, according to the
+// grammar of RFC 6265 section 4.1.1.
+func ValidateNameValue(name, value string) error {
+	if name == "" {
+		return errMalformedName
+	}
+	for i := 0; i < len(name); i++ {
+		if !isTokenByte(name[i]) {
+			return errMalformedName
+		}
+	}
+
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	for i := 0; i < len(value); i++ {
+		if !isCookieOctet(value[i]) {
+			return errMalformedValue
+		}
+	}
+
+	return nil
+}
+
+// isTokenByte reports whether b may appear in a RFC 2616 token: any CHAR
+// except CTLs and separators.
+func isTokenByte(b byte) bool {
+	if b <= ' ' || b >= 0x7f {
+		return false
+	}
+	return !strings.ContainsRune(`()<>@,;:\"/[]?={}`, rune(b))
+}
+
+// isCookieOctet reports whether b is a RFC 6265 cookie-octet: US-ASCII
+// characters excluding CTLs, whitespace, DQUOTE, comma, semicolon and
+// backslash.
+func isCookieOctet(b byte) bool {
+	return b == 0x21 ||
+		0x23 <= b && b <= 0x2b ||
+		0x2d <= b && b <= 0x3a ||
+		0x3c <= b && b <= 0x5b ||
+		0x5d <= b && b <= 0x7e
+}
+
+// endOfTime is the time when session (non-persistent) cookies expire, unless
+// Options.SessionExpiry is set.
 // This instant is representable in most date/time formats (not just
 // Go's time.Time) and should be far enough in the future.
 var endOfTime = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
 
+// DefaultSessionExpiry is the Expires time of session (non-persistent) entries
+// unless configured otherwise, e.g. by Options.SessionExpiry. Importers such as
+// browserimport use it for session cookies read from other formats.
+var DefaultSessionExpiry = endOfTime
+
 // DomainAndType determines the cookie's domain and hostOnly attribute.
+//
+// A domain naming a public suffix according to psList is rejected, unless it
+// equals host: as required by RFC 6265 section 5.3 step 5, the cookie is then
+// a host cookie. Hosts named by a public suffix, e.g. of an internal top-level
+// domain, can thus set cookies for themselves with a Domain attribute, while
+// their subdomains cannot set such cookies. A jar treats the domains listed in
+// Options.AdditionalPublicSuffixExceptions like public suffixes in this regard.
+//
+// A domain longer than DefaultMaxDomainLength, not counting a leading dot, is
+// rejected before any further processing.
 func DomainAndType(host, domain string, psList PublicSuffixList) (string, bool, error) {
+	return domainAndType(host, domain, psList, DefaultMaxDomainLength, nil)
+}
+
+// domainAndType is like DomainAndType, rejecting domains longer than
+// maxLength instead, a non-positive maxLength disabling the check. A domain
+// naming host is a host cookie if host is in suffixExceptions, see
+// Options.AdditionalPublicSuffixExceptions.
+func domainAndType(
+	host, domain string,
+	psList PublicSuffixList,
+	maxLength int,
+	suffixExceptions map[string]bool,
+) (string, bool, error) {
 	if domain == "" {
 		// No domain attribute in the SetCookie header indicates a
 		// host cookie.
@@ -416,6 +2661,12 @@ func DomainAndType(host, domain string, psList PublicSuffixList) (string, bool,
 		domain = domain[1:]
 	}
 
+	if maxLength > 0 && len(domain) > maxLength {
+		// Bound the work spent on hostile input, such a domain
+		// cannot name a host anyway.
+		return "", false, errDomainTooLong
+	}
+
 	if len(domain) == 0 || domain[0] == '.' {
 		// Received either "Domain=." or "Domain=..some.thing",
 		// both are illegal.
@@ -438,6 +2689,11 @@ func DomainAndType(host, domain string, psList PublicSuffixList) (string, bool,
 		return "", false, errMalformedDomain
 	}
 
+	if host == domain && suffixExceptions[domain] {
+		// The host owns the domain like a public suffix below.
+		return host, true, nil
+	}
+
 	// See RFC 6265 section 5.3 #5.
 	if psList != nil {
 		if ps := psList.PublicSuffix(domain); ps != "" && !HasDotSuffix(domain, ps) {
@@ -6,12 +6,15 @@ package cookiejarx
 
 import (
 	"fmt"
+	"mime"
 	"net/http"
 	"net/url"
 	"sort"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/eientei/cookiejarx/punycode"
 )
 
 // tNow is the synthetic current time used as now during testing.
@@ -133,7 +136,15 @@ var canonicalHostTests = map[string]string{
 	"2001:4860:0:2001::68":    "2001:4860:0:2001::68",
 	"[2001:4860:0:::68]:8080": "2001:4860:0:::68",
 	"www.bücher.de":           "www.xn--bcher-kva.de",
+	"www.BÜCHER.de":           "error",
+	"www.bücher\uff0ede":      "error",
 	"www.example.com.":        "www.example.com",
+	"[2001:DB8::0:1]":         "2001:db8::1",
+	"2001:0db8:0:0::1":        "2001:db8::1",
+	"[::1]:8080":              "::1",
+	"[fe80::1%eth0]:8080":     "fe80::1%eth0",
+	"[FE80::0001%eth0]":       "fe80::1%eth0",
+	"fe80::1%eth0":            "fe80::1%eth0",
 	// TODO: Fix CanonicalHost so that all of the following malformed
 	// domain names trigger an error. (This list is not exhaustive, e.g.
 	// malformed internationalized domain names are missing.)
@@ -255,6 +266,8 @@ var isIPTests = map[string]bool{
 	"1.1.1.300":            false,
 	"www.foo.bar.net":      false,
 	"123.foo.bar.net":      false,
+	"fe80::1%eth0":         true,
+	"1.2.3.4%eth0":         false,
 }
 
 func TestIsIP(t *testing.T) {
@@ -265,6 +278,47 @@ func TestIsIP(t *testing.T) {
 	}
 }
 
+func TestIDNAMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode punycode.Mode
+		key  string
+	}{
+		{punycode.Nontransitional, "xn--fa-hia.test"},
+		{punycode.Transitional, "fass.test"},
+	} {
+		jar, _ := New(&Options{PublicSuffixList: testPSL{}, IDNAMode: tc.mode})
+		jar.setCookies(mustParseURL("http://www.faß.test/"), []*http.Cookie{{Name: "a", Value: "1"}}, tNow)
+
+		entries := jar.storage.(Dumper).EntriesDump()
+		if len(entries) != 1 || entries[0].Key != tc.key {
+			t.Errorf("mode %d: got entries %+v, want one with key %q", tc.mode, entries, tc.key)
+		}
+		if got := jar.cookieHeader(mustParseURL("http://www."+tc.key+"/"), tNow); got != "a=1" {
+			t.Errorf("mode %d: got %q for the ASCII host, want %q", tc.mode, got, "a=1")
+		}
+	}
+}
+
+func TestZonedIPv6Host(t *testing.T) {
+	jar := newTestJar()
+	jar.setCookies(mustParseURL("http://[fe80::1%25eth0]:8080/"), []*http.Cookie{{Name: "a", Value: "1"}}, tNow)
+
+	for u, want := range map[string]string{
+		"http://[FE80::0001%25eth0]/": "a=1",
+		"http://[fe80::1%25eth1]/":    "",
+		"http://[fe80::1]/":           "",
+	} {
+		if got := jar.cookieHeader(mustParseURL(u), tNow); got != want {
+			t.Errorf("%s: got %q, want %q", u, got, want)
+		}
+	}
+
+	entries := jar.storage.(Dumper).EntriesDump()
+	if len(entries) != 1 || entries[0].Key != "fe80::1%eth0" || entries[0].Domain != "fe80::1%eth0" {
+		t.Errorf("got entries %+v, want one keyed by the canonical zoned address", entries)
+	}
+}
+
 var defaultPathTests = map[string]string{
 	"/":           "/",
 	"/abc":        "/",
@@ -1320,3 +1374,1786 @@ func TestIssue19384(t *testing.T) {
 		}
 	}
 }
+
+func TestHashIDs(t *testing.T) {
+	ids := []string{
+		"www.host.test;/;a",
+		"www.host.test;/;b",
+		"host.test;/;a",
+		"www.host.test;/foo;a",
+	}
+	seen := make(map[string]string)
+	for _, id := range ids {
+		h := HashID(id)
+		if len(h) != 32 {
+			t.Errorf("%q: got hash %q of length %d, want 32", id, h, len(h))
+		}
+		if other, ok := seen[h]; ok {
+			t.Errorf("%q and %q: both hash to %q", id, other, h)
+		}
+		seen[h] = id
+	}
+
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage, HashIDs: true})
+	jarTest{
+		"Hashed IDs.",
+		"http://www.host.test/foo",
+		[]string{"a=1", "b=2; path=/", "c=3; domain=host.test"},
+		"a=1 b=2 c=3",
+		[]query{{"http://www.host.test/foo/bar", "a=1 b=2 c=3"}},
+	}.run(t, jar)
+	for _, e := range storage.EntriesDump() {
+		if e.ID != HashID(e.RawID()) {
+			t.Errorf("%s: got ID %q, want %q", e.RawID(), e.ID, HashID(e.RawID()))
+		}
+	}
+	jarTest{
+		"Hashed IDs deletion.",
+		"http://www.host.test/foo",
+		[]string{"a=; max-age=-1", "c=; domain=host.test; max-age=-1"},
+		"b=2",
+		[]query{{"http://www.host.test/foo/bar", "b=2"}},
+	}.run(t, jar)
+}
+
+var multiLevelDomainTests = [...]struct {
+	fromURL    string
+	domain     string
+	wantDomain string
+	wantKey    string
+}{
+	{"http://a.b.example.com", "b.example.com", "b.example.com", "example.com"},
+	{"http://a.b.example.com", ".b.example.com", "b.example.com", "example.com"},
+	{"http://a.b.example.com", "example.com", "example.com", "example.com"},
+	{"http://x.a.b.example.com", "a.b.example.com", "a.b.example.com", "example.com"},
+	{"http://a.b.bbc.co.uk", "b.bbc.co.uk", "b.bbc.co.uk", "bbc.co.uk"},
+	{"http://a.b.bbc.co.uk", "bbc.co.uk", "bbc.co.uk", "bbc.co.uk"},
+}
+
+func TestMultiLevelDomain(t *testing.T) {
+	for _, tc := range multiLevelDomainTests {
+		storage := NewInMemoryStorage()
+		jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+		u := mustParseURL(tc.fromURL)
+		jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1", Domain: tc.domain}}, tNow)
+		jar.setCookies(u, []*http.Cookie{{Name: "b", Value: "2"}}, tNow)
+
+		entries := storage.EntriesDump()
+		if len(entries) != 2 {
+			t.Errorf("%s/%s: got %d entries, want 2", tc.fromURL, tc.domain, len(entries))
+			continue
+		}
+		for _, e := range entries {
+			if e.Key != tc.wantKey {
+				t.Errorf("%s/%s: %s: got key %q, want %q", tc.fromURL, tc.domain, e.Name, e.Key, tc.wantKey)
+			}
+			if e.Name == "a" && (e.Domain != tc.wantDomain || e.HostOnly) {
+				t.Errorf("%s/%s: got domain %q/%t, want %q/false",
+					tc.fromURL, tc.domain, e.Domain, e.HostOnly, tc.wantDomain)
+			}
+			if e.Key != JarKey(e.Domain, testPSL{}) {
+				t.Errorf("%s/%s: %s: key %q differs from key of domain %q",
+					tc.fromURL, tc.domain, e.Name, e.Key, JarKey(e.Domain, testPSL{}))
+			}
+		}
+	}
+}
+
+func TestStartSession(t *testing.T) {
+	jar := newTestJar()
+	u := mustParseURL("http://www.host.test/")
+
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "session", Value: "1"},
+		{Name: "persistent", Value: "2", MaxAge: 3600},
+	}, tNow)
+
+	jar.startSession(tNow.Add(time.Second))
+
+	var s []string
+	for _, c := range jar.cookies(u, tNow.Add(2*time.Second)) {
+		s = append(s, c.Name+"="+c.Value)
+	}
+	if got, want := strings.Join(s, " "), "persistent=2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	jar.setCookies(u, []*http.Cookie{{Name: "session", Value: "3"}}, tNow.Add(3*time.Second))
+
+	s = nil
+	for _, c := range jar.cookies(u, tNow.Add(4*time.Second)) {
+		s = append(s, c.Name+"="+c.Value)
+	}
+	sort.Strings(s)
+	if got, want := strings.Join(s, " "), "persistent=2 session=3"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStartSessionWithoutDumper(t *testing.T) {
+	storage := struct{ Storage }{NewInMemoryStorage()}
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/")
+
+	jar.setCookies(u, []*http.Cookie{{Name: "session", Value: "1"}}, tNow)
+	jar.startSession(tNow.Add(time.Second))
+	jar.setCookies(u, []*http.Cookie{{Name: "session", Value: "2"}}, tNow.Add(2*time.Second))
+
+	for _, now := range []time.Time{tNow.Add(3 * time.Second), tNow.Add(4 * time.Second)} {
+		if got := jar.cookies(u, now); len(got) != 1 || got[0].Value != "2" {
+			t.Errorf("at %v: got %v, want session=2", now, got)
+		}
+	}
+}
+
+func TestCookiesForDomain(t *testing.T) {
+	jar := newTestJar()
+	jar.setCookies(mustParseURL("https://api.example.com/v1/"), []*http.Cookie{
+		{Name: "apihost", Value: "1"},
+		{Name: "apidomain", Value: "2", Domain: "api.example.com"},
+		{Name: "apex", Value: "3", Domain: "example.com", Path: "/", Secure: true},
+		{Name: "expired", Value: "4", Domain: "example.com", MaxAge: 1},
+	}, tNow)
+	jar.setCookies(mustParseURL("http://example.com/"), []*http.Cookie{
+		{Name: "apexhost", Value: "5"},
+	}, tNow)
+	jar.setCookies(mustParseURL("http://other.test/"), []*http.Cookie{
+		{Name: "other", Value: "6", Domain: "other.test"},
+	}, tNow)
+	jar.setCookiesPartitioned(mustParseURL("https://www.embed.test/"), mustParseURL("https://example.com/"),
+		[]*http.Cookie{{Name: "embedexample", Value: "7", Secure: true, Partitioned: true}}, tNow)
+	jar.setCookiesPartitioned(mustParseURL("https://www.embed.test/"), mustParseURL("https://other.test/"),
+		[]*http.Cookie{{Name: "embedother", Value: "8", Secure: true, Partitioned: true}}, tNow)
+	jar.setCookiesPartitioned(mustParseURL("https://www.embed.test/"), nil,
+		[]*http.Cookie{{Name: "embedself", Value: "9", Secure: true, Partitioned: true}}, tNow)
+
+	for _, tc := range []struct {
+		scheme, domain, want string
+	}{
+		{"https", "example.com", "apex apexhost"},
+		{"http", "example.com", "apexhost"},
+		{"https", "api.example.com", "apidomain apihost apex"},
+		{"http", "api.example.com", "apidomain apihost"},
+		{"https", "deep.api.example.com", "apidomain apex"},
+		{"https", "www.example.com", "apex"},
+		{"https", "other.test", "other"},
+		{"https", "unknown.test", ""},
+		{"ftp", "example.com", ""},
+		{"https", "www.embed.test", "embedself"},
+		{"http", "www.embed.test", ""},
+	} {
+		var s []string
+		for _, c := range jar.cookiesForDomain(tc.scheme, tc.domain, tNow.Add(2*time.Second)) {
+			s = append(s, c.Name)
+		}
+		if got := strings.Join(s, " "); got != tc.want {
+			t.Errorf("%s://%s: got %q, want %q", tc.scheme, tc.domain, got, tc.want)
+		}
+	}
+}
+
+func TestOnCanonicalHostError(t *testing.T) {
+	// A label long enough to overflow punycode encoding.
+	host := strings.Repeat("a", 2000) + "\U0010ffff.host.test"
+	if _, err := CanonicalHost(host); err == nil {
+		t.Fatalf("%q: got nil error, want non-nil", host)
+	}
+
+	u := &url.URL{Scheme: "http", Host: host, Path: "/"}
+	cookies := []*http.Cookie{{Name: "a", Value: "1"}}
+
+	strict := newTestJar()
+	strict.setCookies(u, cookies, tNow)
+	if got := strict.cookies(u, tNow); len(got) != 0 {
+		t.Errorf("strict: got %v, want none", got)
+	}
+
+	var gotErr error
+	lenient, _ := New(&Options{
+		PublicSuffixList: testPSL{},
+		OnCanonicalHostError: func(host string, err error) (string, error) {
+			gotErr = err
+			return "Fallback.Host.Test.:80", nil
+		},
+	})
+	lenient.setCookies(u, cookies, tNow)
+	if got := lenient.cookies(u, tNow); len(got) != 1 || got[0].Value != "1" {
+		t.Errorf("lenient: got %v, want a=1", got)
+	}
+	if got := lenient.cookies(mustParseURL("http://fallback.host.test/"), tNow); len(got) != 1 {
+		t.Errorf("lenient: got %v for fallback host, want a=1", got)
+	}
+	if gotErr == nil {
+		t.Error("lenient: got no CanonicalHost error passed to OnCanonicalHostError")
+	}
+}
+
+func TestLenientIDNA(t *testing.T) {
+	cookies := []*http.Cookie{{Name: "a", Value: "1"}}
+	canonical := mustParseURL("http://www.bücher.test/")
+
+	for _, host := range []string{"www.BÜCHER.test", "www.Bücher\u3002test", "WWW.BÜCHER\uff0eTEST"} {
+		u := &url.URL{Scheme: "http", Host: host, Path: "/"}
+
+		strict := newTestJar()
+		strict.setCookies(u, cookies, tNow)
+		if got := strict.cookies(u, tNow); len(got) != 0 {
+			t.Errorf("%q strict: got %v, want none", host, got)
+		}
+
+		lenient, _ := New(&Options{PublicSuffixList: testPSL{}, LenientIDNA: true})
+		lenient.setCookies(u, cookies, tNow)
+		if got := lenient.cookies(u, tNow); len(got) != 1 {
+			t.Errorf("%q lenient: got %v, want a=1", host, got)
+		}
+		if got := lenient.cookies(canonical, tNow); len(got) != 1 {
+			t.Errorf("%q lenient: got %v for %s, want a=1", host, got, canonical.Host)
+		}
+	}
+}
+
+func TestSortKeyFor(t *testing.T) {
+	jar := newTestJar()
+	u := mustParseURL("http://www.host.test/a/b/c")
+
+	jar.setCookies(u, []*http.Cookie{{Name: "late", Value: "1", Path: "/a"}}, tNow.Add(time.Second))
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "root", Value: "2", Path: "/"},
+		{Name: "deep", Value: "3", Path: "/a/b"},
+		{Name: "early", Value: "4", Path: "/a"},
+		{Name: "tie", Value: "5", Path: "/a"},
+	}, tNow)
+
+	now := tNow.Add(2 * time.Second)
+	cookies := jar.cookies(u, now)
+
+	type sortKey struct {
+		pathLen  int
+		creation time.Time
+		seq      uint64
+	}
+	var keys []sortKey
+	for _, c := range cookies {
+		pathLen, creation, seq, ok := jar.sortKeyFor(u, c.Name, now)
+		if !ok {
+			t.Fatalf("%s: got not ok", c.Name)
+		}
+		keys = append(keys, sortKey{pathLen, creation, seq})
+	}
+
+	for i := 1; i < len(keys); i++ {
+		a, b := keys[i-1], keys[i]
+		ordered := a.pathLen > b.pathLen ||
+			a.pathLen == b.pathLen && a.creation.Before(b.creation) ||
+			a.pathLen == b.pathLen && a.creation.Equal(b.creation) && a.seq < b.seq
+		if !ordered {
+			t.Errorf("%s before %s: got keys %v and %v out of order",
+				cookies[i-1].Name, cookies[i].Name, a, b)
+		}
+	}
+
+	if got := keys[0]; got.pathLen != len("/a/b") {
+		t.Errorf("deep: got path length %d, want %d", got.pathLen, len("/a/b"))
+	}
+
+	if _, _, _, ok := jar.sortKeyFor(u, "missing", now); ok {
+		t.Errorf("missing: got ok, want not ok")
+	}
+}
+
+func TestFindRedundant(t *testing.T) {
+	jar := newTestJar()
+	jar.setCookies(mustParseURL("https://www.host.test/a/b"), []*http.Cookie{
+		{Name: "host", Value: "1"},
+		{Name: "host", Value: "1", Domain: "host.test"},
+		{Name: "path", Value: "2", Path: "/a"},
+		{Name: "path", Value: "2", Path: "/"},
+		{Name: "value", Value: "3", Path: "/a"},
+		{Name: "value", Value: "4", Path: "/"},
+		{Name: "secure", Value: "5", Path: "/a"},
+		{Name: "secure", Value: "5", Path: "/", Secure: true},
+		{Name: "unique", Value: "6"},
+	}, tNow)
+
+	var s []string
+	for _, e := range jar.findRedundant(mustParseURL("https://www.host.test/a/b"), tNow) {
+		s = append(s, e.ID)
+	}
+	sort.Strings(s)
+	if got, want := strings.Join(s, " "), "www.host.test;/a;host www.host.test;/a;path"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCookiesGrouped(t *testing.T) {
+	jar := newTestJar()
+	jar.setCookies(mustParseURL("http://www.example.com/"), []*http.Cookie{
+		{Name: "host", Value: "1"},
+		{Name: "domain", Value: "2", Domain: "example.com"},
+		{Name: "expired", Value: "3", MaxAge: 1},
+	}, tNow)
+	jar.setCookies(mustParseURL("http://api.example.com/"), []*http.Cookie{
+		{Name: "api", Value: "4"},
+	}, tNow)
+	jar.setCookies(mustParseURL("http://www.bbc.co.uk/"), []*http.Cookie{
+		{Name: "uk", Value: "5", Domain: "bbc.co.uk"},
+	}, tNow)
+	jar.setCookies(mustParseURL("http://127.0.0.1/"), []*http.Cookie{
+		{Name: "ip", Value: "6"},
+	}, tNow)
+
+	groups := jar.cookiesGrouped(tNow.Add(2 * time.Second))
+	want := map[string]string{
+		"example.com": "api=4/api.example.com domain=2/example.com host=1/www.example.com",
+		"bbc.co.uk":   "uk=5/bbc.co.uk",
+		"127.0.0.1":   "ip=6/127.0.0.1",
+	}
+	if len(groups) != len(want) {
+		t.Errorf("got %d groups, want %d", len(groups), len(want))
+	}
+	for key, w := range want {
+		var s []string
+		for _, c := range groups[key] {
+			s = append(s, c.Name+"="+c.Value+"/"+c.Domain)
+		}
+		sort.Strings(s)
+		if got := strings.Join(s, " "); got != w {
+			t.Errorf("%s: got %q, want %q", key, got, w)
+		}
+	}
+}
+
+var validateNameValueTests = [...]struct {
+	name, value string
+	wantErr     error
+}{
+	{"a", "b", nil},
+	{"a", "", nil},
+	{"a", `"b"`, nil},
+	{"a-b_c.d!#$%&'*+^`|~", "!#$%&'()*+-./:<=>?@[]^_`{|}~", nil},
+	{"", "b", errMalformedName},
+	{"a b", "b", errMalformedName},
+	{"a=b", "b", errMalformedName},
+	{"a;", "b", errMalformedName},
+	{"a\x01", "b", errMalformedName},
+	{"ä", "b", errMalformedName},
+	{"a", "b c", errMalformedValue},
+	{"a", "b,c", errMalformedValue},
+	{"a", "b;c", errMalformedValue},
+	{"a", `b\c`, errMalformedValue},
+	{"a", `"b`, errMalformedValue},
+	{"a", "b\x7f", errMalformedValue},
+}
+
+func TestValidateNameValue(t *testing.T) {
+	for _, tc := range validateNameValueTests {
+		if err := ValidateNameValue(tc.name, tc.value); err != tc.wantErr {
+			t.Errorf("%q=%q: got %v, want %v", tc.name, tc.value, err, tc.wantErr)
+		}
+	}
+}
+
+func TestStrictRFC6265(t *testing.T) {
+	if _, err := New(&Options{StrictRFC6265: true}); err != errNoPublicSuffixList {
+		t.Errorf("got %v without public suffix list, want %v", err, errNoPublicSuffixList)
+	}
+
+	strict, err := New(&Options{PublicSuffixList: testPSL{}, StrictRFC6265: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lenient, err := New(&Options{PublicSuffixList: testPSL{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := mustParseURL("http://www.host.test/")
+	cookies := []*http.Cookie{
+		{Name: "ok", Value: "1"},
+		{Name: "bad name", Value: "2"},
+		{Name: "badvalue", Value: "a;b"},
+		{Name: "large", Value: strings.Repeat("x", 4096)},
+		{Name: "maxage", Value: "3"},
+	}
+	ip := mustParseURL("http://127.0.0.1/")
+	ipCookies := []*http.Cookie{{Name: "ip", Value: "4", Domain: "127.0.0.1"}}
+	deletion := (&http.Response{Header: http.Header{"Set-Cookie": {"maxage=; Max-Age=0"}}}).Cookies()
+
+	for _, tc := range []struct {
+		jar  *Jar
+		want string
+	}{
+		{strict, "ok=1"},
+		{lenient, "ok=1 bad name=2 badvalue=a;b large=" + strings.Repeat("x", 4096)},
+	} {
+		tc.jar.setCookies(u, cookies, tNow)
+		tc.jar.setCookies(u, deletion, tNow)
+		tc.jar.setCookies(ip, ipCookies, tNow)
+
+		var s []string
+		for _, c := range tc.jar.cookies(u, tNow) {
+			s = append(s, c.Name+"="+c.Value)
+		}
+		if got := strings.Join(s, " "); got != tc.want {
+			t.Errorf("strict=%t: got %q, want %q", tc.jar.strict, got, tc.want)
+		}
+		if got := tc.jar.cookies(ip, tNow); len(got) != 0 {
+			t.Errorf("strict=%t: got %v for IP domain cookie, want none", tc.jar.strict, got)
+		}
+	}
+}
+
+func TestCookiesFull(t *testing.T) {
+	jar := newTestJar()
+	jar.setCookies(mustParseURL("https://www.host.test/a/"), []*http.Cookie{
+		{Name: "a", Value: "1", Path: "/a", Secure: true, HttpOnly: true, MaxAge: 60, SameSite: http.SameSiteLaxMode},
+		{Name: "b", Value: "2", Domain: "host.test", Path: "/", SameSite: http.SameSiteStrictMode},
+		{Name: "c", Value: "3", Path: "/", SameSite: http.SameSiteDefaultMode},
+	}, tNow)
+
+	got := jar.cookiesFull(mustParseURL("https://www.host.test/a/b"), tNow)
+	want := []*http.Cookie{
+		{Name: "a", Value: "1", Domain: "www.host.test", Path: "/a", Expires: tNow.Add(time.Minute),
+			Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode},
+		{Name: "b", Value: "2", Domain: "host.test", Path: "/", SameSite: http.SameSiteStrictMode},
+		{Name: "c", Value: "3", Domain: "www.host.test", Path: "/", SameSite: http.SameSiteDefaultMode},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d cookies, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].String() != want[i].String() || !got[i].Expires.Equal(want[i].Expires) {
+			t.Errorf("#%d: got %#v, want %#v", i, got[i], want[i])
+		}
+	}
+
+	for _, c := range jar.cookies(mustParseURL("https://www.host.test/a/b"), tNow) {
+		if c.Domain != "" || c.Path != "" || c.Secure || c.HttpOnly || c.SameSite != 0 {
+			t.Errorf("Cookies: got %#v, want name and value only", c)
+		}
+	}
+}
+
+func TestOptionsNow(t *testing.T) {
+	now := tNow
+	jar, _ := New(&Options{
+		PublicSuffixList: testPSL{},
+		Now:              func() time.Time { return now },
+	})
+	u := mustParseURL("http://www.host.test/")
+
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "session", Value: "1"},
+		{Name: "short", Value: "2", MaxAge: 10},
+		{Name: "long", Value: "3", Expires: tNow.Add(time.Hour)},
+	})
+
+	query := func() string {
+		var s []string
+		for _, c := range jar.Cookies(u) {
+			s = append(s, c.Name)
+		}
+		return strings.Join(s, " ")
+	}
+
+	if got, want := query(), "session short long"; got != want {
+		t.Errorf("at start: got %q, want %q", got, want)
+	}
+
+	now = tNow.Add(9 * time.Second)
+	if got, want := query(), "session short long"; got != want {
+		t.Errorf("before Max-Age: got %q, want %q", got, want)
+	}
+
+	now = tNow.Add(10 * time.Second)
+	if got, want := query(), "session long"; got != want {
+		t.Errorf("at Max-Age: got %q, want %q", got, want)
+	}
+
+	now = tNow.Add(time.Hour)
+	if got, want := query(), "session"; got != want {
+		t.Errorf("at Expires: got %q, want %q", got, want)
+	}
+}
+
+func TestExpiringWithin(t *testing.T) {
+	jar := newTestJar()
+	u := mustParseURL("http://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "session", Value: "1"},
+		{Name: "soon", Value: "2", MaxAge: 60},
+		{Name: "edge", Value: "3", MaxAge: 300},
+		{Name: "later", Value: "4", MaxAge: 3600},
+		{Name: "other", Value: "5", MaxAge: 60, Path: "/other"},
+	}, tNow)
+
+	var s []string
+	for _, c := range jar.expiringWithin(u, 5*time.Minute, tNow) {
+		s = append(s, c.Name)
+	}
+	sort.Strings(s)
+	if got, want := strings.Join(s, " "), "edge soon"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := jar.expiringWithin(u, time.Hour, tNow.Add(2*time.Hour)); len(got) != 0 {
+		t.Errorf("expired cookies reported: %v", got)
+	}
+}
+
+func TestStrictPrefixes(t *testing.T) {
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, StrictPrefixes: true})
+
+	jar.setCookies(mustParseURL("https://www.host.test/dir/page"), []*http.Cookie{
+		{Name: "__Secure-a", Value: "1", Secure: true},
+		{Name: "__Secure-b", Value: "2"},
+		{Name: "__Host-c", Value: "3", Secure: true, Path: "/"},
+		{Name: "__Host-d", Value: "4", Secure: true},
+		{Name: "__Host-e", Value: "5", Secure: true, Path: "/", Domain: "host.test"},
+		{Name: "__Host-f", Value: "6", Path: "/"},
+	}, tNow)
+	jar.setCookies(mustParseURL("https://www.host.test/page"), []*http.Cookie{
+		{Name: "__Host-g", Value: "7", Secure: true},
+	}, tNow)
+
+	var s []string
+	for _, c := range jar.cookies(mustParseURL("https://www.host.test/dir/page"), tNow) {
+		s = append(s, c.Name)
+	}
+	sort.Strings(s)
+	if got, want := strings.Join(s, " "), "__Host-c __Host-g __Secure-a"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Removing a prefixed cookie is subject to the same restrictions.
+	u := mustParseURL("https://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{{Name: "__Host-c", Path: "/", MaxAge: -1}}, tNow)
+	if got := len(jar.cookies(u, tNow)); got != 2 {
+		t.Errorf("insecure removal applied: got %d cookies, want 2", got)
+	}
+	jar.setCookies(u, []*http.Cookie{{Name: "__Host-c", Path: "/", MaxAge: -1, Secure: true}}, tNow)
+	if got := len(jar.cookies(u, tNow)); got != 1 {
+		t.Errorf("secure removal not applied: got %d cookies, want 1", got)
+	}
+}
+
+func TestRemoveCookie(t *testing.T) {
+	jar := newTestJar()
+	jar.setCookies(mustParseURL("https://www.host.test/a/b"), []*http.Cookie{
+		{Name: "sid", Value: "host"},
+		{Name: "sid", Value: "domain", Domain: "host.test", Path: "/"},
+		{Name: "sid", Value: "secure", Path: "/a", Secure: true},
+		{Name: "sid", Value: "other-path", Path: "/c"},
+		{Name: "keep", Value: "1", Path: "/"},
+	}, tNow)
+	jar.setCookies(mustParseURL("http://other.host.test/"), []*http.Cookie{
+		{Name: "sid", Value: "sibling"},
+	}, tNow)
+
+	jar.removeCookie(mustParseURL("http://www.host.test/a/b"), "sid", tNow)
+	jar.removeCookie(mustParseURL("http://www.host.test/"), "missing", tNow)
+
+	var s []string
+	for _, e := range jar.storage.(Dumper).EntriesDump() {
+		s = append(s, e.Value)
+	}
+	sort.Strings(s)
+	if got, want := strings.Join(s, " "), "1 other-path sibling"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMatchedEntries(t *testing.T) {
+	jar := newTestJar()
+	u := mustParseURL("http://www.host.test/a/b")
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "a", Value: "1", Path: "/"},
+		{Name: "b", Value: "2"},
+		{Name: "c", Value: "3", Domain: "host.test", Path: "/a"},
+	}, tNow)
+	jar.setCookies(mustParseURL("http://www.other.test/"), []*http.Cookie{{Name: "d", Value: "4"}}, tNow)
+
+	entries := jar.matchedEntries(u, tNow)
+	cookies := jar.cookies(u, tNow)
+	if len(entries) != len(cookies) || len(entries) != 3 {
+		t.Fatalf("got %d entries and %d cookies, want 3", len(entries), len(cookies))
+	}
+	for i, e := range entries {
+		if e.Name != cookies[i].Name || e.Value != cookies[i].Value {
+			t.Errorf("#%d: got entry %s=%s, want %s", i, e.Name, e.Value, cookies[i])
+		}
+		if e.Key != "host.test" || e.Creation.IsZero() {
+			t.Errorf("#%d: got %+v, want metadata", i, e)
+		}
+	}
+
+	entries[0].Value = "modified"
+	if got := jar.cookies(u, tNow)[0].Value; got == "modified" {
+		t.Error("modifying a returned entry changed the stored one")
+	}
+
+	if entries := jar.matchedEntries(mustParseURL("ftp://www.host.test/"), tNow); len(entries) != 0 {
+		t.Errorf("got %d entries for a non-HTTP URL, want 0", len(entries))
+	}
+}
+
+// planSendsJar returns a jar with cookies of several hosts and paths, and
+// URLs requesting them.
+func planSendsJar(storage Storage) (*Jar, []*url.URL) {
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+
+	var urls []*url.URL
+	for _, host := range []string{"www.host.test", "api.host.test", "www.other.test"} {
+		jar.setCookies(mustParseURL("https://"+host+"/a/b"), []*http.Cookie{
+			{Name: "host", Value: host},
+			{Name: "root", Value: host, Path: "/"},
+			{Name: "domain", Value: host, Domain: JarKey(host, testPSL{}), Path: "/a"},
+			{Name: "secure", Value: host, Path: "/", Secure: true},
+		}, tNow)
+
+		for _, path := range []string{"/", "/a", "/a/b", "/c"} {
+			urls = append(urls, mustParseURL("http://"+host+path), mustParseURL("https://"+host+path))
+		}
+	}
+	urls = append(urls, mustParseURL("http://www.none.test/"), mustParseURL("ftp://www.host.test/"))
+
+	return jar, urls
+}
+
+func TestPlanSends(t *testing.T) {
+	for _, storage := range []Storage{NewInMemoryStorage(), NewShardedInMemoryStorage(4), dumpOnlyStorage{NewInMemoryStorage()}} {
+		jar, urls := planSendsJar(storage)
+
+		plan := jar.planSends(urls, tNow)
+		if len(plan) != len(urls) {
+			t.Errorf("%T: got %d planned URLs, want %d", storage, len(plan), len(urls))
+		}
+
+		for _, u := range urls {
+			var got, want []string
+			for _, e := range plan[u.String()] {
+				got = append(got, e.Name+"="+e.Value)
+			}
+			for _, e := range jar.matchedEntries(u, tNow) {
+				want = append(want, e.Name+"="+e.Value)
+			}
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("%T %s: got %q, want %q", storage, u, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkPlanSends(b *testing.B) {
+	jar, urls := planSendsJar(NewInMemoryStorage())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		jar.planSends(urls, tNow)
+	}
+}
+
+func BenchmarkPlanSendsPerURL(b *testing.B) {
+	jar, urls := planSendsJar(NewInMemoryStorage())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		plan := make(map[string][]*http.Cookie, len(urls))
+		for _, u := range urls {
+			plan[u.String()] = jar.cookies(u, tNow)
+		}
+	}
+}
+
+func TestPeekCookies(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/a/")
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "a", Value: "1", Path: "/"},
+		{Name: "b", Value: "2"},
+		{Name: "expiring", Value: "3", MaxAge: 60},
+	}, tNow)
+
+	later := tNow.Add(time.Hour)
+	generation := storage.Generation()
+
+	var s []string
+	for _, c := range jar.peekCookies(u, later) {
+		s = append(s, c.String())
+	}
+	if got, want := strings.Join(s, "; "), "b=2; a=1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := storage.Generation(); got != generation {
+		t.Errorf("got generation %d after peeking, want %d", got, generation)
+	}
+	entries := storage.EntriesDump()
+	if len(entries) != 3 {
+		t.Errorf("got %d entries after peeking, want the expired one kept", len(entries))
+	}
+	for _, e := range entries {
+		if !e.LastAccess.Equal(tNow) {
+			t.Errorf("%s: got last access %v, want %v", e.Name, e.LastAccess, tNow)
+		}
+	}
+
+	if got, want := jar.cookieHeader(u, later), strings.Join(s, "; "); got != want {
+		t.Errorf("got %q from Cookies, want %q as peeked", got, want)
+	}
+}
+
+func TestMaxAgeZero(t *testing.T) {
+	jar := newTestJar()
+	u := mustParseURL("http://www.host.test/")
+	received := func(header string) []*http.Cookie {
+		resp := &http.Response{Header: http.Header{"Set-Cookie": {header}}}
+		return resp.Cookies()
+	}
+
+	jar.setCookies(u, received("a=1; Max-Age=3600"), tNow)
+	jar.setCookies(u, received("b=2"), tNow)
+	jar.setCookies(u, []*http.Cookie{{Name: "c", Value: "3", MaxAge: 0}}, tNow)
+	if got, want := jar.cookieHeader(u, tNow), "a=1; b=2; c=3"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// An explicit Max-Age=0 deletes, unlike a missing attribute.
+	for _, header := range []string{"a=1; Max-Age=0", "b=2; Max-Age=0; Expires=Fri, 01 Jan 2038 00:00:00 GMT"} {
+		jar.setCookies(u, received(header), tNow)
+	}
+	if got, want := jar.cookieHeader(u, tNow), "c=3"; got != want {
+		t.Errorf("got %q after Max-Age=0, want %q", got, want)
+	}
+}
+
+func TestRemoveDomain(t *testing.T) {
+	jar := newTestJar()
+	jar.setCookies(mustParseURL("http://www.host.test/"), []*http.Cookie{
+		{Name: "a", Value: "www"},
+		{Name: "b", Value: "domain", Domain: "host.test"},
+	}, tNow)
+	jar.setCookies(mustParseURL("http://api.host.test/"), []*http.Cookie{{Name: "a", Value: "api"}}, tNow)
+	jar.setCookies(mustParseURL("http://www.other.test/"), []*http.Cookie{{Name: "a", Value: "other"}}, tNow)
+
+	values := func() string {
+		var s []string
+		for _, e := range jar.storage.(Dumper).EntriesDump() {
+			s = append(s, e.Value)
+		}
+		sort.Strings(s)
+		return strings.Join(s, " ")
+	}
+
+	jar.RemoveDomain("none.test")
+	if got, want := values(), "api domain other www"; got != want {
+		t.Errorf("got %q after removing a domain without cookies, want %q", got, want)
+	}
+
+	jar.RemoveDomain("HOST.test")
+	if got, want := values(), "other"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// dumpOnlyStorage exposes InMemoryStorage as Storage and Dumper only.
+type dumpOnlyStorage struct {
+	s *InMemoryStorage
+}
+
+func (d dumpOnlyStorage) SaveEntry(entry *Entry)     { d.s.SaveEntry(entry) }
+func (d dumpOnlyStorage) RemoveEntry(key, id string) { d.s.RemoveEntry(key, id) }
+func (d dumpOnlyStorage) EntriesDump() []*Entry      { return d.s.EntriesDump() }
+func (d dumpOnlyStorage) Entries(https bool, host, path, key string, now time.Time) []*Entry {
+	return d.s.Entries(https, host, path, key, now)
+}
+
+func TestClear(t *testing.T) {
+	for _, storage := range []Storage{NewInMemoryStorage(), dumpOnlyStorage{NewInMemoryStorage()}} {
+		jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+		jar.setCookies(mustParseURL("http://www.host.test/"), []*http.Cookie{
+			{Name: "a", Value: "1"},
+			{Name: "b", Value: "2", Domain: "host.test"},
+		}, tNow)
+		jar.setCookies(mustParseURL("http://www.example.com/"), []*http.Cookie{
+			{Name: "c", Value: "3"},
+		}, tNow)
+
+		jar.Clear()
+
+		if got := len(storage.(Dumper).EntriesDump()); got != 0 {
+			t.Errorf("%T: got %d entries after Clear, want 0", storage, got)
+		}
+	}
+}
+
+func TestCookiesWithExtra(t *testing.T) {
+	jar := newTestJar()
+	u := mustParseURL("http://www.host.test/a")
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "a", Value: "1", Path: "/a"},
+		{Name: "b", Value: "2", Path: "/a"},
+		{Name: "b", Value: "3", Path: "/"},
+		{Name: "c", Value: "4", Path: "/"},
+	}, tNow)
+
+	var s []string
+	for _, c := range jar.cookiesWithExtra(u, []*http.Cookie{
+		{Name: "x", Value: "5"},
+		{Name: "b", Value: "6"},
+	}, tNow) {
+		s = append(s, c.Name+"="+c.Value)
+	}
+	if got, want := strings.Join(s, " "), "a=1 b=6 c=4 x=5"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	s = nil
+	for _, c := range jar.cookies(u, tNow) {
+		s = append(s, c.Name+"="+c.Value)
+	}
+	if got, want := strings.Join(s, " "), "a=1 b=2 b=3 c=4"; got != want {
+		t.Errorf("extra cookies stored: got %q, want %q", got, want)
+	}
+}
+
+func TestCookiesDetailed(t *testing.T) {
+	jar := newTestJar()
+	u := mustParseURL("https://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "strict", Value: "1", SameSite: http.SameSiteStrictMode, MaxAge: 3600},
+		{Name: "lax", Value: "2", SameSite: http.SameSiteLaxMode, Domain: "host.test"},
+		{Name: "plain", Value: "3"},
+	}, tNow)
+
+	got := make(map[string]DetailedCookie)
+	for _, c := range jar.cookiesDetailed(u, tNow.Add(10*time.Minute)) {
+		got[c.Name] = c
+	}
+
+	for name, want := range map[string]DetailedCookie{
+		"strict": {Cookie: http.Cookie{SameSite: http.SameSiteStrictMode}, HostOnly: true, Persistent: true, TTL: 50 * time.Minute},
+		"lax":    {Cookie: http.Cookie{SameSite: http.SameSiteLaxMode}, TTL: SessionTTL},
+		"plain":  {HostOnly: true, TTL: SessionTTL},
+	} {
+		c, ok := got[name]
+		if !ok {
+			t.Errorf("%s: missing", name)
+			continue
+		}
+		if c.SameSite != want.SameSite || c.HostOnly != want.HostOnly ||
+			c.Persistent != want.Persistent || c.TTL != want.TTL {
+			t.Errorf("%s: got %+v, want %+v", name, c, want)
+		}
+	}
+}
+
+func TestDefaultSameSite(t *testing.T) {
+	jar, _ := New(&Options{
+		PublicSuffixList: testPSL{},
+		DefaultSameSite: func(host string) http.SameSite {
+			if host == "www.trusted.test" {
+				return http.SameSiteNoneMode
+			}
+			return http.SameSiteStrictMode
+		},
+	})
+
+	for _, tc := range []struct {
+		url      string
+		cookie   *http.Cookie
+		sameSite http.SameSite
+	}{
+		{"http://www.trusted.test/", &http.Cookie{Name: "a", Value: "1"}, 0},
+		{"http://www.untrusted.test/", &http.Cookie{Name: "a", Value: "1"}, http.SameSiteStrictMode},
+		{"http://www.untrusted.test/x", &http.Cookie{Name: "a", Value: "1", Path: "/x", SameSite: http.SameSiteLaxMode}, http.SameSiteLaxMode},
+	} {
+		u := mustParseURL(tc.url)
+		sameSite := tc.cookie.SameSite
+		jar.setCookies(u, []*http.Cookie{tc.cookie}, tNow)
+		if tc.cookie.SameSite != sameSite {
+			t.Errorf("%s: caller's cookie modified", tc.url)
+		}
+		cookies := jar.cookiesFull(u, tNow)
+		if len(cookies) == 0 {
+			t.Errorf("%s: no cookies", tc.url)
+			continue
+		}
+		if got := cookies[0].SameSite; got != tc.sameSite {
+			t.Errorf("%s: got SameSite %v, want %v", tc.url, got, tc.sameSite)
+		}
+	}
+}
+
+func TestAllowIPCookies(t *testing.T) {
+	for _, tc := range []struct {
+		url, domain string
+		want        bool
+	}{
+		{"http://127.0.0.1/", "127.0.0.1", true},
+		{"http://127.0.0.1:8080/", "127.0.0.1", true},
+		{"http://127.0.0.1/", "127.0.0.2", false},
+		{"http://[::1]:8080/", "::1", true},
+		{"http://[::1]:8080/", "[::1]", true},
+		{"http://[2001:db8::1]:8080/", "2001:DB8:0::1", true},
+		{"http://[::1]:8080/", "::2", false},
+	} {
+		strict := newTestJar()
+		rfc6265, _ := New(&Options{PublicSuffixList: testPSL{}, AllowIPCookies: true, StrictRFC6265: true})
+		relaxed, _ := New(&Options{PublicSuffixList: testPSL{}, AllowIPCookies: true})
+
+		u := mustParseURL(tc.url)
+		cookie := &http.Cookie{Name: "a", Value: "1", Domain: tc.domain}
+		strict.setCookies(u, []*http.Cookie{cookie}, tNow)
+		rfc6265.setCookies(u, []*http.Cookie{cookie}, tNow)
+		relaxed.setCookies(u, []*http.Cookie{cookie}, tNow)
+
+		if got := len(strict.cookies(u, tNow)); got != 0 {
+			t.Errorf("%s Domain=%s: default jar stored %d cookies", tc.url, tc.domain, got)
+		}
+		if got := len(rfc6265.cookies(u, tNow)); got != 0 {
+			t.Errorf("%s Domain=%s: StrictRFC6265 jar stored %d cookies", tc.url, tc.domain, got)
+		}
+		got := relaxed.cookiesDetailed(u, tNow)
+		if (len(got) == 1) != tc.want {
+			t.Errorf("%s Domain=%s: got %d cookies, want stored %t", tc.url, tc.domain, len(got), tc.want)
+		}
+		if len(got) == 1 && !got[0].HostOnly {
+			t.Errorf("%s Domain=%s: got domain cookie, want host-only", tc.url, tc.domain)
+		}
+	}
+}
+
+func TestMaxExpiryForHost(t *testing.T) {
+	jar, _ := New(&Options{
+		PublicSuffixList: testPSL{},
+		MaxExpiryForHost: func(host string) time.Duration {
+			if host == "tracker.analytics.test" {
+				return 24 * time.Hour
+			}
+			return 0
+		},
+	})
+
+	for _, tc := range []struct {
+		url    string
+		cookie *http.Cookie
+		want   time.Time
+	}{
+		{"http://tracker.analytics.test/", &http.Cookie{Name: "id", Value: "1", MaxAge: 86400 * 365}, tNow.Add(24 * time.Hour)},
+		{"http://tracker.analytics.test/x", &http.Cookie{Name: "id", Value: "1", Path: "/x", MaxAge: 60}, tNow.Add(time.Minute)},
+		{"http://www.host.test/", &http.Cookie{Name: "id", Value: "1", MaxAge: 86400 * 365}, tNow.Add(365 * 24 * time.Hour)},
+	} {
+		u := mustParseURL(tc.url)
+		jar.setCookies(u, []*http.Cookie{tc.cookie}, tNow)
+		cookies := jar.cookiesFull(u, tNow)
+		if len(cookies) == 0 {
+			t.Errorf("%s: no cookies", tc.url)
+			continue
+		}
+		if got := cookies[0].Expires; !got.Equal(tc.want) {
+			t.Errorf("%s: got Expires %v, want %v", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestToSetCookieHeader(t *testing.T) {
+	parse := func(header string) Entry {
+		cookies := (&http.Response{Header: http.Header{"Set-Cookie": {header}}}).Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("%q: got %d cookies, want 1", header, len(cookies))
+		}
+		e, _, err := NewEntry(cookies[0], tNow, "/dir", "www.host.test", "host.test", testPSL{})
+		if err != nil {
+			t.Fatalf("%q: %v", header, err)
+		}
+		return e
+	}
+
+	for _, tc := range []struct {
+		header, want string
+	}{
+		{"a=1", "a=1; Path=/dir"},
+		{"a=1; Domain=host.test; Path=/", "a=1; Path=/; Domain=.host.test"},
+		{"a=1; Max-Age=3600; Secure; HttpOnly", "a=1; Path=/dir; Expires=Tue, 01 Jan 2013 13:00:00 GMT; HttpOnly; Secure"},
+		{"a=1; Expires=Wed, 02 Jan 2013 12:00:00 GMT; SameSite=Strict", "a=1; Path=/dir; Expires=Wed, 02 Jan 2013 12:00:00 GMT; SameSite=Strict"},
+		{"a=x y; SameSite=Lax", `a="x y"; Path=/dir; SameSite=Lax`},
+	} {
+		e := parse(tc.header)
+		got := e.ToSetCookieHeader()
+		if got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.header, got, tc.want)
+		}
+		if back := parse(got); back != e {
+			t.Errorf("%q: round trip got %+v, want %+v", tc.header, back, e)
+		}
+	}
+}
+
+func TestSchemeSecurity(t *testing.T) {
+	jar, _ := New(&Options{
+		PublicSuffixList: testPSL{},
+		SchemeSecurity: func(scheme string) (allowed bool, secure bool) {
+			switch scheme {
+			case "app":
+				return true, true
+			case "http", "https":
+				return true, scheme == "https"
+			}
+			return false, false
+		},
+	})
+
+	jar.setCookies(mustParseURL("app://www.host.test/"), []*http.Cookie{
+		{Name: "secure", Value: "1", Secure: true},
+		{Name: "plain", Value: "2"},
+	}, tNow)
+	jar.setCookies(mustParseURL("ftp://www.host.test/"), []*http.Cookie{
+		{Name: "ftp", Value: "3"},
+	}, tNow)
+
+	for _, tc := range []struct {
+		url, want string
+	}{
+		{"app://www.host.test/", "plain secure"},
+		{"https://www.host.test/", "plain secure"},
+		{"http://www.host.test/", "plain"},
+		{"ftp://www.host.test/", ""},
+	} {
+		var s []string
+		for _, c := range jar.cookies(mustParseURL(tc.url), tNow) {
+			s = append(s, c.Name)
+		}
+		sort.Strings(s)
+		if got := strings.Join(s, " "); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestMaxCookieBytes(t *testing.T) {
+	large := &http.Cookie{Name: "large", Value: strings.Repeat("x", DefaultMaxCookieBytes)}
+	small := &http.Cookie{Name: "small", Value: "0123456789"}
+
+	for _, tc := range []struct {
+		max                  int
+		strict               bool
+		wantLarge, wantSmall bool
+	}{
+		{0, false, true, true},
+		{-1, false, true, true},
+		{DefaultMaxCookieBytes, false, false, true},
+		{10, false, false, false},
+		{0, true, false, true},
+		{10, true, false, false},
+	} {
+		jar, err := New(&Options{PublicSuffixList: testPSL{}, MaxCookieBytes: tc.max, StrictRFC6265: tc.strict})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, x := range []struct {
+			c    *http.Cookie
+			want bool
+		}{
+			{large, tc.wantLarge},
+			{small, tc.wantSmall},
+		} {
+			_, _, err := jar.newEntry(x.c, tNow, "/", "www.host.test", "host.test", "host.test")
+			if got := err == nil; got != x.want {
+				t.Errorf("MaxCookieBytes=%d strict=%t %s: got accepted %t, want %t", tc.max, tc.strict, x.c.Name, got, x.want)
+			}
+			if err != nil && err != ErrCookieTooLarge {
+				t.Errorf("MaxCookieBytes=%d strict=%t %s: got error %v, want %v", tc.max, tc.strict, x.c.Name, err, ErrCookieTooLarge)
+			}
+		}
+	}
+}
+
+func TestMaxDomainLength(t *testing.T) {
+	// Non-ASCII is malformed, but rejected by the length check first.
+	hostile := "." + strings.Repeat("\u00e9", DefaultMaxDomainLength)
+	longest := strings.Repeat("a.", DefaultMaxDomainLength/2-4) + "host.test"
+
+	if _, _, err := DomainAndType("www.host.test", hostile, nil); err != errDomainTooLong {
+		t.Errorf("got error %v, want %v", err, errDomainTooLong)
+	}
+	if _, _, err := DomainAndType("www.host.test", longest, nil); err != errIllegalDomain {
+		t.Errorf("%d bytes: got error %v, want %v", len(longest), err, errIllegalDomain)
+	}
+
+	for _, tc := range []struct {
+		max  int
+		c    *http.Cookie
+		want error
+	}{
+		{0, &http.Cookie{Name: "a", Domain: hostile}, errDomainTooLong},
+		{0, &http.Cookie{Name: "a", Domain: ".www.host.test"}, nil},
+		{10, &http.Cookie{Name: "a", Domain: ".www.host.test"}, errDomainTooLong},
+		{10, &http.Cookie{Name: "a", Domain: ".host.test"}, nil},
+		{-1, &http.Cookie{Name: "a", Domain: hostile}, errMalformedDomain},
+	} {
+		jar, err := New(&Options{PublicSuffixList: testPSL{}, MaxDomainLength: tc.max})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = jar.newEntry(tc.c, tNow, "/", "www.host.test", "host.test", "host.test")
+		if err != tc.want {
+			t.Errorf("MaxDomainLength=%d %.20q: got error %v, want %v", tc.max, tc.c.Domain, err, tc.want)
+		}
+	}
+}
+
+func TestAcceptCookieForContentType(t *testing.T) {
+	jar, err := New(&Options{
+		PublicSuffixList: testPSL{},
+		AcceptCookieForContentType: func(contentType string) bool {
+			mediaType, _, _ := mime.ParseMediaType(contentType)
+			return mediaType == "text/html"
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := mustParseURL("http://www.host.test/")
+	for _, tc := range []struct {
+		contentType, cookie string
+	}{
+		{"text/html; charset=utf-8", "document=1"},
+		{"image/gif", "pixel=1"},
+	} {
+		jar.setCookiesFromResponse(&http.Response{
+			Header: http.Header{
+				"Content-Type": {tc.contentType},
+				"Set-Cookie":   {tc.cookie},
+			},
+			Request: &http.Request{URL: u},
+		}, tNow)
+	}
+	jar.setCookiesFromResponse(&http.Response{Header: http.Header{"Set-Cookie": {"norequest=1"}}}, tNow)
+
+	var s []string
+	for _, c := range jar.cookies(u, tNow) {
+		s = append(s, c.Name+"="+c.Value)
+	}
+	if got, want := strings.Join(s, " "), "document=1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   string
+	}{
+		{"a=1", PriorityMedium},
+		{"a=1; Priority=Low", PriorityLow},
+		{"a=1; priority=HIGH", PriorityHigh},
+		{"a=1; Priority=Medium", PriorityMedium},
+		{"a=1; Priority=Urgent", PriorityMedium},
+		{"a=1; Priority=High; Priority=Low", PriorityLow},
+		{"a=1; Secure; Priority = High", PriorityHigh},
+	} {
+		cookies := (&http.Response{Header: http.Header{"Set-Cookie": {tc.header}}}).Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("%q: got %d cookies", tc.header, len(cookies))
+		}
+		if got := ParsePriority(cookies[0].Unparsed); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.header, got, tc.want)
+		}
+	}
+
+	e := Entry{Name: "a", Value: "1", Path: "/", HostOnly: true, Priority: PriorityLow}
+	if got, want := e.ToSetCookieHeader(), "a=1; Path=/; Priority=Low"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDomainCookieKey(t *testing.T) {
+	for _, tc := range []struct {
+		host, domain, wantKey string
+	}{
+		{"www.sub.host.test", "", "host.test"},
+		{"www.sub.host.test", "sub.host.test", "host.test"},
+		{"www.sub.host.test", ".host.test", "host.test"},
+		{"www.bbc.co.uk", "bbc.co.uk", "bbc.co.uk"},
+		// testPSL is broken for www.buggy.psl, making the host its own
+		// key, while the key of the Domain attribute is consistent.
+		{"www.buggy.psl", "", "www.buggy.psl"},
+		{"www.buggy.psl", "buggy.psl", "buggy.psl"},
+	} {
+		c := &http.Cookie{Name: "a", Value: "1", Domain: tc.domain}
+		e, _, err := NewEntry(c, tNow, "/", tc.host, JarKey(tc.host, testPSL{}), testPSL{})
+		if err != nil {
+			t.Errorf("%s %q: %v", tc.host, tc.domain, err)
+			continue
+		}
+		if e.Key != tc.wantKey {
+			t.Errorf("%s %q: got key %q, want %q", tc.host, tc.domain, e.Key, tc.wantKey)
+		}
+	}
+
+	// Lookups from the setting host search the key of the Domain attribute
+	// as well, along with the host's own key.
+	jar := newTestJar()
+	u := mustParseURL("http://www.buggy.psl/")
+	sibling := mustParseURL("http://other.buggy.psl/")
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "a", Value: "1", Domain: "buggy.psl"},
+		{Name: "b", Value: "2"},
+	}, tNow)
+	for _, tc := range []struct {
+		u    *url.URL
+		want string
+	}{
+		{u, "a=1 b=2"},
+		{sibling, "a=1"},
+	} {
+		var planned []*http.Cookie
+		for _, e := range jar.planSends([]*url.URL{tc.u}, tNow)[tc.u.String()] {
+			planned = append(planned, &http.Cookie{Name: e.Name, Value: e.Value})
+		}
+		for name, cookies := range map[string][]*http.Cookie{
+			"Cookies":     jar.cookies(tc.u, tNow),
+			"PeekCookies": jar.peekCookies(tc.u, tNow),
+			"PlanSends":   planned,
+		} {
+			var s []string
+			for _, c := range cookies {
+				s = append(s, c.Name+"="+c.Value)
+			}
+			sort.Strings(s)
+			if got := strings.Join(s, " "); got != tc.want {
+				t.Errorf("%s %s: got %q, want %q", name, tc.u, got, tc.want)
+			}
+		}
+	}
+
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Domain: "buggy.psl", MaxAge: -1}}, tNow)
+	if got := len(jar.cookies(sibling, tNow)); got != 0 {
+		t.Errorf("got %d cookies after removal, want 0", got)
+	}
+}
+
+func TestGetCookie(t *testing.T) {
+	jar := newTestJar()
+	u := mustParseURL("https://www.host.test/a/b")
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "a", Value: "root", Path: "/"},
+		{Name: "b", Value: "2"},
+	}, tNow)
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "domain", Domain: "host.test", Path: "/"}}, tNow.Add(time.Second))
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "deep", Path: "/a"}}, tNow.Add(2*time.Second))
+
+	for _, tc := range []struct {
+		url, name string
+		want      string
+		ok        bool
+	}{
+		{"https://www.host.test/a/b", "a", "deep", true},
+		{"https://www.host.test/", "a", "root", true},
+		{"https://other.host.test/", "a", "domain", true},
+		{"https://www.host.test/a/b", "b", "2", true},
+		{"https://www.host.test/a/b", "c", "", false},
+		{"ftp://www.host.test/a/b", "a", "", false},
+	} {
+		c, ok := jar.getCookie(mustParseURL(tc.url), tc.name, tNow.Add(3*time.Second))
+		if ok != tc.ok || ok && c.Value != tc.want {
+			t.Errorf("%s %s: got %v, %t, want %q, %t", tc.url, tc.name, c, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestCookieHeader(t *testing.T) {
+	jar := newTestJar()
+	u := mustParseURL("http://www.host.test/a/b")
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "a", Value: "1", Path: "/"},
+		{Name: "b", Value: "with space"},
+	}, tNow)
+	jar.setCookies(u, []*http.Cookie{{Name: "c", Value: "3", Path: "/"}}, tNow.Add(time.Second))
+
+	for _, tc := range []struct {
+		url, want string
+	}{
+		{"http://www.host.test/a/b", `b="with space"; a=1; c=3`},
+		{"http://www.host.test/", "a=1; c=3"},
+		{"http://www.other.test/", ""},
+		{"ftp://www.host.test/", ""},
+	} {
+		got := jar.cookieHeader(mustParseURL(tc.url), tNow.Add(time.Second))
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.url, got, tc.want)
+		}
+
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		for _, c := range jar.cookies(mustParseURL(tc.url), tNow.Add(time.Second)) {
+			req.AddCookie(c)
+		}
+		if want := req.Header.Get("Cookie"); got != want {
+			t.Errorf("%s: got %q, want %q as set by AddCookie", tc.url, got, want)
+		}
+	}
+}
+
+func TestCookiesIfChanged(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/")
+
+	cookies, gen, changed := jar.cookiesIfChanged(u, 0, tNow)
+	if !changed || len(cookies) != 0 || gen == 0 {
+		t.Fatalf("got %v, %d, %t for empty jar, want no cookies, non-zero generation, true", cookies, gen, changed)
+	}
+
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1"}, {Name: "b", Value: "2", MaxAge: 60}}, tNow)
+	cookies, gen2, changed := jar.cookiesIfChanged(u, gen, tNow)
+	if !changed || len(cookies) != 2 || gen2 <= gen {
+		t.Fatalf("got %v, %d, %t after set, want 2 cookies, generation above %d, true", cookies, gen2, changed, gen)
+	}
+
+	// Pure reads, updating last access times only, keep the generation.
+	jar.cookies(u, tNow.Add(time.Second))
+	storage.EntriesDump()
+	if cookies, gen3, changed := jar.cookiesIfChanged(u, gen2, tNow.Add(time.Second)); changed || cookies != nil || gen3 != gen2 {
+		t.Errorf("got %v, %d, %t after reads, want unchanged %d", cookies, gen3, changed, gen2)
+	}
+
+	jar.removeCookie(u, "a", tNow)
+	cookies, gen3, changed := jar.cookiesIfChanged(u, gen2, tNow.Add(time.Second))
+	if !changed || len(cookies) != 1 || gen3 <= gen2 {
+		t.Errorf("got %v, %d, %t after removal, want 1 cookie, generation above %d", cookies, gen3, changed, gen2)
+	}
+
+	// Removing expired cookies on lookup changes the generation.
+	jar.cookies(u, tNow.Add(time.Hour))
+	if _, gen4, changed := jar.cookiesIfChanged(u, gen3, tNow.Add(time.Hour)); !changed || gen4 <= gen3 {
+		t.Errorf("got %d, %t after expiration, want generation above %d", gen4, changed, gen3)
+	}
+
+	jar = newTestJar()
+	jar.storage = dumpOnlyStorage{NewInMemoryStorage()}
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1"}}, tNow)
+	if cookies, gen, changed := jar.cookiesIfChanged(u, 0, tNow); !changed || len(cookies) != 1 || gen != 0 {
+		t.Errorf("got %v, %d, %t without generations, want cookie, 0, true", cookies, gen, changed)
+	}
+}
+
+func TestStripTrailingDotDomain(t *testing.T) {
+	strict := newTestJar()
+	lenient, _ := New(&Options{PublicSuffixList: testPSL{}, StripTrailingDotDomain: true})
+
+	for _, tc := range []struct {
+		url, domain  string
+		wantStrict   bool
+		wantLenient  bool
+		wantHostOnly bool
+	}{
+		{"http://www.host.test/", "host.test.", false, true, false},
+		{"http://www.host.test./", "www.host.test.", false, true, false},
+		{"http://www.host.test/", ".host.test.", false, true, false},
+		{"http://www.host.test/", "host.test..", false, false, false},
+		{"http://www.host.test/", ".", false, false, false},
+		{"http://www.host.test/", "other.test.", false, false, false},
+		{"http://www.host.test/", "test.", false, false, false},
+	} {
+		for _, jar := range []*Jar{strict, lenient} {
+			want := tc.wantStrict
+			if jar == lenient {
+				want = tc.wantLenient
+			}
+
+			u := mustParseURL(tc.url)
+			host, err := jar.canonicalHost(u.Host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &http.Cookie{Name: "a", Value: "1", Domain: tc.domain}
+			e, _, err := jar.newEntry(c, tNow, "/", host, JarKey(host, testPSL{}), JarKey(host, testPSL{}))
+			if got := err == nil; got != want {
+				t.Errorf("%s %q strip=%t: got accepted %t (%v), want %t",
+					tc.url, tc.domain, jar.stripTrailingDotDomain, got, err, want)
+				continue
+			}
+			if err == nil && (e.HostOnly != tc.wantHostOnly || strings.HasSuffix(e.Domain, ".")) {
+				t.Errorf("%s %q: got domain %q host-only %t", tc.url, tc.domain, e.Domain, e.HostOnly)
+			}
+		}
+	}
+
+	u := mustParseURL("http://www.host.test/")
+	lenient.setCookies(u, []*http.Cookie{{Name: "a", Value: "1", Domain: "host.test."}}, tNow)
+	if got := len(lenient.cookies(mustParseURL("http://other.host.test./"), tNow)); got != 1 {
+		t.Errorf("got %d cookies for sibling host, want 1", got)
+	}
+}
+
+func TestPartitionedCookies(t *testing.T) {
+	jar := newTestJar()
+
+	embedded := mustParseURL("https://www.embed.test/frame")
+	siteA := mustParseURL("https://www.a.test/")
+	siteB := mustParseURL("https://b.test/")
+
+	setCookie := func(header string) *http.Cookie {
+		resp := http.Response{Header: http.Header{"Set-Cookie": {header}}}
+		return resp.Cookies()[0]
+	}
+
+	jar.setCookiesPartitioned(embedded, siteA, []*http.Cookie{
+		setCookie("p=a; Secure; Partitioned"),
+		setCookie("u=1; Secure"),
+	}, tNow)
+	jar.setCookiesPartitioned(embedded, siteB, []*http.Cookie{
+		setCookie("p=b; Secure; Partitioned"),
+		setCookie("insecure=1; Partitioned"),
+	}, tNow)
+	jar.setCookies(embedded, []*http.Cookie{setCookie("p=own; Secure; Partitioned")}, tNow)
+
+	for _, tc := range []struct {
+		topLevel *url.URL
+		want     string
+	}{
+		{siteA, "p=a u=1"},
+		{mustParseURL("https://other.a.test/"), "p=a u=1"},
+		{siteB, "p=b u=1"},
+		{mustParseURL("https://c.test/"), "u=1"},
+		{nil, "p=own u=1"},
+		{embedded, "p=own u=1"},
+	} {
+		var got []string
+		for _, c := range jar.cookiesPartitioned(embedded, tc.topLevel, tNow) {
+			got = append(got, c.Name+"="+c.Value)
+		}
+		sort.Strings(got)
+		if s := strings.Join(got, " "); s != tc.want {
+			t.Errorf("top-level %v: got %q, want %q", tc.topLevel, s, tc.want)
+		}
+	}
+
+	var got []string
+	for _, c := range jar.cookies(embedded, tNow) {
+		got = append(got, c.Name+"="+c.Value)
+	}
+	sort.Strings(got)
+	if s := strings.Join(got, " "); s != "p=own u=1" {
+		t.Errorf("Cookies: got %q, want %q", s, "p=own u=1")
+	}
+
+	jar.setCookiesPartitioned(embedded, siteA, []*http.Cookie{setCookie("p=; Max-Age=0; Secure; Partitioned")}, tNow)
+	if got := jar.cookiesPartitioned(embedded, siteA, tNow); len(got) != 1 || got[0].Name != "u" {
+		t.Errorf("after removal got %v, want only u", got)
+	}
+	if got := jar.cookiesPartitioned(embedded, siteB, tNow); len(got) != 2 {
+		t.Errorf("partition of b.test: got %v, want 2 cookies", got)
+	}
+}
+
+func TestIsPartitioned(t *testing.T) {
+	for _, tc := range []struct {
+		c    *http.Cookie
+		want bool
+	}{
+		{&http.Cookie{}, false},
+		{&http.Cookie{Unparsed: []string{"Partitioned"}}, true},
+		{&http.Cookie{Unparsed: []string{" partitioned "}}, true},
+		{&http.Cookie{Unparsed: []string{"Priority=High"}}, false},
+	} {
+		if got := IsPartitioned(tc.c); got != tc.want {
+			t.Errorf("%v: got %t, want %t", tc.c.Unparsed, got, tc.want)
+		}
+	}
+}
+
+func TestSetCookie(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage, Now: func() time.Time { return tNow }})
+	u := mustParseURL("https://www.host.test/")
+
+	jar.SetCookie(u, &http.Cookie{Name: "a", Value: "1", MaxAge: 60})
+	entries := storage.EntriesDump()
+	if len(entries) != 1 || !entries[0].Creation.Equal(tNow) ||
+		!entries[0].Expires.Equal(tNow.Add(time.Minute)) {
+		t.Fatalf("got entries %v, want a single one created at %v", entries, tNow)
+	}
+
+	jar.SetCookie(u, &http.Cookie{Name: "a", MaxAge: -1})
+	if got := storage.Len(); got != 0 {
+		t.Errorf("got %d entries after deletion, want 0", got)
+	}
+}
+
+func TestSetCookiesBatch(t *testing.T) {
+	// The embedding struct hides BatchWriter, testing the fallback.
+	for _, storage := range []Storage{NewInMemoryStorage(), NewShardedInMemoryStorage(4), struct{ Storage }{NewInMemoryStorage()}} {
+		observer := &recordingObserver{}
+		jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage, Observer: observer})
+		observer.jar = jar
+
+		jar.setCookiesBatch(map[*url.URL][]*http.Cookie{
+			mustParseURL("http://www.host.test/"): {
+				{Name: "a", Value: "1"},
+				{Name: "a", MaxAge: -1},
+				{Name: "b", Value: "2"},
+				{Name: "b", Value: "3"},
+			},
+			mustParseURL("http://www.other.test/"): {
+				{Name: "c", Value: "4"},
+			},
+			mustParseURL("ftp://www.host.test/"): {
+				{Name: "d", Value: "5"},
+			},
+		}, tNow)
+
+		for u, want := range map[string]string{
+			"http://www.host.test/":  "b=3",
+			"http://www.other.test/": "c=4",
+		} {
+			var s []string
+			for _, c := range jar.cookies(mustParseURL(u), tNow) {
+				s = append(s, c.String())
+			}
+			if got := strings.Join(s, " "); got != want {
+				t.Errorf("%T: got cookies %q for %s, want %q", storage, got, u, want)
+			}
+		}
+
+		want := "set a,remove www.host.test;/;a,set b,set b,set c"
+		if got := strings.Join(observer.events, ","); got != want {
+			t.Errorf("%T: got events %q, want %q", storage, got, want)
+		}
+	}
+}
+
+func TestValidateNameValueOption(t *testing.T) {
+	u := mustParseURL("http://www.host.test/")
+	cookies := []*http.Cookie{
+		{Name: "ok", Value: "1"},
+		{Name: "quoted", Value: `"2"`},
+		{Name: "bad name", Value: "3"},
+		{Name: "bad\x7fname", Value: "4"},
+		{Name: "comma", Value: "a,b"},
+		{Name: "semicolon", Value: "a;b"},
+		{Name: "space", Value: "a b"},
+	}
+
+	for _, tc := range []struct {
+		validate bool
+		want     string
+	}{
+		{false, `ok=1 quoted="2" bad name=3 bad` + "\x7f" + `name=4 comma=a,b semicolon=a;b space=a b`},
+		{true, `ok=1 quoted="2"`},
+	} {
+		jar, _ := New(&Options{PublicSuffixList: testPSL{}, ValidateNameValue: tc.validate})
+		jar.setCookies(u, cookies, tNow)
+
+		var s []string
+		for _, c := range jar.cookies(u, tNow) {
+			s = append(s, c.Name+"="+c.Value)
+		}
+		if got := strings.Join(s, " "); got != tc.want {
+			t.Errorf("validate %t: got %q, want %q", tc.validate, got, tc.want)
+		}
+	}
+
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, ValidateNameValue: true})
+	host := "www.host.test"
+	for _, tc := range []struct {
+		c       *http.Cookie
+		wantErr error
+	}{
+		{&http.Cookie{Name: "comma", Value: "a,b"}, errMalformedValue},
+		{&http.Cookie{Name: "bad name", Value: "1"}, errMalformedName},
+		{&http.Cookie{Name: "large", Value: strings.Repeat("x", 4000)}, nil},
+	} {
+		if _, _, err := jar.newEntry(tc.c, tNow, "/", host, "host.test", "host.test"); err != tc.wantErr {
+			t.Errorf("%q: got %v, want %v", tc.c.Name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestExportHeaders(t *testing.T) {
+	jar := newTestJar()
+	jar.setCookies(mustParseURL("http://www.host.test/a/b"), []*http.Cookie{
+		{Name: "a", Value: "1", Path: "/"},
+		{Name: "b", Value: "2"},
+	}, tNow)
+	jar.setCookies(mustParseURL("https://www.other.test/"), []*http.Cookie{{Name: "s", Value: "3", Secure: true}}, tNow)
+
+	var urls []*url.URL
+	for _, s := range []string{
+		"http://www.host.test/a/b",
+		"http://www.host.test/",
+		"https://www.other.test/",
+		"http://www.other.test/",
+		"http://www.none.test/",
+	} {
+		urls = append(urls, mustParseURL(s))
+	}
+
+	headers := jar.exportHeaders(urls, ExportOptions{IncludeHttpOnly: true, IncludeSecure: true}, tNow)
+	want := map[string]string{
+		"http://www.host.test/a/b": "b=2; a=1",
+		"http://www.host.test/":    "a=1",
+		"https://www.other.test/":  "s=3",
+		"http://www.other.test/":   "",
+		"http://www.none.test/":    "",
+	}
+	if len(headers) != len(want) {
+		t.Errorf("got %d headers, want %d", len(headers), len(want))
+	}
+	for _, u := range urls {
+		got, ok := headers[u.String()]
+		if !ok || got != want[u.String()] {
+			t.Errorf("%s: got %q, %t, want %q", u, got, ok, want[u.String()])
+		}
+
+		var s []string
+		for _, c := range jar.cookies(u, tNow) {
+			s = append(s, c.String())
+		}
+		if cookies := strings.Join(s, "; "); got != cookies {
+			t.Errorf("%s: got %q, want %q as returned by Cookies", u, got, cookies)
+		}
+	}
+}
+
+func TestAcceptCookieWithJar(t *testing.T) {
+	jar, _ := New(&Options{
+		PublicSuffixList: testPSL{},
+		Now:              func() time.Time { return tNow },
+		AcceptCookieWithJar: func(j *Jar, u *url.URL, c *http.Cookie) bool {
+			if c.Name == "consent" {
+				return true
+			}
+			_, ok := j.GetCookie(u, "consent")
+			return ok
+		},
+	})
+
+	names := func(u *url.URL) string {
+		var s []string
+		for _, c := range jar.cookies(u, tNow) {
+			s = append(s, c.Name)
+		}
+		return strings.Join(s, " ")
+	}
+
+	u := mustParseURL("http://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{{Name: "tracking", Value: "1"}}, tNow)
+	if got := names(u); got != "" {
+		t.Errorf("without consent: got %q, want no cookies", got)
+	}
+
+	// Cookies are decided in order, seeing the ones accepted before.
+	jar.setCookies(u, []*http.Cookie{{Name: "consent", Value: "yes"}, {Name: "tracking", Value: "1"}}, tNow)
+	if got, want := names(u), "consent tracking"; got != want {
+		t.Errorf("with consent: got %q, want %q", got, want)
+	}
+
+	other := mustParseURL("http://www.other.test/")
+	jar.setCookies(other, []*http.Cookie{{Name: "tracking", Value: "1"}}, tNow)
+	if got := names(other); got != "" {
+		t.Errorf("other domain: got %q, want no cookies", got)
+	}
+}
+
+func TestPublicSuffixHostDomainCookie(t *testing.T) {
+	// testPSL treats the last label as public suffix, like a list aware of
+	// the top-level domain "corp", but unaware of an internal suffix
+	// "app.corp" owned by the host of the same name.
+	corp := mustParseURL("http://corp/")
+	app := mustParseURL("http://app.corp/")
+	www := mustParseURL("http://www.app.corp/")
+	other := mustParseURL("http://other.corp/")
+
+	for _, tc := range []struct {
+		exceptions []string
+		want       map[*url.URL]string
+	}{
+		{nil, map[*url.URL]string{corp: "own=1", app: "app=2", www: "app=2", other: ""}},
+		{[]string{".APP.corp"}, map[*url.URL]string{corp: "own=1", app: "app=2", www: "", other: ""}},
+	} {
+		jar, _ := New(&Options{PublicSuffixList: testPSL{}, AdditionalPublicSuffixExceptions: tc.exceptions})
+		jar.setCookies(corp, []*http.Cookie{{Name: "own", Value: "1", Domain: "corp"}}, tNow)
+		jar.setCookies(app, []*http.Cookie{
+			{Name: "app", Value: "2", Domain: "app.corp"},
+			{Name: "suffix", Value: "3", Domain: ".corp"},
+		}, tNow)
+
+		for u, want := range tc.want {
+			var s []string
+			for _, c := range jar.cookies(u, tNow) {
+				s = append(s, c.Name+"="+c.Value)
+			}
+			sort.Strings(s)
+			if got := strings.Join(s, " "); got != want {
+				t.Errorf("%q %s: got %q, want %q", tc.exceptions, u, got, want)
+			}
+		}
+
+		e, _, err := jar.newEntry(&http.Cookie{Name: "own", Value: "1", Domain: "corp"}, tNow, "/", "corp", "corp", "corp")
+		if err != nil || !e.HostOnly {
+			t.Errorf("%q: got host-only %t, error %v, want a host-only entry", tc.exceptions, e.HostOnly, err)
+		}
+	}
+}
+
+func TestRootDefaultPath(t *testing.T) {
+	u := mustParseURL("http://www.host.test/a/b/c")
+	for _, tc := range []struct {
+		rootDefaultPath bool
+		wantPath        string
+		want            map[string]string
+	}{
+		{false, "/a/b", map[string]string{"/": "", "/a/b": "a=1", "/a/b/d": "a=1", "/x": ""}},
+		{true, "/", map[string]string{"/": "a=1", "/a/b": "a=1", "/a/b/d": "a=1", "/x": "a=1"}},
+	} {
+		storage := NewInMemoryStorage()
+		jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage, RootDefaultPath: tc.rootDefaultPath})
+		jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1"}, {Name: "b", Value: "2", Path: "/a"}}, tNow)
+
+		for _, e := range storage.EntriesDump() {
+			want := tc.wantPath
+			if e.Name == "b" {
+				want = "/a"
+			}
+			if e.Path != want {
+				t.Errorf("root %t: cookie %s got path %q, want %q", tc.rootDefaultPath, e.Name, e.Path, want)
+			}
+		}
+
+		for path, want := range tc.want {
+			got := ""
+			if c, ok := jar.getCookie(mustParseURL("http://www.host.test"+path), "a", tNow); ok {
+				got = c.Name + "=" + c.Value
+			}
+			if got != want {
+				t.Errorf("root %t: %s got %q, want %q", tc.rootDefaultPath, path, got, want)
+			}
+		}
+	}
+}
+
+func TestEntryExpiredTTL(t *testing.T) {
+	for _, tc := range []struct {
+		e           Entry
+		wantExpired bool
+		wantTTL     time.Duration
+	}{
+		{Entry{Expires: endOfTime}, false, SessionTTL},
+		{Entry{Expires: tNow.Add(-time.Hour)}, false, SessionTTL},
+		{Entry{Persistent: true, Expires: tNow.Add(time.Hour)}, false, time.Hour},
+		{Entry{Persistent: true, Expires: tNow}, true, 0},
+		{Entry{Persistent: true, Expires: tNow.Add(-time.Hour)}, true, 0},
+	} {
+		if got := tc.e.Expired(tNow); got != tc.wantExpired {
+			t.Errorf("%+v: got expired %t, want %t", tc.e, got, tc.wantExpired)
+		}
+		if got := tc.e.TTL(tNow); got != tc.wantTTL {
+			t.Errorf("%+v: got TTL %v, want %v", tc.e, got, tc.wantTTL)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package cookiejarx
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// jsonEntry is the JSON representation of Entry, with timestamps encoded as
+// RFC 3339 strings in UTC.
+type jsonEntry struct {
+	Name         string
+	Value        string
+	Domain       string
+	Path         string
+	SameSite     string
+	Key          string
+	ID           string
+	Secure       bool
+	HttpOnly     bool
+	Persistent   bool
+	HostOnly     bool
+	Expires      string
+	Creation     string
+	LastAccess   string
+	LastModified string
+	Priority     string `json:",omitempty"`
+	Partitioned  bool   `json:",omitempty"`
+	PartitionKey string `json:",omitempty"`
+	SendCount    uint64 `json:",omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. Expires, Creation, LastAccess and
+// LastModified are encoded as RFC 3339 strings in UTC with sub-second precision.
+func (e Entry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonEntry{
+		Name:         e.Name,
+		Value:        e.Value,
+		Domain:       e.Domain,
+		Path:         e.Path,
+		SameSite:     e.SameSite,
+		Key:          e.Key,
+		ID:           e.ID,
+		Secure:       e.Secure,
+		HttpOnly:     e.HttpOnly,
+		Persistent:   e.Persistent,
+		HostOnly:     e.HostOnly,
+		Expires:      formatJSONTime(e.Expires),
+		Creation:     formatJSONTime(e.Creation),
+		LastAccess:   formatJSONTime(e.LastAccess),
+		LastModified: formatJSONTime(e.LastModified),
+		Priority:     e.Priority,
+		Partitioned:  e.Partitioned,
+		PartitionKey: e.PartitionKey,
+		SendCount:    e.SendCount,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	var je jsonEntry
+	if err := json.Unmarshal(data, &je); err != nil {
+		return err
+	}
+
+	expires, err := parseJSONTime(je.Expires)
+	if err != nil {
+		return err
+	}
+	creation, err := parseJSONTime(je.Creation)
+	if err != nil {
+		return err
+	}
+	lastAccess, err := parseJSONTime(je.LastAccess)
+	if err != nil {
+		return err
+	}
+	lastModified, err := parseJSONTime(je.LastModified)
+	if err != nil {
+		return err
+	}
+
+	*e = Entry{
+		Name:         je.Name,
+		Value:        je.Value,
+		Domain:       je.Domain,
+		Path:         je.Path,
+		SameSite:     je.SameSite,
+		Key:          je.Key,
+		ID:           je.ID,
+		Secure:       je.Secure,
+		HttpOnly:     je.HttpOnly,
+		Persistent:   je.Persistent,
+		HostOnly:     je.HostOnly,
+		Expires:      expires,
+		Creation:     creation,
+		LastAccess:   lastAccess,
+		LastModified: lastModified,
+		Priority:     je.Priority,
+		Partitioned:  je.Partitioned,
+		PartitionKey: je.PartitionKey,
+		SendCount:    je.SendCount,
+	}
+
+	return nil
+}
+
+// formatJSONTime formats t as RFC 3339 string in UTC, the zero time being
+// encoded as an empty string.
+func formatJSONTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// parseJSONTime is the inverse of formatJSONTime.
+func parseJSONTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// jsonInMemoryStorage is the JSON representation of InMemoryStorage.
+type jsonInMemoryStorage struct {
+	NextSeqNum uint64
+	Entries    map[string]map[string]jsonInMemoryEntry
+}
+
+// jsonInMemoryEntry is the JSON representation of inMemoryEntry.
+type jsonInMemoryEntry struct {
+	SeqNum uint64
+	Score  float64 `json:",omitempty"`
+	Entry  *Entry
+}
+
+// MarshalJSON implements json.Marshaler. The snapshot includes entry sequence
+// numbers, so that cookie ordering is preserved by UnmarshalJSON, and decayed
+// use scores, see DecayHalfLife.
+func (s *InMemoryStorage) MarshalJSON() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	js := jsonInMemoryStorage{
+		NextSeqNum: s.nextSeqNum,
+		Entries:    make(map[string]map[string]jsonInMemoryEntry, len(s.entries)),
+	}
+
+	for key, submap := range s.entries {
+		jsubmap := make(map[string]jsonInMemoryEntry, len(submap))
+		for id, e := range submap {
+			jsubmap[id] = jsonInMemoryEntry{SeqNum: e.seqNum, Score: e.score, Entry: e.Entry}
+		}
+		js.Entries[key] = jsubmap
+	}
+
+	return json.Marshal(js)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, replacing the storage contents
+// with the snapshot produced by MarshalJSON.
+func (s *InMemoryStorage) UnmarshalJSON(data []byte) error {
+	var js jsonInMemoryStorage
+	if err := json.Unmarshal(data, &js); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = make(map[string]map[string]inMemoryEntry, len(js.Entries))
+	s.keyUsed = make(map[string]uint64, len(js.Entries))
+	s.nextSeqNum = js.NextSeqNum
+	s.generation++
+
+	for key, jsubmap := range js.Entries {
+		submap := make(map[string]inMemoryEntry, len(jsubmap))
+		for id, je := range jsubmap {
+			if je.Entry == nil || !s.acceptImport(je.Entry) {
+				continue
+			}
+			submap[id] = inMemoryEntry{Entry: je.Entry, seqNum: je.SeqNum, score: je.Score}
+		}
+		if len(submap) > 0 {
+			s.entries[key] = submap
+		}
+	}
+
+	s.rebuildNames()
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package cookiejarx
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEntryJSON(t *testing.T) {
+	loc := time.FixedZone("test", 3*3600)
+	e := Entry{
+		Name:         "a",
+		Value:        "1",
+		Domain:       "host.test",
+		Path:         "/",
+		SameSite:     "SameSite=Lax",
+		Key:          "host.test",
+		ID:           "host.test;/;a",
+		Expires:      endOfTime,
+		Creation:     tNow.In(loc).Add(123 * time.Nanosecond),
+		LastAccess:   tNow.Add(time.Second),
+		LastModified: tNow.Add(time.Minute),
+		Priority:     PriorityHigh,
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`"Expires":"9999-12-31T23:59:59Z"`,
+		`"Creation":"2013-01-01T12:00:00.000000123Z"`,
+		`"LastAccess":"2013-01-01T12:00:01Z"`,
+		`"LastModified":"2013-01-01T12:01:00Z"`,
+		`"SameSite":"SameSite=Lax"`,
+	} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("got %s, missing %s", data, s)
+		}
+	}
+
+	var got Entry
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Expires.Equal(endOfTime) || !got.Creation.Equal(e.Creation) || !got.LastAccess.Equal(e.LastAccess) ||
+		!got.LastModified.Equal(e.LastModified) {
+		t.Errorf("got %+v, want times of %+v", got, e)
+	}
+	got.Expires, got.Creation, got.LastAccess = e.Expires, e.Creation, e.LastAccess
+	got.LastModified = e.LastModified
+	if got != e {
+		t.Errorf("got %+v, want %+v", got, e)
+	}
+}
+
+func TestInMemoryStorageJSON(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/")
+	for _, name := range []string{"c", "a", "d", "b"} {
+		jar.setCookies(u, []*http.Cookie{{Name: name, Value: name}}, tNow)
+	}
+	jar.setCookies(mustParseURL("http://www.other.test/"), []*http.Cookie{{Name: "x", MaxAge: 60}}, tNow)
+
+	data, err := json.Marshal(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewInMemoryStorage()
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.nextSeqNum != storage.nextSeqNum {
+		t.Errorf("got nextSeqNum %d, want %d", restored.nextSeqNum, storage.nextSeqNum)
+	}
+
+	restoredJar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: restored})
+	var s []string
+	for _, c := range restoredJar.cookies(u, tNow) {
+		s = append(s, c.Name)
+	}
+	if got, want := strings.Join(s, " "), "c a d b"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := len(restored.EntriesDump()); got != 5 {
+		t.Errorf("got %d entries, want 5", got)
+	}
+}
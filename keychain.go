@@ -0,0 +1,228 @@
+package cookiejarx
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrSecretNotFound is returned by SecretStore.Get when no secret is stored
+// for the service and account.
+var ErrSecretNotFound = errors.New("cookiejar: secret not found")
+
+var errNoSecretStore = errors.New("cookiejar: no secret store available on this platform")
+
+// SecretStore is a store of secrets identified by a service and an account
+// name, such as the macOS Keychain, the Windows Credential Manager or a
+// Secret Service implementation over libsecret. See DefaultSecretStore.
+type SecretStore interface {
+	// Set stores secret for service and account, replacing any previous
+	// secret.
+	Set(service, account string, secret []byte) error
+
+	// Get returns the secret stored for service and account, or
+	// ErrSecretNotFound if there is none.
+	Get(service, account string) ([]byte, error)
+
+	// Delete removes the secret stored for service and account. Deleting a
+	// missing secret is not an error.
+	Delete(service, account string) error
+}
+
+// DefaultSecretStore returns the secret store of the operating system: the
+// Keychain on macOS, the Credential Manager on Windows and the Secret Service
+// on Linux. On other platforms an error is returned, so that callers can fall
+// back to a plain Storage.
+func DefaultSecretStore() (SecretStore, error) {
+	return defaultSecretStore()
+}
+
+// KeychainStorage is a Storage decorator keeping cookie values in a
+// SecretStore, while the remaining entry attributes are kept in the
+// underlying Storage with an empty Value. It keeps e.g. authentication cookies
+// of desktop applications out of plaintext files.
+//
+// Secrets are stored under the storage's service with the entry key and ID as
+// the account. Entries whose secret cannot be read are not returned.
+//
+// Secrets are deleted by RemoveEntry, while entries the underlying storage
+// drops by itself, such as expired or evicted ones, leave their secrets behind
+// until Sweep is called.
+//
+// Storage methods cannot return errors, the most recent one is reported by Err.
+type KeychainStorage struct {
+	inner Storage
+
+	secrets SecretStore
+
+	service string
+
+	// mu guards the remaining fields.
+	mu sync.Mutex
+
+	// err is the error of the most recent failed secret store call.
+	err error
+
+	// accounts maps the accounts of stored secrets to the value of seq when
+	// they were stored.
+	accounts map[string]uint64
+
+	// seq is incremented on every stored secret.
+	seq uint64
+}
+
+// NewKeychainStorage returns a KeychainStorage keeping entries in inner and
+// their values in secrets under service, which should identify the
+// application. If inner implements Dumper, the secrets of its entries are
+// subject to Sweep.
+func NewKeychainStorage(inner Storage, secrets SecretStore, service string) *KeychainStorage {
+	s := &KeychainStorage{
+		inner:    inner,
+		secrets:  secrets,
+		service:  service,
+		accounts: make(map[string]uint64),
+	}
+
+	if dumper, ok := inner.(Dumper); ok {
+		for _, e := range dumper.EntriesDump() {
+			s.accounts[keychainAccount(e.Key, e.ID)] = 0
+		}
+	}
+
+	return s
+}
+
+// SaveEntry implementation of Storage.SaveEntry. The entry is not saved if
+// its value cannot be stored.
+func (s *KeychainStorage) SaveEntry(entry *Entry) {
+	account := keychainAccount(entry.Key, entry.ID)
+	err := s.secrets.Set(s.service, account, []byte(entry.Value))
+	s.setErr(err)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.seq++
+	s.accounts[account] = s.seq
+	s.mu.Unlock()
+
+	e := *entry
+	e.Value = ""
+	s.inner.SaveEntry(&e)
+}
+
+// RemoveEntry implementation of Storage.RemoveEntry.
+func (s *KeychainStorage) RemoveEntry(key, id string) {
+	s.inner.RemoveEntry(key, id)
+
+	account := keychainAccount(key, id)
+	s.mu.Lock()
+	delete(s.accounts, account)
+	s.mu.Unlock()
+
+	s.setErr(s.secrets.Delete(s.service, account))
+}
+
+// Entries implementation of Storage.Entries, returning copies of the entries
+// of the underlying storage with their values read from the secret store.
+func (s *KeychainStorage) Entries(https bool, host, path, key string, now time.Time) (entries []*Entry) {
+	return s.withValues(s.inner.Entries(https, host, path, key, now))
+}
+
+// EntriesDump implements Dumper if the underlying storage does, returning
+// nothing otherwise.
+func (s *KeychainStorage) EntriesDump() (entries []*Entry) {
+	dumper, ok := s.inner.(Dumper)
+	if !ok {
+		return nil
+	}
+	return s.withValues(dumper.EntriesDump())
+}
+
+// withValues returns copies of entries with values read from the secret
+// store, dropping entries whose value cannot be read.
+func (s *KeychainStorage) withValues(entries []*Entry) []*Entry {
+	var err error
+	result := make([]*Entry, 0, len(entries))
+	for _, entry := range entries {
+		value, getErr := s.secrets.Get(s.service, keychainAccount(entry.Key, entry.ID))
+		if getErr != nil {
+			err = getErr
+			continue
+		}
+
+		e := *entry
+		e.Value = string(value)
+		result = append(result, &e)
+	}
+
+	s.setErr(err)
+
+	return result
+}
+
+// Sweep deletes the secrets of entries no longer held by the underlying
+// storage, or expired, such as entries it evicted. It should be called
+// periodically, e.g. along InMemoryStorage.StartSweeper. Secrets of entries
+// dropped before NewKeychainStorage are not known and kept. It does nothing if
+// the underlying storage does not implement Dumper.
+func (s *KeychainStorage) Sweep() {
+	dumper, ok := s.inner.(Dumper)
+	if !ok {
+		return
+	}
+
+	// Secrets stored while dumping are kept, their entries may be missing
+	// from the dump.
+	s.mu.Lock()
+	seq := s.seq
+	s.mu.Unlock()
+
+	now := time.Now()
+	live := make(map[string]bool)
+	for _, e := range dumper.EntriesDump() {
+		if !e.Expired(now) {
+			live[keychainAccount(e.Key, e.ID)] = true
+		}
+	}
+
+	var stale []string
+	s.mu.Lock()
+	for account, stored := range s.accounts {
+		if stored <= seq && !live[account] {
+			stale = append(stale, account)
+			delete(s.accounts, account)
+		}
+	}
+	s.mu.Unlock()
+
+	var err error
+	for _, account := range stale {
+		if deleteErr := s.secrets.Delete(s.service, account); deleteErr != nil {
+			err = deleteErr
+		}
+	}
+	s.setErr(err)
+}
+
+// Err returns the error of the most recent failed secret store call, or nil if
+// the most recent call succeeded.
+func (s *KeychainStorage) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *KeychainStorage) setErr(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// keychainAccount returns the secret store account of the entry with key and
+// id.
+func keychainAccount(key, id string) string {
+	return key + "|" + id
+}
@@ -0,0 +1,75 @@
+package cookiejarx
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+var errSecurityLineBreak = errors.New("cookiejar: keychain service and account must not contain line breaks")
+
+// securityItemNotFound is the exit code of the security command for missing
+// keychain items, errSecItemNotFound.
+const securityItemNotFound = 44
+
+// securityPath is the path of the security command managing keychains.
+const securityPath = "/usr/bin/security"
+
+// keychainStore is a SecretStore using generic password items of the default
+// macOS keychain through the security command.
+type keychainStore struct{}
+
+func defaultSecretStore() (SecretStore, error) {
+	return keychainStore{}, nil
+}
+
+// Set stores secret. The security command is run interactively, reading the
+// command with the hex encoded secret from its input rather than taking the
+// secret as an argument, which would be visible in the process list.
+func (keychainStore) Set(service, account string, secret []byte) error {
+	if strings.ContainsAny(service, "\r\n") || strings.ContainsAny(account, "\r\n") {
+		return errSecurityLineBreak
+	}
+
+	command := "add-generic-password -U -s " + securityQuote(service) + " -a " + securityQuote(account) +
+		" -X " + hex.EncodeToString(secret) + "\n"
+	_, errOut, code, err := runSecretCommand([]byte(command), securityPath, "-i")
+	if err != nil {
+		return err
+	}
+	// Interactive commands may report failures on the error output only.
+	if code != 0 || len(strings.TrimSpace(string(errOut))) > 0 {
+		return secretCommandError("security add-generic-password", code, errOut)
+	}
+	return nil
+}
+
+// securityQuote quotes s as an argument of an interactive security command.
+func securityQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+func (keychainStore) Get(service, account string) ([]byte, error) {
+	out, errOut, code, err := runSecretCommand(nil, securityPath, "find-generic-password", "-s", service, "-a", account, "-w")
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case 0:
+		return trimSecretOutput(out), nil
+	case securityItemNotFound:
+		return nil, ErrSecretNotFound
+	}
+	return nil, secretCommandError("security find-generic-password", code, errOut)
+}
+
+func (keychainStore) Delete(service, account string) error {
+	_, errOut, code, err := runSecretCommand(nil, securityPath, "delete-generic-password", "-s", service, "-a", account)
+	if err != nil {
+		return err
+	}
+	if code != 0 && code != securityItemNotFound {
+		return secretCommandError("security delete-generic-password", code, errOut)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package cookiejarx
+
+import (
+	"os/exec"
+)
+
+// secretToolNotFound is the exit code of secret-tool lookup for missing
+// secrets. Failures, e.g. of a locked keyring or of D-Bus, exit with the same
+// code but report an error message.
+const secretToolNotFound = 1
+
+// secretToolStore is a SecretStore using the Secret Service, e.g. GNOME
+// Keyring or KWallet, through the secret-tool command of libsecret.
+type secretToolStore struct {
+	path string
+}
+
+func defaultSecretStore() (SecretStore, error) {
+	path, err := exec.LookPath("secret-tool")
+	if err != nil {
+		return nil, errNoSecretStore
+	}
+	return secretToolStore{path: path}, nil
+}
+
+func (s secretToolStore) Set(service, account string, secret []byte) error {
+	_, errOut, code, err := runSecretCommand(secret, s.path, "store", "--label="+service+" "+account,
+		"service", service, "account", account)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return secretCommandError("secret-tool store", code, errOut)
+	}
+	return nil
+}
+
+func (s secretToolStore) Get(service, account string) ([]byte, error) {
+	out, errOut, code, err := runSecretCommand(nil, s.path, "lookup", "service", service, "account", account)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case code == 0:
+		return trimSecretOutput(out), nil
+	case code == secretToolNotFound && len(errOut) == 0:
+		return nil, ErrSecretNotFound
+	}
+	return nil, secretCommandError("secret-tool lookup", code, errOut)
+}
+
+func (s secretToolStore) Delete(service, account string) error {
+	// Clearing missing secrets succeeds.
+	_, errOut, code, err := runSecretCommand(nil, s.path, "clear", "service", service, "account", account)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return secretCommandError("secret-tool clear", code, errOut)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !darwin && !linux && !windows
+// +build !darwin,!linux,!windows
+
+package cookiejarx
+
+func defaultSecretStore() (SecretStore, error) {
+	return nil, errNoSecretStore
+}
@@ -0,0 +1,136 @@
+package cookiejarx
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// mapSecretStore is an in-memory SecretStore, optionally failing all calls.
+type mapSecretStore struct {
+	secrets map[string]string
+	err     error
+}
+
+func (s *mapSecretStore) Set(service, account string, secret []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.secrets[service+"/"+account] = string(secret)
+	return nil
+}
+
+func (s *mapSecretStore) Get(service, account string) ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	secret, ok := s.secrets[service+"/"+account]
+	if !ok {
+		return nil, ErrSecretNotFound
+	}
+	return []byte(secret), nil
+}
+
+func (s *mapSecretStore) Delete(service, account string) error {
+	if s.err != nil {
+		return s.err
+	}
+	delete(s.secrets, service+"/"+account)
+	return nil
+}
+
+func TestKeychainStorage(t *testing.T) {
+	inner := NewInMemoryStorage()
+	secrets := &mapSecretStore{secrets: make(map[string]string)}
+	storage := NewKeychainStorage(inner, secrets, "app")
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+
+	u := mustParseURL("http://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{{Name: "session", Value: "secret"}, {Name: "b", Value: "2"}}, tNow)
+
+	for _, e := range inner.EntriesDump() {
+		if e.Value != "" {
+			t.Errorf("got plaintext value %q in underlying storage", e.Value)
+		}
+	}
+	if got, want := secrets.secrets["app/host.test|www.host.test;/;session"], "secret"; got != want {
+		t.Errorf("got secret %q, want %q", got, want)
+	}
+
+	query := func() string {
+		var s []string
+		for _, c := range jar.cookies(u, tNow) {
+			s = append(s, c.Name+"="+c.Value)
+		}
+		return strings.Join(s, " ")
+	}
+	if got, want := query(), "session=secret b=2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := len(storage.EntriesDump()); got != 2 {
+		t.Errorf("got %d dumped entries, want 2", got)
+	}
+
+	jar.setCookies(u, []*http.Cookie{{Name: "b", MaxAge: -1}}, tNow)
+	if len(secrets.secrets) != 1 {
+		t.Errorf("got secrets %v after removal, want 1", secrets.secrets)
+	}
+
+	// Entries whose secret is missing are dropped.
+	secrets.secrets = make(map[string]string)
+	if got := query(); got != "" {
+		t.Errorf("got %q without secrets, want none", got)
+	}
+	if err := storage.Err(); err != ErrSecretNotFound {
+		t.Errorf("got error %v, want %v", err, ErrSecretNotFound)
+	}
+
+	// Entries whose value cannot be stored are not saved.
+	secrets.err = errors.New("locked")
+	jar.setCookies(u, []*http.Cookie{{Name: "c", Value: "3"}}, tNow)
+	if err := storage.Err(); err != secrets.err {
+		t.Errorf("got error %v, want %v", err, secrets.err)
+	}
+	if got := len(inner.EntriesDump()); got != 1 {
+		t.Errorf("got %d entries, want unsaveable entry dropped", got)
+	}
+}
+
+func TestDefaultSecretStore(t *testing.T) {
+	store, err := DefaultSecretStore()
+	if err != nil {
+		if err != errNoSecretStore {
+			t.Fatalf("got error %v, want %v", err, errNoSecretStore)
+		}
+		t.Skip("no secret store available")
+	}
+	if store == nil {
+		t.Fatal("got nil secret store")
+	}
+}
+
+func TestKeychainStorageSweep(t *testing.T) {
+	inner := NewInMemoryStorage()
+	inner.MaxEntriesPerKey = 1
+	secrets := &mapSecretStore{secrets: make(map[string]string)}
+	inner.SaveEntry(&Entry{Name: "old", Key: "host.test", ID: "host.test;/;old", Domain: "host.test", Path: "/", HostOnly: true, Expires: endOfTime})
+	secrets.secrets["app/host.test|host.test;/;old"] = "1"
+
+	storage := NewKeychainStorage(inner, secrets, "app")
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+
+	// Evicting old and expiring a leave secrets behind until swept.
+	u := mustParseURL("http://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1", MaxAge: 60}}, tNow)
+	jar.setCookies(mustParseURL("http://www.other.test/"), []*http.Cookie{{Name: "b", Value: "2"}}, tNow)
+	if got := len(secrets.secrets); got != 3 {
+		t.Fatalf("got %d secrets before Sweep, want 3", got)
+	}
+
+	// a expired long before the current time Sweep uses.
+	storage.Sweep()
+	if _, ok := secrets.secrets["app/other.test|www.other.test;/;b"]; !ok || len(secrets.secrets) != 1 {
+		t.Errorf("got secrets %v after Sweep, want only b", secrets.secrets)
+	}
+}
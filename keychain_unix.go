@@ -0,0 +1,50 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package cookiejarx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// runSecretCommand runs the command line tool of a secret store with stdin as
+// its input and returns its output, its error output and exit code. A non-zero
+// exit code is not an error, it is left to the caller to interpret.
+func runSecretCommand(stdin []byte, name string, args ...string) (out, errOut []byte, code int, err error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err = cmd.Output()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return out, stderr.Bytes(), exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return out, stderr.Bytes(), 0, nil
+}
+
+// secretCommandError returns the error of a secret store command which failed
+// with exit code and error output errOut.
+func secretCommandError(name string, code int, errOut []byte) error {
+	if msg := strings.TrimSpace(string(errOut)); msg != "" {
+		return fmt.Errorf("cookiejar: %s failed with exit code %d: %s", name, code, msg)
+	}
+	return fmt.Errorf("cookiejar: %s failed with exit code %d", name, code)
+}
+
+// trimSecretOutput removes the line break terminating the output of a secret
+// store command.
+func trimSecretOutput(out []byte) []byte {
+	return []byte(strings.TrimSuffix(strings.TrimSuffix(string(out), "\n"), "\r"))
+}
@@ -0,0 +1,119 @@
+package cookiejarx
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Credential Manager constants of wincred.h and winerror.h.
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+	errorNotFound           = syscall.Errno(1168)
+)
+
+var (
+	advapi32        = syscall.NewLazyDLL("advapi32.dll")
+	procCredWriteW  = advapi32.NewProc("CredWriteW")
+	procCredReadW   = advapi32.NewProc("CredReadW")
+	procCredDeleteW = advapi32.NewProc("CredDeleteW")
+	procCredFree    = advapi32.NewProc("CredFree")
+)
+
+// credential is the CREDENTIALW structure of wincred.h.
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// credentialStore is a SecretStore using generic credentials of the Windows
+// Credential Manager. Credential blobs are limited to 2560 bytes, so longer
+// cookie values cannot be stored.
+type credentialStore struct{}
+
+func defaultSecretStore() (SecretStore, error) {
+	if err := advapi32.Load(); err != nil {
+		return nil, errNoSecretStore
+	}
+	return credentialStore{}, nil
+}
+
+// credentialTarget returns the target name of the credential of service and
+// account.
+func credentialTarget(service, account string) (*uint16, error) {
+	return syscall.UTF16PtrFromString(service + ":" + account)
+}
+
+func (credentialStore) Set(service, account string, secret []byte) error {
+	target, err := credentialTarget(service, account)
+	if err != nil {
+		return err
+	}
+	user, err := syscall.UTF16PtrFromString(account)
+	if err != nil {
+		return err
+	}
+
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(secret)),
+		Persist:            credPersistLocalMachine,
+		UserName:           user,
+	}
+	if len(secret) > 0 {
+		cred.CredentialBlob = &secret[0]
+	}
+
+	if r, _, err := procCredWriteW.Call(uintptr(unsafe.Pointer(&cred)), 0); r == 0 {
+		return err
+	}
+	return nil
+}
+
+func (credentialStore) Get(service, account string) ([]byte, error) {
+	target, err := credentialTarget(service, account)
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *credential
+	r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0,
+		uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		if err == errorNotFound {
+			return nil, ErrSecretNotFound
+		}
+		return nil, err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	secret := make([]byte, cred.CredentialBlobSize)
+	if len(secret) > 0 {
+		copy(secret, unsafe.Slice(cred.CredentialBlob, len(secret)))
+	}
+	return secret, nil
+}
+
+func (credentialStore) Delete(service, account string) error {
+	target, err := credentialTarget(service, account)
+	if err != nil {
+		return err
+	}
+
+	r, _, err := procCredDeleteW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0)
+	if r == 0 && err != errorNotFound {
+		return err
+	}
+	return nil
+}
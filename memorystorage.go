@@ -1,9 +1,12 @@
 package cookiejarx
 
 import (
+	"math"
+	"reflect"
 	"sort"
 	"sync"
 	"time"
+	"unsafe"
 )
 
 type inMemoryEntry struct {
@@ -13,12 +16,35 @@ type inMemoryEntry struct {
 	// deterministic order, even for cookies that have equal Path length and
 	// equal Creation time. This simplifies testing.
 	seqNum uint64
+
+	// score is the decayed use count of the entry as of its LastAccess,
+	// see InMemoryStorage.DecayHalfLife and seededScore.
+	score float64
+}
+
+// seededScore returns the score of e, an entry lacking one, e.g. saved while
+// DecayHalfLife was not positive or restored from entries alone, counting as
+// used once at its LastAccess.
+func (e inMemoryEntry) seededScore() float64 {
+	if e.score > 0 {
+		return e.score
+	}
+	return 1
+}
+
+// copied returns e holding a copy of its Entry. Stored entries are modified
+// copy-on-write, so that Entry pointers already returned by the storage, e.g.
+// by EntriesDump, are never written to.
+func (e inMemoryEntry) copied() inMemoryEntry {
+	entry := *e.Entry
+	e.Entry = &entry
+	return e
 }
 
 // InMemoryStorage provides thread-safe in-memory entry storage with predictable entry sorting
 type InMemoryStorage struct {
 	// mu locks the remaining fields.
-	mu sync.Mutex
+	mu sync.RWMutex
 
 	// entries is a set of entries, keyed by their eTLD+1 and subkeyed by
 	// their name/domain/path.
@@ -27,37 +53,517 @@ type InMemoryStorage struct {
 	// nextSeqNum is the next sequence number assigned to a new cookie
 	// created SetCookies.
 	nextSeqNum uint64
+
+	// keyTick is a logical clock tracking the recency of key usage.
+	keyTick uint64
+
+	// keyUsed records the keyTick of the most recent use of each key.
+	keyUsed map[string]uint64
+
+	// generation is incremented on every modification of entries, see
+	// Generation.
+	generation uint64
+
+	// snapshots is the stack of states saved by PushSnapshot.
+	snapshots []inMemoryState
+
+	// names indexes the stored entries by name, nil unless created by
+	// NewIndexedInMemoryStorage.
+	names map[string]map[entryRef]struct{}
+
+	// observers are the observers of jars using the storage, notified of
+	// expired entries after OnExpire, see addObserver.
+	observers []Observer
+
+	// PublicSuffixList is used to derive keys of imported entries which do
+	// not carry one, such as those read by ReadNetscape. It should be the
+	// same list the jar using this storage is configured with.
+	PublicSuffixList PublicSuffixList
+
+	// SessionExpiry is the Expires time given to session entries read by
+	// ReadNetscape, DefaultSessionExpiry if zero. It should be the
+	// Options.SessionExpiry of the jar using this storage.
+	SessionExpiry time.Time
+
+	// OnShadow, if set, is called by SaveEntry for every stored entry with
+	// the same name as the saved entry and an overlapping domain and path
+	// scope, see Entry.Shadows. It is called after the entry is saved and
+	// outside the lock.
+	OnShadow func(entry, existing *Entry)
+
+	// OnExpire, if set, is called for every expired entry removed by
+	// Entries or by the sweeper, see StartSweeper. It is called after the
+	// entry is removed and outside the lock.
+	OnExpire func(entry *Entry)
+
+	// StrictPrefixes makes importing methods such as EntriesRestore drop
+	// entries violating "__Secure-" and "__Host-" name prefix rules, see
+	// Entry.ValidatePrefix.
+	StrictPrefixes bool
+
+	// OnImportReject, if set, is called for every entry dropped by an
+	// importing method together with the reason. It is called while the
+	// storage is locked and must not call back into it.
+	OnImportReject func(entry *Entry, err error)
+
+	// MaxKeys, if positive, limits the number of distinct keys (registrable
+	// domains) held by the storage. Saving an entry under a new key beyond
+	// the limit evicts all entries of the least recently used key. Keys are
+	// marked as used by lookups only while MaxKeys is positive.
+	MaxKeys int
+
+	// KeysLowWatermark, if positive and below MaxKeys, makes exceeding
+	// MaxKeys evict least recently used keys down to KeysLowWatermark in a
+	// single pass instead of evicting one key per insertion, amortizing the
+	// eviction cost under bursty multi-domain load.
+	KeysLowWatermark int
+
+	// MaxEntriesPerKey, if positive, limits the number of entries stored
+	// under a single key. Saving a new entry into a full key evicts the
+	// lowest priority entries of that key before insertion, least recently
+	// accessed first, see Entry.Priority.
+	MaxEntriesPerKey int
+
+	// MaxEntries, if positive, limits the total number of stored entries.
+	// Saving a new entry into a full storage evicts the least recently
+	// accessed entries across all keys before insertion.
+	MaxEntries int
+
+	// KeepNewest makes saving an entry with the same key and ID as a stored
+	// entry, but modified earlier, keep the stored entry, so that a stale
+	// replay, e.g. when merging storages of distributed jars, does not
+	// clobber a fresh cookie. Entries are compared by LastModified, or by
+	// Creation if it is not set, as a stored entry keeps its Creation when
+	// it is overwritten.
+	KeepNewest bool
+
+	// AccessResolution is the granularity of entry last access times
+	// maintained by Entries: the last access time of a returned entry is
+	// only updated if it is older than AccessResolution. As lookups which
+	// update nothing need no exclusive lock, a resolution of e.g. a minute,
+	// as used by Chrome, lets concurrent lookups proceed in parallel, at the
+	// cost of less precise least recently accessed evictions.
+	//
+	// The gain is opt-in: zero, the default, updates the last access time
+	// on every lookup, which thus takes the exclusive lock, as lookups did
+	// before. Either way, updated entries are copied rather than modified,
+	// so entries returned by earlier lookups or by EntriesDump never
+	// change.
+	AccessResolution time.Duration
+
+	// DecayHalfLife, if positive, makes evictions enforcing MaxEntriesPerKey
+	// and MaxEntries pick the entries with the lowest decayed use score
+	// instead of the least recently accessed ones. Saving an entry scores
+	// one use, and so does every lookup updating its last access time, see
+	// AccessResolution, while scores halve every DecayHalfLife. A frequently
+	// sent entry thus outlives a more recently set but rarely sent one.
+	// Within a key, priorities still take precedence, see Entry.Priority.
+	//
+	// Scores are kept by MarshalJSON, MarshalBinary, Clone and Merge.
+	// Entries without a score, e.g. restored by EntriesRestore, count as
+	// used once at their last access time.
+	DecayHalfLife time.Duration
+
+	// TrackStats makes Entries count the lookups selecting each entry,
+	// before any filtering by the jar, see Entry.SendCount and Stats. As
+	// every lookup then modifies the storage, concurrent lookups no longer
+	// proceed in parallel.
+	TrackStats bool
+
+	// Less, if set, replaces the order of entries returned by Entries, and
+	// thus of cookies sent by a jar, with the order it defines, e.g.
+	// alphabetical by name. Entries it considers equal keep the default
+	// order: longest path first, then earliest creation, as required by RFC
+	// 6265 section 5.4. Servers may rely on the default order to pick the
+	// most specific of several cookies of the same name, which a custom
+	// order may defeat.
+	Less func(a, b *Entry) bool
+
+	// EvictionPolicy, if set, picks the entries evicted when saving a new
+	// entry exceeds MaxEntriesPerKey, among the entries of its key, or
+	// MaxEntries, among all entries. Should the limits still be exceeded
+	// afterwards, further entries are evicted in the default order.
+	EvictionPolicy EvictionPolicy
+}
+
+// EntryStat is the usage and scope of a stored entry, see
+// InMemoryStorage.Stats.
+type EntryStat struct {
+	Key        string
+	Name       string
+	SendCount  uint64
+	LastAccess time.Time
+	HostOnly   bool
+	Secure     bool
+	Persistent bool
+}
+
+// StatsSummary counts entries by scope, see SummarizeStats.
+type StatsSummary struct {
+	Total int
+
+	// HostOnly and Domain count host-only and domain entries.
+	HostOnly int
+	Domain   int
+
+	// Secure and Insecure count entries with and without the Secure flag.
+	Secure   int
+	Insecure int
+
+	// Persistent and Session count persistent and session entries.
+	Persistent int
+	Session    int
+}
+
+// SummarizeStats counts the entries of stats, as returned by
+// InMemoryStorage.Stats, by scope, e.g. to spot over-broad or insecure cookies
+// at a glance.
+func SummarizeStats(stats map[string]EntryStat) (summary StatsSummary) {
+	for _, stat := range stats {
+		summary.Total++
+		if stat.HostOnly {
+			summary.HostOnly++
+		} else {
+			summary.Domain++
+		}
+		if stat.Secure {
+			summary.Secure++
+		} else {
+			summary.Insecure++
+		}
+		if stat.Persistent {
+			summary.Persistent++
+		} else {
+			summary.Session++
+		}
+	}
+	return summary
 }
 
 // NewInMemoryStorage returns new InMemoryStorage instance
 func NewInMemoryStorage() *InMemoryStorage {
 	return &InMemoryStorage{
-		entries: make(map[string]map[string]inMemoryEntry),
+		entries:    make(map[string]map[string]inMemoryEntry),
+		keyUsed:    make(map[string]uint64),
+		generation: 1,
+	}
+}
+
+// NewIndexedInMemoryStorage is like NewInMemoryStorage, but the returned
+// storage maintains an index of its entries by name, so that EntriesByName
+// does not scan all entries. The index costs memory and work on every
+// modification, it pays off for large storages queried by name often.
+func NewIndexedInMemoryStorage() *InMemoryStorage {
+	s := NewInMemoryStorage()
+	s.names = make(map[string]map[entryRef]struct{})
+	return s
+}
+
+// entryRef identifies a stored entry by its key and ID.
+type entryRef struct {
+	key, id string
+}
+
+// indexName adds the entry with key and id to the name index, if any. s.mu
+// must be held.
+func (s *InMemoryStorage) indexName(name, key, id string) {
+	if s.names == nil {
+		return
+	}
+	refs := s.names[name]
+	if refs == nil {
+		refs = make(map[entryRef]struct{})
+		s.names[name] = refs
+	}
+	refs[entryRef{key: key, id: id}] = struct{}{}
+}
+
+// unindexName removes the entry with key and id from the name index, if any.
+// s.mu must be held.
+func (s *InMemoryStorage) unindexName(name, key, id string) {
+	if s.names == nil {
+		return
+	}
+	refs := s.names[name]
+	delete(refs, entryRef{key: key, id: id})
+	if len(refs) == 0 {
+		delete(s.names, name)
+	}
+}
+
+// rebuildNames rebuilds the name index, if any, from the stored entries. s.mu
+// must be held.
+func (s *InMemoryStorage) rebuildNames() {
+	if s.names == nil {
+		return
+	}
+	s.names = make(map[string]map[entryRef]struct{})
+	for key, submap := range s.entries {
+		for id, e := range submap {
+			s.indexName(e.Name, key, id)
+		}
+	}
+}
+
+// deleteEntry deletes the entry with id from submap, keeping the name index
+// consistent. s.mu must be held.
+func (s *InMemoryStorage) deleteEntry(submap map[string]inMemoryEntry, id string) {
+	if e, ok := submap[id]; ok {
+		s.unindexName(e.Name, e.Key, id)
 	}
+	delete(submap, id)
 }
 
-// EntriesDump returns all entries persisted in in-memory storage
+// EntriesByName returns the stored entries named name, ordered by key and then
+// by insertion like EntriesDump, whose Entry pointers it returns as well. It
+// looks the entries up in the index of a storage created by
+// NewIndexedInMemoryStorage and scans all entries otherwise.
+func (s *InMemoryStorage) EntriesByName(name string) (entries []*Entry) {
+	s.mu.RLock()
+	var selected []inMemoryEntry
+	if s.names != nil {
+		for ref := range s.names[name] {
+			selected = append(selected, s.entries[ref.key][ref.id])
+		}
+	} else {
+		for _, submap := range s.entries {
+			for _, e := range submap {
+				if e.Name == name {
+					selected = append(selected, e)
+				}
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].Key != selected[j].Key {
+			return selected[i].Key < selected[j].Key
+		}
+		return selected[i].seqNum < selected[j].seqNum
+	})
+
+	for _, e := range selected {
+		entries = append(entries, e.Entry)
+	}
+
+	return entries
+}
+
+// EntriesDump returns all entries persisted in in-memory storage, ordered by
+// key and then by insertion, so that dumps of an unchanged storage are equal.
+//
+// The returned entries are the stored ones and must not be modified. The
+// storage does not modify them either, lookups store updated copies instead,
+// so they can be read while the storage is in use, e.g. encoded by Jar.Save.
 func (s *InMemoryStorage) EntriesDump() (entries []*Entry) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	var selected []inMemoryEntry
+	for _, submap := range s.entries {
+		for _, e := range submap {
+			selected = append(selected, e)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].Key != selected[j].Key {
+			return selected[i].Key < selected[j].Key
+		}
+		return selected[i].seqNum < selected[j].seqNum
+	})
+
+	for _, e := range selected {
+		entries = append(entries, e.Entry)
+	}
+
+	return entries
+}
+
+// Find returns the stored entries for which pred returns true, sparing the
+// full slice built by EntriesDump. Like EntriesDump, it returns the stored
+// Entry pointers.
+//
+// pred is called with the storage locked and must not use it.
+func (s *InMemoryStorage) Find(pred func(*Entry) bool) (entries []*Entry) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	for _, submap := range s.entries {
 		for _, e := range submap {
-			entries = append(entries, e.Entry)
+			if pred(e.Entry) {
+				entries = append(entries, e.Entry)
+			}
 		}
 	}
 
 	return entries
 }
 
+// ForEach calls fn for the stored entries in no particular order until fn
+// returns false, sparing the slice built by EntriesDump. Like EntriesDump, it
+// passes the stored Entry pointers.
+//
+// fn is called with the storage read-locked: it must neither use the storage,
+// nor modify the entries, and should not block, as it delays all writers.
+func (s *InMemoryStorage) ForEach(fn func(*Entry) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, submap := range s.entries {
+		for _, e := range submap {
+			if !fn(e.Entry) {
+				return
+			}
+		}
+	}
+}
+
 // EntriesRestore adds provide entries to current in-memory storage
 func (s *InMemoryStorage) EntriesRestore(entries []*Entry) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	for _, e := range entries {
-		s.saveEntry(e)
+		s.importEntry(e)
+	}
+}
+
+// EntriesImport adds provided entries to current in-memory storage like
+// EntriesRestore, letting resolve decide the outcome whenever an entry with the
+// same key and ID is already stored: resolve returns the entry to store, or nil
+// to keep the existing one. A nil resolve makes incoming entries win.
+//
+// Unlike EntriesRestore, a winning entry is stored as is, keeping its own
+// Creation and LastModified times, regardless of KeepNewest.
+//
+// resolve is called with the storage locked and must not use it.
+func (s *InMemoryStorage) EntriesImport(entries []*Entry, resolve func(existing, incoming *Entry) *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range entries {
+		if !s.acceptImport(e) {
+			continue
+		}
+
+		if existing, ok := s.entries[e.Key][e.ID]; ok && resolve != nil {
+			e = resolve(existing.Entry, e)
+			if e == nil || e == existing.Entry {
+				continue
+			}
+		}
+
+		s.storeEntry(e, true)
+	}
+}
+
+// importEntry saves entry received from an external source, validating it
+// according to import settings.
+func (s *InMemoryStorage) importEntry(entry *Entry) {
+	if s.acceptImport(entry) {
+		s.saveEntry(entry)
+	}
+}
+
+// acceptImport reports whether entry received from an external source passes
+// validation according to import settings.
+func (s *InMemoryStorage) acceptImport(entry *Entry) bool {
+	if s.StrictPrefixes {
+		if err := entry.ValidatePrefix(); err != nil {
+			if s.OnImportReject != nil {
+				s.OnImportReject(entry, err)
+			}
+			return false
+		}
 	}
+
+	return true
+}
+
+// Len implements Counter, returning the number of entries not expired at the
+// current time.
+func (s *InMemoryStorage) Len() int {
+	return s.count(time.Now())
+}
+
+// count is like Len but takes the current time as a parameter.
+func (s *InMemoryStorage) count(now time.Time) (n int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, submap := range s.entries {
+		for _, e := range submap {
+			if !e.Expired(now) {
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+// Domains implements Counter, returning the sorted keys holding entries not
+// expired at the current time.
+func (s *InMemoryStorage) Domains() (domains []string) {
+	now := time.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for key, submap := range s.entries {
+		for _, e := range submap {
+			if !e.Expired(now) {
+				domains = append(domains, key)
+				break
+			}
+		}
+	}
+
+	sort.Strings(domains)
+
+	return domains
+}
+
+// KeyCounts returns the number of entries stored under each key, the
+// registrable domain of the entries. It helps detecting a single domain
+// flooding the storage with cookies for many of its subdomains, which all
+// share its key and are thus capped together by MaxEntriesPerKey.
+func (s *InMemoryStorage) KeyCounts() map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]int, len(s.entries))
+	for key, submap := range s.entries {
+		counts[key] = len(submap)
+	}
+
+	return counts
+}
+
+// entryOverhead is an estimate of the fixed per-entry memory cost: the Entry
+// and inMemoryEntry structs themselves, excluding string contents, plus the
+// map bucket slot holding the entry.
+const entryOverhead = int(unsafe.Sizeof(Entry{})+unsafe.Sizeof(inMemoryEntry{})) + 64
+
+// ApproxBytes returns an approximate amount of memory used by stored entries,
+// summing the lengths of their strings and an estimated per-entry overhead.
+func (s *InMemoryStorage) ApproxBytes() (n int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// The map keys share their contents with the Key and ID of the
+	// entries, which are thus counted once.
+	for key, submap := range s.entries {
+		n += len(key)
+		for _, e := range submap {
+			n += entryOverhead + len(e.ID) +
+				len(e.Name) + len(e.Value) + len(e.Domain) + len(e.Path) +
+				len(e.SameSite) + len(e.Priority) + len(e.PartitionKey)
+		}
+	}
+
+	return n
 }
 
 // EntriesClear empties current in-memory storage
@@ -66,20 +572,83 @@ func (s *InMemoryStorage) EntriesClear() {
 	defer s.mu.Unlock()
 
 	s.entries = make(map[string]map[string]inMemoryEntry)
+	s.keyUsed = make(map[string]uint64)
+	s.rebuildNames()
+	s.generation++
+}
+
+// applyLimits sets MaxEntriesPerKey and MaxEntries to maxPerKey and maxTotal.
+// A zero limit keeps the one already set, or sets the default defPerKey or
+// defTotal if there is none. Limits are only written when they change, so that
+// a jar built on a storage shared with other jars does not race with their
+// lookups unless it changes the limits.
+func (s *InMemoryStorage) applyLimits(maxPerKey, maxTotal, defPerKey, defTotal int) {
+	if maxPerKey == 0 && s.MaxEntriesPerKey == 0 {
+		maxPerKey = defPerKey
+	}
+	if maxPerKey != 0 && maxPerKey != s.MaxEntriesPerKey {
+		s.MaxEntriesPerKey = maxPerKey
+	}
+
+	if maxTotal == 0 && s.MaxEntries == 0 {
+		maxTotal = defTotal
+	}
+	if maxTotal != 0 && maxTotal != s.MaxEntries {
+		s.MaxEntries = maxTotal
+	}
+}
+
+// Clear implements Clearer, it is an alias of EntriesClear.
+func (s *InMemoryStorage) Clear() {
+	s.EntriesClear()
 }
 
 // SaveEntry in-memory implementation of Storage.SaveEntry
 func (s *InMemoryStorage) SaveEntry(entry *Entry) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+
+	if s.isStale(entry) {
+		s.mu.Unlock()
+		return
+	}
+
+	var shadowed []*Entry
+	if s.OnShadow != nil {
+		for _, e := range s.entries[entry.Key] {
+			if entry.Shadows(e.Entry) {
+				shadowed = append(shadowed, e.Entry)
+			}
+		}
+	}
 
 	s.saveEntry(entry)
+	s.mu.Unlock()
+
+	for _, e := range shadowed {
+		s.OnShadow(entry, e)
+	}
 }
 
+// saveEntry stores entry, keeping the Creation, and LastModified if the
+// content is unchanged, of an entry it replaces, see storeEntry. s.mu must be
+// held.
 func (s *InMemoryStorage) saveEntry(entry *Entry) {
+	s.storeEntry(entry, false)
+}
+
+// storeEntry stores entry. Unless keepTimes is set, entries older than the
+// stored one are dropped according to KeepNewest and a replaced entry's
+// Creation, and LastModified if the content is unchanged, are carried over;
+// otherwise entry is stored with its own timestamps. s.mu must be held.
+func (s *InMemoryStorage) storeEntry(entry *Entry, keepTimes bool) {
+	if !keepTimes && s.isStale(entry) {
+		return
+	}
+
 	submap := s.entries[entry.Key]
 
-	if submap == nil {
+	newKey := submap == nil
+	if newKey {
 		submap = make(map[string]inMemoryEntry)
 	}
 
@@ -90,16 +659,293 @@ func (s *InMemoryStorage) saveEntry(entry *Entry) {
 	id := entry.ID
 
 	if old, ok := submap[id]; ok {
-		e.Creation = old.Creation
+		s.unindexName(old.Name, entry.Key, id)
+		if !keepTimes {
+			e.Creation = old.Creation
+			if entry.sameContent(old.Entry) {
+				e.LastModified = old.LastModified
+			}
+		}
 		e.seqNum = old.seqNum
+		e.SendCount = old.SendCount
+		if s.DecayHalfLife > 0 {
+			e.score = decayedScore(old.seededScore(), old.LastAccess, entry.LastAccess, s.DecayHalfLife)
+		}
 	} else {
+		s.evictEntries(entry, submap)
 		e.seqNum = s.nextSeqNum
 		s.nextSeqNum++
 	}
+	if s.DecayHalfLife > 0 {
+		e.score++
+	}
 
 	submap[id] = e
+	s.indexName(entry.Name, entry.Key, id)
+	s.generation++
 
 	s.entries[entry.Key] = submap
+	s.touchKey(entry.Key)
+
+	if newKey {
+		s.evictKeys(entry.Key)
+	}
+}
+
+// isStale reports whether entry must not replace a stored entry according to
+// KeepNewest.
+func (s *InMemoryStorage) isStale(entry *Entry) bool {
+	if !s.KeepNewest {
+		return false
+	}
+
+	old, ok := s.entries[entry.Key][entry.ID]
+	return ok && modifiedAt(entry).Before(modifiedAt(old.Entry))
+}
+
+// modifiedAt returns the time e was last modified, its Creation for entries
+// without LastModified.
+func modifiedAt(e *Entry) time.Time {
+	if e.LastModified.IsZero() {
+		return e.Creation
+	}
+	return e.LastModified
+}
+
+// evictEntries makes room for the incoming entry according to
+// MaxEntriesPerKey and MaxEntries, evicting the entries picked by
+// EvictionPolicy, if any, and then least recently accessed entries, within the
+// key lowest priority entries first.
+// submap is the, possibly not yet stored, submap of the incoming entry's key.
+func (s *InMemoryStorage) evictEntries(incoming *Entry, submap map[string]inMemoryEntry) {
+	key := incoming.Key
+
+	if s.MaxEntriesPerKey > 0 {
+		if s.EvictionPolicy != nil && len(submap) >= s.MaxEntriesPerKey {
+			s.applyEvictionPolicy(incoming, submap, false)
+		}
+		for len(submap) >= s.MaxEntriesPerKey {
+			s.deleteEntry(submap, s.evictionEntry(submap))
+		}
+	}
+
+	if s.MaxEntries <= 0 {
+		return
+	}
+
+	total := 0
+	for _, m := range s.entries {
+		total += len(m)
+	}
+	if s.entries[key] == nil {
+		total += len(submap)
+	}
+
+	if s.EvictionPolicy != nil && total >= s.MaxEntries {
+		total -= s.applyEvictionPolicy(incoming, submap, true)
+	}
+
+	for ; total >= s.MaxEntries && total > 0; total-- {
+		var lruKey, lruID string
+		var lru inMemoryEntry
+		for k, m := range s.entries {
+			if k == key {
+				continue
+			}
+			id := s.lruEntry(m)
+			if lruKey == "" || s.entryLess(m[id], lru) {
+				lruKey, lruID, lru = k, id, m[id]
+			}
+		}
+		if id := s.lruEntry(submap); id != "" && (lruKey == "" || s.entryLess(submap[id], lru)) {
+			s.deleteEntry(submap, id)
+			continue
+		}
+		s.deleteEntry(s.entries[lruKey], lruID)
+		if len(s.entries[lruKey]) == 0 {
+			s.deleteKey(lruKey)
+		}
+	}
+}
+
+// applyEvictionPolicy evicts the entries EvictionPolicy picks to make room for
+// incoming among the entries of submap, the, possibly not yet stored, submap
+// of its key, or among all entries if global is set. It returns the number of
+// evicted entries.
+func (s *InMemoryStorage) applyEvictionPolicy(incoming *Entry, submap map[string]inMemoryEntry, global bool) (evicted int) {
+	type location struct {
+		key string
+		e   inMemoryEntry
+	}
+
+	var candidates []location
+	for _, e := range submap {
+		candidates = append(candidates, location{key: incoming.Key, e: e})
+	}
+	if global {
+		for k, m := range s.entries {
+			if k == incoming.Key {
+				continue
+			}
+			for _, e := range m {
+				candidates = append(candidates, location{key: k, e: e})
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].e.seqNum < candidates[j].e.seqNum
+	})
+
+	entries := make([]*Entry, len(candidates))
+	keys := make(map[string]string, len(candidates))
+	for i, c := range candidates {
+		entries[i] = c.e.Entry
+		keys[c.e.ID] = c.key
+	}
+
+	for _, id := range s.EvictionPolicy.ShouldEvict(entries, incoming) {
+		k, ok := keys[id]
+		if !ok {
+			continue
+		}
+		delete(keys, id)
+		evicted++
+
+		if k == incoming.Key {
+			s.deleteEntry(submap, id)
+			continue
+		}
+		s.deleteEntry(s.entries[k], id)
+		if len(s.entries[k]) == 0 {
+			s.deleteKey(k)
+		}
+	}
+
+	return evicted
+}
+
+// lruEntry returns the ID of the first entry to evict in submap according to
+// entryLess, or an empty string if submap is empty.
+func (s *InMemoryStorage) lruEntry(submap map[string]inMemoryEntry) (lruID string) {
+	var lru inMemoryEntry
+	for id, e := range submap {
+		if lruID == "" || s.entryLess(e, lru) {
+			lruID, lru = id, e
+		}
+	}
+	return lruID
+}
+
+// evictionEntry returns the ID of the first entry to evict among the lowest
+// priority entries in submap, or an empty string if submap is empty.
+func (s *InMemoryStorage) evictionEntry(submap map[string]inMemoryEntry) (evictID string) {
+	var evict inMemoryEntry
+	for id, e := range submap {
+		if evictID == "" || s.evictionLess(e, evict) {
+			evictID, evict = id, e
+		}
+	}
+	return evictID
+}
+
+// evictionLess reports whether a has a lower priority than b or, with equal
+// priorities, whether a is less than b according to entryLess.
+func (s *InMemoryStorage) evictionLess(a, b inMemoryEntry) bool {
+	if ra, rb := priorityRank(a.Priority), priorityRank(b.Priority); ra != rb {
+		return ra < rb
+	}
+	return s.entryLess(a, b)
+}
+
+// entryLess reports whether a is to be evicted before b: whether it has a
+// lower decayed score if DecayHalfLife is positive, or was accessed less
+// recently otherwise, ties broken by sequence number.
+func (s *InMemoryStorage) entryLess(a, b inMemoryEntry) bool {
+	if s.DecayHalfLife > 0 {
+		if ra, rb := a.decayRank(s.DecayHalfLife), b.decayRank(s.DecayHalfLife); ra != rb {
+			return ra < rb
+		}
+	}
+	if !a.LastAccess.Equal(b.LastAccess) {
+		return a.LastAccess.Before(b.LastAccess)
+	}
+	return a.seqNum < b.seqNum
+}
+
+// decayedScore returns score as of from decayed with halfLife to to.
+func decayedScore(score float64, from, to time.Time, halfLife time.Duration) float64 {
+	return score * math.Exp2(-float64(to.Sub(from))/float64(halfLife))
+}
+
+// decayRank returns the base 2 logarithm of the score of e decayed with
+// halfLife to a fixed reference time, shifted by a constant common to all
+// entries. Comparing ranks thus compares scores decayed to any common time,
+// without computing scores too large or small for a float64.
+func (e *inMemoryEntry) decayRank(halfLife time.Duration) float64 {
+	return math.Log2(e.seededScore()) + float64(e.LastAccess.Sub(time.Unix(0, 0)))/float64(halfLife)
+}
+
+// touchKey marks key as most recently used.
+func (s *InMemoryStorage) touchKey(key string) {
+	if s.keyUsed == nil {
+		s.keyUsed = make(map[string]uint64)
+	}
+	s.keyTick++
+	s.keyUsed[key] = s.keyTick
+}
+
+// deleteKey removes all entries stored under key.
+func (s *InMemoryStorage) deleteKey(key string) {
+	for id, e := range s.entries[key] {
+		s.unindexName(e.Name, key, id)
+	}
+	delete(s.entries, key)
+	delete(s.keyUsed, key)
+}
+
+// evictKeys enforces MaxKeys by removing least recently used keys other than
+// keep.
+func (s *InMemoryStorage) evictKeys(keep string) {
+	if s.MaxKeys <= 0 || len(s.entries) <= s.MaxKeys {
+		return
+	}
+
+	target := s.MaxKeys
+	if s.KeysLowWatermark > 0 && s.KeysLowWatermark < s.MaxKeys {
+		target = s.KeysLowWatermark
+	}
+
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		if key != keep {
+			keys = append(keys, key)
+		}
+	}
+
+	n := len(s.entries) - target
+	if n == 1 {
+		// Single eviction needs no sorting.
+		oldest := keys[0]
+		for _, key := range keys[1:] {
+			if s.keyUsed[key] < s.keyUsed[oldest] {
+				oldest = key
+			}
+		}
+		s.deleteKey(oldest)
+		return
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return s.keyUsed[keys[i]] < s.keyUsed[keys[j]]
+	})
+
+	if n > len(keys) {
+		n = len(keys)
+	}
+
+	for _, key := range keys[:n] {
+		s.deleteKey(key)
+	}
 }
 
 // RemoveEntry in-memory implementation of Storage.RemoveEntry
@@ -107,38 +953,121 @@ func (s *InMemoryStorage) RemoveEntry(key, id string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.removeEntry(key, id)
+}
+
+// WriteBatch implements BatchWriter, applying ops in order under a single lock
+// acquisition. OnShadow is called after the lock is released.
+func (s *InMemoryStorage) WriteBatch(ops []BatchOp) {
+	var shadowing, shadowed []*Entry
+
+	s.mu.Lock()
+
+	for _, op := range ops {
+		if op.Remove {
+			s.removeEntry(op.Entry.Key, op.Entry.ID)
+			continue
+		}
+
+		if s.isStale(op.Entry) {
+			continue
+		}
+
+		if s.OnShadow != nil {
+			for _, e := range s.entries[op.Entry.Key] {
+				if op.Entry.Shadows(e.Entry) {
+					shadowing = append(shadowing, op.Entry)
+					shadowed = append(shadowed, e.Entry)
+				}
+			}
+		}
+
+		s.saveEntry(op.Entry)
+	}
+
+	s.mu.Unlock()
+
+	for i, e := range shadowed {
+		s.OnShadow(shadowing[i], e)
+	}
+}
+
+// removeEntry removes the entry with key and id, s.mu must be held.
+func (s *InMemoryStorage) removeEntry(key, id string) {
 	submap := s.entries[key]
 
 	var modified bool
 
 	if submap != nil {
 		if _, ok := submap[id]; ok {
-			delete(submap, id)
+			s.deleteEntry(submap, id)
+			s.generation++
 			modified = true
 		}
 	}
 
 	if modified && len(submap) == 0 {
-		delete(s.entries, key)
+		s.deleteKey(key)
 	}
 }
 
-
 // Entries in-memory implementation of Storage.Entries
+//
+// With a positive AccessResolution, matching entries are collected with the
+// storage read-locked, so that concurrent lookups proceed in parallel, along
+// with the modifications the lookup needs: removing expired entries,
+// updating last access times, see AccessResolution, and marking the key as
+// recently used, see MaxKeys. The storage is write-locked to apply them only
+// if there are any. Otherwise, or while TrackStats is set, nearly every
+// lookup modifies the storage, which is then write-locked right away.
 func (s *InMemoryStorage) Entries(https bool, host, path, key string, now time.Time) (entries []*Entry) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.AccessResolution <= 0 || s.TrackStats {
+		s.mu.Lock()
+		selected, expired := s.updateEntries(https, host, path, key, now)
+		s.mu.Unlock()
+
+		s.notifyExpired(expired)
+
+		return s.sortedEntries(selected)
+	}
+
+	s.mu.RLock()
+	selected, updates := s.scanEntries(https, host, path, key, now)
+	s.mu.RUnlock()
+
+	var expired []*Entry
+	if !updates.empty() {
+		s.mu.Lock()
+		expired = s.applyLookupUpdates(key, updates, now)
+		s.mu.Unlock()
+	}
+
+	s.notifyExpired(expired)
+
+	return s.sortedEntries(selected)
+}
 
+// updateEntries collects the entries of key matching https, host and path
+// like scanEntries, applying the modifications of the lookup right away, and
+// returns the removed expired entries. s.mu must be held.
+func (s *InMemoryStorage) updateEntries(https bool, host, path, key string, now time.Time) (selected []inMemoryEntry, expired []*Entry) {
 	submap := s.entries[key]
 	if submap == nil {
-		return entries
+		return nil, nil
+	}
+
+	if s.keyTouchNeeded(key) {
+		s.touchKey(key)
 	}
 
 	modified := false
-	var selected []inMemoryEntry
 	for id, e := range submap {
-		if e.Persistent && !e.Expires.After(now) {
-			delete(submap, id)
+		if e.Expired(now) {
+			s.deleteEntry(submap, id)
+			s.generation++
+			if s.notifiesExpired() {
+				expired = append(expired, e.Entry)
+			}
 			modified = true
 			continue
 		}
@@ -146,30 +1075,201 @@ func (s *InMemoryStorage) Entries(https bool, host, path, key string, now time.T
 		if !e.ShouldSend(https, host, path) {
 			continue
 		}
-		e.LastAccess = now
-		submap[id] = e
+		if access := s.accessNeeded(e.Entry, now); access || s.TrackStats {
+			e = e.copied()
+			if s.TrackStats {
+				e.SendCount++
+			}
+			if access {
+				if s.DecayHalfLife > 0 {
+					e.score = decayedScore(e.seededScore(), e.LastAccess, now, s.DecayHalfLife) + 1
+				}
+				e.LastAccess = now
+			}
+			submap[id] = e
+			modified = true
+		}
 		selected = append(selected, e)
-		modified = true
 	}
 	if modified {
 		if len(submap) == 0 {
-			delete(s.entries, key)
+			s.deleteKey(key)
 		} else {
 			s.entries[key] = submap
 		}
 	}
 
-	// sort according to RFC 6265 section 5.4 point 2: by longest
-	// path and then by earliest creation time.
-	sort.Slice(selected, func(i, j int) bool {
-		sel := selected
-		if len(sel[i].Path) != len(sel[j].Path) {
-			return len(sel[i].Path) > len(sel[j].Path)
+	return selected, expired
+}
+
+// notifiesExpired reports whether expired entries are to be passed to
+// notifyExpired. s.mu must be held.
+func (s *InMemoryStorage) notifiesExpired() bool {
+	return s.OnExpire != nil || len(s.observers) > 0
+}
+
+// notifyExpired calls OnExpire and the observers added by addObserver for
+// expired entries.
+func (s *InMemoryStorage) notifyExpired(expired []*Entry) {
+	if len(expired) == 0 {
+		return
+	}
+
+	s.mu.RLock()
+	observers := s.observers
+	s.mu.RUnlock()
+
+	for _, e := range expired {
+		if s.OnExpire != nil {
+			s.OnExpire(e)
+		}
+		for _, o := range observers {
+			o.OnExpire(e)
+		}
+	}
+}
+
+// addObserver makes s notify o of expired entries, unless o is a pointer
+// already notified. Pointer observers of jars sharing the storage are thus
+// notified of all of its expired entries, each once, while observers of other
+// kinds are added, and notified, once per jar.
+func (s *InMemoryStorage) addObserver(o Observer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if reflect.ValueOf(o).Kind() == reflect.Ptr {
+		for _, added := range s.observers {
+			if added == o {
+				return
+			}
+		}
+	}
+	s.observers = append(s.observers, o)
+}
+
+// lookupUpdates are the modifications of the storage found necessary by a
+// lookup scanning it read-locked, see scanEntries.
+type lookupUpdates struct {
+	// touchKey is set if the key is to be marked as most recently used.
+	touchKey bool
+
+	// expired holds the IDs of expired entries to remove.
+	expired []string
+
+	// accessed holds the IDs of selected entries whose last access time is
+	// to be updated.
+	accessed []string
+}
+
+// empty reports whether u holds no modifications.
+func (u *lookupUpdates) empty() bool {
+	return !u.touchKey && len(u.expired) == 0 && len(u.accessed) == 0
+}
+
+// scanEntries collects the entries of key matching https, host and path
+// without modifying the storage, along with the modifications the lookup
+// needs, which applyLookupUpdates applies. s.mu must be held, at least
+// read-locked.
+func (s *InMemoryStorage) scanEntries(https bool, host, path, key string, now time.Time) (selected []inMemoryEntry, updates lookupUpdates) {
+	submap := s.entries[key]
+	if submap == nil {
+		return nil, updates
+	}
+
+	updates.touchKey = s.keyTouchNeeded(key)
+
+	for id, e := range submap {
+		if e.Expired(now) {
+			updates.expired = append(updates.expired, id)
+			continue
+		}
+
+		if !e.ShouldSend(https, host, path) {
+			continue
+		}
+		if s.accessNeeded(e.Entry, now) {
+			updates.accessed = append(updates.accessed, id)
+		}
+		selected = append(selected, e)
+	}
+
+	return selected, updates
+}
+
+// applyLookupUpdates applies the modifications collected by scanEntries for a
+// lookup of key at now, skipping those made obsolete by modifications in the
+// meantime, and returns the removed expired entries. s.mu must be held.
+func (s *InMemoryStorage) applyLookupUpdates(key string, updates lookupUpdates, now time.Time) (expired []*Entry) {
+	submap := s.entries[key]
+	if submap == nil {
+		return nil
+	}
+
+	if updates.touchKey && s.keyTouchNeeded(key) {
+		s.touchKey(key)
+	}
+
+	for _, id := range updates.expired {
+		if e, ok := submap[id]; ok && e.Expired(now) {
+			s.deleteEntry(submap, id)
+			s.generation++
+			if s.notifiesExpired() {
+				expired = append(expired, e.Entry)
+			}
 		}
-		if !sel[i].Creation.Equal(sel[j].Creation) {
-			return sel[i].Creation.Before(sel[j].Creation)
+	}
+
+	for _, id := range updates.accessed {
+		if e, ok := submap[id]; ok && s.accessNeeded(e.Entry, now) {
+			e = e.copied()
+			if s.DecayHalfLife > 0 {
+				e.score = decayedScore(e.seededScore(), e.LastAccess, now, s.DecayHalfLife) + 1
+			}
+			e.LastAccess = now
+			submap[id] = e
+		}
+	}
+
+	if len(submap) == 0 {
+		s.deleteKey(key)
+	}
+
+	return expired
+}
+
+// keyTouchNeeded reports whether a lookup of key must mark it as most
+// recently used: key recency is only tracked while MaxKeys is positive, and
+// key being the most recently used one already needs no update.
+func (s *InMemoryStorage) keyTouchNeeded(key string) bool {
+	return s.MaxKeys > 0 && s.keyUsed[key] != s.keyTick
+}
+
+// accessNeeded reports whether a lookup at now must update the last access
+// time of e according to AccessResolution.
+func (s *InMemoryStorage) accessNeeded(e *Entry, now time.Time) bool {
+	return e.LastAccess.Before(now.Add(-s.AccessResolution))
+}
+
+// sortedEntries sorts selected according to RFC 6265 section 5.4 point 2 and
+// then stably by Less, if set, and returns their entries.
+func (s *InMemoryStorage) sortedEntries(selected []inMemoryEntry) []*Entry {
+	entries := sortedEntries(selected)
+	if s.Less != nil {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return s.Less(entries[i], entries[j])
+		})
+	}
+	return entries
+}
+
+// sortedEntries sorts selected like SortEntries, ties broken by sequence
+// number instead of ID, and returns their entries.
+func sortedEntries(selected []inMemoryEntry) (entries []*Entry) {
+	sort.Slice(selected, func(i, j int) bool {
+		if before, ok := sendOrder(selected[i].Entry, selected[j].Entry); ok {
+			return before
 		}
-		return sel[i].seqNum < sel[j].seqNum
+		return selected[i].seqNum < selected[j].seqNum
 	})
 
 	if len(selected) == 0 {
@@ -184,3 +1284,415 @@ func (s *InMemoryStorage) Entries(https bool, host, path, key string, now time.T
 
 	return entries
 }
+
+// EntriesPeek is like Entries for read-only inspection: it selects and sorts
+// the same entries, but neither updates their LastAccess nor removes expired
+// entries, so that it does not perturb the order of evictions. It only holds
+// the read lock.
+func (s *InMemoryStorage) EntriesPeek(https bool, host, path, key string, now time.Time) (entries []*Entry) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var selected []inMemoryEntry
+	for _, e := range s.entries[key] {
+		if e.Expired(now) {
+			continue
+		}
+
+		if !e.ShouldSend(https, host, path) {
+			continue
+		}
+		selected = append(selected, e)
+	}
+
+	return s.sortedEntries(selected)
+}
+
+// planRequest holds the parameters of a request matched by planEntries.
+type planRequest struct {
+	https bool
+
+	host, path string
+}
+
+// planEntries is like peekEntries for several requests to hosts of key,
+// scanning the entries of key once under a single lock acquisition.
+func (s *InMemoryStorage) planEntries(key string, requests []planRequest, now time.Time) [][]*Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	selected := make([][]inMemoryEntry, len(requests))
+	for _, e := range s.entries[key] {
+		if e.Expired(now) {
+			continue
+		}
+
+		for i, r := range requests {
+			if e.ShouldSend(r.https, r.host, r.path) {
+				selected[i] = append(selected[i], e)
+			}
+		}
+	}
+
+	entries := make([][]*Entry, len(requests))
+	for i := range selected {
+		entries[i] = s.sortedEntries(selected[i])
+	}
+
+	return entries
+}
+
+// StartSweeper starts a goroutine removing expired persistent entries of all
+// keys every interval, so that memory held by rarely queried keys is freed.
+// Otherwise expired entries are only removed when their key is looked up.
+//
+// Sweeping locks the storage like any other operation, so it briefly contends
+// with concurrent lookups. The returned stop function terminates the goroutine
+// and waits for it to exit; it is safe to call it multiple times. A
+// non-positive interval starts no goroutine.
+func (s *InMemoryStorage) StartSweeper(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				s.removeExpired(now)
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+			<-done
+		})
+	}
+}
+
+// removeExpired removes all persistent entries expired at now.
+func (s *InMemoryStorage) removeExpired(now time.Time) {
+	var expired []*Entry
+
+	s.mu.Lock()
+	for key, submap := range s.entries {
+		for id, e := range submap {
+			if e.Expired(now) {
+				s.deleteEntry(submap, id)
+				s.generation++
+				if s.notifiesExpired() {
+					expired = append(expired, e.Entry)
+				}
+			}
+		}
+		if len(submap) == 0 {
+			s.deleteKey(key)
+		}
+	}
+	s.mu.Unlock()
+
+	s.notifyExpired(expired)
+}
+
+// Generation returns a number incremented on every modification of the stored
+// entries: saves, removals, including those of expired entries and evictions,
+// and imports. It starts at 1, so that 0 never matches it. Lookups which only
+// update last access times do not change it, so an unchanged generation means
+// that lookups return the same entries, as long as none expired in the
+// meantime.
+func (s *InMemoryStorage) Generation() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.generation
+}
+
+// Stats returns the usage and scope of the stored entries keyed by entry ID,
+// see SummarizeStats for counts by scope. Send counts are only maintained while
+// TrackStats is set.
+func (s *InMemoryStorage) Stats() map[string]EntryStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := make(map[string]EntryStat)
+	for _, submap := range s.entries {
+		for id, e := range submap {
+			stats[id] = e.stat()
+		}
+	}
+
+	return stats
+}
+
+// stat returns the usage of e.
+func (e inMemoryEntry) stat() EntryStat {
+	return EntryStat{
+		Key:        e.Key,
+		Name:       e.Name,
+		SendCount:  e.SendCount,
+		LastAccess: e.LastAccess,
+		HostOnly:   e.HostOnly,
+		Secure:     e.Secure,
+		Persistent: e.Persistent,
+	}
+}
+
+// DebugEntry is the internal state of an entry stored by InMemoryStorage, see
+// DebugState.
+type DebugEntry struct {
+	// Entry is a copy of the stored entry.
+	Entry Entry
+
+	// SeqNum is the sequence number ordering entries with equal path
+	// length and creation time, assigned when the entry is first stored.
+	SeqNum uint64
+}
+
+// DebugState returns a snapshot of the internal structure of s for white-box
+// testing: copies of stored entries with their sequence numbers, keyed by
+// entry key and subkeyed by entry ID exactly as they are held.
+//
+// It is meant for tests only, the structure is no stable API and may change.
+func (s *InMemoryStorage) DebugState() map[string]map[string]DebugEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	state := make(map[string]map[string]DebugEntry, len(s.entries))
+	for key, submap := range s.entries {
+		dsubmap := make(map[string]DebugEntry, len(submap))
+		for id, e := range submap {
+			dsubmap[id] = DebugEntry{Entry: *e.Entry, SeqNum: e.seqNum}
+		}
+		state[key] = dsubmap
+	}
+
+	return state
+}
+
+// seqNum returns the sequence number of the entry with provided key and id.
+func (s *InMemoryStorage) seqNum(key, id string) (uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.entries[key][id]
+	return e.seqNum, ok
+}
+
+// Clone returns a deep copy of s with the same configuration, preserving
+// sequence numbers. The copy shares no entries with s, so that both evolve
+// independently.
+func (s *InMemoryStorage) Clone() *InMemoryStorage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c := NewInMemoryStorage()
+	if s.names != nil {
+		c.names = make(map[string]map[entryRef]struct{})
+	}
+	c.setState(s.state())
+
+	c.PublicSuffixList = s.PublicSuffixList
+	c.SessionExpiry = s.SessionExpiry
+	c.OnShadow = s.OnShadow
+	c.OnExpire = s.OnExpire
+	c.StrictPrefixes = s.StrictPrefixes
+	c.OnImportReject = s.OnImportReject
+	c.MaxKeys = s.MaxKeys
+	c.KeysLowWatermark = s.KeysLowWatermark
+	c.MaxEntriesPerKey = s.MaxEntriesPerKey
+	c.MaxEntries = s.MaxEntries
+	c.KeepNewest = s.KeepNewest
+	c.AccessResolution = s.AccessResolution
+	c.DecayHalfLife = s.DecayHalfLife
+	c.TrackStats = s.TrackStats
+	c.Less = s.Less
+	c.EvictionPolicy = s.EvictionPolicy
+
+	return c
+}
+
+// ReindexIDs recomputes the ID of every stored entry from its Domain, Path,
+// Name and partition, see Entry.RawID, and rebuilds the storage accordingly,
+// e.g. to migrate entries stored under an earlier ID format. Entries whose new
+// IDs collide are deduplicated, keeping the newest one: the one with the
+// latest Creation, or the one stored last.
+//
+// Storages of a jar configured with Options.HashIDs must use ReindexIDsWith
+// and HashID instead.
+func (s *InMemoryStorage) ReindexIDs() {
+	s.ReindexIDsWith(func(e *Entry) string {
+		return e.RawID()
+	})
+}
+
+// ReindexIDsWith is like ReindexIDs, computing the new IDs by id. id is called
+// with the storage locked and must not use it.
+func (s *InMemoryStorage) ReindexIDsWith(id func(*Entry) string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, submap := range s.entries {
+		reindexed := make(map[string]inMemoryEntry, len(submap))
+		for _, e := range submap {
+			e = e.copied()
+			e.ID = id(e.Entry)
+			if old, ok := reindexed[e.ID]; ok && newerEntry(old, e) {
+				continue
+			}
+			reindexed[e.ID] = e
+		}
+		s.entries[key] = reindexed
+	}
+
+	s.rebuildNames()
+	s.generation++
+}
+
+// newerEntry reports whether a was created after b or, if created at the same
+// time, stored after b.
+func newerEntry(a, b inMemoryEntry) bool {
+	if !a.Creation.Equal(b.Creation) {
+		return a.Creation.After(b.Creation)
+	}
+	return a.seqNum > b.seqNum
+}
+
+// inMemoryState is the state of the entries of an InMemoryStorage, see
+// PushSnapshot.
+type inMemoryState struct {
+	entries    map[string]map[string]inMemoryEntry
+	nextSeqNum uint64
+	keyTick    uint64
+	keyUsed    map[string]uint64
+}
+
+// state returns a deep copy of the state of the entries of s. s.mu must be
+// held for reading.
+func (s *InMemoryStorage) state() inMemoryState {
+	st := inMemoryState{
+		entries:    make(map[string]map[string]inMemoryEntry, len(s.entries)),
+		nextSeqNum: s.nextSeqNum,
+		keyTick:    s.keyTick,
+		keyUsed:    make(map[string]uint64, len(s.keyUsed)),
+	}
+
+	for key, used := range s.keyUsed {
+		st.keyUsed[key] = used
+	}
+
+	for key, submap := range s.entries {
+		csubmap := make(map[string]inMemoryEntry, len(submap))
+		for id, e := range submap {
+			entry := *e.Entry
+			csubmap[id] = inMemoryEntry{Entry: &entry, seqNum: e.seqNum, score: e.score}
+		}
+		st.entries[key] = csubmap
+	}
+
+	return st
+}
+
+// setState replaces the state of the entries of s with st. s.mu must be held.
+func (s *InMemoryStorage) setState(st inMemoryState) {
+	s.entries = st.entries
+	s.nextSeqNum = st.nextSeqNum
+	s.keyTick = st.keyTick
+	s.keyUsed = st.keyUsed
+	s.rebuildNames()
+	s.generation++
+}
+
+// PushSnapshot saves a copy of the stored entries, along with their sequence
+// numbers, on a stack, so that PopSnapshot can roll back to it later, e.g. to
+// undo the cookies set by a sequence of requests in tests.
+//
+// Every snapshot holds a full copy of the entries, costing about as much
+// memory as the storage itself, see ApproxBytes, until it is popped.
+func (s *InMemoryStorage) PushSnapshot() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshots = append(s.snapshots, s.state())
+}
+
+// PopSnapshot replaces the stored entries with the most recently pushed
+// snapshot and removes it from the stack. It reports false, leaving the
+// storage unchanged, if there is no snapshot. Observers such as OnExpire are
+// not notified of entries removed or restored by the rollback.
+func (s *InMemoryStorage) PopSnapshot() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.snapshots) == 0 {
+		return false
+	}
+
+	last := len(s.snapshots) - 1
+	s.setState(s.snapshots[last])
+	s.snapshots[last] = inMemoryState{}
+	s.snapshots = s.snapshots[:last]
+
+	return true
+}
+
+// Merge adds copies of all entries of other to s. When both hold an entry with
+// the same key and ID, the one with the later Creation wins. Entries new to s
+// are added in the order they were added to other, subject to the limits of s.
+//
+// Both storages are locked for the duration of the merge, in a consistent
+// order, so that concurrent merges in opposite directions do not deadlock.
+func (s *InMemoryStorage) Merge(other *InMemoryStorage) {
+	if s == other {
+		return
+	}
+
+	first, second := s, other
+	if uintptr(unsafe.Pointer(second)) < uintptr(unsafe.Pointer(first)) {
+		first, second = second, first
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	second.mu.Lock()
+	defer second.mu.Unlock()
+
+	var incoming []inMemoryEntry
+	for _, submap := range other.entries {
+		for _, e := range submap {
+			incoming = append(incoming, e)
+		}
+	}
+	sort.Slice(incoming, func(i, j int) bool {
+		return incoming[i].seqNum < incoming[j].seqNum
+	})
+
+	for _, e := range incoming {
+		entry := *e.Entry
+		existing, ok := s.entries[entry.Key][entry.ID]
+		switch {
+		case !ok:
+			s.saveEntry(&entry)
+			if saved, ok := s.entries[entry.Key][entry.ID]; ok && saved.Entry == &entry {
+				saved.score = e.score
+				s.entries[entry.Key][entry.ID] = saved
+			}
+		case entry.Creation.After(existing.Creation):
+			s.unindexName(existing.Name, entry.Key, entry.ID)
+			s.entries[entry.Key][entry.ID] = inMemoryEntry{Entry: &entry, seqNum: existing.seqNum, score: e.score}
+			s.indexName(entry.Name, entry.Key, entry.ID)
+			s.generation++
+		}
+	}
+}
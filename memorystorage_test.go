@@ -0,0 +1,1157 @@
+package cookiejarx
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInMemoryStorageOnShadow(t *testing.T) {
+	storage := NewInMemoryStorage()
+
+	var shadows [][2]string
+	storage.OnShadow = func(entry, existing *Entry) {
+		shadows = append(shadows, [2]string{entry.ID, existing.ID})
+	}
+
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/")
+
+	jar.setCookies(u, []*http.Cookie{{Name: "sid", Value: "1"}}, tNow)
+	jar.setCookies(u, []*http.Cookie{{Name: "other", Value: "1", Domain: "host.test"}}, tNow)
+	jar.setCookies(u, []*http.Cookie{{Name: "sid", Value: "1", Path: "/x"}}, tNow)
+	if len(shadows) != 1 {
+		t.Fatalf("got %v, want single shadowing for path scoped cookie", shadows)
+	}
+
+	shadows = nil
+	jar.setCookies(mustParseURL("http://other.host.test/"), []*http.Cookie{{Name: "sid", Value: "2"}}, tNow)
+	if len(shadows) != 0 {
+		t.Errorf("got %v, want no shadowing for sibling host cookie", shadows)
+	}
+
+	jar.setCookies(u, []*http.Cookie{{Name: "sid", Value: "2", Domain: "host.test"}}, tNow)
+	want := [][2]string{
+		{"host.test;/;sid", "www.host.test;/;sid"},
+		{"host.test;/;sid", "www.host.test;/x;sid"},
+		{"host.test;/;sid", "other.host.test;/;sid"},
+	}
+	if len(shadows) != len(want) {
+		t.Fatalf("got %v, want %v", shadows, want)
+	}
+	for _, w := range want {
+		found := false
+		for _, s := range shadows {
+			found = found || s == w
+		}
+		if !found {
+			t.Errorf("got %v, missing %v", shadows, w)
+		}
+	}
+}
+
+func TestInMemoryStorageStrictPrefixes(t *testing.T) {
+	entries := []*Entry{
+		{Name: "__Secure-a", Key: "host.test", ID: "1", Secure: true, Path: "/x"},
+		{Name: "__Secure-b", Key: "host.test", ID: "2", Path: "/"},
+		{Name: "__Host-c", Key: "host.test", ID: "3", Secure: true, HostOnly: true, Path: "/"},
+		{Name: "__Host-d", Key: "host.test", ID: "4", Secure: true, Path: "/"},
+		{Name: "__Host-e", Key: "host.test", ID: "5", Secure: true, HostOnly: true, Path: "/x"},
+		{Name: "f", Key: "host.test", ID: "6"},
+	}
+
+	lenient := NewInMemoryStorage()
+	lenient.EntriesRestore(entries)
+	if got := len(lenient.EntriesDump()); got != len(entries) {
+		t.Errorf("lenient: got %d entries, want %d", got, len(entries))
+	}
+
+	rejected := make(map[string]error)
+	strict := NewInMemoryStorage()
+	strict.StrictPrefixes = true
+	strict.OnImportReject = func(entry *Entry, err error) {
+		rejected[entry.Name] = err
+	}
+	strict.EntriesRestore(entries)
+
+	want := map[string]error{
+		"__Secure-b": errSecurePrefix,
+		"__Host-d":   errHostPrefix,
+		"__Host-e":   errHostPrefix,
+	}
+	if len(rejected) != len(want) {
+		t.Errorf("got rejected %v, want %v", rejected, want)
+	}
+	for name, err := range want {
+		if rejected[name] != err {
+			t.Errorf("%s: got %v, want %v", name, rejected[name], err)
+		}
+	}
+	if got := len(strict.EntriesDump()); got != len(entries)-len(want) {
+		t.Errorf("strict: got %d entries, want %d", got, len(entries)-len(want))
+	}
+}
+
+func TestInMemoryStorageApproxBytes(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/")
+
+	if got := storage.ApproxBytes(); got != 0 {
+		t.Errorf("empty storage: got %d, want 0", got)
+	}
+
+	jar.setCookies(u, []*http.Cookie{{Name: "a0", Value: "value"}}, tNow)
+	first := storage.ApproxBytes()
+	if want := entryOverhead + len("host.test") + len("www.host.test;/;a0") +
+		len("a0") + len("value") + len("www.host.test") + len("/") + len(PriorityMedium); first != want {
+		t.Errorf("got %d, want %d", first, want)
+	}
+
+	for i := 1; i < 10; i++ {
+		jar.setCookies(u, []*http.Cookie{{Name: "a" + string(rune('0'+i)), Value: "value"}}, tNow)
+	}
+	// Every cookie differs only by name, so apart from the key string each
+	// adds the same amount.
+	perEntry := first - len("host.test")
+	if got, want := storage.ApproxBytes(), len("host.test")+10*perEntry; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+
+	storage.EntriesClear()
+	resp := http.Response{Header: http.Header{"Set-Cookie": {"p=1; Secure; Partitioned; Priority=High"}}}
+	jar.setCookiesPartitioned(mustParseURL("https://www.host.test/"), mustParseURL("https://top.test/"), resp.Cookies(), tNow)
+	// The ID of a partitioned entry ends with its PartitionKey as well.
+	if got, want := storage.ApproxBytes(), entryOverhead+len("host.test")+len("www.host.test;/;p;top.test")+
+		len("p")+len("1")+len("www.host.test")+len("/")+len("High")+len("top.test"); got != want {
+		t.Errorf("partitioned: got %d, want %d", got, want)
+	}
+}
+
+func TestInMemoryStorageMaxKeys(t *testing.T) {
+	save := func(s *InMemoryStorage, key string) {
+		s.SaveEntry(&Entry{Name: "a", Key: key, ID: key + ";/;a", Domain: key, Path: "/", Expires: endOfTime})
+	}
+	keys := func(s *InMemoryStorage) (keys []string) {
+		for key := range s.entries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	single := NewInMemoryStorage()
+	single.MaxKeys = 3
+	for _, key := range []string{"a.test", "b.test", "c.test"} {
+		save(single, key)
+	}
+	single.Entries(false, "a.test", "/", "a.test", tNow)
+	save(single, "d.test")
+	if got, want := strings.Join(keys(single), " "), "a.test c.test d.test"; got != want {
+		t.Errorf("single: got %q, want %q", got, want)
+	}
+
+	watermark := NewInMemoryStorage()
+	watermark.MaxKeys = 4
+	watermark.KeysLowWatermark = 2
+	for _, key := range []string{"a.test", "b.test", "c.test", "d.test"} {
+		save(watermark, key)
+	}
+	watermark.Entries(false, "b.test", "/", "b.test", tNow)
+	save(watermark, "e.test")
+	if got, want := strings.Join(keys(watermark), " "), "b.test e.test"; got != want {
+		t.Errorf("watermark: got %q, want %q", got, want)
+	}
+	if len(watermark.keyUsed) != 2 {
+		t.Errorf("watermark: got %d tracked keys, want 2", len(watermark.keyUsed))
+	}
+}
+
+func benchmarkInMemoryStorageMaxKeys(b *testing.B, lowWatermark int) {
+	entries := make([]*Entry, 1000)
+	for i := range entries {
+		key := fmt.Sprintf("host%d.test", i)
+		entries[i] = &Entry{Name: "a", Key: key, ID: key + ";/;a", Domain: key, Path: "/"}
+	}
+
+	s := NewInMemoryStorage()
+	s.MaxKeys = 500
+	s.KeysLowWatermark = lowWatermark
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.SaveEntry(entries[i%len(entries)])
+	}
+}
+
+func BenchmarkInMemoryStorageMaxKeysSingle(b *testing.B) {
+	benchmarkInMemoryStorageMaxKeys(b, 0)
+}
+
+func BenchmarkInMemoryStorageMaxKeysWatermark(b *testing.B) {
+	benchmarkInMemoryStorageMaxKeys(b, 400)
+}
+
+func TestInMemoryStorageCookieLimits(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{
+		PublicSuffixList:    testPSL{},
+		Storage:             storage,
+		MaxCookiesPerDomain: 3,
+		MaxCookiesTotal:     5,
+	})
+	if storage.MaxEntriesPerKey != 3 || storage.MaxEntries != 5 {
+		t.Fatalf("got limits %d/%d, want 3/5", storage.MaxEntriesPerKey, storage.MaxEntries)
+	}
+
+	names := func() string {
+		var s []string
+		for _, e := range storage.EntriesDump() {
+			s = append(s, e.Domain+":"+e.Name)
+		}
+		sort.Strings(s)
+		return strings.Join(s, " ")
+	}
+
+	a := mustParseURL("http://a.test/")
+	b := mustParseURL("http://b.test/")
+	now := tNow
+	set := func(u *url.URL, name string) {
+		now = now.Add(time.Second)
+		jar.setCookies(u, []*http.Cookie{{Name: name, Value: "1"}}, now)
+	}
+
+	set(a, "a1")
+	set(a, "a2")
+	set(a, "a3")
+	// Accessing a1 makes a2 the least recently accessed one.
+	now = now.Add(time.Second)
+	jar.cookies(mustParseURL("http://a.test/"), now)
+	set(a, "a1")
+	set(a, "a4")
+	if got, want := names(), "a.test:a1 a.test:a3 a.test:a4"; got != want {
+		t.Errorf("per domain: got %q, want %q", got, want)
+	}
+
+	set(b, "b1")
+	set(b, "b2")
+	if got, want := names(), "a.test:a1 a.test:a3 a.test:a4 b.test:b1 b.test:b2"; got != want {
+		t.Errorf("total: got %q, want %q", got, want)
+	}
+
+	set(b, "b3")
+	if got, want := names(), "a.test:a1 a.test:a4 b.test:b1 b.test:b2 b.test:b3"; got != want {
+		t.Errorf("total eviction: got %q, want %q", got, want)
+	}
+}
+
+func TestInMemoryStorageDefaultCookieLimits(t *testing.T) {
+	storage := NewInMemoryStorage()
+	if storage.MaxEntriesPerKey != 0 || storage.MaxEntries != 0 {
+		t.Errorf("got limits %d/%d for bare storage, want none", storage.MaxEntriesPerKey, storage.MaxEntries)
+	}
+
+	New(&Options{Storage: storage})
+	if storage.MaxEntriesPerKey != DefaultMaxCookiesPerDomain || storage.MaxEntries != DefaultMaxCookiesTotal {
+		t.Errorf("got limits %d/%d, want defaults", storage.MaxEntriesPerKey, storage.MaxEntries)
+	}
+
+	// Limits set on a provided storage are kept, unless set by options.
+	storage.MaxEntriesPerKey = 7
+	New(&Options{Storage: storage})
+	if storage.MaxEntriesPerKey != 7 || storage.MaxEntries != DefaultMaxCookiesTotal {
+		t.Errorf("got limits %d/%d, want 7/default", storage.MaxEntriesPerKey, storage.MaxEntries)
+	}
+
+	jar, _ := New(&Options{Storage: storage, MaxCookiesPerDomain: -1, MaxCookiesTotal: -1})
+	u := mustParseURL("http://a.test/")
+	for i := 0; i < DefaultMaxCookiesPerDomain+10; i++ {
+		jar.setCookies(u, []*http.Cookie{{Name: fmt.Sprint(i), Value: "1"}}, tNow)
+	}
+	if got := len(storage.EntriesDump()); got != DefaultMaxCookiesPerDomain+10 {
+		t.Errorf("got %d entries with disabled limits, want %d", got, DefaultMaxCookiesPerDomain+10)
+	}
+}
+
+func TestInMemoryStorageEntriesImport(t *testing.T) {
+	storage := NewInMemoryStorage()
+	storage.EntriesRestore([]*Entry{
+		{Name: "a", Value: "old", Key: "host.test", ID: "a", Creation: tNow},
+		{Name: "b", Value: "stored", Key: "host.test", ID: "b", Creation: tNow.Add(time.Hour)},
+	})
+
+	newest := func(existing, incoming *Entry) *Entry {
+		if incoming.Creation.After(existing.Creation) {
+			return incoming
+		}
+		return nil
+	}
+
+	storage.EntriesImport([]*Entry{
+		{Name: "a", Value: "new", Key: "host.test", ID: "a", Creation: tNow.Add(time.Minute)},
+		{Name: "b", Value: "stale", Key: "host.test", ID: "b", Creation: tNow},
+		{Name: "c", Value: "added", Key: "host.test", ID: "c", Creation: tNow},
+	}, newest)
+
+	got := make(map[string]string)
+	for _, e := range storage.EntriesDump() {
+		got[e.ID] = e.Value
+		if e.ID == "a" && !e.Creation.Equal(tNow.Add(time.Minute)) {
+			t.Errorf("got Creation %v of the winning entry, want its own %v", e.Creation, tNow.Add(time.Minute))
+		}
+	}
+	want := map[string]string{"a": "new", "b": "stored", "c": "added"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	storage.EntriesImport([]*Entry{{Name: "b", Value: "forced", Key: "host.test", ID: "b"}}, nil)
+	for _, e := range storage.EntriesDump() {
+		if e.ID == "b" && e.Value != "forced" {
+			t.Errorf("nil resolve: got value %q, want %q", e.Value, "forced")
+		}
+	}
+}
+
+func TestInMemoryStorageLastModified(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/")
+
+	lastModified := func() time.Time {
+		entries := storage.EntriesDump()
+		if len(entries) != 1 {
+			t.Fatalf("got %d entries, want 1", len(entries))
+		}
+		return entries[0].LastModified
+	}
+
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1"}}, tNow)
+	if got := lastModified(); !got.Equal(tNow) {
+		t.Errorf("new cookie: got %v, want %v", got, tNow)
+	}
+
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1"}}, tNow.Add(time.Minute))
+	jar.cookies(u, tNow.Add(2*time.Minute))
+	if got := lastModified(); !got.Equal(tNow) {
+		t.Errorf("unchanged cookie: got %v, want %v", got, tNow)
+	}
+
+	for i, c := range []*http.Cookie{
+		{Name: "a", Value: "2"},
+		{Name: "a", Value: "2", Secure: true},
+		{Name: "a", Value: "2", Secure: true, MaxAge: 3600},
+	} {
+		now := tNow.Add(time.Duration(i+3) * time.Minute)
+		jar.setCookies(mustParseURL("https://www.host.test/"), []*http.Cookie{c}, now)
+		if got := lastModified(); !got.Equal(now) {
+			t.Errorf("change %d: got %v, want %v", i, got, now)
+		}
+	}
+}
+
+func TestInMemoryStorageSweeper(t *testing.T) {
+	storage := NewInMemoryStorage()
+	storage.EntriesRestore([]*Entry{
+		{Name: "expired", Key: "rare.test", ID: "1", Persistent: true, Expires: time.Now().Add(-time.Second)},
+		{Name: "live", Key: "host.test", ID: "2", Persistent: true, Expires: time.Now().Add(time.Hour)},
+		{Name: "session", Key: "host.test", ID: "3", Expires: endOfTime},
+	})
+
+	stop := storage.StartSweeper(time.Millisecond)
+	defer stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(storage.EntriesDump()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expired entry not swept, got %d entries", len(storage.EntriesDump()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	stop()
+	stop()
+
+	storage.mu.Lock()
+	_, ok := storage.entries["rare.test"]
+	storage.mu.Unlock()
+	if ok {
+		t.Errorf("empty key not pruned")
+	}
+}
+
+func TestInMemoryStorageSubdomainFlood(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{
+		PublicSuffixList:    testPSL{},
+		Storage:             storage,
+		MaxCookiesPerDomain: 10,
+		MaxCookiesTotal:     -1,
+	})
+
+	jar.setCookies(mustParseURL("http://www.victim.test/"), []*http.Cookie{{Name: "sid", Value: "1"}}, tNow)
+
+	for i := 0; i < 100; i++ {
+		u := mustParseURL(fmt.Sprintf("http://sub%d.attacker.test/", i))
+		jar.setCookies(u, []*http.Cookie{{Name: "flood", Value: "1"}}, tNow.Add(time.Duration(i)*time.Second))
+	}
+
+	counts := storage.KeyCounts()
+	if got := counts["attacker.test"]; got != 10 {
+		t.Errorf("got %d entries for flooding key, want 10", got)
+	}
+	if got := counts["victim.test"]; got != 1 {
+		t.Errorf("got %d entries for other key, want 1", got)
+	}
+
+	// The most recently set cookies survive.
+	for _, e := range storage.EntriesDump() {
+		if e.Key == "attacker.test" && e.Creation.Before(tNow.Add(90*time.Second)) {
+			t.Errorf("got stale entry %s", e.ID)
+		}
+	}
+}
+
+func TestInMemoryStorageCounter(t *testing.T) {
+	now := time.Now()
+	storage := NewInMemoryStorage()
+	storage.EntriesRestore([]*Entry{
+		{Name: "a", Key: "a.test", ID: "1", Expires: endOfTime},
+		{Name: "b", Key: "a.test", ID: "2", Persistent: true, Expires: now.Add(time.Hour)},
+		{Name: "c", Key: "c.test", ID: "3", Persistent: true, Expires: now.Add(-time.Hour)},
+		{Name: "d", Key: "b.test", ID: "4", Expires: endOfTime},
+	})
+
+	if got := storage.Len(); got != 3 {
+		t.Errorf("got Len %d, want 3", got)
+	}
+	if got, want := strings.Join(storage.Domains(), " "), "a.test b.test"; got != want {
+		t.Errorf("got Domains %q, want %q", got, want)
+	}
+
+	jar, _ := New(&Options{Storage: storage})
+	if got := jar.count(now.Add(2 * time.Hour)); got != 2 {
+		t.Errorf("got jar Len %d, want 2", got)
+	}
+	if got := (&Jar{storage: dumpOnlyStorage{storage}}).count(now); got != 3 {
+		t.Errorf("got Dumper jar Len %d, want 3", got)
+	}
+}
+
+func TestInMemoryStorageClone(t *testing.T) {
+	storage := NewInMemoryStorage()
+	storage.MaxEntriesPerKey = 7
+	storage.EntriesRestore([]*Entry{
+		{Name: "a", Value: "1", Key: "host.test", ID: "a", Expires: endOfTime},
+	})
+
+	clone := storage.Clone()
+	if clone.MaxEntriesPerKey != 7 {
+		t.Errorf("got MaxEntriesPerKey %d, want 7", clone.MaxEntriesPerKey)
+	}
+
+	clone.EntriesDump()[0].Value = "mutated"
+	clone.SaveEntry(&Entry{Name: "b", Value: "2", Key: "host.test", ID: "b", Expires: endOfTime})
+
+	entries := storage.EntriesDump()
+	if len(entries) != 1 || entries[0].Value != "1" {
+		t.Errorf("original changed: got %+v", entries)
+	}
+	if clone.nextSeqNum != storage.nextSeqNum+1 {
+		t.Errorf("got clone nextSeqNum %d, want %d", clone.nextSeqNum, storage.nextSeqNum+1)
+	}
+}
+
+func TestInMemoryStorageMerge(t *testing.T) {
+	storage := NewInMemoryStorage()
+	storage.EntriesRestore([]*Entry{
+		{Name: "a", Value: "old", Key: "host.test", ID: "a", Creation: tNow, Expires: endOfTime},
+		{Name: "b", Value: "newer", Key: "host.test", ID: "b", Creation: tNow.Add(time.Hour), Expires: endOfTime},
+	})
+
+	other := NewInMemoryStorage()
+	other.EntriesRestore([]*Entry{
+		{Name: "a", Value: "new", Key: "host.test", ID: "a", Creation: tNow.Add(time.Minute), Expires: endOfTime},
+		{Name: "b", Value: "older", Key: "host.test", ID: "b", Creation: tNow, Expires: endOfTime},
+		{Name: "c", Value: "added", Key: "other.test", ID: "c", Creation: tNow, Expires: endOfTime},
+	})
+
+	storage.Merge(other)
+	storage.Merge(storage)
+
+	got := make(map[string]string)
+	for _, e := range storage.EntriesDump() {
+		got[e.ID] = e.Value
+	}
+	want := map[string]string{"a": "new", "b": "newer", "c": "added"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	storage.EntriesDump()[0].Value = "mutated"
+	for _, e := range other.EntriesDump() {
+		if e.Value == "mutated" {
+			t.Errorf("merged entries shared with source")
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			storage.Merge(other)
+		}()
+		go func() {
+			defer wg.Done()
+			other.Merge(storage)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestInMemoryStorageFind(t *testing.T) {
+	storage := NewInMemoryStorage()
+	storage.EntriesRestore([]*Entry{
+		{Name: "a", Key: "a.test", ID: "a", Secure: true, Expires: endOfTime},
+		{Name: "b", Key: "a.test", ID: "b", Persistent: true, Expires: tNow.Add(30 * time.Minute)},
+		{Name: "c", Key: "c.test", ID: "c", Persistent: true, Expires: tNow.Add(2 * time.Hour)},
+	})
+
+	names := func(entries []*Entry) string {
+		var s []string
+		for _, e := range entries {
+			s = append(s, e.Name)
+		}
+		sort.Strings(s)
+		return strings.Join(s, " ")
+	}
+
+	insecure := storage.Find(func(e *Entry) bool { return !e.Secure })
+	if got, want := names(insecure), "b c"; got != want {
+		t.Errorf("insecure: got %q, want %q", got, want)
+	}
+
+	expiring := storage.Find(func(e *Entry) bool {
+		return e.Persistent && e.Expires.Before(tNow.Add(time.Hour))
+	})
+	if got, want := names(expiring), "b"; got != want {
+		t.Errorf("expiring: got %q, want %q", got, want)
+	}
+
+	if got := storage.Find(func(*Entry) bool { return false }); len(got) != 0 {
+		t.Errorf("got %d entries, want none", len(got))
+	}
+}
+
+func TestInMemoryStoragePriorityEviction(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage, MaxCookiesPerDomain: 3})
+
+	u := mustParseURL("http://www.host.test/")
+	now := tNow
+	set := func(header string) {
+		now = now.Add(time.Second)
+		jar.setCookies(u, (&http.Response{Header: http.Header{"Set-Cookie": {header}}}).Cookies(), now)
+	}
+
+	names := func() string {
+		var s []string
+		for _, e := range storage.EntriesDump() {
+			s = append(s, e.Name+":"+e.Priority)
+		}
+		sort.Strings(s)
+		return strings.Join(s, " ")
+	}
+
+	set("high=1; Priority=High")
+	set("medium=1")
+	set("low=1; priority=low")
+	set("new1=1")
+	if got, want := names(), "high:High medium:Medium new1:Medium"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Among equal priorities the least recently accessed entry is evicted.
+	set("new2=1; Priority=High")
+	if got, want := names(), "high:High new1:Medium new2:High"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestInMemoryStorageKeepNewest(t *testing.T) {
+	// Saving an entry updates its Creation, so fresh entries are used for
+	// every save.
+	newer := func() *Entry {
+		return &Entry{Name: "a", Value: "newer", Domain: "host.test", Path: "/", Key: "host.test",
+			ID: "host.test;/;a", Expires: endOfTime, Creation: tNow}
+	}
+	older := func() *Entry {
+		e := newer()
+		e.Value = "older"
+		e.Creation = tNow.Add(-time.Hour)
+		return e
+	}
+
+	for _, keepNewest := range []bool{false, true} {
+		storage := NewInMemoryStorage()
+		storage.KeepNewest = keepNewest
+		storage.SaveEntry(newer())
+		storage.SaveEntry(older())
+
+		want := "older"
+		if keepNewest {
+			want = "newer"
+		}
+		entries := storage.EntriesDump()
+		if len(entries) != 1 || entries[0].Value != want {
+			t.Errorf("KeepNewest=%t: got %+v, want value %q", keepNewest, entries, want)
+		}
+	}
+
+	storage := NewInMemoryStorage()
+	storage.KeepNewest = true
+	storage.SaveEntry(older())
+	storage.SaveEntry(newer())
+	if entries := storage.EntriesDump(); len(entries) != 1 || entries[0].Value != "newer" {
+		t.Errorf("got %+v, want newer entry to replace older one", entries)
+	}
+
+	// A replay created after the stored entry, but before its last
+	// modification, is stale although the stored entry keeps its earlier
+	// Creation.
+	updated := newer()
+	updated.Value = "updated"
+	updated.Creation = tNow.Add(2 * time.Hour)
+	updated.LastModified = updated.Creation
+	storage.SaveEntry(updated)
+	replay := newer()
+	replay.Value = "replay"
+	replay.Creation = tNow.Add(time.Hour)
+	replay.LastModified = replay.Creation
+	storage.SaveEntry(replay)
+	if entries := storage.EntriesDump(); len(entries) != 1 || entries[0].Value != "updated" {
+		t.Errorf("got %+v, want replay to keep updated entry", entries)
+	}
+}
+
+func TestInMemoryStorageAccessResolution(t *testing.T) {
+	storage := NewInMemoryStorage()
+	storage.AccessResolution = time.Minute
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+
+	u := mustParseURL("http://www.host.test/a/b")
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "a", Value: "1", Path: "/"},
+		{Name: "b", Value: "2", Path: "/a"},
+		{Name: "c", Value: "3", MaxAge: 30},
+	}, tNow)
+
+	lastAccess := func() time.Time {
+		entries := storage.EntriesPeek(false, "www.host.test", "/", "host.test", tNow)
+		return entries[0].LastAccess
+	}
+
+	query := func(now time.Time) string {
+		var s []string
+		for _, e := range storage.Entries(false, "www.host.test", "/a/b", "host.test", now) {
+			s = append(s, e.Name)
+		}
+		return strings.Join(s, " ")
+	}
+
+	if got, want := query(tNow.Add(10*time.Second)), "b c a"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := lastAccess(); !got.Equal(tNow) {
+		t.Errorf("got LastAccess %v within resolution, want %v", got, tNow)
+	}
+
+	if got, want := query(tNow.Add(30*time.Second)), "b a"; got != want {
+		t.Errorf("expired: got %q, want %q", got, want)
+	}
+	if n := storage.count(tNow); n != 2 {
+		t.Errorf("got %d stored entries, want expired entry removed", n)
+	}
+
+	if got, want := query(tNow.Add(2*time.Minute)), "b a"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := lastAccess(), tNow.Add(2*time.Minute); !got.Equal(want) {
+		t.Errorf("got LastAccess %v beyond resolution, want %v", got, want)
+	}
+}
+
+func benchmarkInMemoryStorageEntriesParallel(b *testing.B, resolution time.Duration) {
+	s := NewInMemoryStorage()
+	s.AccessResolution = resolution
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("host%d.test", i)
+		for _, name := range []string{"a", "b", "c"} {
+			s.SaveEntry(&Entry{Name: name, Key: keys[i], ID: keys[i] + ";/;" + name, Domain: keys[i], Path: "/",
+				Expires: endOfTime, LastAccess: time.Now()})
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			key := keys[i%len(keys)]
+			s.Entries(false, key, "/", key, time.Now())
+		}
+	})
+}
+
+// BenchmarkInMemoryStorageEntriesParallelExact updates last access times on
+// every lookup, serializing lookups on the write lock.
+func BenchmarkInMemoryStorageEntriesParallelExact(b *testing.B) {
+	benchmarkInMemoryStorageEntriesParallel(b, 0)
+}
+
+// BenchmarkInMemoryStorageEntriesParallelResolution lets lookups proceed in
+// parallel under the read lock.
+func BenchmarkInMemoryStorageEntriesParallelResolution(b *testing.B) {
+	benchmarkInMemoryStorageEntriesParallel(b, time.Minute)
+}
+
+func TestInMemoryStorageDebugState(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+
+	jar.setCookies(mustParseURL("http://www.host.test/"), []*http.Cookie{
+		{Name: "a", Value: "1"},
+		{Name: "b", Value: "2", Domain: "host.test"},
+	}, tNow)
+	jar.setCookies(mustParseURL("http://other.test/"), []*http.Cookie{{Name: "c", Value: "3"}}, tNow)
+	jar.setCookies(mustParseURL("http://www.host.test/"), []*http.Cookie{
+		{Name: "a", Value: "changed"},
+		{Name: "b", Domain: "host.test", MaxAge: -1},
+	}, tNow)
+
+	var got []string
+	for key, submap := range storage.DebugState() {
+		for id, e := range submap {
+			got = append(got, fmt.Sprintf("%s|%s|%d|%s", key, id, e.SeqNum, e.Entry.Value))
+		}
+	}
+	sort.Strings(got)
+
+	want := []string{
+		"host.test|www.host.test;/;a|0|changed",
+		"other.test|other.test;/;c|2|3",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestInMemoryStorageDecayHalfLife(t *testing.T) {
+	entry := func(name string, lastAccess time.Time) *Entry {
+		return &Entry{Name: name, Value: "1", Domain: "www.host.test", Path: "/" + name, Key: "host.test",
+			ID: "www.host.test;/" + name + ";" + name, HostOnly: true, Expires: endOfTime,
+			Creation: lastAccess, LastAccess: lastAccess}
+	}
+
+	for _, tc := range []struct {
+		halfLife time.Duration
+		want     string
+	}{
+		{0, "fresh third"},
+		{time.Hour, "sent third"},
+	} {
+		storage := NewInMemoryStorage()
+		storage.MaxEntriesPerKey = 2
+		storage.DecayHalfLife = tc.halfLife
+
+		// sent is set two hours ago and sent frequently for ten minutes,
+		// while fresh is set later and never sent.
+		now := tNow.Add(-2 * time.Hour)
+		storage.SaveEntry(entry("sent", now))
+		for i := 0; i < 10; i++ {
+			now = now.Add(time.Minute)
+			storage.Entries(false, "www.host.test", "/sent", "host.test", now)
+		}
+		storage.SaveEntry(entry("fresh", tNow))
+
+		// Scores survive snapshots and merges.
+		jsonStorage := NewInMemoryStorage()
+		if data, err := storage.MarshalJSON(); err != nil {
+			t.Fatal(err)
+		} else if err = jsonStorage.UnmarshalJSON(data); err != nil {
+			t.Fatal(err)
+		}
+		binaryStorage := NewInMemoryStorage()
+		if data, err := storage.MarshalBinary(); err != nil {
+			t.Fatal(err)
+		} else if err = binaryStorage.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		mergedStorage := NewInMemoryStorage()
+		mergedStorage.Merge(storage)
+
+		for name, s := range map[string]*InMemoryStorage{
+			"original": storage,
+			"json":     jsonStorage,
+			"binary":   binaryStorage,
+			"merged":   mergedStorage,
+		} {
+			s.MaxEntriesPerKey = 2
+			s.DecayHalfLife = tc.halfLife
+			s.SaveEntry(entry("third", tNow.Add(time.Second)))
+
+			var names []string
+			for _, e := range s.EntriesDump() {
+				names = append(names, e.Name)
+			}
+			sort.Strings(names)
+			if got := strings.Join(names, " "); got != tc.want {
+				t.Errorf("%s half-life %v: got %q, want %q", name, tc.halfLife, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestInMemoryStorageSnapshots(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, tNow)
+
+	if storage.PopSnapshot() {
+		t.Errorf("PopSnapshot of empty stack succeeded")
+	}
+
+	before := storage.DebugState()
+	storage.PushSnapshot()
+
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "changed"}, {Name: "c", Value: "3"}}, tNow.Add(time.Second))
+	jar.setCookies(u, []*http.Cookie{{Name: "b", MaxAge: -1}}, tNow.Add(time.Second))
+	storage.PushSnapshot()
+	jar.setCookies(u, []*http.Cookie{{Name: "d", Value: "4"}}, tNow.Add(2*time.Second))
+
+	if !storage.PopSnapshot() {
+		t.Fatalf("PopSnapshot failed")
+	}
+	if got := len(storage.EntriesDump()); got != 2 {
+		t.Errorf("got %d entries after first pop, want 2", got)
+	}
+
+	if !storage.PopSnapshot() {
+		t.Fatalf("PopSnapshot failed")
+	}
+	if after := storage.DebugState(); !reflect.DeepEqual(after, before) {
+		t.Errorf("got state %v, want %v", after, before)
+	}
+
+	// New entries continue the restored sequence.
+	jar.setCookies(u, []*http.Cookie{{Name: "e", Value: "5"}}, tNow.Add(3*time.Second))
+	if seq, _ := storage.seqNum("host.test", "www.host.test;/;e"); seq != 2 {
+		t.Errorf("got sequence number %d, want 2", seq)
+	}
+}
+
+func TestInMemoryStorageStats(t *testing.T) {
+	for _, trackStats := range []bool{false, true} {
+		storage := NewInMemoryStorage()
+		jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage, TrackStats: trackStats})
+		u := mustParseURL("http://www.host.test/dir/")
+		jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1", Path: "/"}, {Name: "b", Value: "2"}}, tNow)
+
+		for i := 1; i <= 3; i++ {
+			jar.cookies(mustParseURL("http://www.host.test/dir/"), tNow.Add(time.Duration(i)*time.Second))
+		}
+		jar.cookies(mustParseURL("http://www.host.test/"), tNow.Add(4*time.Second))
+
+		// Setting a cookie again keeps its count.
+		jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "changed", Path: "/"}}, tNow.Add(5*time.Second))
+
+		want := map[string]EntryStat{
+			"www.host.test;/;a":    {Key: "host.test", Name: "a", SendCount: 4, LastAccess: tNow.Add(5 * time.Second), HostOnly: true},
+			"www.host.test;/dir;b": {Key: "host.test", Name: "b", SendCount: 3, LastAccess: tNow.Add(3 * time.Second), HostOnly: true},
+		}
+		if !trackStats {
+			for id, stat := range want {
+				stat.SendCount = 0
+				want[id] = stat
+			}
+		}
+		if got := storage.Stats(); !reflect.DeepEqual(got, want) {
+			t.Errorf("track stats %t: got %v, want %v", trackStats, got, want)
+		}
+	}
+}
+
+func TestInMemoryStorageLess(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/a/b/c")
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "c", Value: "1", Path: "/"},
+		{Name: "a", Value: "2", Path: "/a"},
+		{Name: "b", Value: "3", Path: "/a/b"},
+		{Name: "a", Value: "4", Path: "/a/b"},
+	}, tNow)
+
+	cookies := func() string {
+		var s []string
+		for _, c := range jar.cookies(u, tNow) {
+			s = append(s, c.String())
+		}
+		return strings.Join(s, " ")
+	}
+
+	if got, want := cookies(), "b=3 a=4 a=2 c=1"; got != want {
+		t.Errorf("default order: got %q, want %q", got, want)
+	}
+
+	// Cookies of the same name keep the RFC 6265 order.
+	storage.Less = func(a, b *Entry) bool { return a.Name < b.Name }
+	if got, want := cookies(), "a=4 a=2 b=3 c=1"; got != want {
+		t.Errorf("by name: got %q, want %q", got, want)
+	}
+}
+
+func TestInMemoryStorageForEach(t *testing.T) {
+	storage := NewInMemoryStorage()
+	storage.EntriesRestore([]*Entry{
+		{Name: "a", Key: "a.test", ID: "a", Expires: endOfTime},
+		{Name: "b", Key: "a.test", ID: "b", Expires: endOfTime},
+		{Name: "c", Key: "c.test", ID: "c", Expires: endOfTime},
+	})
+
+	var names []string
+	storage.ForEach(func(e *Entry) bool {
+		names = append(names, e.Name)
+		return true
+	})
+	sort.Strings(names)
+	if got, want := strings.Join(names, " "), "a b c"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	calls := 0
+	storage.ForEach(func(*Entry) bool {
+		calls++
+		return calls < 2
+	})
+	if calls != 2 {
+		t.Errorf("got %d calls, want 2 before stopping", calls)
+	}
+}
+
+func TestSummarizeStats(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	jar.setCookies(mustParseURL("https://www.host.test/"), []*http.Cookie{
+		{Name: "host", Value: "1"},
+		{Name: "domain", Value: "2", Domain: "host.test"},
+		{Name: "secure", Value: "3", Secure: true, MaxAge: 60},
+		{Name: "securedomain", Value: "4", Domain: "host.test", Secure: true},
+		{Name: "persistent", Value: "5", Domain: "host.test", MaxAge: 60},
+	}, tNow)
+
+	want := StatsSummary{
+		Total:      5,
+		HostOnly:   2,
+		Domain:     3,
+		Secure:     2,
+		Insecure:   3,
+		Persistent: 2,
+		Session:    3,
+	}
+	if got := SummarizeStats(storage.Stats()); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if got := SummarizeStats(nil); got != (StatsSummary{}) {
+		t.Errorf("got %+v for no entries, want zero", got)
+	}
+}
+
+func TestInMemoryStorageReindexIDs(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+
+	// Entries stored under an old "Name|Domain|Path" ID format, two of them
+	// differing in the case of their ID only.
+	storage.EntriesRestore([]*Entry{
+		{Name: "a", Value: "1", Domain: "www.host.test", Path: "/", HostOnly: true, Key: "host.test",
+			ID: "a|www.host.test|/", Expires: endOfTime, Creation: tNow},
+		{Name: "b", Value: "old", Domain: "host.test", Path: "/", Key: "host.test",
+			ID: "b|host.test|/", Expires: endOfTime, Creation: tNow},
+		{Name: "b", Value: "new", Domain: "host.test", Path: "/", Key: "host.test",
+			ID: "B|HOST.TEST|/", Expires: endOfTime, Creation: tNow.Add(time.Second)},
+	})
+
+	storage.ReindexIDs()
+
+	var ids []string
+	for _, e := range storage.EntriesDump() {
+		ids = append(ids, e.ID+"="+e.Value)
+	}
+	sort.Strings(ids)
+	if got, want := strings.Join(ids, " "), "host.test;/;b=new www.host.test;/;a=1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Reindexed entries can be replaced and removed by the jar.
+	u := mustParseURL("http://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "2"}, {Name: "b", MaxAge: -1, Domain: "host.test"}}, tNow)
+	if got := storage.Len(); got != 1 {
+		t.Errorf("got %d entries, want 1", got)
+	}
+	if c, _ := jar.getCookie(u, "a", tNow); c == nil || c.Value != "2" {
+		t.Errorf("got %v, want a=2", c)
+	}
+
+	storage.ReindexIDsWith(func(e *Entry) string { return HashID(e.RawID()) })
+	if got, want := storage.EntriesDump()[0].ID, HashID("www.host.test;/;a"); got != want {
+		t.Errorf("got ID %q, want %q", got, want)
+	}
+}
+
+func TestInMemoryStorageEntriesDumpOrder(t *testing.T) {
+	for _, storage := range []Storage{NewInMemoryStorage(), NewShardedInMemoryStorage(4)} {
+		jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+		for _, host := range []string{"www.c.test", "www.a.test", "www.b.test"} {
+			u := mustParseURL("http://" + host + "/")
+			for _, name := range []string{"z", "x", "y"} {
+				jar.setCookies(u, []*http.Cookie{{Name: name, Value: host}}, tNow)
+			}
+		}
+
+		dumper := storage.(Dumper)
+		first := dumper.EntriesDump()
+		for i := 0; i < 10; i++ {
+			if again := dumper.EntriesDump(); !reflect.DeepEqual(first, again) {
+				t.Fatalf("%T: dumps of the same state differ", storage)
+			}
+		}
+
+		var s []string
+		for _, e := range first {
+			s = append(s, e.Key+":"+e.Name)
+		}
+		want := "a.test:z a.test:x a.test:y b.test:z b.test:x b.test:y c.test:z c.test:x c.test:y"
+		if got := strings.Join(s, " "); got != want {
+			t.Errorf("%T: got %q, want %q", storage, got, want)
+		}
+	}
+}
+
+// checkNameIndex reports differences of the name index of s from its entries.
+func checkNameIndex(t *testing.T, step string, s *InMemoryStorage) {
+	t.Helper()
+
+	want := make(map[string]map[entryRef]struct{})
+	for key, submap := range s.entries {
+		for id, e := range submap {
+			if want[e.Name] == nil {
+				want[e.Name] = make(map[entryRef]struct{})
+			}
+			want[e.Name][entryRef{key: key, id: id}] = struct{}{}
+		}
+	}
+	if !reflect.DeepEqual(s.names, want) {
+		t.Errorf("%s: got index %v, want %v", step, s.names, want)
+	}
+}
+
+func TestInMemoryStorageNameIndex(t *testing.T) {
+	storage := NewIndexedInMemoryStorage()
+	storage.MaxEntriesPerKey = 3
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+
+	u := mustParseURL("http://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "a", Value: "1"},
+		{Name: "a", Value: "2", Path: "/x"},
+		{Name: "b", Value: "3", MaxAge: 60},
+	}, tNow)
+	jar.setCookies(mustParseURL("http://www.other.test/"), []*http.Cookie{{Name: "a", Value: "4"}}, tNow)
+	checkNameIndex(t, "save", storage)
+
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "overwritten"}}, tNow)
+	checkNameIndex(t, "overwrite", storage)
+
+	jar.setCookies(u, []*http.Cookie{{Name: "c", Value: "5"}}, tNow)
+	checkNameIndex(t, "eviction", storage)
+
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Path: "/x", MaxAge: -1}}, tNow)
+	checkNameIndex(t, "removal", storage)
+
+	storage.Entries(false, "www.host.test", "/", "host.test", tNow.Add(time.Hour))
+	checkNameIndex(t, "expiry", storage)
+
+	storage.PushSnapshot()
+	jar.setCookies(u, []*http.Cookie{{Name: "d", Value: "6"}}, tNow)
+	storage.PopSnapshot()
+	checkNameIndex(t, "snapshot", storage)
+
+	storage.ReindexIDsWith(func(e *Entry) string { return HashID(e.RawID()) })
+	checkNameIndex(t, "reindex", storage)
+
+	clone := storage.Clone()
+	checkNameIndex(t, "clone", clone)
+
+	var got []string
+	for _, e := range storage.EntriesByName("a") {
+		got = append(got, e.Value)
+	}
+	if want := "4"; strings.Join(got, " ") != want {
+		t.Errorf("got entries named a %q, want %q", got, want)
+	}
+	scanned := NewInMemoryStorage()
+	scanned.EntriesRestore(storage.EntriesDump())
+	if !reflect.DeepEqual(storage.EntriesByName("c"), scanned.EntriesByName("c")) {
+		t.Error("indexed and scanned lookups differ")
+	}
+
+	data, err := storage.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewIndexedInMemoryStorage()
+	if err = restored.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	checkNameIndex(t, "unmarshal", restored)
+
+	storage.EntriesClear()
+	checkNameIndex(t, "clear", storage)
+}
+
+// nameQueryStorage returns a storage with many entries of distinct names.
+func nameQueryStorage(s *InMemoryStorage) *InMemoryStorage {
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("host%d.test", i%500)
+		e := &Entry{Name: fmt.Sprintf("n%d", i%100), Domain: key, Path: fmt.Sprintf("/%d", i), Key: key, Expires: endOfTime}
+		e.ID = e.RawID()
+		s.SaveEntry(e)
+	}
+	return s
+}
+
+func BenchmarkInMemoryStorageEntriesByName(b *testing.B) {
+	s := nameQueryStorage(NewInMemoryStorage())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.EntriesByName("n42")
+	}
+}
+
+func BenchmarkInMemoryStorageEntriesByNameIndexed(b *testing.B) {
+	s := nameQueryStorage(NewIndexedInMemoryStorage())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.EntriesByName("n42")
+	}
+}
@@ -0,0 +1,189 @@
+package cookiejarx
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// netscapeHeader is the conventional first line of a Netscape cookies.txt file.
+const netscapeHeader = "# Netscape HTTP Cookie File"
+
+// netscapeHttpOnlyPrefix marks HttpOnly cookies in the domain column.
+const netscapeHttpOnlyPrefix = "#HttpOnly_"
+
+// WriteNetscape writes all entries in the Netscape cookies.txt format used by
+// curl and wget, one tab-separated line per entry:
+//
+//	domain	subdomains	path	secure	expiration	name	value
+//
+// Domain cookies are written with a leading dot in the domain column and TRUE
+// in the subdomains column. Session cookies are written with expiration 0 and
+// HttpOnly cookies have their domain column prefixed with "#HttpOnly_".
+func (s *InMemoryStorage) WriteNetscape(w io.Writer) error {
+	s.mu.RLock()
+	var selected []inMemoryEntry
+	for _, submap := range s.entries {
+		for _, e := range submap {
+			entry := *e.Entry
+			selected = append(selected, inMemoryEntry{Entry: &entry, seqNum: e.seqNum})
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].Key != selected[j].Key {
+			return selected[i].Key < selected[j].Key
+		}
+		return selected[i].seqNum < selected[j].seqNum
+	})
+
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintln(bw, netscapeHeader); err != nil {
+		return err
+	}
+
+	for _, e := range selected {
+		domain := e.Domain
+		if !e.HostOnly {
+			domain = "." + domain
+		}
+		if e.HttpOnly {
+			domain = netscapeHttpOnlyPrefix + domain
+		}
+
+		var expires int64
+		if e.Persistent {
+			expires = e.Expires.Unix()
+		}
+
+		_, err := fmt.Fprintf(bw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, netscapeBool(!e.HostOnly), e.Path, netscapeBool(e.Secure), expires, e.Name, e.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ReadNetscape adds entries read from the Netscape cookies.txt format written
+// by WriteNetscape to the storage. Empty lines and comment lines starting with
+// "#" are skipped, except for lines prefixed with "#HttpOnly_" which denote
+// HttpOnly cookies.
+//
+// Entry keys are derived from the cookie domains using the storage's
+// PublicSuffixList, session entries expire at its SessionExpiry. Entries are
+// only added if the whole input is read successfully.
+func (s *InMemoryStorage) ReadNetscape(r io.Reader) error {
+	now := time.Now()
+
+	sessionExpiry := s.SessionExpiry
+	if sessionExpiry.IsZero() {
+		sessionExpiry = DefaultSessionExpiry
+	}
+
+	var entries []*Entry
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		var httpOnly bool
+		if strings.HasPrefix(line, netscapeHttpOnlyPrefix) {
+			line = line[len(netscapeHttpOnlyPrefix):]
+			httpOnly = true
+		} else if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		e, err := parseNetscapeLine(line, now, sessionExpiry, s.PublicSuffixList)
+		if err != nil {
+			return fmt.Errorf("cookiejar: netscape line %d: %w", n, err)
+		}
+		e.HttpOnly = httpOnly
+
+		entries = append(entries, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range entries {
+		s.importEntry(e)
+	}
+
+	return nil
+}
+
+// parseNetscapeLine parses a single cookies.txt line without the "#HttpOnly_"
+// prefix, session cookies expiring at sessionExpiry.
+func parseNetscapeLine(line string, now, sessionExpiry time.Time, psList PublicSuffixList) (*Entry, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 7 {
+		return nil, fmt.Errorf("got %d fields, want 7", len(fields))
+	}
+
+	includeSubdomains, err := parseNetscapeBool(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	secure, err := parseNetscapeBool(fields[3])
+	if err != nil {
+		return nil, err
+	}
+
+	expires, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Entry{
+		Domain:     strings.TrimPrefix(fields[0], "."),
+		Path:       fields[2],
+		Name:       fields[5],
+		Value:      fields[6],
+		Secure:     secure,
+		HostOnly:   !includeSubdomains,
+		Creation:   now,
+		LastAccess: now,
+	}
+
+	if expires == 0 {
+		e.Expires = sessionExpiry
+	} else {
+		e.Expires = time.Unix(expires, 0).UTC()
+		e.Persistent = true
+	}
+
+	e.Key = JarKey(e.Domain, psList)
+	e.ID = e.RawID()
+
+	return e, nil
+}
+
+func netscapeBool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+
+func parseNetscapeBool(s string) (bool, error) {
+	switch strings.ToUpper(s) {
+	case "TRUE":
+		return true, nil
+	case "FALSE":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", s)
+}
@@ -0,0 +1,111 @@
+package cookiejarx
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNetscapeRoundTrip(t *testing.T) {
+	storage := NewInMemoryStorage()
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	jar.setCookies(mustParseURL("https://www.host.test/foo/"), []*http.Cookie{
+		{Name: "session", Value: "1"},
+		{Name: "persistent", Value: "2", MaxAge: 3600, Secure: true},
+		{Name: "domain", Value: "3", Domain: "host.test", Path: "/", HttpOnly: true},
+	}, tNow)
+	jar.setCookies(mustParseURL("http://www.bbc.co.uk/"), []*http.Cookie{
+		{Name: "uk", Value: "4", Domain: "bbc.co.uk", MaxAge: 60},
+	}, tNow)
+
+	var buf bytes.Buffer
+	if err := storage.WriteNetscape(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := buf.String(); !strings.HasPrefix(got, netscapeHeader+"\n") {
+		t.Errorf("got %q, want header", got)
+	}
+	for _, line := range []string{
+		".bbc.co.uk\tTRUE\t/\tFALSE\t1357041660\tuk\t4",
+		"www.host.test\tFALSE\t/foo\tFALSE\t0\tsession\t1",
+		"www.host.test\tFALSE\t/foo\tTRUE\t1357045200\tpersistent\t2",
+		"#HttpOnly_.host.test\tTRUE\t/\tFALSE\t0\tdomain\t3",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("got %q, missing line %q", buf.String(), line)
+		}
+	}
+
+	restored := NewInMemoryStorage()
+	restored.PublicSuffixList = testPSL{}
+	if err := restored.ReadNetscape(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	original := make(map[string]*Entry)
+	for _, e := range storage.EntriesDump() {
+		original[e.ID] = e
+	}
+	entries := restored.EntriesDump()
+	if len(entries) != len(original) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(original))
+	}
+	for _, e := range entries {
+		o := original[e.ID]
+		if o == nil {
+			t.Errorf("%s: unexpected entry", e.ID)
+			continue
+		}
+		if e.Name != o.Name || e.Value != o.Value || e.Domain != o.Domain || e.Path != o.Path ||
+			e.Key != o.Key || e.Secure != o.Secure || e.HttpOnly != o.HttpOnly ||
+			e.HostOnly != o.HostOnly || e.Persistent != o.Persistent || !e.Expires.Equal(o.Expires) {
+			t.Errorf("%s: got %+v, want %+v", e.ID, e, o)
+		}
+	}
+}
+
+func TestReadNetscape(t *testing.T) {
+	input := "# Netscape HTTP Cookie File\n" +
+		"# comment\n" +
+		"\n" +
+		"#HttpOnly_.example.com\tTRUE\t/\tTRUE\t0\ta\t1\r\n" +
+		"www.example.com\tFALSE\t/x\tFALSE\t2000000000\tb\t\n"
+
+	storage := NewInMemoryStorage()
+	if err := storage.ReadNetscape(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := storage.EntriesDump()
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	for _, e := range entries {
+		switch e.Name {
+		case "a":
+			if !e.HttpOnly || !e.Secure || e.HostOnly || e.Persistent || e.Domain != "example.com" || e.Key != "example.com" {
+				t.Errorf("a: got %+v", e)
+			}
+		case "b":
+			if e.HttpOnly || !e.HostOnly || !e.Persistent || e.Expires.Unix() != 2000000000 || e.Value != "" || e.Path != "/x" {
+				t.Errorf("b: got %+v", e)
+			}
+		}
+	}
+
+	for _, bad := range []string{
+		"example.com\tTRUE\t/\tFALSE\t0\ta\n",
+		"example.com\tMAYBE\t/\tFALSE\t0\ta\t1\n",
+		"example.com\tTRUE\t/\tFALSE\tnever\ta\t1\n",
+	} {
+		storage := NewInMemoryStorage()
+		if err := storage.ReadNetscape(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: got nil error, want non-nil", bad)
+		}
+		if len(storage.EntriesDump()) != 0 {
+			t.Errorf("%q: got entries stored after error", bad)
+		}
+	}
+}
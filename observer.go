@@ -0,0 +1,116 @@
+package cookiejarx
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// Observer is notified of changes of a Jar's cookies, see Options.Observer.
+//
+// Methods are called after the corresponding storage operation, outside of
+// storage locks, so they may call back into the jar.
+type Observer interface {
+	// OnSet is called after entry is saved by SetCookies or a related
+	// method.
+	OnSet(entry *Entry)
+
+	// OnRemove is called after the entry with key and id is removed,
+	// either by a deleting Set-Cookie or by a method such as RemoveCookie
+	// or Clear.
+	OnRemove(key, id string)
+
+	// OnExpire is called after an expired entry is removed: a persistent
+	// entry removed lazily by a lookup or by a sweeper, see
+	// InMemoryStorage.OnExpire, or a session entry outdated by
+	// StartSession.
+	OnExpire(entry *Entry)
+}
+
+// RateLimitObserver is an Observer also notified of cookies dropped because
+// of Options.MaxSetCookiesPerSecond.
+type RateLimitObserver interface {
+	Observer
+
+	// OnRateLimit is called with the URL and cookies of a SetCookies call
+	// exceeding the limit.
+	OnRateLimit(u *url.URL, cookies []*http.Cookie)
+}
+
+// Logger receives diagnostic messages of a Jar, see Options.Logger.
+type Logger interface {
+	// Debugf logs a message formatted like fmt.Sprintf.
+	Debugf(format string, args ...interface{})
+}
+
+// observeStorage makes the jar's storage report expired entries to the
+// observer. Only InMemoryStorage based storages report them. Jars sharing a
+// storage and a pointer observer register it once.
+func (j *Jar) observeStorage() {
+	if j.observer == nil {
+		return
+	}
+
+	switch storage := j.storage.(type) {
+	case *InMemoryStorage:
+		storage.addObserver(j.observer)
+	case *shardedInMemoryStorage:
+		for _, shard := range storage.shards {
+			shard.addObserver(j.observer)
+		}
+	}
+}
+
+// saveEntry saves entry to the storage and notifies the observer.
+func (j *Jar) saveEntry(entry *Entry) {
+	_ = j.saveEntryContext(context.Background(), entry)
+}
+
+// saveEntryContext is like saveEntry, passing ctx to the storage if it
+// implements ContextStorage. The observer is not notified if the storage
+// returns an error.
+func (j *Jar) saveEntryContext(ctx context.Context, entry *Entry) error {
+	if err := saveEntryContext(ctx, j.storage, entry); err != nil {
+		return err
+	}
+	if j.observer != nil {
+		j.observer.OnSet(entry)
+	}
+	return nil
+}
+
+// removeEntry removes the entry with key and id from the storage and notifies
+// the observer.
+func (j *Jar) removeEntry(key, id string) {
+	_ = j.removeEntryContext(context.Background(), key, id)
+}
+
+// removeEntryContext is like removeEntry, passing ctx to the storage like
+// saveEntryContext.
+func (j *Jar) removeEntryContext(ctx context.Context, key, id string) error {
+	if err := removeEntryContext(ctx, j.storage, key, id); err != nil {
+		return err
+	}
+	if j.observer != nil {
+		j.observer.OnRemove(key, id)
+	}
+	return nil
+}
+
+// expireEntry removes the expired entry from the storage and notifies the
+// observer.
+func (j *Jar) expireEntry(entry *Entry) {
+	_ = j.expireEntryContext(context.Background(), entry)
+}
+
+// expireEntryContext is like expireEntry, passing ctx to the storage like
+// saveEntryContext.
+func (j *Jar) expireEntryContext(ctx context.Context, entry *Entry) error {
+	if err := removeEntryContext(ctx, j.storage, entry.Key, entry.ID); err != nil {
+		return err
+	}
+	if j.observer != nil {
+		j.observer.OnExpire(entry)
+	}
+	return nil
+}
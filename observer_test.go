@@ -0,0 +1,207 @@
+package cookiejarx
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingObserver records observed events, calling back into jar to ensure
+// observers run outside storage locks.
+type recordingObserver struct {
+	jar    *Jar
+	events []string
+}
+
+func (o *recordingObserver) OnSet(entry *Entry) {
+	o.jar.count(tNow)
+	o.events = append(o.events, "set "+entry.Name)
+}
+
+func (o *recordingObserver) OnRemove(key, id string) {
+	o.jar.count(tNow)
+	o.events = append(o.events, "remove "+id)
+}
+
+func (o *recordingObserver) OnExpire(entry *Entry) {
+	o.jar.count(tNow)
+	o.events = append(o.events, "expire "+entry.Name)
+}
+
+func TestObserver(t *testing.T) {
+	observer := &recordingObserver{}
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Observer: observer})
+	observer.jar = jar
+
+	u := mustParseURL("http://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "a", Value: "1"},
+		{Name: "b", Value: "2", MaxAge: 60},
+		{Name: "c", Value: "3"},
+	}, tNow)
+	jar.setCookies(u, []*http.Cookie{{Name: "a", MaxAge: -1}}, tNow)
+	jar.cookies(u, tNow.Add(time.Hour))
+	jar.removeCookie(u, "c", tNow)
+	jar.setCookies(u, []*http.Cookie{{Name: "d", Value: "4"}}, tNow)
+	jar.startSession(tNow.Add(time.Second))
+	jar.setCookies(u, []*http.Cookie{{Name: "e", Value: "5"}}, tNow.Add(time.Second))
+	jar.Clear()
+
+	want := []string{
+		"set a", "set b", "set c",
+		"remove www.host.test;/;a",
+		"expire b",
+		"remove www.host.test;/;c",
+		"set d",
+		"expire d",
+		"set e",
+		"remove www.host.test;/;e",
+	}
+	if got := strings.Join(observer.events, ", "); got != strings.Join(want, ", ") {
+		t.Errorf("got events %q, want %q", got, strings.Join(want, ", "))
+	}
+}
+
+func TestObserverSharedStorage(t *testing.T) {
+	storage := NewInMemoryStorage()
+	observer := &recordingObserver{}
+	var jar *Jar
+	for i := 0; i < 3; i++ {
+		jar, _ = New(&Options{PublicSuffixList: testPSL{}, Storage: storage, Observer: observer})
+	}
+	observer.jar = jar
+
+	if storage.OnExpire != nil {
+		t.Error("OnExpire was set by New")
+	}
+
+	u := mustParseURL("http://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1", MaxAge: 60}}, tNow)
+	jar.cookies(u, tNow.Add(time.Hour))
+
+	if got, want := strings.Join(observer.events, ", "), "set a, expire a"; got != want {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+}
+
+// rateLimitObserver records the names of rate limited cookies.
+type rateLimitObserver struct {
+	recordingObserver
+	limited []string
+}
+
+func (o *rateLimitObserver) OnRateLimit(u *url.URL, cookies []*http.Cookie) {
+	for _, c := range cookies {
+		o.limited = append(o.limited, u.Host+":"+c.Name)
+	}
+}
+
+func TestMaxSetCookiesPerSecond(t *testing.T) {
+	observer := &rateLimitObserver{}
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Observer: observer, MaxSetCookiesPerSecond: 3})
+	observer.jar = jar
+
+	u := mustParseURL("http://www.host.test/")
+	sub := mustParseURL("http://sub.host.test/")
+	other := mustParseURL("http://www.other.test/")
+
+	// Five calls within a second, the last two exceed the limit shared by
+	// hosts of the same registrable domain.
+	for i := 0; i < 5; i++ {
+		now := tNow.Add(time.Duration(i) * 100 * time.Millisecond)
+		target := u
+		if i == 3 {
+			target = sub
+		}
+		jar.setCookies(target, []*http.Cookie{{Name: fmt.Sprintf("c%d", i), Value: "1"}}, now)
+	}
+	jar.setCookies(other, []*http.Cookie{{Name: "o", Value: "1"}}, tNow.Add(500*time.Millisecond))
+
+	// A new window starts a second after the first call.
+	jar.setCookies(u, []*http.Cookie{{Name: "c5", Value: "1"}}, tNow.Add(time.Second))
+
+	var s []string
+	for _, c := range jar.cookies(u, tNow.Add(time.Second)) {
+		s = append(s, c.Name)
+	}
+	if got, want := strings.Join(s, " "), "c0 c1 c2 c5"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := len(jar.cookies(other, tNow.Add(time.Second))); got != 1 {
+		t.Errorf("got %d cookies of other domain, want 1", got)
+	}
+	if got, want := strings.Join(observer.limited, " "), "sub.host.test:c3 www.host.test:c4"; got != want {
+		t.Errorf("got rate limited %q, want %q", got, want)
+	}
+}
+
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func TestLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Logger: logger})
+
+	jar.setCookies(mustParseURL("http://www.host.test/"), []*http.Cookie{
+		{Name: "ok", Value: "1"},
+		{Name: "illegal", Value: "2", Domain: "other.test"},
+		{Name: "malformed", Value: "3", Domain: "..host.test"},
+	}, tNow)
+	jar.setCookies(mustParseURL("ftp://www.host.test/"), []*http.Cookie{{Name: "ftp", Value: "4"}}, tNow)
+	resp := http.Response{Header: http.Header{"Set-Cookie": {
+		"ok=; Max-Age=0",
+		"past=; Expires=Thu, 01 Jan 1970 00:00:00 GMT",
+	}}}
+	jar.setCookies(mustParseURL("http://www.host.test/"), resp.Cookies(), tNow)
+
+	want := []string{
+		`cookiejar: dropping cookie "illegal" from http://www.host.test/: ` + errIllegalDomain.Error(),
+		`cookiejar: dropping cookie "malformed" from http://www.host.test/: ` + errMalformedDomain.Error(),
+		`cookiejar: dropping 1 cookies from ftp://www.host.test/: scheme "ftp" not allowed`,
+		`cookiejar: removing cookie "ok" from http://www.host.test/: Max-Age <= 0`,
+		`cookiejar: removing cookie "past" from http://www.host.test/: Expires Thu, 01 Jan 1970 00:00:00 GMT in the past`,
+	}
+	if !reflect.DeepEqual(logger.messages, want) {
+		t.Errorf("got messages %q, want %q", logger.messages, want)
+	}
+}
+
+// valueObserver is a comparable observer type whose field holds an
+// uncomparable map, counting expired entries by name.
+type valueObserver struct {
+	expired interface{}
+}
+
+func (o valueObserver) OnSet(entry *Entry)      {}
+func (o valueObserver) OnRemove(key, id string) {}
+
+func (o valueObserver) OnExpire(entry *Entry) {
+	o.expired.(map[string]int)[entry.Name]++
+}
+
+func TestObserverSharedStorageValue(t *testing.T) {
+	storage := NewInMemoryStorage()
+	observer := valueObserver{expired: make(map[string]int)}
+	var jar *Jar
+	for i := 0; i < 2; i++ {
+		jar, _ = New(&Options{PublicSuffixList: testPSL{}, Storage: storage, Observer: observer})
+	}
+
+	u := mustParseURL("http://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1", MaxAge: 60}}, tNow)
+	jar.cookies(u, tNow.Add(time.Hour))
+
+	// Observers other than pointers are notified once per jar.
+	if got := observer.expired.(map[string]int)["a"]; got != 2 {
+		t.Errorf("got %d expirations of a, want 2", got)
+	}
+}
@@ -0,0 +1,56 @@
+package cookiejarx
+
+import "time"
+
+// Option configures a Jar created by New.
+//
+// An *Options is an Option itself, setting all options at once and replacing
+// any set by preceding Options, so that New(&Options{...}) keeps working.
+// Options of the With functions apply on top of preceding ones.
+type Option interface {
+	applyOption(o *Options)
+}
+
+// applyOption implements Option. A nil *Options resets all options.
+func (o *Options) applyOption(dst *Options) {
+	if o == nil {
+		*dst = Options{}
+		return
+	}
+	*dst = *o
+}
+
+// optionFunc is an Option setting a single field.
+type optionFunc func(o *Options)
+
+func (f optionFunc) applyOption(o *Options) {
+	f(o)
+}
+
+// WithPublicSuffixList sets Options.PublicSuffixList.
+func WithPublicSuffixList(psList PublicSuffixList) Option {
+	return optionFunc(func(o *Options) {
+		o.PublicSuffixList = psList
+	})
+}
+
+// WithStorage sets Options.Storage.
+func WithStorage(storage Storage) Option {
+	return optionFunc(func(o *Options) {
+		o.Storage = storage
+	})
+}
+
+// WithNow sets Options.Now.
+func WithNow(now func() time.Time) Option {
+	return optionFunc(func(o *Options) {
+		o.Now = now
+	})
+}
+
+// WithMaxCookiesPerDomain sets Options.MaxCookiesPerDomain.
+func WithMaxCookiesPerDomain(n int) Option {
+	return optionFunc(func(o *Options) {
+		o.MaxCookiesPerDomain = n
+	})
+}
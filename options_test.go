@@ -0,0 +1,51 @@
+package cookiejarx
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFunctionalOptions(t *testing.T) {
+	storage := NewInMemoryStorage()
+	now := tNow
+	jar, err := New(
+		WithPublicSuffixList(testPSL{}),
+		WithStorage(storage),
+		WithNow(func() time.Time { return now }),
+		WithMaxCookiesPerDomain(2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if jar.psList == nil || jar.storage != storage || storage.MaxEntriesPerKey != 2 {
+		t.Errorf("options not applied: %+v", jar)
+	}
+
+	jar.SetCookies(mustParseURL("http://www.host.test/"), []*http.Cookie{{Name: "a", Value: "1", MaxAge: 1}})
+	if got := storage.EntriesDump()[0].Creation; !got.Equal(tNow) {
+		t.Errorf("got Creation %v, want %v", got, tNow)
+	}
+}
+
+func TestLegacyOptions(t *testing.T) {
+	var nilOptions *Options
+	for _, opts := range [][]Option{nil, {nil}, {nilOptions}, {&Options{}}} {
+		jar, err := New(opts...)
+		if err != nil || jar.psList != nil {
+			t.Errorf("%v: got %+v, %v", opts, jar, err)
+		}
+	}
+
+	// Options replace preceding ones, With functions apply on top.
+	jar, _ := New(WithMaxCookiesPerDomain(2), &Options{PublicSuffixList: testPSL{}}, WithMaxCookiesPerDomain(3))
+	storage := jar.storage.(*InMemoryStorage)
+	if jar.psList == nil || storage.MaxEntriesPerKey != 3 {
+		t.Errorf("got psList %v and MaxEntriesPerKey %d", jar.psList, storage.MaxEntriesPerKey)
+	}
+	jar, _ = New(WithMaxCookiesPerDomain(2), &Options{})
+	if got := jar.storage.(*InMemoryStorage).MaxEntriesPerKey; got != DefaultMaxCookiesPerDomain {
+		t.Errorf("got MaxEntriesPerKey %d, want default", got)
+	}
+}
@@ -0,0 +1,39 @@
+package cookiejarx
+
+import "fmt"
+
+// publicSuffixTestVectors are domains of the public suffix list test data at
+// publicsuffix.org with their public suffixes, restricted to stable ICANN
+// rules.
+var publicSuffixTestVectors = []struct {
+	domain, suffix string
+}{
+	{"com", "com"},
+	{"example.com", "com"},
+	{"www.example.com", "com"},
+	{"org", "org"},
+	{"example.org", "org"},
+	{"uk", "uk"},
+	{"co.uk", "co.uk"},
+	{"example.co.uk", "co.uk"},
+	{"www.example.co.uk", "co.uk"},
+	{"com.au", "com.au"},
+	{"foo.example.com.au", "com.au"},
+	{"pvt.k12.ma.us", "pvt.k12.ma.us"},
+	{"bar.pvt.k12.ma.us", "pvt.k12.ma.us"},
+	{"foo.bar.pvt.k12.ma.us", "pvt.k12.ma.us"},
+}
+
+// ValidatePublicSuffixList checks psl against a small embedded set of known
+// domains and their public suffixes, returning an error for every mismatch.
+// It helps detecting a broken or misconfigured list at startup; a valid list
+// yields no errors.
+func ValidatePublicSuffixList(psl PublicSuffixList) (errs []error) {
+	for _, v := range publicSuffixTestVectors {
+		if got := psl.PublicSuffix(v.domain); got != v.suffix {
+			errs = append(errs, fmt.Errorf("cookiejar: public suffix list %s: public suffix of %q is %q, want %q",
+				psl, v.domain, got, v.suffix))
+		}
+	}
+	return errs
+}
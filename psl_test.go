@@ -0,0 +1,39 @@
+package cookiejarx_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/eientei/cookiejarx"
+)
+
+// vectorPSL implements the public suffix rules covered by
+// ValidatePublicSuffixList.
+type vectorPSL struct{}
+
+func (vectorPSL) PublicSuffix(domain string) string {
+	for _, suffix := range []string{"pvt.k12.ma.us", "co.uk", "com.au"} {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return suffix
+		}
+	}
+	return domain[strings.LastIndex(domain, ".")+1:]
+}
+
+func (vectorPSL) String() string {
+	return "vector"
+}
+
+func TestValidatePublicSuffixList(t *testing.T) {
+	if errs := cookiejarx.ValidatePublicSuffixList(vectorPSL{}); len(errs) != 0 {
+		t.Errorf("got errors for correct list: %v", errs)
+	}
+
+	errs := cookiejarx.ValidatePublicSuffixList(publicsuffix)
+	if len(errs) == 0 {
+		t.Fatal("got no errors for dummy list")
+	}
+	if got, want := errs[0].Error(), `public suffix of "example.com" is "example.com", want "com"`; !strings.Contains(got, want) {
+		t.Errorf("got %q, want it to contain %q", got, want)
+	}
+}
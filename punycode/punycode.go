@@ -8,6 +8,7 @@ package punycode
 
 import (
 	"fmt"
+	"math"
 	"strings"
 	"unicode/utf8"
 )
@@ -97,6 +98,92 @@ func Encode(prefix, s string) (string, error) {
 	return string(output), nil
 }
 
+// Decode decodes a string as specified in section 6.2. It is the inverse of
+// Encode with an empty prefix.
+func Decode(encoded string) (string, error) {
+	if encoded == "" {
+		return "", nil
+	}
+	pos := 1 + strings.LastIndex(encoded, "-")
+	if pos == 1 {
+		return "", fmt.Errorf("cookiejar: invalid label %q", encoded)
+	}
+	if pos == len(encoded) {
+		return encoded[:len(encoded)-1], nil
+	}
+	output := make([]rune, 0, len(encoded))
+	if pos != 0 {
+		for _, r := range encoded[:pos-1] {
+			output = append(output, r)
+		}
+	}
+	i, n, bias := int32(0), initialN, initialBias
+	overflow := false
+	for pos < len(encoded) {
+		oldI, w := i, int32(1)
+		for k := base; ; k += base {
+			if pos == len(encoded) {
+				return "", fmt.Errorf("cookiejar: invalid label %q", encoded)
+			}
+			digit, ok := decodeDigit(encoded[pos])
+			if !ok {
+				return "", fmt.Errorf("cookiejar: invalid label %q", encoded)
+			}
+			pos++
+			i, overflow = madd(i, digit, w)
+			if overflow {
+				return "", fmt.Errorf("cookiejar: invalid label %q", encoded)
+			}
+			t := k - bias
+			if k <= bias {
+				t = tmin
+			} else if k >= bias+tmax {
+				t = tmax
+			}
+			if digit < t {
+				break
+			}
+			w, overflow = madd(0, w, base-t)
+			if overflow {
+				return "", fmt.Errorf("cookiejar: invalid label %q", encoded)
+			}
+		}
+		x := int32(len(output) + 1)
+		bias = adapt(i-oldI, x, oldI == 0)
+		n += i / x
+		i %= x
+		if n < 0 || n > utf8.MaxRune {
+			return "", fmt.Errorf("cookiejar: invalid label %q", encoded)
+		}
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = n
+		i++
+	}
+	return string(output), nil
+}
+
+// madd computes a + (b * c), detecting overflow.
+func madd(a, b, c int32) (next int32, overflow bool) {
+	p := int64(b) * int64(c)
+	if p > math.MaxInt32-int64(a) {
+		return 0, true
+	}
+	return a + int32(p), false
+}
+
+func decodeDigit(x byte) (digit int32, ok bool) {
+	switch {
+	case '0' <= x && x <= '9':
+		return int32(x - ('0' - 26)), true
+	case 'A' <= x && x <= 'Z':
+		return int32(x - 'A'), true
+	case 'a' <= x && x <= 'z':
+		return int32(x - 'a'), true
+	}
+	return 0, false
+}
+
 func encodeDigit(digit int32) byte {
 	switch {
 	case 0 <= digit && digit < 26:
@@ -129,13 +216,51 @@ func adapt(delta, numPoints int32, firstTime bool) int32 {
 // acePrefix is the ASCII Compatible Encoding prefix.
 const acePrefix = "xn--"
 
+// Mode selects the processing of the deviation characters of UTS #46, which
+// IDNA2008 and the earlier IDNA2003 treat differently: ß (U+00DF), final sigma
+// ς (U+03C2), ZERO WIDTH NON-JOINER (U+200C) and ZERO WIDTH JOINER (U+200D).
+//
+// Other characters are encoded alike in all modes. Neither mode performs the
+// remaining UTS #46 mapping, e.g. of Unicode case or compatibility forms, nor
+// validates labels against the IDNA2008 rules.
+type Mode int
+
+const (
+	// Nontransitional keeps deviation characters, as IDNA2008 and UTS #46
+	// nontransitional processing, used by current browsers, do. For
+	// example, "faß.de" becomes "xn--fa-hia.de".
+	Nontransitional Mode = iota
+
+	// Transitional maps deviation characters as IDNA2003 and UTS #46
+	// transitional processing do: ß to "ss" and ς to σ, while the joiners
+	// are removed. For example, "faß.de" becomes "fass.de".
+	Transitional
+)
+
+// transitional maps the deviation characters for Transitional.
+var transitional = strings.NewReplacer(
+	"\u00df", "ss",
+	"\u03c2", "\u03c3",
+	"\u200c", "",
+	"\u200d", "",
+)
+
 // ToASCII converts a domain or domain label to its ASCII form. For example,
 // ToASCII("bücher.example.com") is "xn--bcher-kva.example.com", and
-// ToASCII("golang") is "golang".
+// ToASCII("golang") is "golang". It is ToASCIIMode with Nontransitional.
 func ToASCII(s string) (string, error) {
+	return ToASCIIMode(s, Nontransitional)
+}
+
+// ToASCIIMode is like ToASCII, processing deviation characters according to
+// mode.
+func ToASCIIMode(s string, mode Mode) (string, error) {
 	if Is(s) {
 		return s, nil
 	}
+	if mode == Transitional {
+		s = transitional.Replace(s)
+	}
 	labels := strings.Split(s, ".")
 	for i, label := range labels {
 		if !Is(label) {
@@ -148,3 +273,21 @@ func ToASCII(s string) (string, error) {
 	}
 	return strings.Join(labels, "."), nil
 }
+
+// ToUnicode converts a domain or domain label to its Unicode form, decoding
+// each label starting with the ACE prefix "xn--" independently and leaving
+// other labels untouched. For example, ToUnicode("xn--bcher-kva.example.com")
+// is "bücher.example.com". It is the inverse of ToASCII for valid inputs.
+func ToUnicode(s string) (string, error) {
+	labels := strings.Split(s, ".")
+	for i, label := range labels {
+		if len(label) > len(acePrefix) && EqualFold(label[:len(acePrefix)], acePrefix) {
+			u, err := Decode(label[len(acePrefix):])
+			if err != nil {
+				return "", err
+			}
+			labels[i] = u
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
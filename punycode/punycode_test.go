@@ -159,3 +159,75 @@ func TestPunycode(t *testing.T) {
 		}
 	}
 }
+
+func TestDecode(t *testing.T) {
+	for _, tc := range punycodeTestCases {
+		if got, err := Decode(tc.encoded); err != nil {
+			t.Errorf(`Decode(%q): %v`, tc.encoded, err)
+		} else if got != tc.s {
+			t.Errorf(`Decode(%q): got %q, want %q`, tc.encoded, got, tc.s)
+		}
+	}
+}
+
+var idnTestCases = [...]struct {
+	unicode, ascii string
+}{
+	{"golang.org", "golang.org"},
+	{"bücher.example.com", "xn--bcher-kva.example.com"},
+	{"perché.com", "xn--perch-fsa.com"},
+	{"münchen.de", "xn--mnchen-3ya.de"},
+	{"пример.рф", "xn--e1afmkfd.xn--p1ai"},
+	{"例え.テスト", "xn--r8jz45g.xn--zckzah"},
+	{"www.☃.net", "www.xn--n3h.net"},
+}
+
+func TestToUnicode(t *testing.T) {
+	for _, tc := range idnTestCases {
+		ascii, err := ToASCII(tc.unicode)
+		if err != nil || ascii != tc.ascii {
+			t.Errorf("ToASCII(%q): got %q, %v, want %q", tc.unicode, ascii, err, tc.ascii)
+		}
+		got, err := ToUnicode(tc.ascii)
+		if err != nil || got != tc.unicode {
+			t.Errorf("ToUnicode(%q): got %q, %v, want %q", tc.ascii, got, err, tc.unicode)
+		}
+	}
+
+	if got, err := ToUnicode("XN--bcher-kva.example.com"); err != nil || got != "bücher.example.com" {
+		t.Errorf("upper case prefix: got %q, %v", got, err)
+	}
+
+	for _, s := range []string{"xn--a!b.com", "www.xn--99999999999.com", "xn---abc"} {
+		if got, err := ToUnicode(s); err == nil {
+			t.Errorf("ToUnicode(%q): got %q, want error", s, got)
+		}
+	}
+}
+
+// deviationTestCases are deviation character vectors of the Unicode IDNA
+// conformance tests, IdnaTestV2.txt.
+var deviationTestCases = []struct {
+	in, nontransitional, transitional string
+}{
+	{"faß.de", "xn--fa-hia.de", "fass.de"},
+	{"βόλος.com", "xn--nxasmm1c.com", "xn--nxasmq6b.com"},
+	{"ශ්\u200dරී.com", "xn--10cl1a0b660p.com", "xn--10cl1a0b.com"},
+	{"نامه\u200cای.com", "xn--mgba3gch31f060k.com", "xn--mgba3gch31f.com"},
+	{"www.bücher.de", "www.xn--bcher-kva.de", "www.xn--bcher-kva.de"},
+	{"example.com", "example.com", "example.com"},
+}
+
+func TestToASCIIMode(t *testing.T) {
+	for _, tc := range deviationTestCases {
+		for mode, want := range map[Mode]string{Nontransitional: tc.nontransitional, Transitional: tc.transitional} {
+			got, err := ToASCIIMode(tc.in, mode)
+			if err != nil || got != want {
+				t.Errorf("ToASCIIMode(%q, %d): got %q, %v, want %q", tc.in, mode, got, err, want)
+			}
+		}
+		if got, _ := ToASCII(tc.in); got != tc.nontransitional {
+			t.Errorf("ToASCII(%q): got %q, want %q", tc.in, got, tc.nontransitional)
+		}
+	}
+}
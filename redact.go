@@ -0,0 +1,92 @@
+package cookiejarx
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// redactionKeySize is the size of generated redaction keys.
+const redactionKeySize = 32
+
+// RedactEntry returns a copy of e safe to be kept in audit logs: its Value is
+// replaced by a truncated HMAC-SHA256 keyed with key, so that a value remains
+// recognizable across records redacted with the same key without being
+// revealed, as is its Name if redactName is set. Domain, Path, flags and times
+// are kept.
+//
+// key must be kept secret, otherwise guessable values such as session flags
+// can be recovered by hashing candidates.
+func RedactEntry(e *Entry, key []byte, redactName bool) *Entry {
+	redacted := *e
+	redacted.Value = redact(key, e.Value)
+	if redactName {
+		redacted.Name = redact(key, e.Name)
+		redacted.ID = redact(key, e.ID)
+	}
+	return &redacted
+}
+
+// redact returns a truncated HMAC of s keyed with key, a valid cookie name and
+// value.
+func redact(key []byte, s string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return "hmac-" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// newRedactionKey returns a random redaction key.
+func newRedactionKey() ([]byte, error) {
+	key := make([]byte, redactionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// redactingObserver passes redacted entries to inner, see
+// NewRedactingObserver.
+type redactingObserver struct {
+	inner Observer
+
+	key []byte
+
+	redactNames bool
+}
+
+// NewRedactingObserver returns an Observer passing entries redacted by
+// RedactEntry with key to inner, e.g. an audit logger. If redactNames is set,
+// names are redacted as well, including the IDs passed to OnRemove, which are
+// derived from them.
+//
+// An empty key is replaced by a random one, so that redacted values are only
+// recognizable within the records of the returned observer.
+func NewRedactingObserver(inner Observer, key []byte, redactNames bool) (Observer, error) {
+	if len(key) == 0 {
+		var err error
+		if key, err = newRedactionKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &redactingObserver{inner: inner, key: key, redactNames: redactNames}, nil
+}
+
+// OnSet implements Observer.
+func (o *redactingObserver) OnSet(entry *Entry) {
+	o.inner.OnSet(RedactEntry(entry, o.key, o.redactNames))
+}
+
+// OnRemove implements Observer.
+func (o *redactingObserver) OnRemove(key, id string) {
+	if o.redactNames {
+		id = redact(o.key, id)
+	}
+	o.inner.OnRemove(key, id)
+}
+
+// OnExpire implements Observer.
+func (o *redactingObserver) OnExpire(entry *Entry) {
+	o.inner.OnExpire(RedactEntry(entry, o.key, o.redactNames))
+}
@@ -0,0 +1,107 @@
+package cookiejarx
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// entryObserver records the entries it is notified of.
+type entryObserver struct {
+	set     []*Entry
+	removed []string
+}
+
+func (o *entryObserver) OnSet(entry *Entry)      { o.set = append(o.set, entry) }
+func (o *entryObserver) OnRemove(key, id string) { o.removed = append(o.removed, id) }
+func (o *entryObserver) OnExpire(*Entry)         {}
+
+func TestRedactedLogging(t *testing.T) {
+	cookie := &http.Cookie{Name: "session", Value: "s3cr3t", Domain: "host.test", Path: "/app", Secure: true, HttpOnly: true}
+
+	for _, redactNames := range []bool{false, true} {
+		logger := &recordingLogger{}
+		jar, _ := New(&Options{
+			PublicSuffixList: testPSL{},
+			Logger:           logger,
+			LogAccepted:      true,
+			LogRedactNames:   redactNames,
+			LogRedactionKey:  []byte("key"),
+		})
+		jar.setCookies(mustParseURL("https://www.host.test/"), []*http.Cookie{
+			cookie,
+			{Name: "dropped", Value: "x", Domain: "other.test"},
+		}, tNow)
+
+		if len(logger.messages) != 2 {
+			t.Fatalf("redactNames=%t: got messages %q, want 2", redactNames, logger.messages)
+		}
+
+		accepted := logger.messages[0]
+		for _, s := range []string{redact([]byte("key"), "s3cr3t"), "Path=/app", "Domain=.host.test", "HttpOnly", "Secure"} {
+			if !strings.Contains(accepted, s) {
+				t.Errorf("redactNames=%t: message %q lacks %q", redactNames, accepted, s)
+			}
+		}
+		if strings.Contains(accepted, "s3cr3t") {
+			t.Errorf("redactNames=%t: message %q leaks the value", redactNames, accepted)
+		}
+		if got := strings.Contains(accepted, "session="); got == redactNames {
+			t.Errorf("redactNames=%t: message %q, want name redacted %t", redactNames, accepted, redactNames)
+		}
+		if got := strings.Contains(logger.messages[1], "dropped"); got == redactNames {
+			t.Errorf("redactNames=%t: message %q, want name redacted %t", redactNames, logger.messages[1], redactNames)
+		}
+	}
+}
+
+func TestRedactingObserver(t *testing.T) {
+	observer := &entryObserver{}
+	redacting, err := NewRedactingObserver(observer, []byte("key"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Observer: redacting})
+
+	u := mustParseURL("http://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "secret", Path: "/", HttpOnly: true}}, tNow)
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Path: "/", MaxAge: -1}}, tNow)
+
+	if len(observer.set) != 1 {
+		t.Fatalf("got %d set entries, want 1", len(observer.set))
+	}
+	e := observer.set[0]
+	if e.Value != redact([]byte("key"), "secret") || e.Name != redact([]byte("key"), "a") {
+		t.Errorf("got %s=%s, want name and value redacted", e.Name, e.Value)
+	}
+	if e.Domain != "www.host.test" || e.Path != "/" || !e.HttpOnly || !e.HostOnly || e.Key != "host.test" {
+		t.Errorf("got %+v, want metadata intact", e)
+	}
+	if len(observer.removed) != 1 || observer.removed[0] != redact([]byte("key"), "www.host.test;/;a") {
+		t.Errorf("got removed %q, want redacted ID", observer.removed)
+	}
+}
+
+func TestRedactionKey(t *testing.T) {
+	if redact([]byte("a"), "secret") == redact([]byte("b"), "secret") {
+		t.Error("got equal redactions with different keys")
+	}
+	if redact([]byte("a"), "secret") != redact([]byte("a"), "secret") {
+		t.Error("got different redactions with the same key")
+	}
+
+	// Without a configured key, each jar redacts with a random one.
+	var accepted []string
+	for i := 0; i < 2; i++ {
+		logger := &recordingLogger{}
+		jar, _ := New(&Options{PublicSuffixList: testPSL{}, Logger: logger, LogAccepted: true})
+		jar.setCookies(mustParseURL("https://www.host.test/"), []*http.Cookie{{Name: "a", Value: "secret"}}, tNow)
+		if len(logger.messages) != 1 {
+			t.Fatalf("got messages %q, want 1", logger.messages)
+		}
+		accepted = append(accepted, logger.messages[0])
+	}
+	if accepted[0] == accepted[1] {
+		t.Errorf("got equal messages %q with generated keys", accepted[0])
+	}
+}
@@ -0,0 +1,127 @@
+package cookiejarx
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SameSiteContext describes the relation between a request and the site which
+// initiated it, determining which SameSite cookies the request may carry.
+type SameSiteContext int
+
+const (
+	// CrossSite is the context of a cross-site request other than a
+	// top-level GET navigation, e.g. a subresource request or a form POST.
+	// Neither Strict nor Lax cookies are sent.
+	CrossSite SameSiteContext = iota
+
+	// SameSiteLax is the context of a cross-site top-level GET navigation.
+	// Lax cookies are sent, Strict cookies are not.
+	SameSiteLax
+
+	// SameSiteStrict is the context of a same-site request. All cookies
+	// are sent.
+	SameSiteStrict
+)
+
+// ShouldSendContext is like ShouldSend, but additionally withholds cookies
+// whose SameSite attribute forbids sending them in sameSiteContext.
+func (e *Entry) ShouldSendContext(https bool, host, path string, sameSiteContext SameSiteContext) bool {
+	if !e.ShouldSend(https, host, path) {
+		return false
+	}
+
+	switch e.SameSite {
+	case "SameSite=Strict":
+		return sameSiteContext == SameSiteStrict
+	case "SameSite=Lax":
+		return sameSiteContext != CrossSite
+	}
+
+	return true
+}
+
+// CookiesForRequest is like Cookies for a top-level GET navigation to u
+// initiated from initiator, withholding SameSite cookies according to the
+// derived SameSiteContext: a navigation is same-site if initiator is nil, as
+// for a URL entered by the user, or if u and initiator share their registrable
+// domain, and cross-site otherwise.
+//
+// Requests other than top-level GET navigations should use CookiesContext.
+func (j *Jar) CookiesForRequest(u, initiator *url.URL) (cookies []*http.Cookie) {
+	return j.cookiesContext(u, j.sameSiteContext(u, initiator), j.now())
+}
+
+// CookiesContext is like Cookies, withholding SameSite cookies which must not
+// be sent in sameSiteContext.
+func (j *Jar) CookiesContext(u *url.URL, sameSiteContext SameSiteContext) (cookies []*http.Cookie) {
+	return j.cookiesContext(u, sameSiteContext, j.now())
+}
+
+// CookiesForMethod is like Cookies for a request to u using the HTTP method,
+// withholding SameSite cookies according to the derived SameSiteContext: a
+// same-site request carries all cookies, whereas a cross-site request carries
+// Lax cookies only if method is safe, i.e. GET, HEAD, OPTIONS or TRACE, as in
+// a top-level navigation, and neither Lax nor Strict cookies otherwise. An
+// empty method means GET, as for http.Request.
+func (j *Jar) CookiesForMethod(u *url.URL, method string, crossSite bool) (cookies []*http.Cookie) {
+	return j.cookiesContext(u, methodContext(method, crossSite), j.now())
+}
+
+// methodContext derives the SameSiteContext of a request using the HTTP
+// method, see CookiesForMethod.
+func methodContext(method string, crossSite bool) SameSiteContext {
+	if !crossSite {
+		return SameSiteStrict
+	}
+
+	switch strings.ToUpper(method) {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return SameSiteLax
+	}
+
+	return CrossSite
+}
+
+// cookiesContext is like CookiesContext but takes the current time as a
+// parameter.
+func (j *Jar) cookiesContext(u *url.URL, sameSiteContext SameSiteContext, now time.Time) (cookies []*http.Cookie) {
+	https, host, path, key, ok := j.requestParams(u)
+	if !ok {
+		return cookies
+	}
+
+	for _, e := range j.entries(https, host, path, key, now) {
+		if !e.ShouldSendContext(https, host, path, sameSiteContext) {
+			continue
+		}
+		cookies = append(cookies, &http.Cookie{Name: e.Name, Value: e.Value})
+	}
+
+	return cookies
+}
+
+// sameSiteContext derives the SameSiteContext of a top-level GET navigation to
+// u initiated from initiator.
+func (j *Jar) sameSiteContext(u, initiator *url.URL) SameSiteContext {
+	if initiator == nil {
+		return SameSiteStrict
+	}
+
+	host, err := j.canonicalHost(u.Host)
+	if err != nil {
+		return SameSiteLax
+	}
+	initiatorHost, err := j.canonicalHost(initiator.Host)
+	if err != nil {
+		return SameSiteLax
+	}
+
+	if JarKey(host, j.psList) == JarKey(initiatorHost, j.psList) {
+		return SameSiteStrict
+	}
+
+	return SameSiteLax
+}
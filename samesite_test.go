@@ -0,0 +1,106 @@
+package cookiejarx
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestShouldSendContext(t *testing.T) {
+	for _, tc := range []struct {
+		sameSite string
+		want     [3]bool // CrossSite, SameSiteLax, SameSiteStrict
+	}{
+		{"", [3]bool{true, true, true}},
+		{"SameSite", [3]bool{true, true, true}},
+		{"SameSite=Lax", [3]bool{false, true, true}},
+		{"SameSite=Strict", [3]bool{false, false, true}},
+	} {
+		e := &Entry{Domain: "host.test", Path: "/", HostOnly: true, SameSite: tc.sameSite}
+		for ctx, want := range tc.want {
+			if got := e.ShouldSendContext(false, "host.test", "/", SameSiteContext(ctx)); got != want {
+				t.Errorf("%q in context %d: got %t, want %t", tc.sameSite, ctx, got, want)
+			}
+		}
+	}
+
+	e := &Entry{Domain: "host.test", Path: "/", HostOnly: true}
+	if e.ShouldSendContext(false, "other.test", "/", SameSiteStrict) {
+		t.Errorf("cookie sent to non-matching host")
+	}
+}
+
+func TestCookiesForRequest(t *testing.T) {
+	jar := newTestJar()
+	u := mustParseURL("http://www.host.test/")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "none", Value: "1"},
+		{Name: "lax", Value: "2", SameSite: http.SameSiteLaxMode},
+		{Name: "strict", Value: "3", SameSite: http.SameSiteStrictMode},
+	})
+
+	names := func(cookies []*http.Cookie) string {
+		var s []string
+		for _, c := range cookies {
+			s = append(s, c.Name)
+		}
+		return strings.Join(s, " ")
+	}
+
+	for _, tc := range []struct {
+		initiator string
+		want      string
+	}{
+		{"", "none lax strict"},
+		{"http://www.host.test/page", "none lax strict"},
+		{"https://api.host.test/", "none lax strict"},
+		{"http://www.other.test/", "none lax"},
+	} {
+		var initiator *url.URL
+		if tc.initiator != "" {
+			initiator = mustParseURL(tc.initiator)
+		}
+		if got := names(jar.CookiesForRequest(u, initiator)); got != tc.want {
+			t.Errorf("initiator %q: got %q, want %q", tc.initiator, got, tc.want)
+		}
+	}
+
+	if got, want := names(jar.CookiesContext(u, CrossSite)), "none"; got != want {
+		t.Errorf("cross-site: got %q, want %q", got, want)
+	}
+}
+
+func TestCookiesForMethod(t *testing.T) {
+	jar := newTestJar()
+	u := mustParseURL("http://www.host.test/")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "none", Value: "1"},
+		{Name: "lax", Value: "2", SameSite: http.SameSiteLaxMode},
+		{Name: "strict", Value: "3", SameSite: http.SameSiteStrictMode},
+	})
+
+	for _, tc := range []struct {
+		method    string
+		crossSite bool
+		want      string
+	}{
+		{http.MethodGet, false, "none lax strict"},
+		{http.MethodPost, false, "none lax strict"},
+		{http.MethodGet, true, "none lax"},
+		{"get", true, "none lax"},
+		{"", true, "none lax"},
+		{http.MethodHead, true, "none lax"},
+		{http.MethodPost, true, "none"},
+		{http.MethodPut, true, "none"},
+		{http.MethodDelete, true, "none"},
+	} {
+		var s []string
+		for _, c := range jar.CookiesForMethod(u, tc.method, tc.crossSite) {
+			s = append(s, c.Name)
+		}
+		if got := strings.Join(s, " "); got != tc.want {
+			t.Errorf("%q cross-site %t: got %q, want %q", tc.method, tc.crossSite, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package cookiejarx
+
+import (
+	"context"
+	"time"
+)
+
+// semaphoreStorage is a Storage decorator limiting the number of concurrent
+// calls to the underlying Storage, see NewSemaphoreStorage.
+type semaphoreStorage struct {
+	inner Storage
+
+	// sem holds a token for each in-flight call.
+	sem chan struct{}
+}
+
+// semaphoreDumperStorage is the semaphore storage of an underlying storage
+// implementing Dumper.
+type semaphoreDumperStorage struct {
+	*semaphoreStorage
+}
+
+// NewSemaphoreStorage returns a Storage allowing at most max concurrent calls
+// to inner, queuing excess calls until an in-flight one completes. It protects
+// backends which do not handle high concurrency well, e.g. by exhausting their
+// connections. A max below one is treated as one.
+//
+// Storage methods wait for their turn indefinitely, while the ContextStorage
+// methods give up once their context is done, and otherwise pass it on to
+// inner if it implements ContextStorage, as SQLStorage does. A Jar calls the
+// latter from Jar.CookiesWithContext and Jar.SetCookiesWithContext.
+//
+// Clearer, Counter and Generation, see InMemoryStorage.Generation, are
+// forwarded to inner, falling back to its Storage and Dumper methods, and take
+// a slot like the other calls. The returned storage implements Dumper only if
+// inner does.
+func NewSemaphoreStorage(inner Storage, max int) ContextStorage {
+	if max < 1 {
+		max = 1
+	}
+
+	s := &semaphoreStorage{
+		inner: inner,
+		sem:   make(chan struct{}, max),
+	}
+
+	if _, ok := inner.(Dumper); ok {
+		return semaphoreDumperStorage{s}
+	}
+	return s
+}
+
+// acquire waits for a free slot or until ctx is done.
+func (s *semaphoreStorage) acquire(ctx context.Context) error {
+	select {
+	case s.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire.
+func (s *semaphoreStorage) release() {
+	<-s.sem
+}
+
+// SaveEntry implementation of Storage.SaveEntry.
+func (s *semaphoreStorage) SaveEntry(entry *Entry) {
+	_ = s.SaveEntryContext(context.Background(), entry)
+}
+
+// SaveEntryContext implements ContextStorage, returning the error of ctx
+// without saving entry if ctx is done before a slot is free.
+func (s *semaphoreStorage) SaveEntryContext(ctx context.Context, entry *Entry) error {
+	if err := s.acquire(ctx); err != nil {
+		return err
+	}
+	defer s.release()
+
+	return saveEntryContext(ctx, s.inner, entry)
+}
+
+// RemoveEntry implementation of Storage.RemoveEntry.
+func (s *semaphoreStorage) RemoveEntry(key, id string) {
+	_ = s.RemoveEntryContext(context.Background(), key, id)
+}
+
+// RemoveEntryContext implements ContextStorage, returning the error of ctx
+// without removing the entry if ctx is done before a slot is free.
+func (s *semaphoreStorage) RemoveEntryContext(ctx context.Context, key, id string) error {
+	if err := s.acquire(ctx); err != nil {
+		return err
+	}
+	defer s.release()
+
+	return removeEntryContext(ctx, s.inner, key, id)
+}
+
+// Entries implementation of Storage.Entries.
+func (s *semaphoreStorage) Entries(https bool, host, path, key string, now time.Time) (entries []*Entry) {
+	entries, _ = s.EntriesContext(context.Background(), https, host, path, key, now)
+	return entries
+}
+
+// EntriesContext implements ContextStorage, returning the error of ctx and no
+// entries if ctx is done before a slot is free.
+func (s *semaphoreStorage) EntriesContext(
+	ctx context.Context,
+	https bool,
+	host, path, key string,
+	now time.Time,
+) (entries []*Entry, err error) {
+	if err = s.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	return entriesContext(ctx, s.inner, https, host, path, key, now)
+}
+
+// Clear implements Clearer.
+func (s *semaphoreStorage) Clear() {
+	_ = s.acquire(context.Background())
+	defer s.release()
+
+	clearInner(s.inner)
+}
+
+// Len implements Counter.
+func (s *semaphoreStorage) Len() int {
+	_ = s.acquire(context.Background())
+	defer s.release()
+
+	return lenInner(s.inner)
+}
+
+// Domains implements Counter.
+func (s *semaphoreStorage) Domains() []string {
+	_ = s.acquire(context.Background())
+	defer s.release()
+
+	return domainsInner(s.inner)
+}
+
+// Generation returns the generation of the underlying storage, or 0 if it does
+// not count modifications.
+func (s *semaphoreStorage) Generation() uint64 {
+	_ = s.acquire(context.Background())
+	defer s.release()
+
+	return generationInner(s.inner)
+}
+
+// EntriesDump implements Dumper.
+func (s semaphoreDumperStorage) EntriesDump() (entries []*Entry) {
+	_ = s.acquire(context.Background())
+	defer s.release()
+
+	return s.inner.(Dumper).EntriesDump()
+}
@@ -0,0 +1,165 @@
+package cookiejarx
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyStorage is a slow Storage recording the highest number of
+// concurrent calls.
+type concurrencyStorage struct {
+	Storage
+
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (s *concurrencyStorage) enter() {
+	s.mu.Lock()
+	s.inFlight++
+	if s.inFlight > s.max {
+		s.max = s.inFlight
+	}
+	s.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	s.mu.Lock()
+	s.inFlight--
+	s.mu.Unlock()
+}
+
+func (s *concurrencyStorage) SaveEntry(entry *Entry) {
+	s.enter()
+	s.Storage.SaveEntry(entry)
+}
+
+func (s *concurrencyStorage) RemoveEntry(key, id string) {
+	s.enter()
+	s.Storage.RemoveEntry(key, id)
+}
+
+func (s *concurrencyStorage) Entries(https bool, host, path, key string, now time.Time) []*Entry {
+	s.enter()
+	return s.Storage.Entries(https, host, path, key, now)
+}
+
+func TestSemaphoreStorageLimit(t *testing.T) {
+	const limit = 3
+
+	inner := &concurrencyStorage{Storage: NewInMemoryStorage()}
+	storage := NewSemaphoreStorage(inner, limit)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("host%d.test", i%5)
+			storage.SaveEntry(&Entry{Key: key, ID: fmt.Sprint(i), Domain: key, Path: "/", Expires: endOfTime})
+			storage.Entries(false, key, "/", key, tNow)
+			storage.RemoveEntry(key, fmt.Sprint(i))
+		}(i)
+	}
+	wg.Wait()
+
+	if inner.max > limit {
+		t.Errorf("got %d concurrent calls, want at most %d", inner.max, limit)
+	}
+	if inner.inFlight != 0 {
+		t.Errorf("got %d calls in flight after completion", inner.inFlight)
+	}
+}
+
+func TestSemaphoreStorageContext(t *testing.T) {
+	storage := NewSemaphoreStorage(NewInMemoryStorage(), 1)
+	sem := storage.(semaphoreDumperStorage)
+
+	// Occupy the only slot.
+	if err := sem.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	entry := &Entry{Key: "host.test", ID: "a", Domain: "host.test", Path: "/", Expires: endOfTime}
+	if err := storage.SaveEntryContext(ctx, entry); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	sem.release()
+
+	if err := storage.SaveEntryContext(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := storage.EntriesContext(context.Background(), false, "host.test", "/", "host.test", tNow)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("got %d entries, %v, want 1 saved entry", len(entries), err)
+	}
+}
+
+func TestSemaphoreStorageForwarding(t *testing.T) {
+	inner := NewInMemoryStorage()
+	storage := NewSemaphoreStorage(inner, 1)
+	if _, ok := storage.(Dumper); !ok {
+		t.Errorf("semaphore storage does not implement Dumper over a Dumper")
+	}
+	if _, ok := NewSemaphoreStorage(struct{ Storage }{inner}, 1).(Dumper); ok {
+		t.Errorf("semaphore storage implements Dumper over a non-Dumper")
+	}
+
+	storage.SaveEntry(&Entry{Key: "host.test", ID: "a", Domain: "host.test", Path: "/", Expires: endOfTime})
+
+	if dump := storage.(Dumper).EntriesDump(); len(dump) != 1 {
+		t.Errorf("got %d dumped entries, want 1", len(dump))
+	}
+	if n := storage.(Counter).Len(); n != 1 {
+		t.Errorf("got Len %d, want 1", n)
+	}
+	if got, want := storage.(generational).Generation(), inner.Generation(); got != want {
+		t.Errorf("got Generation %d, want %d", got, want)
+	}
+
+	storage.(Clearer).Clear()
+	if n := inner.Len(); n != 0 {
+		t.Errorf("got %d entries after Clear, want 0", n)
+	}
+}
+
+func TestSemaphoreStorageJarContext(t *testing.T) {
+	storage := NewSemaphoreStorage(NewInMemoryStorage(), 1)
+	sem := storage.(semaphoreDumperStorage)
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/")
+	cookies := []*http.Cookie{{Name: "a", Value: "1"}}
+
+	// Occupy the only slot.
+	if err := sem.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := jar.SetCookiesWithContext(ctx, u, cookies); err != context.DeadlineExceeded {
+		t.Errorf("SetCookiesWithContext: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := jar.CookiesWithContext(ctx, u); err != context.DeadlineExceeded {
+		t.Errorf("CookiesWithContext: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	sem.release()
+
+	if err := jar.SetCookiesWithContext(context.Background(), u, cookies); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := jar.CookiesWithContext(context.Background(), u); err != nil || len(got) != 1 {
+		t.Errorf("got %v, %v, want a=1", got, err)
+	}
+}
@@ -0,0 +1,158 @@
+package cookiejarx
+
+import (
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// shardedInMemoryStorage is a Storage distributing entries over independent
+// InMemoryStorage shards by their key, see NewShardedInMemoryStorage.
+type shardedInMemoryStorage struct {
+	shards []*InMemoryStorage
+}
+
+// NewShardedInMemoryStorage returns an in-memory Storage split into shards
+// independent InMemoryStorage instances, each with its own lock, reducing lock
+// contention between lookups of different registrable domains. Entries are
+// routed to a shard by a hash of their key, so that all entries of a key are
+// held by a single shard. A shards value below one is treated as one.
+//
+// The returned storage implements Dumper, Clearer and Counter. When used by
+// a Jar, Options.MaxCookiesPerDomain applies exactly, while
+// Options.MaxCookiesTotal is divided evenly among the shards and thus only
+// approximately enforced: a shard may evict entries while others have room.
+func NewShardedInMemoryStorage(shards int) Storage {
+	if shards < 1 {
+		shards = 1
+	}
+
+	s := &shardedInMemoryStorage{
+		shards: make([]*InMemoryStorage, shards),
+	}
+	for i := range s.shards {
+		s.shards[i] = NewInMemoryStorage()
+	}
+
+	return s
+}
+
+// shard returns the shard holding entries of key.
+func (s *shardedInMemoryStorage) shard(key string) *InMemoryStorage {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// setLimits applies per key and total entry limits to the shards like
+// InMemoryStorage.applyLimits, dividing total limits among them.
+func (s *shardedInMemoryStorage) setLimits(maxPerKey, maxTotal int) {
+	for _, shard := range s.shards {
+		shard.applyLimits(maxPerKey, s.shardLimit(maxTotal), DefaultMaxCookiesPerDomain, s.shardLimit(DefaultMaxCookiesTotal))
+	}
+}
+
+// shardLimit returns the share of a shard of the total limit maxTotal.
+func (s *shardedInMemoryStorage) shardLimit(maxTotal int) int {
+	if maxTotal > 0 {
+		maxTotal = (maxTotal + len(s.shards) - 1) / len(s.shards)
+	}
+	return maxTotal
+}
+
+// SaveEntry implementation of Storage.SaveEntry
+func (s *shardedInMemoryStorage) SaveEntry(entry *Entry) {
+	s.shard(entry.Key).SaveEntry(entry)
+}
+
+// RemoveEntry implementation of Storage.RemoveEntry
+func (s *shardedInMemoryStorage) RemoveEntry(key, id string) {
+	s.shard(key).RemoveEntry(key, id)
+}
+
+// WriteBatch implements BatchWriter, writing the ops of each shard as a single
+// batch. Ops of a key are applied in order.
+func (s *shardedInMemoryStorage) WriteBatch(ops []BatchOp) {
+	batches := make(map[*InMemoryStorage][]BatchOp)
+	for _, op := range ops {
+		shard := s.shard(op.Entry.Key)
+		batches[shard] = append(batches[shard], op)
+	}
+	for shard, batch := range batches {
+		shard.WriteBatch(batch)
+	}
+}
+
+// Entries implementation of Storage.Entries
+func (s *shardedInMemoryStorage) Entries(https bool, host, path, key string, now time.Time) (entries []*Entry) {
+	return s.shard(key).Entries(https, host, path, key, now)
+}
+
+// peekEntries is like Entries, but neither updates LastAccess nor removes
+// expired entries.
+func (s *shardedInMemoryStorage) peekEntries(https bool, host, path, key string, now time.Time) (entries []*Entry) {
+	return s.shard(key).EntriesPeek(https, host, path, key, now)
+}
+
+// EntriesDump implements Dumper, returning entries of all shards ordered like
+// InMemoryStorage.EntriesDump.
+func (s *shardedInMemoryStorage) EntriesDump() (entries []*Entry) {
+	for _, shard := range s.shards {
+		entries = append(entries, shard.EntriesDump()...)
+	}
+	// Entries of a key are held by a single shard, already in order.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// EntriesClear empties all shards.
+func (s *shardedInMemoryStorage) EntriesClear() {
+	for _, shard := range s.shards {
+		shard.EntriesClear()
+	}
+}
+
+// Clear implements Clearer, it is an alias of EntriesClear.
+func (s *shardedInMemoryStorage) Clear() {
+	s.EntriesClear()
+}
+
+// Len implements Counter, summing the counts of all shards.
+func (s *shardedInMemoryStorage) Len() (n int) {
+	for _, shard := range s.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+// Generation returns the sum of the generations of all shards, see
+// InMemoryStorage.Generation.
+func (s *shardedInMemoryStorage) Generation() (generation uint64) {
+	for _, shard := range s.shards {
+		generation += shard.Generation()
+	}
+	return generation
+}
+
+// Stats returns the usage of the entries of all shards, see
+// InMemoryStorage.Stats.
+func (s *shardedInMemoryStorage) Stats() map[string]EntryStat {
+	stats := make(map[string]EntryStat)
+	for _, shard := range s.shards {
+		for id, stat := range shard.Stats() {
+			stats[id] = stat
+		}
+	}
+	return stats
+}
+
+// Domains implements Counter, merging the keys of all shards.
+func (s *shardedInMemoryStorage) Domains() (domains []string) {
+	for _, shard := range s.shards {
+		domains = append(domains, shard.Domains()...)
+	}
+	sort.Strings(domains)
+	return domains
+}
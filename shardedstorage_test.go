@@ -0,0 +1,99 @@
+package cookiejarx
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShardedInMemoryStorage(t *testing.T) {
+	storage := NewShardedInMemoryStorage(4)
+	jar, _ := New(&Options{
+		PublicSuffixList:    testPSL{},
+		Storage:             storage,
+		MaxCookiesPerDomain: 2,
+		MaxCookiesTotal:     100,
+	})
+
+	sharded := storage.(*shardedInMemoryStorage)
+	for _, shard := range sharded.shards {
+		if shard.MaxEntriesPerKey != 2 || shard.MaxEntries != 25 {
+			t.Fatalf("got shard limits %d/%d, want 2/25", shard.MaxEntriesPerKey, shard.MaxEntries)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		u := mustParseURL(fmt.Sprintf("http://www.host%d.test/", i))
+		jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1"}, {Name: "b", Value: "2", Path: "/b"}}, tNow)
+	}
+
+	used := 0
+	for _, shard := range sharded.shards {
+		if shard.count(tNow) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("got entries in %d shards, want them distributed", used)
+	}
+
+	// The full key evicts its least recently accessed entry, a=1.
+	u := mustParseURL("http://www.host7.test/b")
+	jar.setCookies(u, []*http.Cookie{{Name: "c", Value: "3"}}, tNow.Add(time.Second))
+
+	var s []string
+	for _, c := range jar.cookies(u, tNow.Add(time.Second)) {
+		s = append(s, c.Name+"="+c.Value)
+	}
+	if got, want := strings.Join(s, " "), "b=2 c=3"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got, want := jar.Len(), 40; got != want {
+		t.Errorf("got Len %d, want %d", got, want)
+	}
+	if got := len(storage.(Counter).Domains()); got != 20 {
+		t.Errorf("got %d domains, want 20", got)
+	}
+	if got := len(storage.(Dumper).EntriesDump()); got != 40 {
+		t.Errorf("got %d dumped entries, want 40", got)
+	}
+
+	jar.Clear()
+	if got := jar.Len(); got != 0 {
+		t.Errorf("got Len %d after Clear, want 0", got)
+	}
+}
+
+func benchmarkShardedInMemoryStorage(b *testing.B, shards int) {
+	s := NewShardedInMemoryStorage(shards)
+
+	entries := make([]*Entry, 256)
+	for i := range entries {
+		key := fmt.Sprintf("host%d.test", i)
+		entries[i] = &Entry{Name: "a", Key: key, ID: key + ";/;a", Domain: key, Path: "/", Expires: endOfTime}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			e := entries[i%len(entries)]
+			s.SaveEntry(e)
+			s.Entries(false, e.Domain, "/", e.Key, time.Now())
+		}
+	})
+}
+
+func BenchmarkShardedInMemoryStorage1(b *testing.B) {
+	benchmarkShardedInMemoryStorage(b, 1)
+}
+
+func BenchmarkShardedInMemoryStorage4(b *testing.B) {
+	benchmarkShardedInMemoryStorage(b, 4)
+}
+
+func BenchmarkShardedInMemoryStorage16(b *testing.B) {
+	benchmarkShardedInMemoryStorage(b, 16)
+}
@@ -0,0 +1,406 @@
+package cookiejarx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSQLTimeout is the default SQLStorage.Timeout.
+const DefaultSQLTimeout = 5 * time.Second
+
+// sqlColumns are the columns of an SQLStorage table, in the order they are
+// selected and scanned.
+var sqlColumns = []string{
+	"jar_key", "id", "name", "value", "domain", "path", "samesite",
+	"secure", "httponly", "persistent", "hostonly",
+	"expires", "creation", "lastaccess", "lastmodified",
+	"priority", "partitioned", "partition_key",
+}
+
+// sqlUpdatedColumns are the columns changed when an existing entry is saved
+// again: all but the primary key and the creation time, which is preserved.
+var sqlUpdatedColumns = []string{
+	"name", "value", "domain", "path", "samesite",
+	"secure", "httponly", "persistent", "hostonly",
+	"expires", "lastaccess", "lastmodified",
+	"priority", "partitioned", "partition_key",
+}
+
+var errInvalidTableName = errors.New("cookiejar: invalid sql table name")
+
+// SQLDialect selects the SQL variant used by an SQLStorage for query
+// placeholders and for saving entries.
+type SQLDialect int
+
+const (
+	// SQLDialectGeneric uses "?" placeholders and portable SQL, saving an
+	// entry being an UPDATE followed, if no row is affected, by an INSERT
+	// within a transaction. If the INSERT fails, e.g. because another
+	// process inserted the entry meanwhile, the save is retried once.
+	SQLDialectGeneric SQLDialect = iota
+
+	// SQLDialectSQLite uses "?" placeholders and saves entries with a single
+	// INSERT ... ON CONFLICT DO UPDATE, supported since SQLite 3.24.
+	SQLDialectSQLite
+
+	// SQLDialectPostgres uses "$1" placeholders and saves entries with a
+	// single INSERT ... ON CONFLICT DO UPDATE.
+	SQLDialectPostgres
+
+	// SQLDialectMySQL uses "?" placeholders and saves entries with a single
+	// INSERT ... ON DUPLICATE KEY UPDATE.
+	SQLDialectMySQL
+)
+
+// placeholder returns the placeholder of the n-th query argument, counting
+// from 1.
+func (d SQLDialect) placeholder(n int) string {
+	if d == SQLDialectPostgres {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// SQLStorage is a Storage keeping entries in an SQL database table, allowing
+// several processes to share cookies. It is used through database/sql, so the
+// caller registers a driver of choice and opens the database.
+//
+// Queries are built according to Dialect. Times are stored as microseconds
+// since the Unix epoch. The key and id columns are limited to 255 characters,
+// long cookie identifiers therefore require Options.HashIDs.
+//
+// SQLStorage implements ContextStorage, whose methods return errors and run
+// queries with the caller's context. Storage methods cannot return errors, the
+// most recent one of either kind is reported by Err.
+type SQLStorage struct {
+	db *sql.DB
+
+	table string
+
+	// Timeout limits the duration of each storage call, DefaultSQLTimeout
+	// by default. The ContextStorage methods end calls earlier if their
+	// context is done before.
+	Timeout time.Duration
+
+	// Dialect is the SQL variant of the database, SQLDialectGeneric by
+	// default. It must be set before the storage is used.
+	Dialect SQLDialect
+
+	// mu guards err.
+	mu sync.Mutex
+
+	// err is the error of the most recent failed call.
+	err error
+}
+
+// NewSQLStorage returns an SQLStorage using table in db, creating the table if
+// it does not exist. table must consist of ASCII letters, digits and
+// underscores only.
+func NewSQLStorage(db *sql.DB, table string) (*SQLStorage, error) {
+	if !isSQLIdentifier(table) {
+		return nil, errInvalidTableName
+	}
+
+	s := &SQLStorage{
+		db:      db,
+		table:   table,
+		Timeout: DefaultSQLTimeout,
+	}
+
+	ctx, cancel := s.context(context.Background())
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	jar_key VARCHAR(255) NOT NULL,
+	id VARCHAR(255) NOT NULL,
+	name TEXT NOT NULL,
+	value TEXT NOT NULL,
+	domain TEXT NOT NULL,
+	path TEXT NOT NULL,
+	samesite TEXT NOT NULL,
+	secure BOOLEAN NOT NULL,
+	httponly BOOLEAN NOT NULL,
+	persistent BOOLEAN NOT NULL,
+	hostonly BOOLEAN NOT NULL,
+	expires BIGINT NOT NULL,
+	creation BIGINT NOT NULL,
+	lastaccess BIGINT NOT NULL,
+	lastmodified BIGINT NOT NULL,
+	priority TEXT NOT NULL,
+	partitioned BOOLEAN NOT NULL,
+	partition_key TEXT NOT NULL,
+	PRIMARY KEY (jar_key, id)
+)`, table))
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// SaveEntry implementation of Storage.SaveEntry, preserving the creation time
+// of an existing entry with the same key and id.
+func (s *SQLStorage) SaveEntry(entry *Entry) {
+	_ = s.SaveEntryContext(context.Background(), entry)
+}
+
+// SaveEntryContext implements ContextStorage like SaveEntry.
+func (s *SQLStorage) SaveEntryContext(ctx context.Context, entry *Entry) error {
+	err := s.saveEntry(ctx, entry)
+	s.setErr(err)
+	return err
+}
+
+func (s *SQLStorage) saveEntry(ctx context.Context, entry *Entry) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	values := sqlEntryValues(entry)
+
+	if s.Dialect != SQLDialectGeneric {
+		_, err := s.db.ExecContext(ctx, s.upsertQuery(), sqlArgs(values, sqlColumns)...)
+		return err
+	}
+
+	insertFailed, err := s.updateOrInsert(ctx, entry, values)
+	if insertFailed {
+		// The entry was most likely inserted by another process after
+		// the UPDATE, which now finds it.
+		_, err = s.updateOrInsert(ctx, entry, values)
+	}
+
+	return err
+}
+
+// upsertQuery returns the statement inserting an entry or updating the
+// existing one, preserving its creation time, for dialects supporting it.
+func (s *SQLStorage) upsertQuery() string {
+	placeholders := make([]string, len(sqlColumns))
+	for i := range sqlColumns {
+		placeholders[i] = s.Dialect.placeholder(i + 1)
+	}
+
+	conflict := "ON CONFLICT (jar_key, id) DO UPDATE SET "
+	if s.Dialect == SQLDialectMySQL {
+		conflict = "ON DUPLICATE KEY UPDATE "
+	}
+
+	assignments := make([]string, len(sqlUpdatedColumns))
+	for i, column := range sqlUpdatedColumns {
+		if s.Dialect == SQLDialectMySQL {
+			assignments[i] = column + " = VALUES(" + column + ")"
+		} else {
+			assignments[i] = column + " = excluded." + column
+		}
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) %s%s", s.table, strings.Join(sqlColumns, ", "),
+		strings.Join(placeholders, ", "), conflict, strings.Join(assignments, ", "))
+}
+
+// updateOrInsert saves entry with an UPDATE followed, if no row is affected, by
+// an INSERT within a transaction, see SQLDialectGeneric. insertFailed reports
+// whether the INSERT was issued and failed.
+func (s *SQLStorage) updateOrInsert(
+	ctx context.Context,
+	entry *Entry,
+	values map[string]interface{},
+) (insertFailed bool, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	assignments := make([]string, len(sqlUpdatedColumns))
+	for i, column := range sqlUpdatedColumns {
+		assignments[i] = column + " = ?"
+	}
+	args := append(sqlArgs(values, sqlUpdatedColumns), entry.Key, entry.ID)
+
+	res, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s WHERE jar_key = ? AND id = ?",
+		s.table, strings.Join(assignments, ", ")), args...)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if updated == 0 {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) VALUES (?%s)",
+			s.table, strings.Join(sqlColumns, ", "), strings.Repeat(", ?", len(sqlColumns)-1)),
+			sqlArgs(values, sqlColumns)...)
+		if err != nil {
+			return true, err
+		}
+	}
+
+	return false, tx.Commit()
+}
+
+// RemoveEntry implementation of Storage.RemoveEntry.
+func (s *SQLStorage) RemoveEntry(key, id string) {
+	_ = s.RemoveEntryContext(context.Background(), key, id)
+}
+
+// RemoveEntryContext implements ContextStorage like RemoveEntry.
+func (s *SQLStorage) RemoveEntryContext(ctx context.Context, key, id string) error {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE jar_key = %s AND id = %s",
+		s.table, s.Dialect.placeholder(1), s.Dialect.placeholder(2)), key, id)
+	s.setErr(err)
+	return err
+}
+
+// Entries implementation of Storage.Entries. Expired entries of key are
+// deleted. Unlike InMemoryStorage, the last access time of returned entries is
+// not updated.
+func (s *SQLStorage) Entries(https bool, host, path, key string, now time.Time) (entries []*Entry) {
+	entries, _ = s.EntriesContext(context.Background(), https, host, path, key, now)
+	return entries
+}
+
+// EntriesContext implements ContextStorage like Entries.
+func (s *SQLStorage) EntriesContext(
+	ctx context.Context,
+	https bool,
+	host, path, key string,
+	now time.Time,
+) (entries []*Entry, err error) {
+	entries, err = s.entries(ctx, https, host, path, key, now)
+	s.setErr(err)
+	return entries, err
+}
+
+func (s *SQLStorage) entries(
+	ctx context.Context,
+	https bool,
+	host, path, key string,
+	now time.Time,
+) (entries []*Entry, err error) {
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+
+	_, err = s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE jar_key = %s AND expires <= %s",
+		s.table, s.Dialect.placeholder(1), s.Dialect.placeholder(2)), key, now.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE jar_key = %s AND expires > %s",
+		strings.Join(sqlColumns, ", "), s.table, s.Dialect.placeholder(1), s.Dialect.placeholder(2)),
+		key, now.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e Entry
+		var expires, creation, lastAccess, lastModified int64
+		err = rows.Scan(&e.Key, &e.ID, &e.Name, &e.Value, &e.Domain, &e.Path, &e.SameSite,
+			&e.Secure, &e.HttpOnly, &e.Persistent, &e.HostOnly,
+			&expires, &creation, &lastAccess, &lastModified,
+			&e.Priority, &e.Partitioned, &e.PartitionKey)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Expires = time.UnixMicro(expires).UTC()
+		e.Creation = time.UnixMicro(creation).UTC()
+		e.LastAccess = time.UnixMicro(lastAccess).UTC()
+		e.LastModified = time.UnixMicro(lastModified).UTC()
+
+		if e.ShouldSend(https, host, path) {
+			entries = append(entries, &e)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	SortEntries(entries)
+
+	return entries, nil
+}
+
+// Err returns the error of the most recent failed storage call, or nil if the
+// most recent call succeeded.
+func (s *SQLStorage) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *SQLStorage) setErr(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// context returns a context of parent limited by Timeout.
+func (s *SQLStorage) context(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, s.Timeout)
+}
+
+// sqlEntryValues returns the column values of e.
+func sqlEntryValues(e *Entry) map[string]interface{} {
+	return map[string]interface{}{
+		"jar_key":       e.Key,
+		"id":            e.ID,
+		"name":          e.Name,
+		"value":         e.Value,
+		"domain":        e.Domain,
+		"path":          e.Path,
+		"samesite":      e.SameSite,
+		"secure":        e.Secure,
+		"httponly":      e.HttpOnly,
+		"persistent":    e.Persistent,
+		"hostonly":      e.HostOnly,
+		"expires":       e.Expires.UnixMicro(),
+		"creation":      e.Creation.UnixMicro(),
+		"lastaccess":    e.LastAccess.UnixMicro(),
+		"lastmodified":  e.LastModified.UnixMicro(),
+		"priority":      e.Priority,
+		"partitioned":   e.Partitioned,
+		"partition_key": e.PartitionKey,
+	}
+}
+
+// sqlArgs returns the values of columns as query arguments.
+func sqlArgs(values map[string]interface{}, columns []string) []interface{} {
+	args := make([]interface{}, len(columns))
+	for i, column := range columns {
+		args[i] = values[column]
+	}
+	return args
+}
+
+// isSQLIdentifier reports whether s is a non-empty identifier of ASCII
+// letters, digits and underscores not starting with a digit.
+func isSQLIdentifier(s string) bool {
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if !(b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_') {
+			return false
+		}
+	}
+	return true
+}
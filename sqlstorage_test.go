@@ -0,0 +1,431 @@
+package cookiejarx
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSQLDriver is a database/sql driver understanding just the statements
+// issued by SQLStorage, keeping rows of a single table in memory for each
+// data source name.
+type fakeSQLDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*fakeSQLDB
+}
+
+// fakeSQLDB is the table of a fakeSQLDriver data source.
+type fakeSQLDB struct {
+	mu   sync.Mutex
+	rows map[[2]string]map[string]driver.Value
+
+	// beforeInsert, if set, is called once before the next INSERT, with
+	// mu held.
+	beforeInsert func(rows map[[2]string]map[string]driver.Value)
+}
+
+var fakeSQL = &fakeSQLDriver{}
+
+func init() {
+	sql.Register("cookiejarx-fake", fakeSQL)
+}
+
+// db returns the table of the data source name.
+func (d *fakeSQLDriver) db(name string) *fakeSQLDB {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.dbs == nil {
+		d.dbs = make(map[string]*fakeSQLDB)
+	}
+	if d.dbs[name] == nil {
+		d.dbs[name] = &fakeSQLDB{rows: make(map[[2]string]map[string]driver.Value)}
+	}
+	return d.dbs[name]
+}
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	return fakeSQLConn{d.db(name)}, nil
+}
+
+type fakeSQLConn struct {
+	db *fakeSQLDB
+}
+
+func (c fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeSQLStmt{c.db, query}, nil
+}
+
+func (c fakeSQLConn) Close() error              { return nil }
+func (c fakeSQLConn) Begin() (driver.Tx, error) { return fakeSQLTx{}, nil }
+
+type fakeSQLTx struct{}
+
+func (fakeSQLTx) Commit() error   { return nil }
+func (fakeSQLTx) Rollback() error { return nil }
+
+type fakeSQLStmt struct {
+	db    *fakeSQLDB
+	query string
+}
+
+func (s fakeSQLStmt) Close() error  { return nil }
+func (s fakeSQLStmt) NumInput() int { return -1 }
+
+// between returns the part of s after the first start and before the
+// following end.
+func between(s, start, end string) string {
+	s = s[strings.Index(s, start)+len(start):]
+	return s[:strings.Index(s, end)]
+}
+
+// checkPlaceholders reports an error unless query has a placeholder for each of
+// args, either all "?" or "$1" to "$n".
+func (s fakeSQLStmt) checkPlaceholders(args []driver.Value) error {
+	if !strings.Contains(s.query, "$") {
+		if n := strings.Count(s.query, "?"); n != len(args) {
+			return fmt.Errorf("got %d placeholders for %d arguments in %q", n, len(args), s.query)
+		}
+		return nil
+	}
+
+	if strings.Contains(s.query, "?") || strings.Count(s.query, "$") != len(args) {
+		return fmt.Errorf("got mixed placeholders for %d arguments in %q", len(args), s.query)
+	}
+	for n := len(args); n > 0; n-- {
+		if !strings.Contains(s.query, fmt.Sprintf("$%d", n)) {
+			return fmt.Errorf("got no placeholder $%d in %q", n, s.query)
+		}
+	}
+	return nil
+}
+
+// columnNames returns the column names of the comma separated assignments or
+// column list.
+func columnNames(list string) []string {
+	columns := strings.Split(list, ", ")
+	for i, column := range columns {
+		if j := strings.Index(column, " = "); j >= 0 {
+			columns[i] = column[:j]
+		}
+	}
+	return columns
+}
+
+func (s fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.checkPlaceholders(args); err != nil {
+		return nil, err
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	var affected int64
+	switch {
+	case strings.HasPrefix(s.query, "UPDATE"):
+		columns := columnNames(between(s.query, "SET ", " WHERE"))
+		pk := [2]string{args[len(columns)].(string), args[len(columns)+1].(string)}
+		if row, ok := s.db.rows[pk]; ok {
+			for i, column := range columns {
+				row[column] = args[i]
+			}
+			affected++
+		}
+	case strings.HasPrefix(s.query, "INSERT"):
+		if s.db.beforeInsert != nil {
+			s.db.beforeInsert(s.db.rows)
+			s.db.beforeInsert = nil
+		}
+
+		row := make(map[string]driver.Value)
+		for i, column := range columnNames(between(s.query, "(", ")")) {
+			row[column] = args[i]
+		}
+		pk := [2]string{row["jar_key"].(string), row["id"].(string)}
+
+		existing, ok := s.db.rows[pk]
+		var updated []string
+		switch {
+		case strings.Contains(s.query, " DO UPDATE SET "):
+			updated = columnNames(s.query[strings.Index(s.query, " DO UPDATE SET ")+len(" DO UPDATE SET "):])
+		case strings.Contains(s.query, " ON DUPLICATE KEY UPDATE "):
+			updated = columnNames(s.query[strings.Index(s.query, " KEY UPDATE ")+len(" KEY UPDATE "):])
+		case ok:
+			return nil, errors.New("duplicate primary key")
+		}
+
+		if ok {
+			for _, column := range updated {
+				existing[column] = row[column]
+			}
+		} else {
+			s.db.rows[pk] = row
+		}
+		affected++
+	case strings.HasPrefix(s.query, "DELETE") && strings.Contains(s.query, "expires"):
+		for pk, row := range s.db.rows {
+			if row["jar_key"] == args[0] && row["expires"].(int64) <= args[1].(int64) {
+				delete(s.db.rows, pk)
+				affected++
+			}
+		}
+	case strings.HasPrefix(s.query, "DELETE"):
+		pk := [2]string{args[0].(string), args[1].(string)}
+		if _, ok := s.db.rows[pk]; ok {
+			delete(s.db.rows, pk)
+			affected++
+		}
+	}
+
+	return driver.RowsAffected(affected), nil
+}
+
+func (s fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.checkPlaceholders(args); err != nil {
+		return nil, err
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	rows := &fakeSQLRows{columns: strings.Split(between(s.query, "SELECT ", " FROM"), ", ")}
+	for _, row := range s.db.rows {
+		if row["jar_key"] == args[0] && row["expires"].(int64) > args[1].(int64) {
+			values := make([]driver.Value, len(rows.columns))
+			for i, column := range rows.columns {
+				values[i] = row[column]
+			}
+			rows.values = append(rows.values, values)
+		}
+	}
+
+	return rows, nil
+}
+
+type fakeSQLRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string { return r.columns }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func TestSQLStorage(t *testing.T) {
+	for name, dialect := range map[string]SQLDialect{
+		"generic":  SQLDialectGeneric,
+		"sqlite":   SQLDialectSQLite,
+		"postgres": SQLDialectPostgres,
+		"mysql":    SQLDialectMySQL,
+	} {
+		t.Run(name, func(t *testing.T) {
+			testSQLStorage(t, name, dialect)
+		})
+	}
+}
+
+func testSQLStorage(t *testing.T, dataSource string, dialect SQLDialect) {
+	db, err := sql.Open("cookiejarx-fake", dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	storage, err := NewSQLStorage(db, "cookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Dialect = dialect
+
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("https://www.host.test/a/b")
+
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "a", Value: "1", Path: "/"},
+		{Name: "b", Value: "2", Path: "/a", Secure: true, SameSite: http.SameSiteLaxMode},
+		{Name: "c", Value: "3", Domain: "host.test", MaxAge: 60},
+		{Name: "d", Value: "4"},
+	}, tNow)
+	jar.setCookies(u, []*http.Cookie{
+		{Name: "a", Value: "changed", Path: "/"},
+		{Name: "d", MaxAge: -1},
+	}, tNow.Add(time.Second))
+
+	if err := storage.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(u string, now time.Time) string {
+		var s []string
+		for _, c := range jar.cookiesFull(mustParseURL(u), now) {
+			s = append(s, c.Name+"="+c.Value)
+		}
+		return strings.Join(s, " ")
+	}
+
+	if got, want := query("https://www.host.test/a/b", tNow.Add(2*time.Second)), "c=3 b=2 a=changed"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := query("http://www.host.test/a/b", tNow.Add(2*time.Second)), "c=3 a=changed"; got != want {
+		t.Errorf("insecure: got %q, want %q", got, want)
+	}
+
+	entries := storage.Entries(true, "www.host.test", "/", "host.test", tNow.Add(2*time.Second))
+	for _, e := range entries {
+		if e.Name == "a" && !e.Creation.Equal(tNow) {
+			t.Errorf("got Creation %v for updated entry, want %v", e.Creation, tNow)
+		}
+	}
+
+	if got, want := query("https://www.host.test/a/b", tNow.Add(time.Hour)), "b=2 a=changed"; got != want {
+		t.Errorf("expired: got %q, want %q", got, want)
+	}
+	if err := storage.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLStorageInsertConflict(t *testing.T) {
+	db, err := sql.Open("cookiejarx-fake", "conflict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	storage, err := NewSQLStorage(db, "cookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := &Entry{
+		Key: "host.test", ID: "host.test;/;a", Name: "a", Value: "mine", Domain: "host.test", Path: "/",
+		Expires: endOfTime, Creation: tNow, LastAccess: tNow, LastModified: tNow,
+	}
+
+	// Another process inserts the entry between the UPDATE and the INSERT.
+	fake := fakeSQL.db("conflict")
+	fake.mu.Lock()
+	fake.beforeInsert = func(rows map[[2]string]map[string]driver.Value) {
+		row := make(map[string]driver.Value)
+		for column, value := range sqlEntryValues(&Entry{Key: entry.Key, ID: entry.ID, Value: "theirs"}) {
+			row[column] = value
+		}
+		rows[[2]string{entry.Key, entry.ID}] = row
+	}
+	fake.mu.Unlock()
+
+	storage.SaveEntry(entry)
+	if err := storage.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := storage.Entries(false, "host.test", "/", "host.test", tNow)
+	if len(entries) != 1 || entries[0].Value != "mine" {
+		t.Errorf("got %v, want the saved entry to update the concurrently inserted one", entries)
+	}
+}
+
+func TestSQLStoragePartitioned(t *testing.T) {
+	db, err := sql.Open("cookiejarx-fake", "partitioned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	storage, err := NewSQLStorage(db, "cookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	embedded := mustParseURL("https://www.embed.test/frame")
+	siteA := mustParseURL("https://www.a.test/")
+
+	resp := http.Response{Header: http.Header{"Set-Cookie": {"p=a; Secure; Partitioned; Priority=High"}}}
+	jar.setCookiesPartitioned(embedded, siteA, resp.Cookies(), tNow)
+	if err := storage.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := jar.cookiesPartitioned(embedded, siteA, tNow); len(got) != 1 || got[0].Value != "a" {
+		t.Errorf("partition of a.test: got %v, want p=a", got)
+	}
+	if got := jar.cookiesPartitioned(embedded, mustParseURL("https://b.test/"), tNow); len(got) != 0 {
+		t.Errorf("partition of b.test: got %v, want none", got)
+	}
+
+	entries := storage.Entries(true, "www.embed.test", "/", "embed.test", tNow)
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	if e := entries[0]; !e.Partitioned || e.PartitionKey != "a.test" || e.Priority != PriorityHigh {
+		t.Errorf("got %+v, want a partitioned entry of a.test with high priority", *e)
+	}
+}
+
+func TestSQLStorageTableName(t *testing.T) {
+	db, err := sql.Open("cookiejarx-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, table := range []string{"", "1cookies", "cookies; DROP TABLE users", "my-cookies"} {
+		if _, err := NewSQLStorage(db, table); err != errInvalidTableName {
+			t.Errorf("%q: got error %v, want %v", table, err, errInvalidTableName)
+		}
+	}
+}
+
+func TestSQLStorageContext(t *testing.T) {
+	db, err := sql.Open("cookiejarx-fake", "context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	storage, err := NewSQLStorage(db, "cookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/")
+	cookies := []*http.Cookie{{Name: "a", Value: "1"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := jar.SetCookiesWithContext(ctx, u, cookies); err != context.Canceled {
+		t.Errorf("SetCookiesWithContext: got error %v, want %v", err, context.Canceled)
+	}
+	if err := storage.Err(); err != context.Canceled {
+		t.Errorf("Err: got %v, want %v", err, context.Canceled)
+	}
+	if _, err := jar.CookiesWithContext(ctx, u); err != context.Canceled {
+		t.Errorf("CookiesWithContext: got error %v, want %v", err, context.Canceled)
+	}
+
+	if err := jar.SetCookiesWithContext(context.Background(), u, cookies); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := jar.CookiesWithContext(context.Background(), u); err != nil || len(got) != 1 {
+		t.Errorf("got %v, %v, want a=1", got, err)
+	}
+}
@@ -0,0 +1,162 @@
+package cookiejarx
+
+import (
+	"context"
+	"time"
+)
+
+// Span names of the operations traced by NewTracedStorage.
+const (
+	SpanSaveEntry   = "cookiejar.SaveEntry"
+	SpanRemoveEntry = "cookiejar.RemoveEntry"
+	SpanEntries     = "cookiejar.Entries"
+)
+
+// Span attribute keys set by NewTracedStorage.
+const (
+	AttributeKey        = "cookiejar.key"
+	AttributeOperation  = "cookiejar.operation"
+	AttributeEntryCount = "cookiejar.entry_count"
+)
+
+// Tracer starts spans, see NewTracedStorage. It is a subset of the
+// OpenTelemetry trace.Tracer, which can be adapted by a few lines wrapping its
+// Start method and converting attributes with attribute.String and
+// attribute.Int, keeping this package free of dependencies.
+type Tracer interface {
+	// Start starts a span named name as a child of any span in ctx.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute sets the attribute key of the span to value, a string
+	// or an int.
+	SetAttribute(key string, value interface{})
+
+	// End completes the span.
+	End()
+}
+
+// tracedStorage is a Storage decorator wrapping calls to the underlying
+// Storage in spans, see NewTracedStorage.
+type tracedStorage struct {
+	inner Storage
+
+	tracer Tracer
+}
+
+// tracedDumperStorage is the traced storage of an underlying storage
+// implementing Dumper.
+type tracedDumperStorage struct {
+	*tracedStorage
+}
+
+// NewTracedStorage returns a Storage keeping entries in inner and wrapping
+// calls to it in spans reported to tracer, e.g. for distributed tracing of
+// remote backends such as SQLStorage.
+//
+// Spans of the context-aware methods are started as children of any span in
+// their context, which is passed on to inner if it implements ContextStorage.
+// Jars call them with the context of Jar.CookiesWithContext and
+// Jar.SetCookiesWithContext. Storage methods take no context, their spans are
+// started from context.Background.
+//
+// Clearer, Counter and Generation, see InMemoryStorage.Generation, are
+// forwarded to inner without tracing, falling back to its Storage and Dumper
+// methods. The returned storage implements Dumper only if inner does.
+func NewTracedStorage(inner Storage, tracer Tracer) ContextStorage {
+	s := &tracedStorage{
+		inner:  inner,
+		tracer: tracer,
+	}
+
+	if _, ok := inner.(Dumper); ok {
+		return tracedDumperStorage{s}
+	}
+	return s
+}
+
+// SaveEntry implementation of Storage.SaveEntry.
+func (s *tracedStorage) SaveEntry(entry *Entry) {
+	_ = s.SaveEntryContext(context.Background(), entry)
+}
+
+// SaveEntryContext implements ContextStorage.
+func (s *tracedStorage) SaveEntryContext(ctx context.Context, entry *Entry) error {
+	ctx, span := s.start(ctx, SpanSaveEntry, "save", entry.Key)
+	defer span.End()
+
+	return saveEntryContext(ctx, s.inner, entry)
+}
+
+// RemoveEntry implementation of Storage.RemoveEntry.
+func (s *tracedStorage) RemoveEntry(key, id string) {
+	_ = s.RemoveEntryContext(context.Background(), key, id)
+}
+
+// RemoveEntryContext implements ContextStorage.
+func (s *tracedStorage) RemoveEntryContext(ctx context.Context, key, id string) error {
+	ctx, span := s.start(ctx, SpanRemoveEntry, "remove", key)
+	defer span.End()
+
+	return removeEntryContext(ctx, s.inner, key, id)
+}
+
+// Entries implementation of Storage.Entries.
+func (s *tracedStorage) Entries(https bool, host, path, key string, now time.Time) (entries []*Entry) {
+	entries, _ = s.EntriesContext(context.Background(), https, host, path, key, now)
+	return entries
+}
+
+// EntriesContext implements ContextStorage, the span reporting the number of
+// returned entries.
+func (s *tracedStorage) EntriesContext(
+	ctx context.Context,
+	https bool,
+	host, path, key string,
+	now time.Time,
+) (entries []*Entry, err error) {
+	ctx, span := s.start(ctx, SpanEntries, "entries", key)
+	defer span.End()
+
+	entries, err = entriesContext(ctx, s.inner, https, host, path, key, now)
+	span.SetAttribute(AttributeEntryCount, len(entries))
+
+	return entries, err
+}
+
+// Clear implements Clearer.
+func (s *tracedStorage) Clear() {
+	clearInner(s.inner)
+}
+
+// Len implements Counter.
+func (s *tracedStorage) Len() int {
+	return lenInner(s.inner)
+}
+
+// Domains implements Counter.
+func (s *tracedStorage) Domains() []string {
+	return domainsInner(s.inner)
+}
+
+// Generation returns the generation of the underlying storage, or 0 if it does
+// not count modifications.
+func (s *tracedStorage) Generation() uint64 {
+	return generationInner(s.inner)
+}
+
+// EntriesDump implements Dumper.
+func (s tracedDumperStorage) EntriesDump() (entries []*Entry) {
+	return s.inner.(Dumper).EntriesDump()
+}
+
+// start starts a span for operation on key as a child of any span in ctx.
+func (s *tracedStorage) start(ctx context.Context, name, operation, key string) (context.Context, Span) {
+	ctx, span := s.tracer.Start(ctx, name)
+	span.SetAttribute(AttributeOperation, operation)
+	span.SetAttribute(AttributeKey, key)
+
+	return ctx, span
+}
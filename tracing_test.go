@@ -0,0 +1,157 @@
+package cookiejarx
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type spanParentKey struct{}
+
+type recordedSpan struct {
+	name       string
+	attributes map[string]interface{}
+	ended      bool
+	parent     *recordedSpan
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.attributes[key] = value
+}
+
+func (s *recordedSpan) End() {
+	s.ended = true
+}
+
+type recordingTracer struct {
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanParentKey{}).(*recordedSpan)
+	span := &recordedSpan{name: name, attributes: make(map[string]interface{}), parent: parent}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spanParentKey{}, span), span
+}
+
+func TestTracedStorage(t *testing.T) {
+	tracer := &recordingTracer{}
+	jar, _ := New(&Options{
+		PublicSuffixList: testPSL{},
+		Storage:          NewTracedStorage(NewInMemoryStorage(), tracer),
+	})
+
+	u := mustParseURL("http://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, tNow)
+	jar.cookies(u, tNow)
+	jar.setCookies(u, []*http.Cookie{{Name: "a", MaxAge: -1}}, tNow)
+
+	want := []recordedSpan{
+		{SpanSaveEntry, map[string]interface{}{AttributeOperation: "save", AttributeKey: "host.test"}, true, nil},
+		{SpanSaveEntry, map[string]interface{}{AttributeOperation: "save", AttributeKey: "host.test"}, true, nil},
+		{SpanEntries, map[string]interface{}{AttributeOperation: "entries", AttributeKey: "host.test", AttributeEntryCount: 2}, true, nil},
+		{SpanRemoveEntry, map[string]interface{}{AttributeOperation: "remove", AttributeKey: "host.test"}, true, nil},
+	}
+
+	var got []recordedSpan
+	for _, span := range tracer.spans {
+		got = append(got, *span)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got spans %+v, want %+v", got, want)
+	}
+}
+
+func TestTracedStorageContext(t *testing.T) {
+	tracer := &recordingTracer{}
+	storage := NewTracedStorage(NewTracedStorage(NewInMemoryStorage(), tracer), tracer)
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	e := &Entry{Key: "host.test", ID: "host.test;/;a", Name: "a", Domain: "host.test", Path: "/", HostOnly: true}
+	if err := storage.SaveEntryContext(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := storage.EntriesContext(ctx, false, "host.test", "/", "host.test", tNow)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("got %d entries, %v, want 1 entry", len(entries), err)
+	}
+	if err := storage.RemoveEntryContext(ctx, e.Key, e.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each outer span is a child of root, each inner span a child of the
+	// preceding outer one.
+	spans := tracer.spans[1:]
+	if len(spans) != 6 {
+		t.Fatalf("got %d spans, want 6", len(spans))
+	}
+	for i := 0; i < len(spans); i += 2 {
+		if spans[i].parent != root {
+			t.Errorf("span %d %s: got parent %v, want root", i, spans[i].name, spans[i].parent)
+		}
+		if spans[i+1].parent != spans[i] {
+			t.Errorf("span %d %s: got parent %v, want outer span", i+1, spans[i+1].name, spans[i+1].parent)
+		}
+	}
+}
+
+func TestTracedStorageJarContext(t *testing.T) {
+	tracer := &recordingTracer{}
+	jar, _ := New(&Options{
+		PublicSuffixList: testPSL{},
+		Storage:          NewTracedStorage(NewInMemoryStorage(), tracer),
+	})
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	u := mustParseURL("http://www.host.test/")
+	if err := jar.setCookiesWithContext(ctx, u, []*http.Cookie{{Name: "a", Value: "1"}}, tNow); err != nil {
+		t.Fatal(err)
+	}
+	cookies, err := jar.cookiesWithContext(ctx, u, tNow)
+	if err != nil || len(cookies) != 1 {
+		t.Fatalf("got %v, %v, want a single cookie", cookies, err)
+	}
+
+	spans := tracer.spans[1:]
+	if len(spans) != 2 || spans[0].name != SpanSaveEntry || spans[1].name != SpanEntries {
+		t.Fatalf("got spans %+v, want a save and a lookup", spans)
+	}
+	for _, span := range spans {
+		if span.parent != root {
+			t.Errorf("%s: got parent %v, want root", span.name, span.parent)
+		}
+	}
+}
+
+func TestTracedStorageForwarding(t *testing.T) {
+	inner := NewInMemoryStorage()
+	storage := NewTracedStorage(inner, &recordingTracer{})
+	if _, ok := storage.(Dumper); !ok {
+		t.Errorf("traced storage does not implement Dumper over a Dumper")
+	}
+	if _, ok := NewTracedStorage(struct{ Storage }{inner}, &recordingTracer{}).(Dumper); ok {
+		t.Errorf("traced storage implements Dumper over a non-Dumper")
+	}
+
+	jar, _ := New(&Options{PublicSuffixList: testPSL{}, Storage: storage})
+	u := mustParseURL("http://www.host.test/")
+	jar.setCookies(u, []*http.Cookie{{Name: "a", Value: "1", MaxAge: 3600}}, time.Now())
+
+	counter := storage.(Counter)
+	if n := counter.Len(); n != 1 {
+		t.Errorf("got Len %d, want 1", n)
+	}
+	if got := counter.Domains(); !reflect.DeepEqual(got, []string{"host.test"}) {
+		t.Errorf("got Domains %q, want [host.test]", got)
+	}
+	if got, want := storage.(generational).Generation(), inner.Generation(); got != want {
+		t.Errorf("got Generation %d, want %d", got, want)
+	}
+
+	storage.(Clearer).Clear()
+	if n := inner.Len(); n != 0 {
+		t.Errorf("got %d entries after Clear, want 0", n)
+	}
+}